@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/aggregator"
+	"github.com/kinvolk/fanotify-poc/pkg/mtls"
+	"github.com/kinvolk/fanotify-poc/pkg/status"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	aggregatorAddr          string
+	aggregatorGRPCAddr      string
+	aggregatorMaxViolations int
+	aggregatorTLS           mtls.Files
+	aggregatorClients       []string
+	aggregatorStaleAfter    time.Duration
+)
+
+var aggregatorCmd = &cobra.Command{
+	Use:   "aggregator",
+	Short: "Serve the reports of all the node agents in a single place",
+	Run: func(cmd *cobra.Command, args []string) {
+		s := &aggregator.Server{MaxViolations: aggregatorMaxViolations, StaleAfter: aggregatorStaleAfter}
+		if aggregatorTLS.CertFile != "" {
+			var err error
+			if s.TLS, err = mtls.ServerConfig(aggregatorTLS, aggregatorClients); err != nil {
+				log.Fatalf("configuring TLS: %v", err)
+			}
+		} else if aggregatorTLS.CAFile != "" || len(aggregatorClients) > 0 {
+			log.Fatalf("the client certificates are only checked over TLS")
+		}
+
+		go func() {
+			if err := s.RunGRPC(aggregatorGRPCAddr); err != nil {
+				log.Fatalf("serving aggregator gRPC service: %v", err)
+			}
+		}()
+
+		if err := s.Run(aggregatorAddr); err != nil {
+			log.Fatalf("serving aggregator: %v", err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(aggregatorCmd)
+
+	f := aggregatorCmd.Flags()
+	f.StringVarP(&aggregatorAddr, "listen-address", "", ":8080", "Address to serve the HTTP queries of the aggregator on")
+	f.StringVarP(&aggregatorGRPCAddr, "grpc-listen-address", "", ":9090", "Address to serve the gRPC service the agents report to on")
+	f.DurationVarP(&aggregatorStaleAfter, "stale-after", "", time.Minute, "How long a node can go without reporting before it is listed as stale, 0 to never list them")
+	f.IntVarP(&aggregatorMaxViolations, "max-violations", "", aggregator.DefaultMaxViolations, "How many distinct violations to keep")
+	f.StringVarP(&aggregatorTLS.CertFile, "tls-cert-file", "", "", "Path to the TLS certificate, gRPC over TLS and HTTPS are served with it. It is read again when it changes")
+	f.StringVarP(&aggregatorTLS.KeyFile, "tls-key-file", "", "", "Path to the TLS key")
+	f.StringVarP(&aggregatorTLS.CAFile, "client-ca-file", "", "", "Path to the CA certificates of the clients, a client certificate signed by them is then required")
+	f.StringArrayVarP(&aggregatorClients, "allowed-client", "", nil, "Identity allowed in the client certificates, matched with their common name, DNS names and URIs. It can be a pattern like spiffe://cluster.local/ns/kube-system/sa/* and be repeated, all the clients with a certificate signed by the CA are allowed without it")
+}
+
+// aggregatorClient returns the client of the aggregator of the agent, with its TLS files.
+func aggregatorClient() (*aggregator.Client, error) {
+	client := &aggregator.Client{URL: cfg.AggregatorURL}
+	files := mtls.Files{CertFile: cfg.AggregatorCertFile, KeyFile: cfg.AggregatorKeyFile, CAFile: cfg.AggregatorCAFile}
+	if files == (mtls.Files{}) {
+		return client, nil
+	}
+
+	u, err := url.Parse(cfg.AggregatorURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing aggregator URL: %w", err)
+	}
+
+	if client.TLS, err = mtls.ClientConfig(files, u.Hostname()); err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// reportToAggregator periodically sends the state of the enforced containers and the buffered violations to the
+// aggregator. The violations which could not be sent are kept for the next report.
+func reportToAggregator(nodeName string, client *aggregator.Client, interval time.Duration, buf *aggregator.Buffer, containers func() []status.Container, anchor func() *status.ChainAnchor) {
+	ctx := context.Background()
+
+	for {
+		time.Sleep(interval)
+
+		violations, dropped := buf.Take()
+		if dropped > 0 {
+			log.Warnf("dropped %d violations not sent to the aggregator", dropped)
+		}
+
+		report := &aggregator.Report{
+			Node:       nodeName,
+			Time:       time.Now(),
+			Status:     status.New(nodeName, containers(), nil).Status,
+			Violations: violations,
+		}
+		report.Status.EventChain = anchor()
+
+		if err := client.Send(ctx, report); err != nil {
+			log.Errorf("reporting to the aggregator: %v", err)
+			buf.Return(violations)
+		}
+	}
+}
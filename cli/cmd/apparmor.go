@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/apparmor"
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/eventstore"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	apparmorSince     time.Duration
+	apparmorNamespace string
+	apparmorPod       string
+	apparmorContainer string
+	apparmorProfile   string
+	apparmorExecs     []string
+	apparmorOutput    string
+)
+
+var apparmorCmd = &cobra.Command{
+	Use:   "apparmor",
+	Short: "Generate an AppArmor profile allowing the executions observed in a container",
+	Long: `Generate an AppArmor profile allowing the executions observed in a container.
+
+The executions are the ones stored by the agent running on this node, which were not denied. Run the pod with a policy
+in audit mode first so all its executions are observed. The entrypoint of the container is executed before the agent
+attaches to it, it has to be added with --exec.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		q := eventstore.Query{Namespace: apparmorNamespace, Pod: apparmorPod}
+		if apparmorSince > 0 {
+			q.Since = time.Now().Add(-apparmorSince)
+		}
+
+		evs, err := adminClient().Events(context.Background(), &q)
+		if err != nil {
+			log.Fatalf("querying events: %v", err)
+		}
+
+		observed := []events.Event{}
+		for _, e := range evs {
+			if e.Container == apparmorContainer {
+				observed = append(observed, e)
+			}
+		}
+
+		for _, path := range apparmorExecs {
+			observed = append(observed, events.Event{Path: path, Verdict: events.VerdictAllow})
+		}
+
+		if len(observed) == 0 {
+			log.Fatalf("no executions observed in container %s of pod %s/%s", apparmorContainer, apparmorNamespace, apparmorPod)
+		}
+
+		name := apparmorProfile
+		if name == "" {
+			name = fmt.Sprintf("fanotify-mon-%s-%s", apparmorPod, apparmorContainer)
+		}
+
+		p := apparmor.FromEvents(name, observed)
+		log.Infof("apply the profile with the pod annotation %s", p.Annotation(apparmorContainer))
+
+		if apparmorOutput == "-" {
+			fmt.Print(p.String())
+			return
+		}
+
+		if err := os.WriteFile(apparmorOutput, []byte(p.String()), 0o644); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(apparmorCmd)
+
+	f := apparmorCmd.Flags()
+	f.DurationVarP(&apparmorSince, "since", "", 0, "Only use the executions of this last period, 0 for all of them")
+	f.StringVarP(&apparmorNamespace, "namespace", "n", "default", "Namespace of the pod")
+	f.StringVarP(&apparmorPod, "pod", "", "", "Name of the pod")
+	f.StringVarP(&apparmorContainer, "container", "c", "", "Name of the container")
+	f.StringVarP(&apparmorProfile, "profile", "", "", "Name of the profile, fanotify-mon-<pod>-<container> by default")
+	f.StringSliceVarP(&apparmorExecs, "exec", "", nil, "Executables to allow even if they were not observed, like the entrypoint of the container")
+	f.StringVarP(&apparmorOutput, "output", "o", "-", "File to write the profile to, - for the standard output")
+	apparmorCmd.MarkFlagRequired("pod")
+	apparmorCmd.MarkFlagRequired("container")
+}
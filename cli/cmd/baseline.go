@@ -0,0 +1,201 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/baseline"
+	"github.com/kinvolk/fanotify-poc/pkg/containerd"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	baselineOutput    string
+	baselinePull      bool
+	baselineContainer string
+	baselineFile      string
+	baselinePath      string
+)
+
+var baselineCmd = &cobra.Command{
+	Use:   "baseline",
+	Short: "Manage the baselines of the trusted executables",
+}
+
+var baselineGenerateCmd = &cobra.Command{
+	Use:   "generate <image>",
+	Short: "Compute the baseline of an image from the containerd store",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var files map[string]string
+
+		name, digest, err := containerd.WithImageRootFS(context.Background(), args[0], containerd.ContainerdNamespace, baselinePull, func(root string) error {
+			var err error
+			files, err = (&baseline.Walker{Workers: runtime.NumCPU()}).Compute(root)
+			return err
+		})
+		if err != nil {
+			log.Fatalf("computing baseline of %s: %v", args[0], err)
+		}
+
+		b := baseline.New(files)
+		b.Image = name
+		b.ImageDigest = digest
+
+		if err := b.WriteFile(baselineOutput); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var baselineExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Write the baseline trusted by the agent for a running container",
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := adminClient().Baseline(context.Background(), baselineContainer)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := b.WriteFile(baselineOutput); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var baselineImportCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Make the agent trust a baseline, for a running container or for the new containers of its image",
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := baseline.ReadFile(baselineFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := adminClient().ImportBaseline(context.Background(), baselineContainer, b); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var baselineDiffCmd = &cobra.Command{
+	Use:   "diff <before> [after]",
+	Short: "List the executables which changed between two baselines",
+	Long: `List the executables which changed between two baselines.
+
+The baselines are files written by generate or export, like the ones of two versions of an image. With --container and
+a single file, the baseline trusted by the agent for the running container is the one after: it shows the drift of the
+container from a reference baseline. The baselines are compared as Merkle trees of their directories, and only the
+directories whose hashes differ are looked into, so only the ones which changed are fetched from the agent. --path
+compares a directory only.
+
+The executables are listed as added, removed or modified, the command fails if there are any.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		before := readTree(args[0]).Source()
+
+		var after baseline.NodeSource
+		fetched := 0
+		switch {
+		case len(args) == 2 && baselineContainer == "":
+			after = readTree(args[1]).Source()
+		case len(args) == 1 && baselineContainer != "":
+			client := adminClient()
+			after = func(dir string) (*baseline.TreeNode, error) {
+				fetched++
+				return client.BaselineTree(context.Background(), baselineContainer, dir)
+			}
+		default:
+			log.Fatal("two baselines are needed, or one with --container")
+		}
+
+		diff, err := baseline.Compare(before, after, baselinePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, path := range diff.Added {
+			fmt.Printf("added\t%s\n", path)
+		}
+		for _, path := range diff.Removed {
+			fmt.Printf("removed\t%s\n", path)
+		}
+		for _, path := range diff.Modified {
+			fmt.Printf("modified\t%s\n", path)
+		}
+
+		if fetched > 0 {
+			log.Debugf("fetched %d directories of the baseline of container %s", fetched, baselineContainer)
+		}
+		fmt.Fprintf(os.Stderr, "%d added, %d removed, %d modified\n", len(diff.Added), len(diff.Removed), len(diff.Modified))
+		if !diff.Empty() {
+			os.Exit(1)
+		}
+	},
+}
+
+// readTree returns the Merkle tree of the baseline file.
+func readTree(file string) *baseline.Tree {
+	b, err := baseline.ReadFile(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tree, err := baseline.NewTree(baseline.Map(b.Files))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return tree
+}
+
+// removedImageGrace is how long the baselines of the images which are not on the node are kept after they were last
+// used, so the ones imported ahead of the pull of their image are not removed right away.
+const removedImageGrace = 24 * time.Hour
+
+// collectBaselines removes the baselines stored past the quota and, with the containerd runtime, the ones of the images
+// removed from the node, every interval.
+func collectBaselines(baselines *baseline.Store, quota int64, withImages bool, interval time.Duration) {
+	for {
+		var images map[string]bool
+		if withImages {
+			var err error
+			if images, err = containerd.ListImageDigests(containerd.ContainerdNamespace); err != nil {
+				log.Errorf("listing images to collect their baselines: %v", err)
+			}
+		}
+
+		if err := baselines.GC(quota, images, removedImageGrace); err != nil {
+			log.Errorf("collecting baselines: %v", err)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(baselineCmd)
+	baselineCmd.AddCommand(baselineGenerateCmd, baselineExportCmd, baselineImportCmd, baselineDiffCmd)
+
+	f := baselineGenerateCmd.Flags()
+	f.StringVarP(&baselineOutput, "output", "o", "-", "File to write the baseline to, - for the standard output")
+	f.BoolVarP(&baselinePull, "pull", "", true, "Pull the image if it is not in the containerd store")
+
+	f = baselineExportCmd.Flags()
+	f.StringVarP(&baselineContainer, "container", "", "", "ID of the container, it can be shortened")
+	f.StringVarP(&baselineOutput, "output", "o", "-", "File to write the baseline to, - for the standard output")
+	baselineExportCmd.MarkFlagRequired("container")
+
+	f = baselineImportCmd.Flags()
+	f.StringVarP(&baselineContainer, "container", "", "", "ID of the container to replace the baseline of, by default it is used for the new containers of the image of the baseline")
+	f.StringVarP(&baselineFile, "file", "f", "", "File with the baseline")
+	baselineImportCmd.MarkFlagRequired("file")
+
+	f = baselineDiffCmd.Flags()
+	f.StringVarP(&baselineContainer, "container", "", "", "ID of the running container whose baseline is compared with the file, it can be shortened")
+	f.StringVarP(&baselinePath, "path", "", "/", "Directory of the baselines to compare")
+}
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/alert"
+	"github.com/kinvolk/fanotify-poc/pkg/controller"
+	"github.com/kinvolk/fanotify-poc/pkg/k8s"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const controllerLease = "fanotify-mon-controller"
+
+var (
+	controllerInterval   time.Duration
+	controllerStaleAfter time.Duration
+	controllerNamespace  string
+)
+
+var controllerCmd = &cobra.Command{
+	Use:   "controller",
+	Short: "Aggregate the node statuses into the status of the policies",
+	Long: `Aggregate the node statuses into the status of the policies.
+
+Every --interval the NodeStatus objects of the nodes are aggregated into the status of their ExecPolicy objects: the
+nodes enforcing them, the pods and containers covered and the nodes with errors, or which did not report for
+--stale-after. With --aggregator-url the distinct violations of the last 24 hours are counted too.
+
+The nodes whose agent stopped reporting for --stale-after get the Reporting condition set to false, and with
+--alertmanager-url the FanotifyMonAgentNotReporting alert fires until it reports again. The NodeStatus objects of the
+nodes which are gone are deleted. Several replicas can run, only the one holding the
+fanotify-mon-controller Lease of --leader-election-namespace works.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := k8s.NewDynamicClient(cfg.Kubeconfig)
+		if err != nil {
+			log.Fatalf("creating client: %v", err)
+		}
+
+		clientset, err := k8s.NewClientset(cfg.Kubeconfig)
+		if err != nil {
+			log.Fatalf("creating clientset: %v", err)
+		}
+
+		c := &controller.Controller{
+			Client:     client,
+			Clientset:  clientset,
+			Interval:   controllerInterval,
+			StaleAfter: controllerStaleAfter,
+		}
+
+		if cfg.AggregatorURL != "" {
+			if c.Aggregator, err = aggregatorClient(); err != nil {
+				log.Fatalf("creating aggregator client: %v", err)
+			}
+		}
+
+		if cfg.AlertmanagerURL != "" {
+			c.Alerts = alert.NewClient(cfg.AlertmanagerURL)
+		}
+
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatalf("getting hostname: %v", err)
+		}
+		identity := fmt.Sprintf("%s_%d", hostname, os.Getpid())
+
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		k8s.RunLeader(ctx, clientset, controllerNamespace, controllerLease, identity, func(ctx context.Context) {
+			log.Infof("leading as %s", identity)
+			c.Run(ctx)
+		})
+
+		if ctx.Err() == nil {
+			log.Fatalf("lost the leadership")
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(controllerCmd)
+
+	f := controllerCmd.Flags()
+	f.DurationVarP(&controllerInterval, "interval", "", time.Minute, "How often to aggregate the statuses")
+	f.DurationVarP(&controllerStaleAfter, "stale-after", "", 5*time.Minute, "How long the agent of a node can go without reporting its status before it is flagged as not reporting, a few --status-interval of the agents")
+	f.StringVarP(&controllerNamespace, "leader-election-namespace", "", "kube-system", "Namespace of the Lease electing the working replica")
+	f.StringVarP(&cfg.AlertmanagerURL, "alertmanager-url", "", cfg.AlertmanagerURL, "Alertmanager to send the alerts of the nodes whose agent stopped reporting to, /api/v2/alerts is added to the URL without path")
+	f.StringVarP(&cfg.AggregatorURL, "aggregator-url", "", cfg.AggregatorURL, "URL of the gRPC service of the aggregator to count the violations of the policies from, http://HOST:PORT or https://HOST:PORT")
+	f.StringVarP(&cfg.AggregatorCAFile, "aggregator-ca-file", "", cfg.AggregatorCAFile, "Path to the CA certificates verifying the aggregator, the system ones are used without it")
+	f.StringVarP(&cfg.AggregatorCertFile, "aggregator-cert-file", "", cfg.AggregatorCertFile, "Path to the client certificate sent to the aggregator")
+	f.StringVarP(&cfg.AggregatorKeyFile, "aggregator-key-file", "", cfg.AggregatorKeyFile, "Path to the key of the client certificate sent to the aggregator")
+}
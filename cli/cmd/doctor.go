@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/containerd"
+	"github.com/kinvolk/fanotify-poc/pkg/docker"
+	"github.com/kinvolk/fanotify-poc/pkg/doctor"
+	"github.com/kinvolk/fanotify-poc/pkg/k8s"
+	"github.com/spf13/cobra"
+)
+
+var doctorSkipRBAC bool
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check that the agent can run on this node",
+	Run: func(cmd *cobra.Command, args []string) {
+		checks := []doctor.Check{
+			// FAN_OPEN_EXEC_PERM was added in Linux 5.0.
+			doctor.KernelVersion(5, 0),
+			doctor.KernelConfig("CONFIG_FANOTIFY", "CONFIG_FANOTIFY_ACCESS_PERMISSIONS"),
+			doctor.CapSysAdmin(),
+			doctor.Fanotify(),
+			doctor.HostPID(),
+			doctor.Socket("containerd", containerd.ContainerdSocket),
+		}
+
+		if cfg.Runtime == docker.RuntimeDocker {
+			checks = append(checks, doctor.Socket("docker", docker.DockerSocket))
+		}
+
+		if !doctorSkipRBAC {
+			checks = append(checks, doctor.Check{Name: "RBAC", Run: checkRBAC})
+		}
+
+		results := doctor.Run(checks)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "CHECK\tSTATUS\tDETAIL")
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", r.Name, r.Status, r.Detail)
+		}
+		w.Flush()
+
+		if doctor.Failed(results) {
+			os.Exit(1)
+		}
+	},
+}
+
+func checkRBAC() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	missing, err := k8s.MissingPermissions(ctx, cfg.Kubeconfig, k8s.AgentPermissions)
+	if err != nil {
+		return "", err
+	}
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing %s, see deploy/agent-rbac.yaml", strings.Join(missing, ", "))
+	}
+
+	return "all permissions granted", nil
+}
+
+func init() {
+	RootCmd.AddCommand(doctorCmd)
+
+	doctorCmd.Flags().BoolVarP(&doctorSkipRBAC, "skip-rbac", "", false, "Don't check the permissions in the cluster, e.g. when it can't be reached")
+}
@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/eventstore"
+	"github.com/kinvolk/fanotify-poc/pkg/status"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	eventsSince   time.Duration
+	eventsQuery   eventstore.Query
+	eventsVerdict string
+	eventsJSON    bool
+
+	eventsAnchors []string
+)
+
+var eventsCmd = &cobra.Command{
+	Use:   "events",
+	Short: "Show the decisions stored by the agent running on this node",
+	Run: func(cmd *cobra.Command, args []string) {
+		q := eventsQuery
+		q.Verdict = events.Verdict(eventsVerdict)
+		if eventsSince > 0 {
+			q.Since = time.Now().Add(-eventsSince)
+		}
+
+		evs, err := adminClient().Events(context.Background(), &q)
+		if err != nil {
+			log.Fatalf("querying events: %v", err)
+		}
+
+		if eventsJSON {
+			enc := json.NewEncoder(os.Stdout)
+			for _, e := range evs {
+				if err := enc.Encode(e); err != nil {
+					log.Fatalf("writing events: %v", err)
+				}
+			}
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tVERDICT\tNAMESPACE\tPOD\tCONTAINER\tPATH\tREASON")
+		for _, e := range evs {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Time.Format(time.RFC3339), e.Verdict, e.Namespace, e.Pod, e.Container, e.Path, e.Reason)
+		}
+		w.Flush()
+	},
+}
+
+var eventsVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify the hash chain of the events stored on this node",
+	Long: `Verify the hash chain of the events stored on this node.
+
+Every stored event is chained to the previous one by a hash, modifying, removing or inserting events breaks the chain.
+The heads of the chain logged by the agent, or reported in the NodeStatus object of the node, can be given with
+--anchor: rewriting the events before them would change them. The store is read from --event-dir directly, the agent
+doesn't need to be running.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		v, err := eventstore.Verify(cfg.EventDir, eventsAnchors)
+		if err != nil {
+			log.Fatalf("verifying events: %v", err)
+		}
+
+		fmt.Printf("events: %d, head: %s\n", v.Events, v.Head)
+		if v.Unchained > 0 {
+			fmt.Printf("lines without chain: %d\n", v.Unchained)
+		}
+
+		failed := false
+		if v.Broken != "" {
+			fmt.Printf("chain broken at %s\n", v.Broken)
+			failed = true
+		}
+
+		for _, a := range eventsAnchors {
+			if !v.Anchors[a] {
+				fmt.Printf("anchor %s not found\n", a)
+				failed = true
+			}
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+		fmt.Println("chain intact")
+	},
+}
+
+// eventChainAnchor returns the current anchor of the event store, nil without store or events.
+func eventChainAnchor(store *eventstore.Store) func() *status.ChainAnchor {
+	return func() *status.ChainAnchor {
+		if store == nil {
+			return nil
+		}
+
+		head := store.Head()
+		if head == "" {
+			return nil
+		}
+
+		return &status.ChainAnchor{Head: head, Time: metav1.Now()}
+	}
+}
+
+// logEventChain logs the head of the chain of the event store every interval when it changed, the logs shipped off the
+// node then anchor the events.
+func logEventChain(store *eventstore.Store, interval time.Duration) {
+	logged := ""
+	for {
+		time.Sleep(interval)
+
+		if head := store.Head(); head != logged {
+			log.WithField("head", head).Info("event chain anchor")
+			logged = head
+		}
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(eventsCmd)
+	eventsCmd.AddCommand(eventsVerifyCmd)
+
+	vf := eventsVerifyCmd.Flags()
+	vf.StringVarP(&cfg.EventDir, "event-dir", "", cfg.EventDir, "Directory the agent stores the decisions in")
+	vf.StringSliceVarP(&eventsAnchors, "anchor", "", nil, "Head of the chain recorded earlier, which must be in the chain")
+
+	f := eventsCmd.Flags()
+	f.DurationVarP(&eventsSince, "since", "", time.Hour, "Only show the events of this last period, 0 for all of them")
+	f.StringVarP(&eventsQuery.Namespace, "namespace", "n", "", "Only show the events of this namespace")
+	f.StringVarP(&eventsQuery.Pod, "pod", "", "", "Only show the events of this pod")
+	f.StringVarP(&eventsQuery.Path, "path", "", "", "Only show the events of the executed files matching this glob")
+	f.StringVarP(&eventsVerdict, "verdict", "", "", "Only show the events with this verdict: allow, deny or audit")
+	f.BoolVarP(&eventsQuery.Drift, "drift", "", false, "Only show the executions of files modified or added since the baseline")
+	f.BoolVarP(&eventsJSON, "json", "", false, "Print the events as JSON lines, like they are stored")
+	f.IntVarP(&eventsQuery.Limit, "limit", "", 100, "Maximum number of events to show, the most recent ones")
+}
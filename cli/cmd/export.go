@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/eventstore"
+	"github.com/kinvolk/fanotify-poc/pkg/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+// exportTimeout is how long uploading one segment of the event store can take.
+const exportTimeout = 5 * time.Minute
+
+// exportBucket returns the bucket of --export-url with the credentials of the environment, and the prefix of the
+// keys.
+func exportBucket() (*s3.Bucket, string, error) {
+	bucket, prefix, err := s3.ParseURL(cfg.ExportURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if bucket.Creds, err = s3.EnvCredentials(); err != nil {
+		return nil, "", err
+	}
+
+	if cfg.ExportRegion != "" {
+		bucket.Region = cfg.ExportRegion
+	}
+
+	return bucket, prefix, nil
+}
+
+// exportEvents uploads the hours of events of the store every interval, once they are complete, under
+// PREFIX/NODE/2006010215.jsonl.gz.
+func exportEvents(nodeName string, store *eventstore.Store, bucket *s3.Bucket, prefix string, interval time.Duration) {
+	upload := func(name string, data []byte) error {
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		defer cancel()
+
+		return bucket.Put(ctx, path.Join(prefix, nodeName, name), data, "application/gzip")
+	}
+
+	for {
+		exported, err := store.Export(time.Now(), upload)
+		if exported > 0 {
+			log.Infof("exported %d hours of events to bucket %s", exported, bucket.Name)
+		}
+		if err != nil {
+			log.Errorf("exporting events: %v", err)
+		}
+
+		time.Sleep(interval)
+	}
+}
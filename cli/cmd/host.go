@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/kinvolk/fanotify-poc/internal"
+	"github.com/kinvolk/fanotify-poc/pkg/config"
+	"github.com/kinvolk/fanotify-poc/pkg/systemd"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var hostConfigFile string
+
+var hostCmd = &cobra.Command{
+	Use:   "host",
+	Short: "Enforce the baselines of host directories and systemd services, without Kubernetes",
+	Long: `Enforce the baselines of host directories and systemd services, without Kubernetes.
+
+The targets are read from a YAML file. The baseline of a target is computed from its paths when the agent starts, the
+executions of their files are then verified against it. The targets with a systemd unit only enforce the executions of
+the processes of the unit, wherever their files are.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		hostCfg, err := config.LoadHostConfig(hostConfigFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := hostCfg.Validate(); err != nil {
+			log.Fatalf("invalid host config: %v", err)
+		}
+
+		enforcer, err := internal.NewHostEnforcer(hostCfg, runtime.NumCPU())
+		if err != nil {
+			log.Fatalf("enforcing host: %v", err)
+		}
+		defer enforcer.Close()
+
+		log.Infof("enforcing %d targets", len(hostCfg.Targets))
+		if err := systemd.Notify(fmt.Sprintf("READY=1\nSTATUS=enforcing %d targets", len(hostCfg.Targets))); err != nil {
+			log.Errorf("notifying readiness: %v", err)
+		}
+
+		// systemd restarts the agent when an execution waits for too long, the host would be stuck otherwise.
+		if interval, ok := systemd.WatchdogInterval(); ok {
+			go systemd.Watchdog(interval, func() bool {
+				return !enforcer.Stuck(interval)
+			})
+		}
+
+		if err := enforcer.Run(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(hostCmd)
+
+	hostCmd.Flags().StringVarP(&hostConfigFile, "targets", "", "/etc/fanotify-mon/host.yaml", "Path to the YAML file with the targets to enforce")
+}
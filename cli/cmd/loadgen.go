@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	loadgenDuration    time.Duration
+	loadgenConcurrency int
+)
+
+var loadgenCmd = &cobra.Command{
+	Use:   "loadgen [command [args...]]",
+	Short: "Run a command over and over and measure the latency of its executions",
+	Long: `Run a command over and over and measure the latency of its executions.
+
+The command, /bin/true by default, is run by --concurrency workers for --duration. The executions per second and the
+latency percentiles of the executions are printed once done. Run it in an enforced container and in one which is not,
+the difference is what the agent adds to every execution.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			args = []string{"/bin/true"}
+		}
+
+		var (
+			lock      sync.Mutex
+			latencies []time.Duration
+			failures  int
+			wg        sync.WaitGroup
+		)
+
+		end := time.Now().Add(loadgenDuration)
+		for i := 0; i < loadgenConcurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for time.Now().Before(end) {
+					start := time.Now()
+					err := exec.Command(args[0], args[1:]...).Run()
+					latency := time.Since(start)
+
+					lock.Lock()
+					if err != nil {
+						failures++
+					} else {
+						latencies = append(latencies, latency)
+					}
+					lock.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if len(latencies) == 0 {
+			log.Fatalf("all the %d executions failed", failures)
+		}
+
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		percentile := func(p int) time.Duration {
+			return latencies[(len(latencies)-1)*p/100].Round(time.Microsecond)
+		}
+
+		fmt.Printf("executions: %d, failed: %d, %.1f/s\n", len(latencies), failures, float64(len(latencies))/loadgenDuration.Seconds())
+		fmt.Printf("latency: p50 %s, p90 %s, p99 %s, max %s\n", percentile(50), percentile(90), percentile(99), percentile(100))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(loadgenCmd)
+
+	f := loadgenCmd.Flags()
+	f.DurationVarP(&loadgenDuration, "duration", "", 10*time.Second, "How long to run the command for")
+	f.IntVarP(&loadgenConcurrency, "concurrency", "", runtime.NumCPU(), "How many executions run at once")
+}
@@ -0,0 +1,374 @@
+package cmd
+
+import (
+	"github.com/kinvolk/fanotify-poc/internal"
+	"github.com/kinvolk/fanotify-poc/pkg/alert"
+	"github.com/kinvolk/fanotify-poc/pkg/baseline"
+	"github.com/kinvolk/fanotify-poc/pkg/config"
+	"github.com/kinvolk/fanotify-poc/pkg/eventstore"
+	"github.com/kinvolk/fanotify-poc/pkg/hashpool"
+	"github.com/kinvolk/fanotify-poc/pkg/metrics"
+	"github.com/kinvolk/fanotify-poc/pkg/sink"
+	"github.com/kinvolk/fanotify-poc/pkg/status"
+)
+
+// newMetrics returns the metrics of the agent.
+func newMetrics(cfg *config.Config, fdBudget *internal.FDBudget, hashPool *hashpool.Pool, registry *internal.Registry, fanout *sink.Fanout, dedup *sink.Dedup, quarantine *internal.Quarantine, alerts *alert.Engine, store *eventstore.Store, baselines *baseline.Store) *metrics.Registry {
+	r := &metrics.Registry{Labels: metrics.LabelPolicy{
+		Drop:      cfg.MetricsDropLabels,
+		Hash:      cfg.MetricsHashLabels,
+		MaxLength: cfg.MetricsMaxLabelLength,
+	}}
+	containers := registry.Containers
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_notifiers",
+		Help: "Number of notifiers enforcing a container.",
+		Type: metrics.TypeGauge,
+		Collect: func() []metrics.Sample {
+			return metrics.Value(float64(registry.Stats().Active))
+		},
+	})
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_notifiers_pending",
+		Help: "Number of notifiers being created for the containers which just started.",
+		Type: metrics.TypeGauge,
+		Collect: func() []metrics.Sample {
+			return metrics.Value(float64(registry.Stats().Pending))
+		},
+	})
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_notifiers_failed",
+		Help: "Number of running containers which could not be enforced.",
+		Type: metrics.TypeGauge,
+		Collect: func() []metrics.Sample {
+			return metrics.Value(float64(registry.Stats().Failed))
+		},
+	})
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_notifiers_created_total",
+		Help: "Number of notifiers created since the agent started, including the restarted ones.",
+		Type: metrics.TypeCounter,
+		Collect: func() []metrics.Sample {
+			return metrics.Value(float64(registry.Stats().Created))
+		},
+	})
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_notifiers_closed_total",
+		Help: "Number of notifiers closed since the agent started, including the restarted ones.",
+		Type: metrics.TypeCounter,
+		Collect: func() []metrics.Sample {
+			return metrics.Value(float64(registry.Stats().Closed))
+		},
+	})
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_hash_queue",
+		Help: "Number of files waiting to be hashed by priority.",
+		Type: metrics.TypeGauge,
+		Collect: func() []metrics.Sample {
+			samples := []metrics.Sample{}
+			for _, prio := range []hashpool.Priority{hashpool.PriorityExec, hashpool.PriorityBackground} {
+				samples = append(samples, metrics.Sample{
+					Labels: map[string]string{"priority": prio.String()},
+					Value:  float64(hashPool.Waiting(prio)),
+				})
+			}
+
+			return samples
+		},
+	})
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_open_fds",
+		Help: "Number of files open by the agent.",
+		Type: metrics.TypeGauge,
+		Collect: func() []metrics.Sample {
+			return metrics.Value(float64(fdBudget.Open()))
+		},
+	})
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_fd_limit",
+		Help: "Maximum number of files the agent can open.",
+		Type: metrics.TypeGauge,
+		Collect: func() []metrics.Sample {
+			return metrics.Value(float64(fdBudget.Limit))
+		},
+	})
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_fd_budget_degraded",
+		Help: "1 when the agent is running out of files and only audits the denials.",
+		Type: metrics.TypeGauge,
+		Collect: func() []metrics.Sample {
+			if fdBudget.Degraded() {
+				return metrics.Value(1)
+			}
+
+			return metrics.Value(0)
+		},
+	})
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_container_open_fds",
+		Help: "Number of files open by the agent for each enforced container.",
+		Type: metrics.TypeGauge,
+		Collect: func() []metrics.Sample {
+			samples := []metrics.Sample{}
+			for _, cnt := range containers() {
+				samples = append(samples, metrics.Sample{
+					Labels: containerLabels(cnt),
+					Value:  float64(cnt.OpenFDs),
+				})
+			}
+
+			return samples
+		},
+	})
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_baseline_files",
+		Help: "Number of executables found in the rootfs of each enforced container when computing its baseline.",
+		Type: metrics.TypeGauge,
+		Collect: func() []metrics.Sample {
+			samples := []metrics.Sample{}
+			for _, cnt := range containers() {
+				samples = append(samples, metrics.Sample{Labels: containerLabels(cnt), Value: float64(cnt.BaselineFiles)})
+			}
+
+			return samples
+		},
+	})
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_baseline_files_hashed",
+		Help: "Number of executables of the rootfs of each enforced container hashed so far.",
+		Type: metrics.TypeGauge,
+		Collect: func() []metrics.Sample {
+			samples := []metrics.Sample{}
+			for _, cnt := range containers() {
+				samples = append(samples, metrics.Sample{Labels: containerLabels(cnt), Value: float64(cnt.BaselineHashed)})
+			}
+
+			return samples
+		},
+	})
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_pending_events",
+		Help: "Number of events of each enforced container waiting to be answered, in the fanotify queue or being handled.",
+		Type: metrics.TypeGauge,
+		Collect: func() []metrics.Sample {
+			samples := []metrics.Sample{}
+			for _, cnt := range containers() {
+				samples = append(samples, metrics.Sample{Labels: containerLabels(cnt), Value: float64(cnt.PendingEvents)})
+			}
+
+			return samples
+		},
+	})
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_backlog_age_seconds",
+		Help: "How long the oldest pending event of each enforced container waits at most.",
+		Type: metrics.TypeGauge,
+		Collect: func() []metrics.Sample {
+			samples := []metrics.Sample{}
+			for _, cnt := range containers() {
+				samples = append(samples, metrics.Sample{Labels: containerLabels(cnt), Value: cnt.BacklogSeconds})
+			}
+
+			return samples
+		},
+	})
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_backpressure",
+		Help: "1 for the enforced containers whose denials are only audited because their notifier is falling behind.",
+		Type: metrics.TypeGauge,
+		Collect: func() []metrics.Sample {
+			samples := []metrics.Sample{}
+			for _, cnt := range containers() {
+				value := 0.0
+				if cnt.Backpressure {
+					value = 1
+				}
+				samples = append(samples, metrics.Sample{Labels: containerLabels(cnt), Value: value})
+			}
+
+			return samples
+		},
+	})
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_shadow_divergences_total",
+		Help: "Number of executions of each enforced container the shadow policy decided differently than the enforced one.",
+		Type: metrics.TypeCounter,
+		Collect: func() []metrics.Sample {
+			samples := []metrics.Sample{}
+			for _, cnt := range containers() {
+				if cnt.ShadowPolicy == "" {
+					continue
+				}
+
+				labels := containerLabels(cnt)
+				labels["policy"] = cnt.Policy
+				labels["shadow_policy"] = cnt.ShadowPolicy
+				samples = append(samples, metrics.Sample{Labels: labels, Value: float64(cnt.ShadowDivergences)})
+			}
+
+			return samples
+		},
+	})
+
+	sinkStats := func(value func(sink.Stats) int64) []metrics.Sample {
+		samples := []metrics.Sample{}
+		for _, s := range fanout.Stats() {
+			samples = append(samples, metrics.Sample{Labels: map[string]string{"sink": s.Name}, Value: float64(value(s))})
+		}
+
+		return samples
+	}
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_sink_sent_total",
+		Help: "Number of decisions sent to each sink.",
+		Type: metrics.TypeCounter,
+		Collect: func() []metrics.Sample {
+			return sinkStats(func(s sink.Stats) int64 { return s.Sent })
+		},
+	})
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_sink_failed_total",
+		Help: "Number of decisions dropped after sending them to each sink failed, retries included.",
+		Type: metrics.TypeCounter,
+		Collect: func() []metrics.Sample {
+			return sinkStats(func(s sink.Stats) int64 { return s.Failed })
+		},
+	})
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_sink_dropped_total",
+		Help: "Number of decisions dropped because the queue of each sink was full.",
+		Type: metrics.TypeCounter,
+		Collect: func() []metrics.Sample {
+			return sinkStats(func(s sink.Stats) int64 { return s.Dropped })
+		},
+	})
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_decisions_deduplicated_total",
+		Help: "Number of identical consecutive decisions collapsed into summaries by the dedup window.",
+		Type: metrics.TypeCounter,
+		Collect: func() []metrics.Sample {
+			return metrics.Value(float64(dedup.Suppressed()))
+		},
+	})
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_quarantined_total",
+		Help: "Number of containers quarantined after reaching the quarantine denials.",
+		Type: metrics.TypeCounter,
+		Collect: func() []metrics.Sample {
+			return metrics.Value(float64(quarantine.Quarantined()))
+		},
+	})
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_baseline_store_bytes",
+		Help: "Size of the baselines imported for the images.",
+		Type: metrics.TypeGauge,
+		Collect: func() []metrics.Sample {
+			stats, err := baselines.Stats()
+			if err != nil {
+				return nil
+			}
+
+			return metrics.Value(float64(stats.Bytes))
+		},
+	})
+
+	r.Register(&metrics.Metric{
+		Name: "fanotify_mon_baseline_store_evictions_total",
+		Help: "Number of imported baselines removed, by reason: quota or image-removed.",
+		Type: metrics.TypeCounter,
+		Collect: func() []metrics.Sample {
+			stats, err := baselines.Stats()
+			if err != nil {
+				return nil
+			}
+
+			samples := []metrics.Sample{}
+			for _, reason := range []string{baseline.EvictQuota, baseline.EvictImageRemoved} {
+				samples = append(samples, metrics.Sample{
+					Labels: map[string]string{"reason": reason},
+					Value:  float64(stats.Evictions[reason]),
+				})
+			}
+
+			return samples
+		},
+	})
+
+	if store != nil {
+		r.Register(&metrics.Metric{
+			Name: "fanotify_mon_event_store_bytes",
+			Help: "Size of the stored decisions.",
+			Type: metrics.TypeGauge,
+			Collect: func() []metrics.Sample {
+				return metrics.Value(float64(store.Stats().Bytes))
+			},
+		})
+
+		r.Register(&metrics.Metric{
+			Name: "fanotify_mon_event_store_evictions_total",
+			Help: "Number of hours of stored decisions removed, by reason: retention or quota.",
+			Type: metrics.TypeCounter,
+			Collect: func() []metrics.Sample {
+				stats := store.Stats()
+				samples := []metrics.Sample{}
+				for _, reason := range []string{eventstore.EvictRetention, eventstore.EvictQuota} {
+					samples = append(samples, metrics.Sample{
+						Labels: map[string]string{"reason": reason},
+						Value:  float64(stats.Evictions[reason]),
+					})
+				}
+
+				return samples
+			},
+		})
+	}
+
+	if alerts != nil {
+		r.Register(&metrics.Metric{
+			Name: "fanotify_mon_alerts_firing",
+			Help: "Number of alerts of the alert rules firing.",
+			Type: metrics.TypeGauge,
+			Collect: func() []metrics.Sample {
+				return metrics.Value(float64(alerts.Firing()))
+			},
+		})
+	}
+
+	for _, s := range fanout.Sinks() {
+		if p, ok := s.(*sink.Prometheus); ok {
+			r.Register(p.Metric())
+		}
+	}
+
+	return r
+}
+
+func containerLabels(cnt status.Container) map[string]string {
+	return map[string]string{
+		"namespace": cnt.Namespace,
+		"pod":       cnt.Pod,
+		"container": cnt.Name,
+	}
+}
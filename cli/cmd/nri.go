@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/nri"
+	"github.com/kinvolk/fanotify-poc/pkg/ocihook"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// nriPluginName is the name of the plugin in its results.
+const nriPluginName = "fanotify-mon"
+
+// nriConf is the configuration of the plugin in /etc/nri/conf.json.
+type nriConf struct {
+	HookSocket string          `json:"hookSocket,omitempty"`
+	Timeout    metav1.Duration `json:"timeout,omitempty"`
+	FailClosed bool            `json:"failClosed,omitempty"`
+}
+
+var nriCmd = &cobra.Command{
+	Use:     "nri",
+	Aliases: []string{"invoke"},
+	Short:   "Attach and remove the containers as an NRI plugin of containerd",
+	Long: `Attach and remove the containers as an NRI plugin of containerd.
+
+containerd runs the plugins of /opt/nri/bin with the invoke argument when the task of a container is created, before
+its process runs, and when it is deleted, and waits for them. The plugin sends the container to the agent listening on
+the hookSocket of its configuration, or --hook-socket, and returns once the agent attached or removed it. The
+container is created anyway when the agent can't be reached or does not answer within the timeout, 10s by default,
+unless failClosed is set: containerd then fails to create it.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		// The runtime reads the result on the standard output.
+		log.SetLevel(log.WarnLevel)
+
+		req, err := nri.ReadRequest(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		conf := &nriConf{HookSocket: cfg.HookSocket, Timeout: metav1.Duration{Duration: 10 * time.Second}}
+		if err := req.DecodeConf(conf); err != nil {
+			log.Fatal(err)
+		}
+
+		metadata := map[string]string{}
+		switch {
+		case conf.HookSocket == "":
+			log.Warnf("no hook socket in the NRI plugin configuration, container %s is not sent to the agent", req.ID)
+		case req.State == nri.Create && req.Pid != 0:
+			resp, err := ocihook.Call(conf.HookSocket, &ocihook.State{ID: req.ID, Pid: req.Pid}, conf.Timeout.Duration)
+			if err == nil && resp.Error != "" {
+				err = errors.New(resp.Error)
+			}
+
+			if err != nil {
+				if conf.FailClosed {
+					log.Fatalf("attaching container %s: %v", req.ID, err)
+				}
+
+				log.Warnf("creating container %s without attaching it first: %v", req.ID, err)
+				break
+			}
+
+			metadata["enforced"] = strconv.FormatBool(resp.Enforced)
+		case req.State == nri.Delete:
+			if _, err := ocihook.Call(conf.HookSocket, &ocihook.State{ID: req.ID, Deleted: true}, conf.Timeout.Duration); err != nil {
+				log.Warnf("removing container %s: %v", req.ID, err)
+			}
+		}
+
+		if err := nri.WriteResult(os.Stdout, nriPluginName, metadata); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(nriCmd)
+}
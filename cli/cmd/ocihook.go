@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/ocihook"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	ociHookTimeout    time.Duration
+	ociHookFailClosed bool
+)
+
+var ociHookCmd = &cobra.Command{
+	Use:   "oci-hook",
+	Short: "Attach the container about to start, as the createRuntime hook of the OCI runtime",
+	Long: `Attach the container about to start, as the createRuntime hook of the OCI runtime.
+
+The hook reads the state of the container on its standard input, like the runtime gives it, and sends it to the agent
+listening on --hook-socket. It returns once the agent placed the marks on the container, before its process runs, so
+there is no window in which its executions are not seen. The container starts anyway when the agent can't be reached
+or does not answer within --timeout, unless --fail-closed is set: the runtime then fails to create it.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		// The runtime only shows the output of the hooks when they fail.
+		log.SetLevel(log.WarnLevel)
+
+		if cfg.HookSocket == "" {
+			log.Fatal("no --hook-socket")
+		}
+
+		state, err := ocihook.ReadState(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		resp, err := ocihook.Call(cfg.HookSocket, state, ociHookTimeout)
+		if err == nil && resp.Error != "" {
+			err = errors.New(resp.Error)
+		}
+
+		if err != nil {
+			if ociHookFailClosed {
+				log.Fatalf("attaching container %s: %v", state.ID, err)
+			}
+
+			log.Warnf("starting container %s without attaching it first: %v", state.ID, err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(ociHookCmd)
+
+	f := ociHookCmd.Flags()
+	f.DurationVarP(&ociHookTimeout, "timeout", "", 10*time.Second, "How long to wait for the agent, it should be longer than its --hook-timeout")
+	f.BoolVarP(&ociHookFailClosed, "fail-closed", "", false, "Fail the creation of the container when it could not be attached")
+}
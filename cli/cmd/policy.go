@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/kinvolk/fanotify-poc/pkg/fapolicyd"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	"github.com/kinvolk/fanotify-poc/pkg/simulate"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	policyName   string
+	policyOutput string
+)
+
+var policyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "Manage the execution policies",
+}
+
+var policyImportFapolicydCmd = &cobra.Command{
+	Use:   "import-fapolicyd <rules file...>",
+	Short: "Translate fapolicyd rules into an ExecPolicy",
+	Long: `Translate fapolicyd rules into an ExecPolicy.
+
+The rule files are read in order, like the ones of /etc/fapolicyd/rules.d. The rules which can't be translated are
+skipped with a warning, the policy has to be reviewed before it is applied.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		res := &fapolicyd.Result{}
+		for _, name := range args {
+			f, err := os.Open(name)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			err = fapolicyd.Import(f, filepath.Base(name), res)
+			f.Close()
+			if err != nil {
+				log.Fatalf("importing fapolicyd rules: %v", err)
+			}
+		}
+
+		for _, warning := range res.Warnings {
+			log.Warn(warning)
+		}
+
+		p := &policy.ExecPolicy{
+			TypeMeta:   metav1.TypeMeta{APIVersion: policy.APIVersion, Kind: policy.Kind},
+			ObjectMeta: metav1.ObjectMeta{Name: policyName},
+			Spec:       policy.ExecPolicySpec{Rules: res.Rules},
+		}
+
+		if err := p.Validate(); err != nil {
+			log.Fatalf("validating policy: %v", err)
+		}
+
+		data, err := yaml.Marshal(p)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if policyOutput == "-" {
+			fmt.Print(string(data))
+			return
+		}
+
+		if err := os.WriteFile(policyOutput, data, 0o644); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var policyTestCmd = &cobra.Command{
+	Use:   "test <fixture file...>",
+	Short: "Evaluate the policies of --policy-file on synthetic executions and check their decisions",
+	Long: `Evaluate the policies of --policy-file on synthetic executions and check their decisions.
+
+The fixture files list cases with the request the policy is evaluated on, like the ones of the events, and the expected
+verdict. The command fails if any case gets another verdict, or a reason without the expected one.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if cfg.PolicyFile == "" {
+			log.Fatal("--policy-file is required")
+		}
+
+		policies, err := policy.LoadFile(cfg.PolicyFile)
+		if err != nil {
+			log.Fatalf("loading policies: %v", err)
+		}
+
+		total, failed := 0, 0
+		for _, name := range args {
+			fixture, err := simulate.LoadFixture(name)
+			if err != nil {
+				log.Fatalf("%s: %v", name, err)
+			}
+
+			failures, err := fixture.Test(policies)
+			if err != nil {
+				log.Fatalf("%s: %v", name, err)
+			}
+
+			for _, f := range failures {
+				expected := string(f.Case.Expect)
+				if f.Case.Reason != "" {
+					expected += " (" + f.Case.Reason + ")"
+				}
+
+				fmt.Printf("FAIL\t%s: %s: expected %s, got %s (%s)\n", name, f.Case.Name, expected, f.Verdict, f.Reason)
+			}
+
+			total += len(fixture.Cases)
+			failed += len(failures)
+		}
+
+		fmt.Printf("%d cases, %d failed\n", total, failed)
+		if failed > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+var policyCanaryCmd = &cobra.Command{
+	Use:   "canary <policy> <percent|policy>",
+	Short: "Change the percentage of the pods a policy is enforced on, until the agent is restarted",
+	Long: `Change the percentage of the pods a policy is enforced on, until the agent is restarted.
+
+The pods are chosen by a stable hash of their UID, so the ones enforced stay enforced when the percentage grows. The
+other pods of the policy are audited. The percentage of the canary of the policy is used again with policy. Only the
+node of the agent is changed.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		var percent *int
+		if args[1] != modePolicy {
+			p, err := strconv.Atoi(args[1])
+			if err != nil {
+				log.Fatalf("invalid percentage %q", args[1])
+			}
+			percent = &p
+		}
+
+		if err := adminClient().SetCanary(context.Background(), args[0], percent); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(policyCmd)
+	policyCmd.AddCommand(policyImportFapolicydCmd)
+	policyCmd.AddCommand(policyCanaryCmd)
+	policyCmd.AddCommand(policyTestCmd)
+
+	f := policyImportFapolicydCmd.Flags()
+	f.StringVarP(&policyName, "name", "", "fapolicyd", "Name of the policy")
+	f.StringVarP(&policyOutput, "output", "o", "-", "File to write the policy to, - for the standard output")
+}
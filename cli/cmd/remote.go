@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/kinvolk/fanotify-poc/pkg/admin"
+	"github.com/kinvolk/fanotify-poc/pkg/mtls"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	agentAddr       string
+	agentTLS        mtls.Files
+	agentServerName string
+)
+
+func init() {
+	pf := RootCmd.PersistentFlags()
+	pf.StringVarP(&agentAddr, "agent", "", "", "Address of a remote agent serving the admin API with --admin-addr, like node-1:9443, for the commands using the admin API. Empty to use the local socket")
+	pf.StringVarP(&agentTLS.CAFile, "agent-ca-file", "", "", "Path to the CA certificates verifying the remote agent, the system ones are used without it")
+	pf.StringVarP(&agentTLS.CertFile, "agent-cert-file", "", "", "Path to the client certificate sent to the remote agent")
+	pf.StringVarP(&agentTLS.KeyFile, "agent-key-file", "", "", "Path to the key of the client certificate sent to the remote agent")
+	pf.StringVarP(&agentServerName, "agent-server-name", "", "", "Name the certificate of the remote agent is verified against, the host of --agent by default")
+}
+
+// adminClient returns the client of the admin API of the remote agent of --agent, or of the local one. It exits when
+// the options are invalid.
+func adminClient() admin.API {
+	client, err := newAdminClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return client
+}
+
+func newAdminClient() (admin.API, error) {
+	if agentAddr == "" {
+		if agentTLS != (mtls.Files{}) || agentServerName != "" {
+			return nil, fmt.Errorf("the agent TLS options need --agent")
+		}
+
+		return admin.NewClient(cfg.AdminSocket), nil
+	}
+
+	serverName := agentServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(agentAddr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing agent address: %w", err)
+		}
+		serverName = host
+	}
+
+	tlsConfig, err := mtls.ClientConfig(agentTLS, serverName)
+	if err != nil {
+		return nil, fmt.Errorf("configuring agent TLS: %w", err)
+	}
+
+	client, err := admin.NewRemoteClient(agentAddr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
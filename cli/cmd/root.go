@@ -2,36 +2,103 @@
 package cmd
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/kinvolk/fanotify-poc/internal"
+	"github.com/kinvolk/fanotify-poc/pkg/admin"
+	"github.com/kinvolk/fanotify-poc/pkg/aggregator"
+	"github.com/kinvolk/fanotify-poc/pkg/alert"
+	"github.com/kinvolk/fanotify-poc/pkg/baseline"
+	"github.com/kinvolk/fanotify-poc/pkg/bpflsm"
+	"github.com/kinvolk/fanotify-poc/pkg/config"
 	"github.com/kinvolk/fanotify-poc/pkg/containerd"
+	"github.com/kinvolk/fanotify-poc/pkg/dashboard"
 	"github.com/kinvolk/fanotify-poc/pkg/docker"
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/eventstore"
+	"github.com/kinvolk/fanotify-poc/pkg/hashpool"
 	"github.com/kinvolk/fanotify-poc/pkg/k8s"
+	"github.com/kinvolk/fanotify-poc/pkg/mtls"
+	"github.com/kinvolk/fanotify-poc/pkg/ocihook"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	"github.com/kinvolk/fanotify-poc/pkg/seccomp"
+	"github.com/kinvolk/fanotify-poc/pkg/sink"
+	"github.com/kinvolk/fanotify-poc/pkg/status"
+	"github.com/kinvolk/fanotify-poc/pkg/systemd"
 	containercollection "github.com/kinvolk/inspektor-gadget/pkg/container-collection"
+	pb "github.com/kinvolk/inspektor-gadget/pkg/gadgettracermanager/api"
 	"github.com/kinvolk/inspektor-gadget/pkg/gadgettracermanager/pubsub"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"golang.org/x/sys/unix"
+	"github.com/spf13/pflag"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
 )
 
+const (
+	aggregatorInterval      = 10 * time.Second
+	maxBufferedViolations   = 1000
+	fdCheckInterval         = 5 * time.Second
+	bpfEventInterval        = time.Second
+	watchdogInterval        = 5 * time.Second
+	remountInterval         = 5 * time.Second
+	backpressureInterval    = time.Second
+	dockerRetryInterval     = 5 * time.Second
+	containerdRetryInterval = 5 * time.Second
+	// baselineHotEntries is how many lookups of every baseline table are kept in memory.
+	baselineHotEntries = 512
+	// handoffTimeout is how long the containers of the previous agent have to be enforced again.
+	handoffTimeout = 2 * time.Minute
+	// unlistedDelay is how long a container missing from the spec of its pod is waited for, before it is enforced
+	// with the policy of the pod. The containers added to the spec, like the ephemeral ones, show up meanwhile.
+	unlistedDelay = 5 * time.Second
+	// podWaitTimeout is how long the pod of a container is waited for at most, when it is not listed yet.
+	podWaitTimeout = 10 * time.Minute
+	// exitCheckInterval is how often the containers waiting for their pod are checked for having exited.
+	exitCheckInterval = 5 * time.Second
+	// evictTimeout is how long evicting the pod of a container which could not be enforced can take.
+	evictTimeout = 30 * time.Second
+	// quarantineTimeout is how long labeling a quarantined pod and its node can take.
+	quarantineTimeout = 30 * time.Second
+)
+
+// notifierBackoff is how creating the notifier of a container is retried, before the container is reported as not
+// enforced.
+var notifierBackoff = wait.Backoff{Duration: time.Second, Factor: 2, Steps: 5, Cap: 30 * time.Second}
+
 var (
-	hostname    string
-	hostRuntime string
-	kubeconfig  string
+	configFile string
+	// cfg has the flag values until loadConfig sets it from all the sources.
+	cfg = config.Default()
 )
 
 var RootCmd = &cobra.Command{
 	Use:   "fanotify-mon",
 	Short: "Monitor for fanotify",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := loadConfig(cmd); err != nil {
+			return err
+		}
+
+		logToJournal()
+
+		containerd.SetContainerdNamespace(cfg.Runtime)
+		return nil
+	},
 	Run: func(cmd *cobra.Command, args []string) {
-		fanotify(hostname, hostRuntime, kubeconfig)
+		fanotify(cfg)
 	},
 }
 
@@ -46,79 +113,856 @@ func init() {
 	RootCmd.DisableAutoGenTag = true
 
 	pf := RootCmd.PersistentFlags()
-	pf.StringVarP(&hostname, "hostname", "", "", "Name of node in which fanotify-mon binary is running")
-	pf.StringVarP(&hostRuntime, "runtime", "", "docker", "Name of k8s container runtime")
-	pf.StringVarP(&kubeconfig, "kubeconfig", "", "$HOME/.kube/config", "Path to kubeconfig")
-	containerd.SetContainerdNamespace(hostRuntime)
+	pf.StringVarP(&configFile, "config", "", "", "Path to a YAML file with the options, the flags and the "+config.EnvPrefix+"* environment variables override it")
+	pf.StringVarP(&cfg.Hostname, "hostname", "", cfg.Hostname, "Name of node in which fanotify-mon binary is running")
+	pf.StringVarP(&cfg.Runtime, "runtime", "", cfg.Runtime, "Name of k8s container runtime")
+	pf.StringVarP(&cfg.Kubeconfig, "kubeconfig", "", cfg.Kubeconfig, "Path to kubeconfig")
+	pf.StringVarP(&cfg.PolicyFile, "policy-file", "", cfg.PolicyFile, "Path to a YAML file with the ExecPolicy objects to apply")
+	pf.StringArrayVarP(&cfg.PodSelectors, "pod-selector", "", cfg.PodSelectors, "Label selector of the enforced pods, like \"app in (a, b),!canary\", it can be repeated to enforce the pods matching any of them")
+	pf.DurationVarP(&cfg.StatusInterval.Duration, "status-interval", "", cfg.StatusInterval.Duration, "How often to report the node status in its NodeStatus object, 0 to disable it")
+	pf.StringVarP(&cfg.AdminSocket, "admin-socket", "", cfg.AdminSocket, "Path to the unix socket of the admin API")
+	pf.IntVarP(&cfg.AdminGroup, "admin-group", "", cfg.AdminGroup, "ID of the group whose members can use the admin API besides root, -1 for none")
+	pf.StringVarP(&cfg.HandoffSocket, "handoff-socket", "", cfg.HandoffSocket, "Path to the unix socket where the fanotify groups are handed off to the next agent during upgrades, empty to not hand them off")
+	pf.StringVarP(&cfg.HookSocket, "hook-socket", "", cfg.HookSocket, "Path to the unix socket where the OCI hooks send the containers about to start, for the agent to attach them before their process runs. Empty to not serve it")
+	pf.StringVarP(&cfg.SeccompSocket, "seccomp-socket", "", cfg.SeccompSocket, "Path to the unix socket receiving the seccomp notification FDs of the containers with the seccomp backend")
+
+	f := RootCmd.Flags()
+	f.StringArrayVarP(&cfg.DockerLabels, "docker-label", "", cfg.DockerLabels, "Label of the plain docker containers to enforce, like fanotify-mon.enforce=true, without Kubernetes: the containers are then watched from dockerd and the policies select them with their labels. It can be repeated, the containers need all of them")
+	f.DurationVarP(&cfg.HookTimeout.Duration, "hook-timeout", "", cfg.HookTimeout.Duration, "How long the OCI hooks wait for their container to be attached, it starts without it then")
+	f.StringVarP(&cfg.ContainerSource, "container-source", "", cfg.ContainerSource, "How the containers starting and stopping are found: container-collection, containerd to subscribe to the task events of containerd directly, without tracing the runc processes, or nri to only get them from the NRI plugin on --hook-socket")
+	f.StringVarP(&cfg.MarkMode, "mark-mode", "", cfg.MarkMode, "How to mark the container rootfs: mount, namespace to mark all the container mounts from its mount namespace, or filesystem to also cover the other mounts of its overlayfs")
+	f.StringVarP(&cfg.AggregatorURL, "aggregator-url", "", cfg.AggregatorURL, "URL of the gRPC service of the aggregator to send the violations and the node status to, http://HOST:PORT or https://HOST:PORT")
+	f.StringVarP(&cfg.AggregatorCAFile, "aggregator-ca-file", "", cfg.AggregatorCAFile, "Path to the CA certificates verifying the aggregator, the system ones are used without it")
+	f.StringVarP(&cfg.AggregatorCertFile, "aggregator-cert-file", "", cfg.AggregatorCertFile, "Path to the client certificate sent to the aggregator, it is read again when it changes")
+	f.StringVarP(&cfg.AggregatorKeyFile, "aggregator-key-file", "", cfg.AggregatorKeyFile, "Path to the key of the client certificate sent to the aggregator")
+	f.StringVarP(&cfg.AdminAddr, "admin-addr", "", cfg.AdminAddr, "Address to also serve the admin API on over mutual TLS, like :9443, for the remote clients, see --agent. Empty to only serve it on the socket")
+	f.StringVarP(&cfg.AdminCertFile, "admin-tls-cert-file", "", cfg.AdminCertFile, "Path to the TLS certificate of --admin-addr, it is read again when it changes")
+	f.StringVarP(&cfg.AdminKeyFile, "admin-tls-key-file", "", cfg.AdminKeyFile, "Path to the TLS key of --admin-addr")
+	f.StringVarP(&cfg.AdminClientCAFile, "admin-client-ca-file", "", cfg.AdminClientCAFile, "Path to the CA certificates of the clients of --admin-addr, a client certificate signed by them is required")
+	f.StringArrayVarP(&cfg.AdminAllowedClients, "admin-allowed-client", "", cfg.AdminAllowedClients, "Identity allowed in the client certificates of --admin-addr, matched with their common name, DNS names and URIs. It can be a pattern like spiffe://cluster.local/ns/ops/sa/* and be repeated, all the clients with a certificate signed by the CA are allowed without it")
+	f.StringArrayVarP(&cfg.Sinks, "sink", "", cfg.Sinks, "Where to send the decisions, as TYPE[:TARGET] [OPTION=VALUE...]: log for JSON lines on the standard output, file:PATH, webhook:URL, grpc:ADDRESS, forward:HOST[:PORT] for Fluentd and Fluent Bit or prometheus for fanotify_mon_decisions_total. The verdict and namespace options filter the decisions, retries sets how many times they are sent again. It can be repeated")
+	f.StringVarP(&cfg.AlertmanagerURL, "alertmanager-url", "", cfg.AlertmanagerURL, "Alertmanager to send the alerts of the --alert-rule rules to, /api/v2/alerts is added to the URL without path")
+	f.StringArrayVarP(&cfg.AlertRules, "alert-rule", "", cfg.AlertRules, "Alert fired when the decisions reach a count within a window, as NAME count=N [window=DURATION] [verdict=V,...] [namespace=NS,...] [by=namespace,pod,container] [severity=S]. The denials are counted by namespace in 5m windows by default. It can be repeated")
+	f.DurationVarP(&cfg.DedupWindow.Duration, "dedup-window", "", cfg.DedupWindow.Duration, "Window in which the identical consecutive decisions of a container, same path, verdict and access, are collapsed into one summary with their count, sent at the end of the window. The first one is sent right away, 0 sends all of them")
+	f.StringVarP(&cfg.EventDir, "event-dir", "", cfg.EventDir, "Directory to store the decisions in, empty to not store them")
+	f.DurationVarP(&cfg.EventRetention.Duration, "event-retention", "", cfg.EventRetention.Duration, "How long to keep the stored decisions, 0 to keep them forever")
+	f.Int64VarP(&cfg.EventQuota, "event-quota", "", cfg.EventQuota, "Size in bytes of the stored decisions past which the oldest hours are removed, 0 for no limit. The current hour is kept")
+	f.DurationVarP(&cfg.EventAnchorInterval.Duration, "event-anchor-interval", "", cfg.EventAnchorInterval.Duration, "How often to log the head of the hash chain of the stored events, to verify them against later, 0 to disable it")
+	f.StringVarP(&cfg.ExportURL, "export-url", "", cfg.ExportURL, "S3-compatible bucket to upload every complete hour of the event store to, compressed, as https://ENDPOINT/BUCKET[/PREFIX]. The credentials are taken from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN")
+	f.StringVarP(&cfg.ExportRegion, "export-region", "", cfg.ExportRegion, "Region of the bucket of --export-url")
+	f.DurationVarP(&cfg.ExportInterval.Duration, "export-interval", "", cfg.ExportInterval.Duration, "How often to look for the hours of events to upload to --export-url")
+	f.StringVarP(&cfg.BaselineDir, "baseline-dir", "", cfg.BaselineDir, "Directory to store the imported baselines of the images in")
+	f.Int64VarP(&cfg.BaselineQuota, "baseline-quota", "", cfg.BaselineQuota, "Size in bytes of --baseline-dir past which the least recently used baselines are removed, 0 for no limit")
+	f.DurationVarP(&cfg.BaselineGCInterval.Duration, "baseline-gc-interval", "", cfg.BaselineGCInterval.Duration, "How often to enforce --baseline-quota and, with the containerd runtime, remove the baselines of the images no longer on the node and not used for a day. 0 to disable it")
+	f.StringVarP(&cfg.MetricsAddr, "metrics-addr", "", cfg.MetricsAddr, "Address to serve the Prometheus metrics on, like :9090, empty to not serve them")
+	f.StringArrayVarP(&cfg.MetricsDropLabels, "metrics-drop-label", "", cfg.MetricsDropLabels, "Label removed from all the metrics, like pod or container, the samples left with the same labels are summed. It can be repeated")
+	f.StringArrayVarP(&cfg.MetricsHashLabels, "metrics-hash-label", "", cfg.MetricsHashLabels, "Label whose values are replaced by a short hash in all the metrics, like path. It can be repeated")
+	f.IntVarP(&cfg.MetricsMaxLabelLength, "metrics-max-label-length", "", cfg.MetricsMaxLabelLength, "Length the values of the labels of the metrics are truncated to, 0 to not truncate them")
+	f.StringVarP(&cfg.DashboardAddr, "dashboard-addr", "", cfg.DashboardAddr, "Address to serve the read-only status dashboard on, like 127.0.0.1:9091, empty to not serve it. It has no authentication")
+	f.DurationVarP(&cfg.WatchdogThreshold.Duration, "watchdog-threshold", "", cfg.WatchdogThreshold.Duration, "How long a permission event can be handled before the event loop of the container is stuck, its pending executions are then allowed and it is restarted. 0 to disable the watchdog")
+	f.IntVarP(&cfg.BackpressureQueue, "backpressure-queue", "", cfg.BackpressureQueue, "How many events of a container can be pending before its notifier is falling behind, 0 to not count them")
+	f.DurationVarP(&cfg.BackpressureAge.Duration, "backpressure-age", "", cfg.BackpressureAge.Duration, "How long the oldest pending event of a container can wait before its notifier is falling behind, 0 to not check it")
+	f.StringArrayVarP(&cfg.BackpressureActions, "backpressure-action", "", cfg.BackpressureActions, "What to do while a notifier is falling behind: audit to only audit the denials of its container, alert to report it as an error of the container. It can be repeated")
+	f.DurationVarP(&cfg.ResponseDeadline.Duration, "response-deadline", "", cfg.ResponseDeadline.Duration, "How long an execution can wait for its file to be verified before it is answered according to the failure mode of the policy, 0 to wait as long as it takes")
+	f.IntVarP(&cfg.HashWorkers, "hash-workers", "", cfg.HashWorkers, "How many files can be hashed at once, 0 for the number of CPUs")
+	f.Int64VarP(&cfg.MaxFileSize, "max-file-size", "", cfg.MaxFileSize, "Size in bytes of the largest file which can be hashed, 0 for no limit. The executions of larger files are answered according to the failure mode of the policy")
+	f.StringVarP(&cfg.BaselineTableDir, "baseline-table-dir", "", cfg.BaselineTableDir, "Directory to write the baselines of more than 256 files to, so they are not kept in memory: only their index and their last lookups are. Empty to keep them in memory")
+	f.IntVarP(&cfg.BaselineWorkers, "baseline-workers", "", cfg.BaselineWorkers, "How many files of a container rootfs are hashed at once when computing its baseline")
+	f.IntVarP(&cfg.QuarantineDenials, "quarantine-denials", "", cfg.QuarantineDenials, "Denials after which the pod of a container is labeled enforce.k8s.io/quarantine=true with a warning event, 0 to disable it")
+	f.DurationVarP(&cfg.QuarantineWindow.Duration, "quarantine-window", "", cfg.QuarantineWindow.Duration, "How long the denials are counted for the quarantine, 0 counts them since the container started")
+	f.BoolVarP(&cfg.QuarantineNode, "quarantine-node", "", cfg.QuarantineNode, "Label the node of the quarantined pods too")
+	f.StringVarP(&cfg.Isolation, "isolation", "", cfg.Isolation, "Cut the quarantined pods from the network with a network policy, keeping them running: networkpolicy for a Kubernetes NetworkPolicy, cilium for a CiliumNetworkPolicy or calico for a Calico NetworkPolicy. Empty to not isolate them")
+	f.BoolVarP(&cfg.EvictOnFailure, "evict-on-failure", "", cfg.EvictOnFailure, "Evict the pods whose containers could not be enforced, they are only reported as not enforced in the node status otherwise")
+	f.StringVarP(&cfg.ParanoidLevel, "paranoid-level", "", cfg.ParanoidLevel, "high to hash the executed files every time, low to not hash the files allowed before again while their size, change time and inode are the same")
+	f.BoolVarP(&cfg.XattrCache, "xattr-cache", "", cfg.XattrCache, "Cache the sha256sums of the files in their xattrs in the overlayfs layers of the containers, so they are not hashed again by the other containers of the image")
+	f.StringVarP(&cfg.Backend, "backend", "", cfg.Backend, "How the executions are enforced: fanotify, bpf-lsm to decide in the kernel with eBPF LSM programs, against the unmodified files of the baselines only, or seccomp to answer the seccomp user notifications of the containers using the profile of the seccomp-profile command")
+	f.BoolVarP(&cfg.SelfProtection, "self-protection", "", cfg.SelfProtection, "Deny the writes to the binary, the config, the policies and the baselines of the agent, and report them with the replacements of these files and of its sockets")
+	f.BoolVarP(&cfg.KernelAudit, "kernel-audit", "", cfg.KernelAudit, "Make the kernel write an audit record for every denied execution, it needs CAP_AUDIT_WRITE")
+	f.BoolVarP(&cfg.ImmutableRootfs, "immutable-rootfs", "", cfg.ImmutableRootfs, "Enforce the immutableRootfs of the policies. Every open of the files of the rootfs of their containers waits for the agent, not only the ones for writing, which slows down the containers opening many files")
+	f.BoolVarP(&cfg.AttachDiff, "attach-diff", "", cfg.AttachDiff, "When a container is attached, report the executables of its rootfs modified or added since it was created, as audited decisions with the attach access. They are compared with the imported baseline of the image or else with the lower layers of its overlayfs")
+	f.IntVarP(&cfg.BaselineWarmupImages, "baseline-warmup-images", "", cfg.BaselineWarmupImages, "How many of the last images pulled by containerd have their baseline computed in the background, ahead of their containers which then don't walk their rootfs. 0 to disable it")
+	f.BoolVarP(&cfg.AnalyzeBinaries, "analyze-binaries", "", cfg.AnalyzeBinaries, "Look for packers and suspicious ELF headers in the executed binaries which don't match the baseline, and add the findings to their events")
+	f.IntVarP(&cfg.FDThreshold, "fd-threshold", "", cfg.FDThreshold, "Percentage of the open files limit from which the denials are only audited")
 }
 
-func fanotify(hostname, hostRuntime, kubeconfig string) {
-	pods := make(map[string]*v1.Pod)
-	go k8s.GetNewPods(pods, hostname, kubeconfig)
+// loadConfig sets the configuration from the config file, then the environment and then the flags given in the
+// command line.
+func loadConfig(cmd *cobra.Command) error {
+	c := config.Default()
+	if configFile != "" {
+		var err error
+		if c, err = config.LoadFile(configFile); err != nil {
+			return err
+		}
+	}
+
+	if err := c.ApplyEnv(os.LookupEnv); err != nil {
+		return err
+	}
 
-	fanotifyFDs := make(map[string]*internal.ContainerNotifier)
+	for _, name := range c.Flags() {
+		f := cmd.Flags().Lookup(name)
+		if f == nil || !f.Changed {
+			continue
+		}
+
+		values := []string{f.Value.String()}
+		if slice, ok := f.Value.(pflag.SliceValue); ok {
+			values = slice.GetSlice()
+		}
+
+		if err := c.Set(name, values...); err != nil {
+			return fmt.Errorf("--%s: %w", name, err)
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	*cfg = *c
+	return nil
+}
+
+func fanotify(cfg *config.Config) {
+	hostname, hostRuntime := cfg.Hostname, cfg.Runtime
+	cntRuntime := containerd.NewRuntime(hostRuntime)
+
+	policies := &policy.Set{}
+	if cfg.PolicyFile != "" {
+		var err error
+		if policies, err = policy.LoadFile(cfg.PolicyFile); err != nil {
+			log.Fatalf("loading policies: %v", err)
+		}
+	}
+
+	// This has to be done before the pod watcher and the notifiers open files.
+	fdLimit, err := internal.RaiseFDLimit()
+	if err != nil {
+		log.Fatalf("raising open files limit: %v", err)
+	}
+	log.Infof("open files limit: %d", fdLimit)
+
+	fdBudget := &internal.FDBudget{Limit: fdLimit, Threshold: cfg.FDThreshold}
+	go fdBudget.Watch(fdCheckInterval)
+
+	hashWorkers := cfg.HashWorkers
+	if hashWorkers == 0 {
+		hashWorkers = runtime.NumCPU()
+	}
+	hashPool := hashpool.New(hashWorkers)
+	hashPool.MaxFileSize = cfg.MaxFileSize
+
+	var enforcer *bpflsm.Enforcer
+	if cfg.Backend == internal.BackendBPFLSM {
+		if enforcer, err = bpflsm.Load(); err != nil {
+			log.Fatalf("loading eBPF LSM programs: %v", err)
+		}
+		// The executions are not enforced anymore once they are detached.
+		defer enforcer.Close()
+
+		go enforcer.Run(bpfEventInterval)
+	}
+
+	var seccompAgent *seccomp.Agent
+	if cfg.Backend == internal.BackendSeccomp {
+		seccompAgent = seccomp.NewAgent()
 
-	handleContainerEvents := func(event pubsub.PubSubEvent) {
 		go func() {
-			cid := event.Container.Id
-			cnt := event.Container
+			if err := seccompAgent.Run(cfg.SeccompSocket); err != nil {
+				log.Errorf("receiving seccomp notification FDs: %v", err)
+			}
+		}()
+	}
+
+	selector, err := k8s.NewPodSelector(cfg.PodSelectors)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The plain docker containers are enforced without Kubernetes.
+	standalone := len(cfg.DockerLabels) > 0
+
+	pods := k8s.NewPods()
+	if !standalone {
+		go k8s.GetNewPods(pods, hostname, cfg.Kubeconfig, policies.Namespaces(), selector)
+	}
+
+	registry := internal.NewRegistry()
+	dispatcher := internal.NewDispatcher()
+
+	// The fanotify groups of the previous agent are used instead of new ones, the executions wait in them meanwhile.
+	handedOff := map[string]*internal.HandedOff{}
+	var handedOffLock sync.Mutex
+	if cfg.HandoffSocket != "" {
+		received, err := internal.ReceiveHandoff(cfg.HandoffSocket)
+		if err != nil {
+			log.Errorf("taking over from the previous agent: %v", err)
+		}
+
+		for cid, h := range received {
+			handedOff[cid] = h
+		}
+
+		// The containers which are not enforced anymore get their executions allowed.
+		time.AfterFunc(handoffTimeout, func() {
+			handedOffLock.Lock()
+			defer handedOffLock.Unlock()
+
+			for cid, h := range handedOff {
+				log.Infof("container %s of the previous agent not enforced anymore", cid)
+				h.Close()
+				delete(handedOff, cid)
+			}
+		})
+	}
+
+	// The rootfs of the containers sent by the OCI hooks, they are attached before they pivot to it.
+	preStart := map[string]string{}
+	var preStartLock sync.Mutex
+
+	// findNotifier returns the notifier of the container, the ID can be shortened as long as it is not ambiguous.
+	findNotifier := func(cntID string) (*internal.ContainerNotifier, error) {
+		notifier, err := registry.Find(cntID)
+		if errors.Is(err, internal.ErrNotFound) {
+			return nil, fmt.Errorf("%w: %s", admin.ErrNotFound, cntID)
+		}
+
+		return notifier, err
+	}
+
+	baselines := &baseline.Store{Dir: cfg.BaselineDir}
+	baselineCache := &baseline.Cache{}
+	warmBaselines := &baseline.WarmCache{Max: cfg.BaselineWarmupImages}
+
+	var baselineTables *baseline.Tables
+	if cfg.BaselineTableDir != "" {
+		baselineTables = &baseline.Tables{Dir: cfg.BaselineTableDir, Hot: baselineHotEntries}
+	}
+
+	canaries := &internal.Canaries{}
+
+	var outputs []sink.Output
+	adminServer := &admin.Server{
+		Baseline: func(cntID string) (*baseline.Baseline, error) {
+			notifier, err := findNotifier(cntID)
+			if err != nil {
+				return nil, err
+			}
+
+			return notifier.Baseline()
+		},
+		ImportBaseline: func(cntID string, b *baseline.Baseline) error {
+			if cntID == "" {
+				return baselines.Put(b)
+			}
+
+			notifier, err := findNotifier(cntID)
+			if err != nil {
+				return err
+			}
+
+			notifier.SetBaseline(b)
+			return nil
+		},
+		SetMode: func(cntID string, mode policy.Mode) error {
+			notifier, err := findNotifier(cntID)
+			if err != nil {
+				return err
+			}
+
+			return notifier.SetMode(mode)
+		},
+		Verify: func(cntID, dir string) (*admin.VerifyResult, error) {
+			notifier, err := findNotifier(cntID)
+			if err != nil {
+				return nil, err
+			}
+
+			modified, missing, total, err := notifier.VerifyBaseline(dir)
+			if err != nil {
+				return nil, err
+			}
+
+			return &admin.VerifyResult{Container: notifier.Status().ID, Path: dir, Files: total, Modified: modified, Missing: missing}, nil
+		},
+		BaselineTree: func(cntID, dir string) (*baseline.TreeNode, error) {
+			notifier, err := findNotifier(cntID)
+			if err != nil {
+				return nil, err
+			}
+
+			tree, err := notifier.BaselineTree()
+			if err != nil {
+				return nil, err
+			}
 
-			cntName, err := containerd.GetContainerName(cnt, hostRuntime)
+			return tree.Node(dir), nil
+		},
+		SetReadOnly: func(cntID string, readOnly bool) error {
+			notifier, err := findNotifier(cntID)
 			if err != nil {
-				log.Errorf("getting container name: %v", err)
+				return err
+			}
+
+			return notifier.SetReadOnly(readOnly)
+		},
+		SetCanary: func(policyName string, percent *int) error {
+			if policyName != policy.Default.Name && !policies.HasName(policyName) {
+				return fmt.Errorf("policy %q not found", policyName)
+			}
+
+			return canaries.Set(policyName, percent)
+		},
+		Group: cfg.AdminGroup,
+	}
+
+	var store *eventstore.Store
+	if cfg.EventDir != "" {
+		var err error
+		store, err = eventstore.Open(cfg.EventDir, cfg.EventRetention.Duration, cfg.EventQuota)
+		if err != nil {
+			log.Fatalf("opening event store: %v", err)
+		}
+		defer store.Close()
+
+		outputs = append(outputs, sink.Output{Name: "event-store", Sink: sink.Func(store.Record)})
+		adminServer.Events = store.Query
+	}
+	anchor := eventChainAnchor(store)
+
+	// The violations are only kept when they are sent to the aggregator.
+	violations := &aggregator.Buffer{Max: maxBufferedViolations}
+	if cfg.AggregatorURL != "" {
+		outputs = append(outputs, sink.Output{Name: "aggregator", Sink: sink.Func(violations.Add)})
+	}
+
+	var alerts *alert.Engine
+	if len(cfg.AlertRules) > 0 {
+		if cfg.AlertmanagerURL == "" {
+			log.Fatalf("the alert rules need --alertmanager-url")
+		}
+
+		rules := []*alert.Rule{}
+		for _, spec := range cfg.AlertRules {
+			r, err := alert.ParseRule(spec)
+			if err != nil {
+				log.Fatalf("configuring alerts: %v", err)
+			}
+			rules = append(rules, r)
+		}
+
+		alerts = alert.NewEngine(hostname, rules, alert.NewClient(cfg.AlertmanagerURL))
+		outputs = append(outputs, sink.Output{Name: "alerts", Sink: sink.Func(alerts.Record)})
+		go alerts.Run()
+	}
+
+	var isolator k8s.Isolator
+	if cfg.Isolation != "" && !standalone {
+		var err error
+		if isolator, err = k8s.NewIsolator(cfg.Isolation, cfg.Kubeconfig); err != nil {
+			log.Fatalf("configuring the isolation: %v", err)
+		}
+	}
+
+	quarantine := &internal.Quarantine{
+		Denials: cfg.QuarantineDenials,
+		Window:  cfg.QuarantineWindow.Duration,
+		OnQuarantine: func(e *events.Event, denials int) {
+			node := ""
+			if cfg.QuarantineNode {
+				node = hostname
+			}
+			quarantinePod(cfg.Kubeconfig, e, denials, node, isolator, standalone)
+		},
+	}
+	if cfg.QuarantineDenials > 0 {
+		outputs = append(outputs, sink.Output{Name: "quarantine", Sink: sink.Func(quarantine.Record), Filter: sink.Filter{Verdicts: []events.Verdict{events.VerdictDeny}}})
+	}
+
+	for _, spec := range cfg.Sinks {
+		out, err := sink.Parse(spec)
+		if err != nil {
+			log.Fatalf("configuring sinks: %v", err)
+		}
+
+		for _, o := range outputs {
+			if o.Name == out.Name {
+				out.Name = fmt.Sprintf("%s-%d", out.Name, len(outputs))
+				break
+			}
+		}
+		outputs = append(outputs, out)
+	}
+
+	// The decisions are sent to every sink from its own queue, the enforcement never waits for them.
+	fanout := sink.NewFanout(outputs...)
+	defer fanout.Close()
+
+	// Closed before the fanout, the summaries of the windows which did not end are sent too. The notifiers are still
+	// running then, their last decisions are dropped by the closed fanout.
+	dedup := sink.NewDedup(cfg.DedupWindow.Duration, fanout.Report)
+	defer dedup.Close()
+
+	onDecision := func(e *events.Event) {
+		e.Node = hostname
+		dedup.Report(e)
+	}
+
+	if cfg.SelfProtection {
+		if protector, err := protectAgent(cfg, onDecision); err != nil {
+			log.Errorf("protecting the agent files: %v", err)
+		} else {
+			defer protector.Close()
+		}
+	}
+
+	// enforceContainer attaches a notifier to the container which just started, whatever the runtime told about it.
+	enforceContainer := func(cnt *pb.ContainerDefinition, cntName string, pod *v1.Pod, cntSpec *v1.Container, unlisted, ephemeral bool) {
+		cid := cnt.Id
+
+		if name := pod.Annotations[policy.PolicyAnnotation]; name != "" && policies.Bound(pod) == nil {
+			log.Warnf("policy %q of container %s not found, selecting one with the labels", name, cntName)
+		}
+
+		pol := policies.Select(pod)
+		log.Infof("applying policy %q to container: %s", pol.Name, cntName)
+
+		shadow := policies.Shadow(pol, pod)
+		if shadow != nil {
+			log.Infof("evaluating shadow policy %q on container: %s", shadow.Name, cntName)
+		}
+
+		// The add events can be repeated, or handled after the remove ones.
+		if !registry.Reserve(cid) {
+			log.Debugf("container already enforced or removed: %s", cntName)
+			return
+		}
+
+		handedOffLock.Lock()
+		h := handedOff[cid]
+		delete(handedOff, cid)
+		handedOffLock.Unlock()
+
+		preStartLock.Lock()
+		preStartRootFS := preStart[cid]
+		delete(preStart, cid)
+		preStartLock.Unlock()
+
+		notifierCfg := &internal.NotifierConfig{
+			Pod:           pod,
+			ContainerSpec: cntSpec,
+			Policy:        pol,
+			Shadow:        shadow,
+			Canaries:      canaries,
+			Unlisted:      unlisted,
+			Ephemeral:     ephemeral,
+			MarkMode:      cfg.MarkMode,
+			Baselines:     baselines,
+			OnDecision:    onDecision,
+			FDBudget:      fdBudget,
+			HashPool:      hashPool,
+
+			ResponseDeadline: cfg.ResponseDeadline.Duration,
+			BaselineWorkers:  cfg.BaselineWorkers,
+			BaselineCache:    baselineCache,
+			WarmBaselines:    warmBaselines,
+			BaselineTables:   baselineTables,
+			XattrCache:       cfg.XattrCache,
+			ParanoidLevel:    cfg.ParanoidLevel,
+			KernelAudit:      cfg.KernelAudit,
+			AnalyzeBinaries:  cfg.AnalyzeBinaries,
+			ImmutableRootfs:  cfg.ImmutableRootfs,
+			BPF:              enforcer,
+			Seccomp:          seccompAgent,
+			HandedOff:        h,
+			Runtime:          cntRuntime,
+			PreStartRootFS:   preStartRootFS,
+		}
+
+		// The containers joining the mount namespace of an enforced one would get the same marks, and every event
+		// twice.
+		if shared := registry.Sharing(cnt.Pid); shared != nil && h == nil {
+			err := shared.Share(cnt, notifierCfg)
+			switch {
+			case err != nil:
+				log.Warnf("enforcing container %s with its own notifier: %v", cntName, err)
+			case registry.AddShared(cid, shared):
+				log.Infof("container started: %v", cid)
 				return
 			}
+		}
+
+		notifier, err := newNotifier(cnt, notifierCfg)
+		if err != nil {
+			if notifierCfg.HandedOff != nil {
+				notifierCfg.HandedOff.Close()
+			}
+
+			if !internal.ProcessExists(cnt.Pid) {
+				registry.Abort(cid)
+				// This is common for init containers which can be done before they are attached.
+				log.Infof("container exited before being enforced: %s", cntName)
+				return
+			}
+
+			// The other containers of the node are still enforced, this one is reported until it is removed.
+			log.Errorf("enforcing container %s: %v", cntName, err)
+			registry.Fail(cid, status.Container{
+				ID:        cid,
+				Name:      cntSpec.Name,
+				Namespace: pod.Namespace,
+				Pod:       pod.Name,
+				PodUID:    string(pod.UID),
+				Policy:    pol.Name,
+				Unlisted:  unlisted,
+				Errors:    1,
+				LastError: err.Error(),
+			})
+
+			if cfg.EvictOnFailure && !standalone {
+				go evictPod(cfg.Kubeconfig, pod)
+			}
+			return
+		}
+
+		if !registry.Add(cid, notifier) {
+			log.Infof("container exited while being enforced: %s", cntName)
+			return
+		}
+
+		log.Infof("container started: %v", cid)
+		// TODO: Create a signal associated with this go routine to stop the go routine.
+		go internal.WatchContainerFANotifyEvents(notifier)
+
+		// The handed off containers were diffed by the previous agent.
+		if cfg.AttachDiff && h == nil {
+			go notifier.ReportImageDiff()
+		}
+	}
+
+	// removeContainer stops enforcing the container, the other containers of its mount namespace get their own
+	// notifier then.
+	removeContainer := func(cid string) {
+		if registry.Has(cid) {
+			log.Infof("container stopped: %v", cid)
+		}
+		quarantine.Forget(cid)
+
+		for _, s := range registry.Remove(cid) {
+			s := s
+			log.Infof("enforcing container %s again after container %s stopped", s.Container.Id, cid)
+			dispatcher.Dispatch(s.Container.Id, func() {
+				enforceContainer(s.Container, s.Container.Id, s.Config.Pod, s.Config.ContainerSpec, s.Config.Unlisted, s.Config.Ephemeral)
+			})
+		}
+	}
+
+	// addContainer looks up the pod of the container which just started, then enforces it.
+	addContainer := func(cnt *pb.ContainerDefinition) {
+		cntName, err := cntRuntime.ContainerName(cnt)
+		if err != nil {
+			log.Errorf("getting container name: %v", err)
+			return
+		}
+
+		// Ignore list.
+		// This is a pause container.
+		if strings.HasPrefix(cntName, "k8s_POD_") {
+			return
+		}
+
+		// The pod may not be listed yet by the pod watcher, it is waited for until the container exits. Its remove
+		// event waits behind this one.
+		ctx, cancel := context.WithTimeout(context.Background(), podWaitTimeout)
+		defer cancel()
+		go cancelOnExit(ctx, cancel, cnt.Pid)
+
+		pod, unlisted, err := pods.Wait(ctx, cntName, unlistedDelay)
+		if err != nil {
+			log.Debugf("ignoring container %s: %v", cntName, err)
+			return
+		}
+
+		cntSpec := k8s.GetContainer(pod, cntName)
+		if unlisted != "" {
+			log.Warnf("container %s is not in the spec of its pod, applying the policy of the pod", cntName)
+			cntSpec = &v1.Container{Name: unlisted}
+		}
+
+		ephemeral := k8s.IsEphemeralContainer(pod, cntName)
+		if ephemeral {
+			log.Infof("ephemeral container: %s", cntName)
+		}
+
+		enforceContainer(cnt, cntName, pod, cntSpec, unlisted != "", ephemeral)
+	}
+
+	// The events of every container are handled in order, so a container is never removed before it is added, while
+	// waiting for its pod.
+	handleContainerEvent := func(eventType pubsub.EventType, cnt *pb.ContainerDefinition) {
+		cid := cnt.Id
+
+		if eventType == pubsub.EventTypeRemoveContainer {
+			// The container may be gone from the runtime already, its name is not needed.
+			dispatcher.Dispatch(cid, func() { removeContainer(cid) })
+			return
+		}
+
+		if eventType != pubsub.EventTypeAddContainer {
+			return
+		}
+
+		dispatcher.Dispatch(cid, func() { addContainer(cnt) })
+	}
+
+	containers := registry.Containers
+	notifiers := registry.Notifiers
+
+	adminServer.Status = containers
 
-			// Ignore list.
-			// This is a pause container.
-			if strings.HasPrefix(cntName, "k8s_POD_") {
+	// handoffDone is closed once a new agent took over, the agent exits like on SIGTERM then.
+	handoffDone := make(chan struct{})
+	if cfg.HandoffSocket != "" {
+		go func() {
+			err := internal.ServeHandoff(cfg.HandoffSocket, notifiers)
+			if errors.Is(err, internal.ErrHandoffAborted) {
+				// Closing the fanotify groups of the paused event loops allows the executions waiting in them.
+				log.Fatalf("handing off to a new agent: %v", err)
+			}
+			if err != nil {
+				log.Errorf("handing off to a new agent: %v", err)
 				return
 			}
 
-			// Sometimes the container can take time to be available.
-			var retryInterval = time.Second * 1
-			var timeout = time.Minute * 1
-			if err := wait.PollImmediate(retryInterval, timeout, func() (done bool, err error) {
-				_, ok := pods[cntName]
+			close(handoffDone)
+		}()
+	}
+
+	if cfg.WatchdogThreshold.Duration > 0 {
+		watchdog := &internal.Watchdog{
+			Threshold: cfg.WatchdogThreshold.Duration,
+			Notifiers: notifiers,
+			OnRestart: func(stuck, restarted *internal.ContainerNotifier) {
+				cid := stuck.Status().ID
+				shared, ok := registry.Replace(cid, stuck, restarted)
 				if !ok {
-					// This means that this is not the target container with our required labels.
-					log.Debugf("given container with prefix not found in the k8s list: %s", cntName)
-					return false, nil
+					// The container was removed meanwhile.
+					if restarted != nil {
+						restarted.Close()
+					}
+					return
 				}
 
-				return true, nil
-			}); err != nil {
-				log.Debugf("ignoring container: %s", cntName)
-				return
+				for _, s := range shared {
+					s := s
+					log.Infof("enforcing container %s again after the notifier of container %s failed to restart", s.Container.Id, cid)
+					dispatcher.Dispatch(s.Container.Id, func() {
+						enforceContainer(s.Container, s.Container.Id, s.Config.Pod, s.Config.ContainerSpec, s.Config.Unlisted, s.Config.Ephemeral)
+					})
+				}
+
+				if restarted != nil {
+					go internal.WatchContainerFANotifyEvents(restarted)
+				}
+			},
+		}
+
+		go watchdog.Run(watchdogInterval)
+	}
+
+	if cfg.BackpressureQueue > 0 || cfg.BackpressureAge.Duration > 0 {
+		backpressure := &internal.Backpressure{
+			Queue:     cfg.BackpressureQueue,
+			Age:       cfg.BackpressureAge.Duration,
+			Notifiers: notifiers,
+		}
+
+		for _, action := range cfg.BackpressureActions {
+			switch action {
+			case "audit":
+				backpressure.Audit = true
+			case "alert":
+				backpressure.Alert = true
 			}
+		}
 
-			switch event.Type {
-			case pubsub.EventTypeAddContainer:
-				notifier, err := internal.NewContainerNotifier(&cnt)
-				if err != nil {
-					log.Fatalf("creating notifier: %v\n", err)
+		go backpressure.Run(backpressureInterval)
+	}
+
+	if !standalone {
+		go remountReadyContainers(notifiers, pods, remountInterval)
+	}
+
+	if cfg.StatusInterval.Duration > 0 && !standalone {
+		go reportStatus(hostname, cfg.Kubeconfig, cfg.StatusInterval.Duration, containers, anchor)
+	}
+
+	if cfg.MetricsAddr != "" {
+		go func() {
+			if err := newMetrics(cfg, fdBudget, hashPool, registry, fanout, dedup, quarantine, alerts, store, baselines).Run(cfg.MetricsAddr); err != nil {
+				log.Errorf("serving metrics: %v", err)
+			}
+		}()
+	}
+
+	if cfg.DashboardAddr != "" {
+		dashboardServer := &dashboard.Server{Node: hostname, Status: containers, Events: adminServer.Events}
+		go func() {
+			if err := dashboardServer.Run(cfg.DashboardAddr); err != nil {
+				log.Errorf("serving dashboard: %v", err)
+			}
+		}()
+	}
+
+	if cfg.HookSocket != "" {
+		hookServer := &ocihook.Server{
+			Timeout: cfg.HookTimeout.Duration,
+			Attach: func(state *ocihook.State) (bool, error) {
+				preStartLock.Lock()
+				preStart[state.ID] = state.RootFS
+				preStartLock.Unlock()
+
+				// The container is attached, or ignored, once the work queued after its add is done.
+				cnt := &pb.ContainerDefinition{Id: state.ID, Pid: uint32(state.Pid)}
+				done := make(chan struct{})
+				dispatcher.Dispatch(state.ID, func() { addContainer(cnt) })
+				dispatcher.Dispatch(state.ID, func() { close(done) })
+				<-done
+
+				preStartLock.Lock()
+				delete(preStart, state.ID)
+				preStartLock.Unlock()
+
+				if registry.Failed(state.ID) {
+					return false, fmt.Errorf("the container could not be enforced")
 				}
 
-				fanotifyFDs[cid] = notifier
+				return registry.Has(state.ID), nil
+			},
+			Remove: func(state *ocihook.State) {
+				done := make(chan struct{})
+				dispatcher.Dispatch(state.ID, func() { removeContainer(state.ID) })
+				dispatcher.Dispatch(state.ID, func() { close(done) })
+				<-done
+			},
+		}
 
-				log.Infof("container started: %v", cid)
-				// TODO: Create a signal associated with this go routine to stop the go routine.
-				go internal.WatchContainerFANotifyEvents(notifier)
+		go func() {
+			if err := hookServer.Run(cfg.HookSocket); err != nil {
+				log.Errorf("serving OCI hooks: %v", err)
+			}
+		}()
+	}
+
+	go func() {
+		if err := adminServer.Run(cfg.AdminSocket); err != nil {
+			log.Errorf("serving admin API: %v", err)
+		}
+	}()
+
+	if cfg.AdminAddr != "" {
+		files := mtls.Files{CertFile: cfg.AdminCertFile, KeyFile: cfg.AdminKeyFile, CAFile: cfg.AdminClientCAFile}
+		tlsConfig, err := mtls.ServerConfig(files, cfg.AdminAllowedClients)
+		if err != nil {
+			log.Fatalf("configuring admin API TLS: %v", err)
+		}
 
-			case pubsub.EventTypeRemoveContainer:
-				log.Infof("container stopped: %v", cid)
-				notifier := fanotifyFDs[cid]
-				notifier.NotifyFD.File.Close()
-				unix.Close(notifier.NotifyFD.Fd)
-				delete(fanotifyFDs, cid)
+		go func() {
+			if err := adminServer.RunTLS(cfg.AdminAddr, tlsConfig); err != nil {
+				log.Errorf("serving admin API over TLS: %v", err)
 			}
 		}()
 	}
 
+	if cfg.AggregatorURL != "" {
+		client, err := aggregatorClient()
+		if err != nil {
+			log.Fatalf("creating aggregator client: %v", err)
+		}
+
+		go reportToAggregator(hostname, client, aggregatorInterval, violations, containers, anchor)
+	}
+
+	if store != nil && cfg.EventAnchorInterval.Duration > 0 {
+		go logEventChain(store, cfg.EventAnchorInterval.Duration)
+	}
+
+	if cfg.ExportURL != "" {
+		if store == nil {
+			log.Fatalf("exporting the events needs --event-dir")
+		}
+
+		bucket, prefix, err := exportBucket()
+		if err != nil {
+			log.Fatalf("configuring the export of the events: %v", err)
+		}
+
+		go exportEvents(hostname, store, bucket, prefix, cfg.ExportInterval.Duration)
+	}
+
+	if cfg.BaselineGCInterval.Duration > 0 {
+		go collectBaselines(baselines, cfg.BaselineQuota, cfg.Runtime == "containerd", cfg.BaselineGCInterval.Duration)
+	}
+
+	if cfg.BaselineWarmupImages > 0 {
+		go warmUpBaselines(warmBaselines, baselines, hashPool, cfg.BaselineWorkers)
+	}
+
+	switch {
+	case standalone:
+		go watchDocker(cfg.DockerLabels, registry, dispatcher, enforceContainer, removeContainer)
+	case cfg.ContainerSource == "containerd":
+		go watchContainerdTasks(handleContainerEvent)
+	case cfg.ContainerSource == "nri":
+		// The NRI plugin sends the containers created and deleted from now on.
+		go listContainerdTasks(handleContainerEvent)
+	default:
+		initContainerCollection(hostRuntime, handleContainerEvent)
+	}
+
+	if err := systemd.Notify("READY=1"); err != nil {
+		log.Errorf("notifying readiness: %v", err)
+	}
+
+	log.Infoln("Waiting for containers to start")
+	log.Infoln("Stop the process using Ctrl + C")
+
+	exitSignal := make(chan os.Signal, 1)
+	signal.Notify(exitSignal, syscall.SIGINT, syscall.SIGTERM)
+
+	// Returning closes the event store and flushes the decisions still queued for the sinks.
+	select {
+	case <-exitSignal:
+	case <-handoffDone:
+		// The new agent enforces the containers now.
+		log.Infof("exiting after the handoff")
+	}
+}
+
+// logToJournal sends the logs to journald with their fields when the agent runs as a systemd unit logging to the
+// journal, instead of the plain text of the standard error.
+func logToJournal() {
+	if !systemd.UnderJournald() {
+		return
+	}
+
+	hook, err := systemd.NewJournalHook("fanotify-mon")
+	if err != nil {
+		log.Warnf("logging to journald with its native protocol: %v", err)
+		return
+	}
+
+	log.AddHook(hook)
+	log.SetOutput(io.Discard)
+}
+
+// initContainerCollection gets the containers started and stopped by the runtime of Kubernetes.
+func initContainerCollection(hostRuntime string, handleContainerEvent func(pubsub.EventType, *pb.ContainerDefinition)) {
 	cc := containercollection.ContainerCollection{}
 	withFuncs := []containercollection.ContainerCollectionOption{
 		containercollection.WithRuncFanotify(),
-		containercollection.WithPubSub([]pubsub.FuncNotify{handleContainerEvents}...),
+		containercollection.WithPubSub(func(event pubsub.PubSubEvent) { handleContainerEvent(event.Type, &event.Container) }),
 	}
 
 	if hostRuntime == docker.RuntimeDocker {
@@ -128,11 +972,234 @@ func fanotify(hostname, hostRuntime, kubeconfig string) {
 	if err := cc.ContainerCollectionInitialize(withFuncs...); err != nil {
 		log.Fatalf("initializing container collection: %v", err)
 	}
+}
 
-	log.Infoln("Waiting for containers to start")
-	log.Infoln("Stop the process using Ctrl + C")
+// watchContainerdTasks gets the containers started and stopped from the events of containerd directly.
+func watchContainerdTasks(handleContainerEvent func(pubsub.EventType, *pb.ContainerDefinition)) {
+	for {
+		err := containerd.WatchTasks(context.Background(), containerd.ContainerdNamespace, func(cnt *pb.ContainerDefinition, started bool) {
+			eventType := pubsub.EventTypeRemoveContainer
+			if started {
+				eventType = pubsub.EventTypeAddContainer
+			}
 
-	exitSignal := make(chan os.Signal)
-	signal.Notify(exitSignal, syscall.SIGINT, syscall.SIGTERM)
-	<-exitSignal
+			handleContainerEvent(eventType, cnt)
+		})
+
+		log.Errorf("watching containerd tasks, retrying in %s: %v", containerdRetryInterval, err)
+		time.Sleep(containerdRetryInterval)
+	}
+}
+
+// listContainerdTasks gets the containers started before the agent, the others are sent by the NRI plugin.
+func listContainerdTasks(handleContainerEvent func(pubsub.EventType, *pb.ContainerDefinition)) {
+	for {
+		err := containerd.ListTasks(context.Background(), containerd.ContainerdNamespace, func(cnt *pb.ContainerDefinition) {
+			handleContainerEvent(pubsub.EventTypeAddContainer, cnt)
+		})
+		if err == nil {
+			return
+		}
+
+		log.Errorf("listing containerd tasks, retrying in %s: %v", containerdRetryInterval, err)
+		time.Sleep(containerdRetryInterval)
+	}
+}
+
+// cancelOnExit cancels the context once the process exited.
+func cancelOnExit(ctx context.Context, cancel func(), pid uint32) {
+	ticker := time.NewTicker(exitCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !internal.ProcessExists(pid) {
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// newNotifier creates the notifier of the container, retrying with backoff as long as the container runs. The group
+// handed off by the previous agent is only tried first, the container is enforced from scratch after.
+func newNotifier(cnt *pb.ContainerDefinition, notifierCfg *internal.NotifierConfig) (*internal.ContainerNotifier, error) {
+	var notifier *internal.ContainerNotifier
+	var err error
+	wait.ExponentialBackoff(notifierBackoff, func() (bool, error) {
+		notifier, err = internal.NewContainerNotifier(cnt, notifierCfg)
+		if err == nil || !internal.ProcessExists(cnt.Pid) {
+			return true, nil
+		}
+
+		log.Warnf("creating notifier of container %s, retrying: %v", cnt.Id, err)
+		if notifierCfg.HandedOff != nil {
+			notifierCfg.HandedOff.Close()
+			notifierCfg.HandedOff = nil
+		}
+
+		return false, nil
+	})
+
+	return notifier, err
+}
+
+// evictPod evicts the pod of a container which could not be enforced, so it is scheduled again, hopefully on a node
+// where it is.
+func evictPod(kubeconfig string, pod *v1.Pod) {
+	ctx, cancel := context.WithTimeout(context.Background(), evictTimeout)
+	defer cancel()
+
+	if err := k8s.Evict(ctx, kubeconfig, pod); err != nil {
+		log.Errorf("%v", err)
+		return
+	}
+
+	log.Warnf("evicted pod %s/%s, one of its containers could not be enforced", pod.Namespace, pod.Name)
+}
+
+// quarantinePod labels the pod of the container which reached the quarantine denials, and its node unless it is empty,
+// for the NetworkPolicies and the controllers to isolate them, and isolates the pod with the isolator if any. The plain
+// docker containers are only reported.
+func quarantinePod(kubeconfig string, e *events.Event, denials int, node string, isolator k8s.Isolator, standalone bool) {
+	reason := fmt.Sprintf("%d executions denied in container %s, the last one of %s", denials, e.Container, e.Path)
+	log.WithFields(log.Fields{
+		"severity":  "critical",
+		"namespace": e.Namespace,
+		"pod":       e.Pod,
+		"container": e.Container,
+		"denials":   denials,
+	}).Errorf("quarantining container %s: %s", e.ContainerID, reason)
+
+	if standalone || e.Pod == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), quarantineTimeout)
+	defer cancel()
+
+	if err := k8s.Quarantine(ctx, kubeconfig, e.Namespace, e.Pod, node, reason); err != nil {
+		log.Errorf("quarantining pod: %v", err)
+	} else {
+		log.Warnf("quarantined pod %s/%s", e.Namespace, e.Pod)
+	}
+
+	if isolator == nil {
+		return
+	}
+
+	if err := isolator.Isolate(ctx, e.Namespace, e.Pod); err != nil {
+		log.Errorf("isolating pod: %v", err)
+		return
+	}
+
+	log.Warnf("isolated pod %s/%s from the network", e.Namespace, e.Pod)
+}
+
+// watchDocker enforces the plain docker containers with the labels, they are described as pods with their labels to
+// select their policies.
+func watchDocker(labels []string, registry *internal.Registry, dispatcher *internal.Dispatcher, enforceContainer func(*pb.ContainerDefinition, string, *v1.Pod, *v1.Container, bool, bool), removeContainer func(string)) {
+	client := docker.NewClient(docker.DockerSocket)
+
+	for {
+		err := client.Watch(context.Background(), labels, func(e docker.Event) {
+			cnt := e.Container
+			if !e.Started {
+				dispatcher.Dispatch(cnt.ID, func() { removeContainer(cnt.ID) })
+				return
+			}
+
+			pod := &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: cnt.Name, UID: types.UID(cnt.ID), Labels: cnt.Labels},
+				Spec:       v1.PodSpec{Containers: []v1.Container{{Name: cnt.Name}}},
+			}
+
+			dispatcher.Dispatch(cnt.ID, func() {
+				// dockerd restarts the containers with the same ID.
+				registry.Forget(cnt.ID)
+				enforceContainer(&pb.ContainerDefinition{Id: cnt.ID, Pid: cnt.Pid, Name: cnt.Name}, cnt.Name, pod, &pod.Spec.Containers[0], false, false)
+			})
+		})
+
+		log.Errorf("watching docker containers, retrying in %s: %v", dockerRetryInterval, err)
+		time.Sleep(dockerRetryInterval)
+	}
+}
+
+// remountReadyContainers remounts the containers read-only once their pod is ready, when their policy asks for it.
+func remountReadyContainers(notifiers func() []*internal.ContainerNotifier, pods *k8s.Pods, interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, notifier := range notifiers() {
+			cnt := notifier.Status()
+
+			pod, ok := pods.Get(k8s.PodKey(cnt.Namespace, cnt.PodUID))
+			if !ok || !k8s.IsPodReady(pod) {
+				continue
+			}
+
+			if err := notifier.RemountReadOnly(); err != nil {
+				log.Errorf("remounting container %s read-only: %v", cnt.ID, err)
+			}
+		}
+	}
+}
+
+// protectAgent denies the writes to the files of the agent, and reports the replacements of its files and sockets.
+func protectAgent(cfg *config.Config, onTampering func(*events.Event)) (*internal.Protector, error) {
+	protector, err := internal.NewProtector()
+	if err != nil {
+		return nil, err
+	}
+	protector.OnTampering = onTampering
+
+	binary, err := os.Executable()
+	if err != nil {
+		protector.Close()
+		return nil, fmt.Errorf("finding agent binary: %w", err)
+	}
+
+	for _, path := range []string{binary, configFile, cfg.PolicyFile, cfg.BaselineDir} {
+		if path == "" {
+			continue
+		}
+
+		if err := protector.Protect(path); err != nil {
+			log.Warnf("self-protection: %v", err)
+		}
+	}
+
+	protector.ProtectSocket(cfg.AdminSocket)
+	if cfg.Backend == internal.BackendSeccomp {
+		protector.ProtectSocket(cfg.SeccompSocket)
+	}
+	if cfg.HookSocket != "" {
+		protector.ProtectSocket(cfg.HookSocket)
+	}
+
+	go protector.Run()
+
+	return protector, nil
+}
+
+// reportStatus periodically writes the state of the enforced containers and the anchor of the event store to the
+// NodeStatus object of the node.
+func reportStatus(nodeName, kubeconfig string, interval time.Duration, containers func() []status.Container, anchor func() *status.ChainAnchor) {
+	client, err := k8s.NewDynamicClient(kubeconfig)
+	if err != nil {
+		log.Errorf("creating client, the node status won't be reported: %v", err)
+		return
+	}
+
+	ctx := context.Background()
+
+	for {
+		if err := k8s.UpdateNodeStatus(ctx, client, nodeName, containers(), anchor()); err != nil {
+			log.Errorf("reporting node status: %v", err)
+		}
+
+		time.Sleep(interval)
+	}
 }
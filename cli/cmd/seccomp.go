@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/kinvolk/fanotify-poc/pkg/seccomp"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	seccompBase   string
+	seccompOutput string
+)
+
+var seccompProfileCmd = &cobra.Command{
+	Use:   "seccomp-profile",
+	Short: "Print the seccomp profile sending the executions to the seccomp backend",
+	Long: `Print the seccomp profile sending the executions to the seccomp backend.
+
+The profile is the linux.seccomp object of the OCI runtime spec, it notifies execve and execveat to the agent listening
+on --seccomp-socket. The rules of the --base profile are kept, like the default profile of the runtime.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var base *specs.LinuxSeccomp
+		if seccompBase != "" {
+			data, err := os.ReadFile(seccompBase)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			base = &specs.LinuxSeccomp{}
+			if err := json.Unmarshal(data, base); err != nil {
+				log.Fatalf("decoding base profile: %v", err)
+			}
+		}
+
+		data, err := json.MarshalIndent(seccomp.Profile(base, cfg.SeccompSocket), "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if seccompOutput == "-" {
+			fmt.Println(string(data))
+			return
+		}
+
+		if err := os.WriteFile(seccompOutput, append(data, '\n'), 0o644); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(seccompProfileCmd)
+
+	f := seccompProfileCmd.Flags()
+	f.StringVarP(&seccompBase, "base", "", "", "Seccomp profile to add the notifications to, none to allow all the other syscalls")
+	f.StringVarP(&seccompOutput, "output", "o", "-", "File to write the profile to, - for the standard output")
+}
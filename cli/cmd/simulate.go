@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	"github.com/kinvolk/fanotify-poc/pkg/simulate"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var simulatePolicy string
+
+var simulateCmd = &cobra.Command{
+	Use:   "simulate [event file...]",
+	Short: "Evaluate recorded events with the policies of --policy-file and show the verdicts which change",
+	Long: `Evaluate recorded events with the policies of --policy-file and show the verdicts which change.
+
+The events are read as JSON objects from the files, like the ones of the event store, or from the standard input.
+Every event is evaluated with the policy of the same name, unless --policy is set.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if cfg.PolicyFile == "" {
+			log.Fatal("--policy-file is required")
+		}
+
+		policies, err := policy.LoadFile(cfg.PolicyFile)
+		if err != nil {
+			log.Fatalf("loading policies: %v", err)
+		}
+
+		if simulatePolicy != "" && !policies.HasName(simulatePolicy) {
+			log.Fatalf("policy %q not found", simulatePolicy)
+		}
+
+		s := &simulate.Simulator{Policies: policies, Policy: simulatePolicy}
+		res := &simulate.Result{}
+
+		if len(args) == 0 {
+			if err := s.Run(os.Stdin, res); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		for _, name := range args {
+			f, err := os.Open(name)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			err = s.Run(f, res)
+			f.Close()
+			if err != nil {
+				log.Fatalf("%s: %v", name, err)
+			}
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAMESPACE\tPOD\tCONTAINER\tPATH\tRECORDED\tSIMULATED\tREASON")
+		for _, c := range res.Changes {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", c.Event.Namespace, c.Event.Pod, c.Event.Container, c.Event.Path, c.Event.Verdict, c.Verdict, c.Reason)
+		}
+		w.Flush()
+
+		fmt.Printf("\n%d events, %d skipped, %d changed: %d allowed, %d audited, %d denied\n", res.Total, res.Skipped, len(res.Changes),
+			res.Verdicts[events.VerdictAllow], res.Verdicts[events.VerdictAudit], res.Verdicts[events.VerdictDeny])
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(simulateCmd)
+
+	simulateCmd.Flags().StringVarP(&simulatePolicy, "policy", "", "", "Name of the policy to evaluate all the events with")
+}
@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// modePolicy restores the mode of the policy.
+const modePolicy = "policy"
+
+var verifyPath string
+
+var statusCmd = &cobra.Command{
+	Use:   "status [container ID]",
+	Short: "Show the containers enforced by the agent running on this node",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cntID := ""
+		if len(args) > 0 {
+			cntID = args[0]
+		}
+
+		cnts, err := adminClient().Status(context.Background(), cntID)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAMESPACE\tPOD\tCONTAINER\tID\tPOLICY\tMODE\tBASELINE\tERRORS\tLAST ERROR")
+		for _, cnt := range cnts {
+			mode := cnt.Mode
+			if cnt.ModeOverride {
+				mode += " (overridden)"
+			}
+
+			baseline := "pending"
+			switch {
+			case cnt.BaselineReady:
+				baseline = "ready"
+			case cnt.BaselineFiles > 0:
+				baseline = fmt.Sprintf("%d/%d", cnt.BaselineHashed, cnt.BaselineFiles)
+			}
+
+			id := cnt.ID
+			if len(id) > 12 {
+				id = id[:12]
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n", cnt.Namespace, cnt.Pod, cnt.Name, id, cnt.Policy, mode, baseline, cnt.Errors, cnt.LastError)
+		}
+		w.Flush()
+	},
+}
+
+var modeCmd = &cobra.Command{
+	Use:   "mode <container ID> <enforce|audit|policy>",
+	Short: "Override the mode of the policy of a container until it is restarted",
+	Long: `Override the mode of the policy of a container until it is restarted.
+
+The container is only audited with audit, or enforced again with enforce, whatever the mode of its policy. The mode of
+the policy is used again with policy.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		mode := policy.Mode(args[1])
+		if mode == modePolicy {
+			mode = ""
+		}
+
+		if err := adminClient().SetMode(context.Background(), args[0], mode); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify <container ID>",
+	Short: "Hash the files of the baseline of a container again",
+	Long: `Hash the files of the baseline of a container again.
+
+The files modified or removed since the baseline was computed or imported are listed, the command fails if there are
+any. With --path only the files under that directory of the container are hashed.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		res, err := adminClient().Verify(context.Background(), args[0], verifyPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, path := range res.Modified {
+			fmt.Printf("modified\t%s\n", path)
+		}
+		for _, path := range res.Missing {
+			fmt.Printf("missing\t%s\n", path)
+		}
+
+		changed := len(res.Modified) + len(res.Missing)
+		where := "container " + res.Container
+		if res.Path != "" {
+			where = fmt.Sprintf("%s of container %s", res.Path, res.Container)
+		}
+		fmt.Fprintf(os.Stderr, "%d of %d files changed in %s\n", changed, res.Files, where)
+		if changed > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+var remountCmd = &cobra.Command{
+	Use:   "remount <container ID> <ro|rw>",
+	Short: "Remount a container read-only, or writable again for a break-glass access",
+	Long: `Remount a container read-only, or writable again for a break-glass access.
+
+Only the containers whose policy has remountReadOnly can be remounted. Once made writable with rw, a container is not
+remounted read-only automatically anymore, until ro is used or it is restarted.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		var readOnly bool
+		switch args[1] {
+		case "ro":
+			readOnly = true
+		case "rw":
+		default:
+			log.Fatalf("unknown mount mode %q, ro or rw expected", args[1])
+		}
+
+		if err := adminClient().SetReadOnly(context.Background(), args[0], readOnly); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(statusCmd)
+	RootCmd.AddCommand(modeCmd)
+	RootCmd.AddCommand(verifyCmd)
+	RootCmd.AddCommand(remountCmd)
+
+	verifyCmd.Flags().StringVarP(&verifyPath, "path", "", "", "Only verify the files of the baseline under this directory of the container")
+}
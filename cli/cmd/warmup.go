@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/baseline"
+	"github.com/kinvolk/fanotify-poc/pkg/containerd"
+	"github.com/kinvolk/fanotify-poc/pkg/hashpool"
+	log "github.com/sirupsen/logrus"
+)
+
+// warmupQueueSize is how many pulled images can wait for their baseline to be computed.
+const warmupQueueSize = 100
+
+// warmUpBaselines computes the baselines of the images pulled on the node one at a time, in the background. The
+// images are pulled under several names, like their tag and their digest, the baseline is only computed once.
+func warmUpBaselines(cache *baseline.WarmCache, baselines *baseline.Store, hashPool *hashpool.Pool, workers int) {
+	queue := make(chan string, warmupQueueSize)
+	go func() {
+		for name := range queue {
+			warmUpBaseline(name, cache, baselines, hashPool, workers)
+		}
+	}()
+
+	for {
+		err := containerd.WatchImages(context.Background(), containerd.ContainerdNamespace, func(name string) {
+			select {
+			case queue <- name:
+			default:
+				log.Warnf("too many images pulled, not computing the baseline of %s ahead", name)
+			}
+		})
+
+		log.Errorf("watching containerd images, retrying in %s: %v", containerdRetryInterval, err)
+		time.Sleep(containerdRetryInterval)
+	}
+}
+
+func warmUpBaseline(name string, cache *baseline.WarmCache, baselines *baseline.Store, hashPool *hashpool.Pool, workers int) {
+	digest, err := containerd.GetImageDigest(name, containerd.ContainerdNamespace)
+	if err != nil {
+		log.Debugf("getting digest of image %s: %v", name, err)
+		return
+	}
+
+	if cache.Get(digest) != nil {
+		return
+	}
+
+	// The imported baseline of the image is used instead.
+	if b, err := baselines.Get(digest); err == nil && b != nil {
+		return
+	}
+
+	start := time.Now()
+	walker := &baseline.Walker{
+		Workers: workers,
+		Hash: func(path string) (string, error) {
+			return hashPool.HashFile(hashpool.PriorityBackground, path)
+		},
+	}
+
+	var files map[string]string
+	_, _, err = containerd.WithImageRootFS(context.Background(), name, containerd.ContainerdNamespace, false, func(root string) error {
+		var err error
+		files, err = walker.Compute(root)
+		return err
+	})
+	if err != nil {
+		log.Errorf("computing baseline of image %s ahead: %v", name, err)
+		return
+	}
+
+	cache.Put(digest, files)
+	log.Infof("computed baseline of image %s ahead of its containers: %d files in %s", name, len(files), time.Since(start).Round(time.Millisecond))
+}
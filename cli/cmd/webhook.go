@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"context"
+
+	"github.com/kinvolk/fanotify-poc/pkg/k8s"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	"github.com/kinvolk/fanotify-poc/pkg/webhook"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	webhookAddr     string
+	webhookCertFile string
+	webhookKeyFile  string
+)
+
+var webhookCmd = &cobra.Command{
+	Use:   "webhook",
+	Short: "Serve the admission webhooks for the policy objects and the pods",
+	Run: func(cmd *cobra.Command, args []string) {
+		runWebhook(cfg.Kubeconfig, webhookAddr, webhookCertFile, webhookKeyFile)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(webhookCmd)
+
+	f := webhookCmd.Flags()
+	f.StringVarP(&webhookAddr, "listen-address", "", ":8443", "Address to serve the webhook on")
+	f.StringVarP(&webhookCertFile, "tls-cert-file", "", "/etc/webhook/tls.crt", "Path to the TLS certificate")
+	f.StringVarP(&webhookKeyFile, "tls-key-file", "", "/etc/webhook/tls.key", "Path to the TLS key")
+}
+
+func runWebhook(kubeconfig, addr, certFile, keyFile string) {
+	client, err := k8s.NewDynamicClient(kubeconfig)
+	if err != nil {
+		log.Fatalf("creating client: %v", err)
+	}
+
+	selector, err := k8s.NewPodSelector(cfg.PodSelectors)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s := &webhook.Server{
+		PodSelector: selector,
+		ListPolicies: func(ctx context.Context) ([]*policy.ExecPolicy, error) {
+			return k8s.ListPolicies(ctx, client)
+		},
+		ListNamespaceDefaults: func(ctx context.Context, namespace string) ([]*policy.NamespaceDefault, error) {
+			return k8s.ListNamespaceDefaults(ctx, client, namespace)
+		},
+	}
+
+	if err := s.Run(addr, certFile, keyFile); err != nil {
+		log.Fatalf("serving webhook: %v", err)
+	}
+}
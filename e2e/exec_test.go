@@ -0,0 +1,185 @@
+//go:build e2e
+// +build e2e
+
+package e2e
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+)
+
+const (
+	enforced = "enforce.k8s.io=deny-third-party-execution"
+	// script is not part of the baseline of the pods, it is written once they run.
+	script = "/bin/e2e-script"
+)
+
+func TestBaselineAllowed(t *testing.T) {
+	pod := createPod(t, "baseline", enforced)
+
+	if _, err := execIn(pod, "ls", "/"); err != nil {
+		t.Fatalf("running ls: %v", err)
+	}
+
+	expectEvent(t, pod, "/bin/ls", events.VerdictAllow, "")
+}
+
+func TestNewExecutableDenied(t *testing.T) {
+	pod := createPod(t, "drift", enforced)
+	writeScript(t, pod)
+
+	if out, err := execIn(pod, script); err == nil {
+		t.Fatalf("the script was run: %s", out)
+	}
+
+	e := expectEvent(t, pod, script, events.VerdictDeny, "")
+	if !e.Drift {
+		t.Errorf("the execution of the script is not reported as drift")
+	}
+}
+
+func TestPolicyRuleDenied(t *testing.T) {
+	pod := createPod(t, "rules", enforced+",e2e=rules")
+
+	if out, err := execIn(pod, "wget", "--help"); err == nil {
+		t.Fatalf("wget was run: %s", out)
+	}
+
+	expectEvent(t, pod, "/bin/wget", events.VerdictDeny, "deny-wget")
+}
+
+func TestAuditMode(t *testing.T) {
+	pod := createPod(t, "audit", enforced+",e2e=audit")
+	writeScript(t, pod)
+
+	out, err := execIn(pod, script)
+	if err != nil {
+		t.Fatalf("running the script: %v", err)
+	}
+	if strings.TrimSpace(out) != "e2e" {
+		t.Errorf("unexpected output of the script: %q", out)
+	}
+
+	expectEvent(t, pod, script, events.VerdictAudit, "")
+}
+
+// createPod runs a pod with the labels and waits until the agent enforces it.
+func createPod(t *testing.T, name, labels string) string {
+	t.Helper()
+
+	pod := "e2e-" + name
+	if _, err := kubectl("run", pod, "--image", "busybox:1.36", "--labels", labels, "--restart", "Never", "--", "sleep", "3600"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { kubectl("delete", "pod", pod, "--wait=false") })
+
+	if _, err := kubectl("wait", "--for", "condition=Ready", "pod/"+pod, "--timeout", "2m"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The agent attaches to the containers once they started, the executions before are not seen.
+	poll(t, func() bool {
+		execIn(pod, "true")
+		return findEvent(t, pod, "/bin/true") != nil
+	})
+
+	return pod
+}
+
+// writeScript writes a shell script in the rootfs of the pod, where it is neither on tmpfs nor world-writable.
+func writeScript(t *testing.T, pod string) {
+	t.Helper()
+
+	if _, err := execIn(pod, "sh", "-c", fmt.Sprintf("printf '#!/bin/sh\\necho e2e\\n' > %s && chmod +x %s", script, script)); err != nil {
+		t.Fatalf("writing script: %v", err)
+	}
+}
+
+func execIn(pod string, args ...string) (string, error) {
+	return kubectl(append([]string{"exec", pod, "--"}, args...)...)
+}
+
+// expectEvent waits for the decision of the execution of the path in the pod and checks its verdict and, if not empty,
+// that its reason has the given one.
+func expectEvent(t *testing.T, pod, path string, verdict events.Verdict, reason string) *events.Event {
+	t.Helper()
+
+	var e *events.Event
+	poll(t, func() bool {
+		e = findEvent(t, pod, path)
+		return e != nil
+	})
+
+	if e.Verdict != verdict {
+		t.Errorf("execution of %s: got verdict %s (%s), expected %s", path, e.Verdict, e.Reason, verdict)
+	}
+	if !strings.Contains(e.Reason, reason) {
+		t.Errorf("execution of %s: got reason %q, expected %q", path, e.Reason, reason)
+	}
+
+	return e
+}
+
+// findEvent returns the last decision of the agent of the node of the pod for the execution of the path, nil when
+// there is none yet.
+func findEvent(t *testing.T, pod, path string) *events.Event {
+	t.Helper()
+
+	agent, err := agentOf(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := kubectl("-n", "kube-system", "exec", agent, "--", "/fanotify-mon", "events", "--json", "--since", "0", "--namespace", "default", "--pod", pod, "--path", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found *events.Event
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		e := &events.Event{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			t.Fatalf("parsing event: %v", err)
+		}
+
+		if found == nil || e.Time.After(found.Time) {
+			found = e
+		}
+	}
+
+	return found
+}
+
+// agentOf returns the agent running on the node of the pod.
+func agentOf(pod string) (string, error) {
+	node, err := kubectl("get", "pod", pod, "-o", "jsonpath={.spec.nodeName}")
+	if err != nil {
+		return "", err
+	}
+
+	agent, err := kubectl("-n", "kube-system", "get", "pods", "-l", "app=fanotify-mon", "--field-selector", "spec.nodeName="+node, "-o", "jsonpath={.items[0].metadata.name}")
+	if err != nil {
+		return "", fmt.Errorf("finding agent of node %s: %w", node, err)
+	}
+
+	return agent, nil
+}
+
+func poll(t *testing.T, done func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Minute)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
@@ -0,0 +1,92 @@
+//go:build e2e
+// +build e2e
+
+// Package e2e deploys the agent in a kind cluster and checks the decisions it takes for the executions in the enforced
+// pods. It needs docker, kind and kubectl:
+//
+//	go test -tags e2e -v ./e2e/
+package e2e
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+const image = "fanotify-mon:e2e"
+
+var (
+	clusterName = flag.String("cluster", "fanotify-mon-e2e", "Name of the kind cluster")
+	useCluster  = flag.Bool("use-cluster", false, "Deploy the agent in the existing kind cluster instead of creating it")
+	keepCluster = flag.Bool("keep-cluster", false, "Keep the kind cluster created for the tests")
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	if !*useCluster {
+		if _, err := run("kind", "create", "cluster", "--name", *clusterName, "--wait", "3m"); err != nil {
+			fmt.Fprintf(os.Stderr, "creating cluster: %v\n", err)
+			return 1
+		}
+
+		if !*keepCluster {
+			defer run("kind", "delete", "cluster", "--name", *clusterName)
+		}
+	}
+
+	if err := deploy(); err != nil {
+		fmt.Fprintf(os.Stderr, "deploying agent: %v\n", err)
+		return 1
+	}
+
+	return m.Run()
+}
+
+// deploy builds the image of the agent from the tree, loads it in the nodes and runs the agent on all of them.
+func deploy() error {
+	if _, err := run("docker", "build", "-t", image, ".."); err != nil {
+		return fmt.Errorf("building image: %w", err)
+	}
+
+	if _, err := run("kind", "load", "docker-image", image, "--name", *clusterName); err != nil {
+		return fmt.Errorf("loading image: %w", err)
+	}
+
+	if _, err := kubectl("apply", "-f", "../deploy/crds.yaml", "-f", "../deploy/agent-rbac.yaml", "-f", "manifests/agent.yaml"); err != nil {
+		return err
+	}
+
+	// A previous run may have left agents with an older image.
+	if _, err := kubectl("-n", "kube-system", "rollout", "restart", "daemonset/fanotify-mon"); err != nil {
+		return err
+	}
+
+	_, err := kubectl("-n", "kube-system", "rollout", "status", "daemonset/fanotify-mon", "--timeout", "3m")
+	return err
+}
+
+func kubectl(args ...string) (string, error) {
+	return run("kubectl", append([]string{"--context", "kind-" + *clusterName}, args...)...)
+}
+
+// run returns the standard output of the command, the error has its standard error.
+func run(name string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return stdout.String(), fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/oci"
+	"github.com/kinvolk/fanotify-poc/pkg/containerd"
+	"github.com/kinvolk/fanotify-poc/pkg/k8s"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	pb "github.com/kinvolk/inspektor-gadget/pkg/gadgettracermanager/api"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// attachConfig returns the config of the containers of the fake runtime, marked in the fake group.
+func attachConfig(runtime *containerd.Fake, g *FakeGroup, pod *v1.Pod) *NotifierConfig {
+	return &NotifierConfig{
+		Pod:           pod,
+		ContainerSpec: &pod.Spec.Containers[0],
+		Policy:        &policy.ExecPolicy{},
+		MarkMode:      MarkModeMount,
+		InitFanotify:  g.Init,
+		Runtime:       runtime,
+	}
+}
+
+// marked tells if the path was marked with the flags.
+func marked(g *FakeGroup, flags uint, path string) bool {
+	for _, m := range g.Marks() {
+		if m.Path == path && m.Flags == flags {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestAttach(t *testing.T) {
+	volume := t.TempDir()
+	hosts := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(hosts, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	shm := t.TempDir()
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "8143ee7d"},
+		Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "app"}}},
+	}
+
+	runtime := containerd.NewFake()
+	runtime.Add("c1", &containerd.FakeContainer{
+		Name: "k8s_web_app_default_8143ee7d",
+		Spec: &oci.Spec{Mounts: []specs.Mount{
+			{Destination: "/data", Type: "bind", Source: volume},
+			{Destination: "/etc/hosts", Type: "bind", Source: hosts},
+			{Destination: "/dev/shm", Type: "bind", Source: shm},
+		}},
+		Image:       "docker.io/library/nginx:latest",
+		ImageDigest: "sha256:0123",
+		PID:         uint32(os.Getpid()),
+	})
+
+	cnt := &pb.ContainerDefinition{Id: "c1", Pid: uint32(os.Getpid())}
+
+	// The containers of the runtime are matched with the containers of the pods by name.
+	name, err := runtime.ContainerName(cnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec := k8s.GetContainer(pod, name); spec == nil || spec.Name != "app" {
+		t.Fatalf("container %s not matched with container app of pod web: %v", name, spec)
+	}
+
+	g := NewFakeGroup()
+	n, err := NewContainerNotifier(cnt, attachConfig(runtime, g, pod))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n.image != "docker.io/library/nginx:latest" || n.imageDigest != "sha256:0123" {
+		t.Errorf("image %s@%s", n.image, n.imageDigest)
+	}
+
+	tests := []struct {
+		name   string
+		flags  uint
+		path   string
+		marked bool
+	}{
+		{name: "rootfs", flags: unix.FAN_MARK_ADD | unix.FAN_MARK_MOUNT, path: procRoot(uint32(os.Getpid())), marked: true},
+		{name: "volume", flags: unix.FAN_MARK_ADD | unix.FAN_MARK_MOUNT, path: volume, marked: true},
+		{name: "file mounted by the runtime", flags: unix.FAN_MARK_ADD, path: hosts, marked: true},
+		{name: "ignored mount", flags: unix.FAN_MARK_ADD | unix.FAN_MARK_MOUNT, path: shm},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if marked(g, tt.flags, tt.path) != tt.marked {
+				t.Errorf("%s marked %v, expected %v: %v", tt.path, !tt.marked, tt.marked, g.Marks())
+			}
+		})
+	}
+
+	// Closing the group removes its marks.
+	n.Close()
+	if _, err := g.NextEvent(); err == nil {
+		t.Error("group of the removed container not closed")
+	}
+}
+
+// TestAttachRestarted checks that the container is marked again through the PID of its new main process.
+func TestAttachRestarted(t *testing.T) {
+	_, proc := sleepExe(t)
+
+	pod := &v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{{Name: "app"}}}}
+	runtime := containerd.NewFake()
+	runtime.Add("c1", &containerd.FakeContainer{PID: uint32(os.Getpid())})
+
+	g := NewFakeGroup()
+	n, err := NewContainerNotifier(&pb.ContainerDefinition{Id: "c1", Pid: uint32(os.Getpid())}, attachConfig(runtime, g, pod))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	if err := runtime.SetPID("c1", uint32(proc.Pid)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !n.refreshProcess() {
+		t.Fatal("restart not found")
+	}
+
+	if root := procRoot(uint32(proc.Pid)); !marked(g, unix.FAN_MARK_ADD|unix.FAN_MARK_MOUNT, root) || n.root() != root {
+		t.Errorf("restarted container not marked at %s: %v", root, g.Marks())
+	}
+}
+
+// TestAttachRemoved checks that the containers gone from the runtime are not attached.
+func TestAttachRemoved(t *testing.T) {
+	backoff := ociSpecBackoff
+	ociSpecBackoff = wait.Backoff{Duration: time.Millisecond, Steps: 2}
+	defer func() { ociSpecBackoff = backoff }()
+
+	pod := &v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{{Name: "app"}}}}
+	runtime := containerd.NewFake()
+	runtime.Add("c1", &containerd.FakeContainer{PID: uint32(os.Getpid())})
+	runtime.Remove("c1")
+
+	g := NewFakeGroup()
+	if _, err := NewContainerNotifier(&pb.ContainerDefinition{Id: "c1", Pid: uint32(os.Getpid())}, attachConfig(runtime, g, pod)); err == nil {
+		t.Fatal("removed container attached")
+	}
+
+	if marks := g.Marks(); len(marks) != 0 {
+		t.Errorf("removed container marked: %v", marks)
+	}
+}
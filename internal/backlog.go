@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// countBuffered records how many events were read from the fanotify FD but are not handled yet, it is called by the
+// event loop after every read.
+func (n *ContainerNotifier) countBuffered() {
+	g := n.kernelGroup()
+	if g == nil {
+		return
+	}
+
+	if rd, ok := g.Rd.(*bufio.Reader); ok {
+		atomic.StoreInt64(&n.bufferedEvents, int64(rd.Buffered()/unix.FAN_EVENT_METADATA_LEN))
+	}
+}
+
+// Backlog returns how many events of the container are waiting: queued in the kernel, read but not handled yet, and
+// being handled. The age is how long the notifier has been behind, the oldest pending event waits at most that long.
+func (n *ContainerNotifier) Backlog() (int, time.Duration) {
+	if n.NotifyFD == nil {
+		return 0, 0
+	}
+
+	select {
+	case <-n.done:
+		// The FD may be another file already.
+		return 0, 0
+	default:
+	}
+
+	// FIONREAD returns the size of the events in the queue.
+	queued := 0
+	if g := n.kernelGroup(); g != nil {
+		if size, err := unix.IoctlGetInt(g.Fd, unix.TIOCINQ); err == nil {
+			queued = size
+		}
+	}
+	pending := queued/unix.FAN_EVENT_METADATA_LEN + int(atomic.LoadInt64(&n.bufferedEvents))
+
+	n.statusLock.Lock()
+	defer n.statusLock.Unlock()
+
+	busy := n.busy.since
+	if !busy.IsZero() {
+		pending++
+	}
+
+	if pending == 0 {
+		n.behindSince = time.Time{}
+		return 0, 0
+	}
+
+	now := time.Now()
+	if n.behindSince.IsZero() {
+		n.behindSince = now
+	}
+	if !busy.IsZero() && busy.Before(n.behindSince) {
+		n.behindSince = busy
+	}
+
+	return pending, now.Sub(n.behindSince)
+}
+
+// backpressured tells if the denials of the container are only audited because its notifier is falling behind.
+func (n *ContainerNotifier) backpressured() bool {
+	return atomic.LoadInt32(&n.backpressure) == 1
+}
+
+// degraded returns why the denials of the container are only audited, empty when they are enforced.
+func (n *ContainerNotifier) degraded() string {
+	switch {
+	case n.fdBudget.Degraded():
+		return "fd budget exceeded"
+	case n.backpressured():
+		return "backpressure"
+	}
+
+	return ""
+}
+
+// Backpressure takes actions on the notifiers falling behind, before their pending executions hit the response
+// deadline or the watchdog.
+type Backpressure struct {
+	// Queue is how many events can be pending and Age how long the oldest one can wait before a notifier is falling
+	// behind, 0 to not check them. It is caught up once under half of them.
+	Queue int
+	Age   time.Duration
+	// Audit only audits the denials of the notifiers falling behind, Alert reports it as an error of their container.
+	Audit bool
+	Alert bool
+	// Notifiers returns the running notifiers.
+	Notifiers func() []*ContainerNotifier
+}
+
+// Run checks the notifiers at every interval.
+func (b *Backpressure) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, n := range b.Notifiers() {
+			// Nothing waits for the verdicts of the detection-only modes.
+			if n.NotifyFD == nil || n.detection != "" {
+				continue
+			}
+
+			b.check(n)
+		}
+	}
+}
+
+func (b *Backpressure) check(n *ContainerNotifier) {
+	pending, age := n.Backlog()
+	behind := (b.Queue > 0 && pending >= b.Queue) || (b.Age > 0 && age >= b.Age)
+	caughtUp := (b.Queue == 0 || pending < b.Queue/2) && (b.Age == 0 || age < b.Age/2)
+
+	switch {
+	case behind && atomic.CompareAndSwapInt32(&n.behind, 0, 1):
+		err := fmt.Errorf("falling behind with %d pending events, the oldest waiting for up to %s", pending, age.Round(time.Millisecond))
+		if b.Alert {
+			log.Errorf("backpressure: container %s: %v", n.cnt.Id, err)
+			n.recordError(err)
+		} else {
+			log.Warnf("backpressure: container %s: %v", n.cnt.Id, err)
+		}
+
+		if b.Audit {
+			log.Warnf("backpressure: only auditing the denials of container %s until it catches up", n.cnt.Id)
+			atomic.StoreInt32(&n.backpressure, 1)
+		}
+
+	case caughtUp && atomic.CompareAndSwapInt32(&n.behind, 1, 0):
+		log.Infof("backpressure: container %s caught up", n.cnt.Id)
+		atomic.StoreInt32(&n.backpressure, 0)
+	}
+}
@@ -0,0 +1,390 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/baseline"
+	"github.com/kinvolk/fanotify-poc/pkg/hashpool"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// baselineProgressInterval is how often the progress of the baseline computation is logged.
+const baselineProgressInterval = 5 * time.Second
+
+// computeBaseline walks the rootfs on the first event, unless the baseline was already set.
+func (n *ContainerNotifier) computeBaseline() error {
+	n.baselineLock.RLock()
+	ready := !n.firstEvent
+	n.baselineLock.RUnlock()
+
+	if ready {
+		return nil
+	}
+
+	root := n.root()
+
+	// The executables modified before the container was attached are trusted too, they are only reported by
+	// ReportImageDiff.
+	log.Infof("first notification received, walking over %s", root)
+
+	// Make a list of all the executables in the rootfs and create a map of file path and its SHA256
+	// store this map in the object.
+	var inodes map[baseline.Inode]string
+	walk := func() (map[string]string, error) {
+		if files := n.warmBaseline(); files != nil {
+			log.Infof("using the baseline computed from image %s for container %s: %d files", n.image, n.cnt.Id, len(files))
+			return files, nil
+		}
+
+		start := time.Now()
+		lastLog := start
+
+		// The agent would get the opens of all the files otherwise, when they are marked for the read rules or the
+		// immutable rootfs.
+		root := root
+		if detached, release, err := n.detachedRoot(); err != nil {
+			log.Debugf("hashing the files of container %s through the marked mount: %v", n.cnt.Id, err)
+		} else {
+			defer release()
+			root = detached
+		}
+
+		walker := &baseline.Walker{
+			Skip: n.skipMountPath,
+			Hash: func(path string) (string, error) {
+				f, err := os.Open(path)
+				if err != nil {
+					return "", fmt.Errorf("opening file: %w", err)
+				}
+				defer f.Close()
+
+				return n.hashCached(hashpool.PriorityBackground, f, strings.TrimPrefix(path, root))
+			},
+			Workers: n.baselineWorkers,
+			Progress: func(hashed, total int) {
+				n.setBaselineProgress(hashed, total)
+
+				if time.Since(lastLog) >= baselineProgressInterval {
+					lastLog = time.Now()
+					log.Infof("computing baseline of container %s: %d/%d files hashed", n.cnt.Id, hashed, total)
+				}
+			},
+		}
+
+		sums, linked, err := walker.ComputeInodes(root)
+		if err != nil {
+			return nil, err
+		}
+		inodes = linked
+
+		log.Infof("computed baseline of container %s: %d files in %s", n.cnt.Id, len(sums), time.Since(start).Round(time.Millisecond))
+		return sums, nil
+	}
+
+	compute := func() (baseline.Sums, error) {
+		files, err := walk()
+		if err != nil {
+			return nil, err
+		}
+
+		return n.storeSums(files), nil
+	}
+
+	var sums baseline.Sums
+	var err error
+
+	key := n.baselineCacheKey()
+	if key == "" {
+		sums, err = compute()
+	} else {
+		sums, err = n.baselineCache.Get(key, compute)
+	}
+
+	if err != nil {
+		if pid := n.pid(); !ProcessExists(pid) {
+			return fmt.Errorf("walking the container rootfs: process %d exited", pid)
+		}
+
+		return fmt.Errorf("walking the container rootfs: %w", err)
+	}
+
+	if inodes == nil {
+		// The baseline was computed from another container of the image, its rootfs has another device.
+		walker := &baseline.Walker{Skip: n.skipMountPath}
+		if inodes, err = walker.Inodes(root); err != nil {
+			log.Warnf("listing the inodes of container %s, the new hard links of its executables are unknown: %v", n.cnt.Id, err)
+		}
+	}
+
+	n.baselineLock.Lock()
+	// The baseline could have been imported meanwhile.
+	if n.inodes == nil {
+		n.inodes = inodes
+	}
+	if n.firstEvent {
+		n.sha256Sums = sums
+		n.sumsChanged()
+		n.sharedBaseline = key
+		n.firstEvent = false
+	} else if key != "" {
+		n.baselineCache.Release(key)
+	} else if table, ok := sums.(*baseline.Table); ok {
+		table.Close()
+	}
+	n.baselineLock.Unlock()
+
+	n.setBaselineReady()
+
+	return nil
+}
+
+// warmBaseline returns the baseline computed from the image of the container when it was pulled, nil if there is
+// none. The files hidden by the mounts of the container are left out, like when the rootfs is walked.
+func (n *ContainerNotifier) warmBaseline() map[string]string {
+	if n.cfg.WarmBaselines == nil || n.imageDigest == "" || n.walksVolumes() {
+		return nil
+	}
+
+	warm := n.cfg.WarmBaselines.Get(n.imageDigest)
+	if warm == nil {
+		return nil
+	}
+
+	files := make(map[string]string, len(warm))
+	for path, sum := range warm {
+		if !n.skipMountPath(path) {
+			files[path] = sum
+		}
+	}
+
+	return files
+}
+
+// baselineCacheKey returns the key under which the baseline computed from the rootfs is shared with the other
+// containers of the same image, which have the same mounts skipped. It is empty when it is not shared.
+func (n *ContainerNotifier) baselineCacheKey() string {
+	// The volumes are not the same in the other containers.
+	if n.baselineCache == nil || n.imageDigest == "" || n.walksVolumes() {
+		return ""
+	}
+
+	mounts := []string{}
+	for _, mnt := range n.cnt.Mounts {
+		mounts = append(mounts, mnt.Destination)
+	}
+	sort.Strings(mounts)
+
+	return n.imageDigest + ":" + strings.Join(mounts, ",")
+}
+
+// storeSums keeps the files of the baseline on disk when they are many, see baseline.Tables.
+func (n *ContainerNotifier) storeSums(files map[string]string) baseline.Sums {
+	sums, err := n.cfg.BaselineTables.Store(files)
+	if err != nil {
+		log.Warnf("keeping the baseline of container %s in memory: %v", n.cnt.Id, err)
+	}
+
+	return sums
+}
+
+// sumsChanged drops the tree of the previous baseline, the baseline lock has to be held.
+func (n *ContainerNotifier) sumsChanged() {
+	n.baselineTree = nil
+	n.sumsVersion++
+}
+
+// BaselineTree returns the Merkle tree of the baseline, it fails if the baseline was not computed yet. It is kept until
+// the baseline changes.
+func (n *ContainerNotifier) BaselineTree() (*baseline.Tree, error) {
+	n.baselineLock.RLock()
+	computed, tree, version := !n.firstEvent, n.baselineTree, n.sumsVersion
+	if !computed || tree != nil {
+		n.baselineLock.RUnlock()
+
+		if !computed {
+			return nil, fmt.Errorf("the baseline is computed on the first execution")
+		}
+		return tree, nil
+	}
+
+	files, err := n.trustedSums()
+	n.baselineLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err = baseline.NewTree(files)
+	if err != nil {
+		return nil, err
+	}
+
+	n.baselineLock.Lock()
+	if n.sumsVersion == version {
+		n.baselineTree = tree
+	}
+	n.baselineLock.Unlock()
+
+	return tree, nil
+}
+
+// trustedSums copies the files of the baseline but the ones removed from it, which are not trusted anywhere. The
+// baseline lock has to be held: the table of the baseline is closed, and its map modified, once it is released.
+func (n *ContainerNotifier) trustedSums() (baseline.Map, error) {
+	files := make(baseline.Map, n.sha256Sums.Len())
+	err := n.sha256Sums.Range(func(path, sum string) bool {
+		if sum != invalidSum {
+			files[path] = sum
+		}
+
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// releaseBaseline stops sharing the baseline, or closes its table when it is the only one using it. The baseline lock
+// has to be held.
+func (n *ContainerNotifier) releaseBaseline() {
+	if n.sharedBaseline != "" {
+		n.baselineCache.Release(n.sharedBaseline)
+		n.sharedBaseline = ""
+		return
+	}
+
+	sums := n.sha256Sums
+	if overlay, ok := sums.(*baseline.Overlay); ok {
+		sums = overlay.Base
+	}
+	if table, ok := sums.(*baseline.Table); ok {
+		table.Close()
+	}
+}
+
+// baselineStatus compares the file with the baseline, st is its status when it is known.
+func (n *ContainerNotifier) baselineStatus(path, currentSum string, st *unix.Stat_t) policy.BaselineStatus {
+	n.baselineLock.RLock()
+	defer n.baselineLock.RUnlock()
+
+	predeterminedSum, ok := n.sha256Sums.Get(path)
+	if !ok && st != nil {
+		// Another name of an executable of the baseline, like a hard link to busybox. The inode could also have
+		// been reused by a new file, which is unknown then.
+		if linked, found := n.inodes[baseline.Inode{Dev: uint64(st.Dev), Ino: st.Ino}]; found {
+			if linkedSum, _ := n.sha256Sums.Get(linked); linkedSum == currentSum {
+				return policy.BaselineMatch
+			}
+		}
+	}
+
+	if !ok {
+		// This means it is a new file that is called for execution.
+		return policy.BaselineUnknown
+	}
+
+	if predeterminedSum != currentSum {
+		// This means that the file was modified.
+		return policy.BaselineModified
+	}
+
+	return policy.BaselineMatch
+}
+
+// Baseline returns what is trusted in the container, it fails if the baseline was not computed yet.
+func (n *ContainerNotifier) Baseline() (*baseline.Baseline, error) {
+	n.baselineLock.RLock()
+	defer n.baselineLock.RUnlock()
+
+	if n.firstEvent {
+		return nil, fmt.Errorf("the baseline is computed on the first execution")
+	}
+
+	files := make(map[string]string, n.sha256Sums.Len())
+	err := n.sha256Sums.Range(func(path, sum string) bool {
+		// The files removed from the baseline are not trusted anywhere.
+		if sum != invalidSum {
+			files[path] = sum
+		}
+
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b := baseline.New(files)
+	b.Image = n.image
+	b.ImageDigest = n.imageDigest
+
+	return b, nil
+}
+
+// SetBaseline replaces what is trusted in the container, it is not computed from its rootfs anymore.
+func (n *ContainerNotifier) SetBaseline(b *baseline.Baseline) {
+	files := make(map[string]string, len(b.Files))
+	for path, sum := range b.Files {
+		files[path] = sum
+	}
+	sums := n.storeSums(files)
+
+	n.baselineLock.Lock()
+	n.releaseBaseline()
+	n.sha256Sums = sums
+	n.sumsChanged()
+	n.firstEvent = false
+	n.baselineLock.Unlock()
+
+	n.setBaselineReady()
+}
+
+// VerifyBaseline hashes the files of the baseline under dir again, all of them when it is empty, it returns the ones
+// modified or removed since it was computed or imported.
+func (n *ContainerNotifier) VerifyBaseline(dir string) (modified, missing []string, total int, err error) {
+	if err := n.computeBaseline(); err != nil {
+		return nil, nil, 0, err
+	}
+
+	n.baselineLock.RLock()
+	files, err := n.trustedSums()
+	n.baselineLock.RUnlock()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	root := n.root()
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		if dir == "" || policy.InDir(path, dir) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	modified, missing = []string{}, []string{}
+	for _, path := range paths {
+		expected := files[path]
+
+		f, err := os.Open(filepath.Join(root, path))
+		if err != nil {
+			missing = append(missing, path)
+			continue
+		}
+
+		sum, err := n.hashCached(hashpool.PriorityBackground, f, path)
+		f.Close()
+		if err != nil || sum != expected {
+			modified = append(modified, path)
+		}
+	}
+
+	return modified, missing, len(paths), nil
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/baseline"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// benchNotifier returns a notifier of a fake group whose baseline has the executable, with the host as rootfs.
+func benchNotifier(b *testing.B, g *FakeGroup, exe, paranoidLevel string) *ContainerNotifier {
+	sum, err := baseline.HashFile(exe)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return fakeNotifier(g, &policy.ExecPolicy{}, baseline.Map{exe: sum}, paranoidLevel)
+}
+
+// BenchmarkHandleEvent measures how long the executions wait for the verdict of the notifier, from reading the event
+// to answering it, with the p99 of the latency added.
+func BenchmarkHandleEvent(b *testing.B) {
+	log.SetLevel(log.WarnLevel)
+
+	exe, proc := sleepExe(b)
+
+	for _, level := range []string{ParanoidHigh, ParanoidLow} {
+		b.Run(level, func(b *testing.B) {
+			g := NewFakeGroup()
+			n := benchNotifier(b, g, exe, level)
+
+			latencies := make([]time.Duration, 0, b.N)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f, err := os.Open(exe)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				start := time.Now()
+				data, err := g.Queue(f, unix.FAN_OPEN_EXEC_PERM, proc.Pid)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				if _, err := n.handleEvent(); err != nil {
+					b.Fatal(err)
+				}
+
+				if response, _ := g.Response(data, time.Second); response != unix.FAN_ALLOW {
+					b.Fatalf("execution not allowed: %d", response)
+				}
+				latencies = append(latencies, time.Since(start))
+			}
+			b.StopTimer()
+
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			b.ReportMetric(float64(latencies[len(latencies)*99/100].Microseconds()), "p99-µs")
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"io"
+	"path"
+	"strings"
+
+	"github.com/kinvolk/fanotify-poc/pkg/binfmt"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// fdReaderAt reads the file of an FD without moving its offset, like the ones of the fanotify events which are hashed
+// meanwhile.
+type fdReaderAt int
+
+func (fd fdReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := unix.Pread(int(fd), p, off)
+	if err != nil {
+		return 0, err
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// identify reads the format of the executed file, it is nil when the file can't be read or is a broken ELF binary. With
+// the analysis of the binaries, the broken ones are identified with what is suspicious in them.
+func (n *ContainerNotifier) identify(r io.ReaderAt, cntPath string) *binfmt.Format {
+	identify := binfmt.Identify
+	if n.analyzeBinaries {
+		identify = binfmt.Analyze
+	}
+
+	format, err := identify(r)
+	if err != nil {
+		log.Debugf("identifying %s: %v", cntPath, err)
+		return nil
+	}
+
+	return format
+}
+
+// setFormat describes the executed binary in the request. The findings of its analysis are only kept when it does not
+// match the baseline.
+func setFormat(req *policy.Request, format *binfmt.Format) {
+	if format == nil {
+		return
+	}
+
+	if req.Baseline != policy.BaselineMatch {
+		req.Findings = format.Findings
+	}
+
+	if !format.ELF {
+		return
+	}
+
+	req.Arch = format.Arch()
+	req.ForeignArch = !format.Native()
+	req.Static = format.Static
+}
+
+// interpreter returns the canonical path inside the container of the interpreter of the script, or of the program run
+// by env, empty for the binaries. The path from the shebang is returned when it can't be resolved.
+func (n *ContainerNotifier) interpreter(format *binfmt.Format) string {
+	if format == nil || format.Interpreter == "" {
+		return ""
+	}
+
+	interp := format.Interpreter
+	if resolved, err := canonicalPath(n.root(), interp); err == nil {
+		interp = resolved
+	}
+
+	if path.Base(interp) != "env" {
+		return interp
+	}
+
+	// Like #!/usr/bin/env -S python3 -u, the options and the variables set by env come first.
+	for _, word := range strings.Fields(format.InterpreterArg) {
+		if strings.HasPrefix(word, "-") || strings.Contains(word, "=") {
+			continue
+		}
+
+		// env looks for it in its PATH, which is usually the one of the container.
+		resolved, err := n.resolveBinary(word)
+		if err != nil {
+			return word
+		}
+
+		return strings.TrimPrefix(resolved, n.root())
+	}
+
+	return interp
+}
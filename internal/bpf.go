@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kinvolk/fanotify-poc/pkg/bpflsm"
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/hashpool"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// BackendFanotify answers the fanotify permission events of the executions.
+	BackendFanotify = "fanotify"
+	// BackendBPFLSM decides on the executions in the kernel with eBPF LSM programs, against an allowlist of the
+	// unmodified files of the baseline. The policy rules are not evaluated.
+	BackendBPFLSM = "bpf-lsm"
+)
+
+// cgroupID returns the id of the cgroup v2 of the process, as seen by the eBPF programs.
+func cgroupID(pid int) (uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return 0, fmt.Errorf("reading cgroup: %w", err)
+	}
+
+	// The cgroup v2 line looks like this: 0::/kubepods/besteffort/pod1234/3f2a9c
+	path := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			path = strings.TrimPrefix(line, "0::")
+		}
+	}
+
+	if path == "" || path == "/" {
+		return 0, fmt.Errorf("process %d is not in a cgroup v2", pid)
+	}
+
+	mounts, err := readMountInfo(os.Getpid())
+	if err != nil {
+		return 0, err
+	}
+
+	for _, mnt := range mounts {
+		if mnt.fsType != "cgroup2" {
+			continue
+		}
+
+		// The id of a cgroup is the inode of its directory.
+		var st unix.Stat_t
+		if err := unix.Stat(filepath.Join(mnt.mountPoint, path), &st); err != nil {
+			return 0, fmt.Errorf("getting cgroup id: %w", err)
+		}
+
+		return st.Ino, nil
+	}
+
+	return 0, fmt.Errorf("cgroup v2 not mounted")
+}
+
+// enforceBPF allows the files of the baseline which are unmodified, then enforces the container until the notifier is
+// closed.
+func (n *ContainerNotifier) enforceBPF() {
+	defer n.bpf.Forget(n.cgroupID)
+
+	if err := n.computeBaseline(); err != nil {
+		log.Errorf("error handling event: %v", err)
+		n.recordError(err)
+		n.Close()
+		return
+	}
+
+	if len(n.policy.Spec.Rules) > 0 || len(n.policy.Spec.Exclude) > 0 {
+		log.Warnf("the rules and the excludes of policy %s are not evaluated by the eBPF LSM backend", n.policy.Name)
+	}
+
+	// The files are hashed again without holding the lock.
+	n.baselineLock.RLock()
+	files, err := n.trustedSums()
+	n.baselineLock.RUnlock()
+	if err != nil {
+		log.Errorf("reading the baseline of container %s, its executables are denied: %v", n.cnt.Id, err)
+	}
+
+	root := n.root()
+	allowed := 0
+	allow := func(cntPath, sum string) {
+		if sum != invalidSum && n.allowBPF(root, cntPath, sum) {
+			allowed++
+		}
+	}
+
+	for cntPath, sum := range files {
+		allow(cntPath, sum)
+	}
+	for cntPath, sum := range n.probeSums {
+		allow(cntPath, sum)
+	}
+
+	// The canary is only applied once, the mode can't be changed afterwards.
+	mode := bpflsm.ModeEnforce
+	if n.currentPolicy().Spec.Mode == policy.ModeAudit {
+		mode = bpflsm.ModeAudit
+	}
+
+	if err := n.bpf.Enforce(n.cgroupID, mode, n.handleBPFEvent); err != nil {
+		log.Errorf("error handling event: %v", err)
+		n.recordError(err)
+		n.Close()
+		return
+	}
+
+	log.Infof("enforcing container %s with eBPF LSM, %d files allowed", n.cnt.Id, allowed)
+
+	<-n.done
+}
+
+// allowBPF allows the file if it still has the sha256sum of the baseline, which could have been imported.
+func (n *ContainerNotifier) allowBPF(root, cntPath, sum string) bool {
+	f, err := os.Open(filepath.Join(root, cntPath))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	var st unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &st); err != nil {
+		return false
+	}
+
+	// The files are hashed again, the xattr cache avoids it for the baselines computed from the rootfs.
+	current, err := n.hashCached(hashpool.PriorityBackground, f, cntPath)
+	if err != nil || current != sum {
+		return false
+	}
+
+	if err := n.bpf.Allow(n.cgroupID, st.Dev, st.Ino); err != nil {
+		log.Errorf("allowing %s in container %s: %v", cntPath, n.cnt.Id, err)
+		return false
+	}
+
+	return true
+}
+
+// handleBPFEvent reports the execution of a file which was not allowed.
+func (n *ContainerNotifier) handleBPFEvent(e *bpflsm.Event) {
+	verdict := events.VerdictDeny
+	if e.Audited {
+		verdict = events.VerdictAudit
+	}
+
+	path := e.Filename
+	if filepath.IsAbs(path) {
+		path = filepath.Join(n.root(), path)
+	}
+
+	reason := "not in the allowlist"
+	log.Infof("[%s]:%s: %s (%s)", strings.ToUpper(string(verdict)), n.cnt.Id, path, reason)
+
+	event := n.event(e.PID, path, nil, verdict, reason)
+	event.Drift = true
+	n.report(event)
+}
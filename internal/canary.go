@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Canaries are the canary percentages of the policies changed through the admin API, they replace the ones of the
+// policies until the agent is restarted.
+type Canaries struct {
+	lock     sync.RWMutex
+	percents map[string]int
+}
+
+// Set changes the percentage of the pods of the policy which are enforced, nil restores the one of the policy.
+func (c *Canaries) Set(name string, percent *int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if percent == nil {
+		delete(c.percents, name)
+		return nil
+	}
+
+	if *percent < 0 || *percent > 100 {
+		return fmt.Errorf("canary percentage %d not between 0 and 100", *percent)
+	}
+
+	if c.percents == nil {
+		c.percents = make(map[string]int)
+	}
+	c.percents[name] = *percent
+
+	return nil
+}
+
+// percent returns the percentage of the pods of the policy which are enforced, it is false when the policy is enforced
+// on all of them.
+func (c *Canaries) percent(p *policy.ExecPolicy) (int, bool) {
+	if c != nil {
+		c.lock.RLock()
+		percent, ok := c.percents[p.Name]
+		c.lock.RUnlock()
+
+		if ok {
+			return percent, true
+		}
+	}
+
+	if p.Spec.Canary == nil {
+		return 0, false
+	}
+
+	return p.Spec.Canary.Percent, true
+}
+
+// outOfCanary tells if the pod is only audited because the canary of its policy does not include it. The containers
+// without pod are enforced.
+func (n *ContainerNotifier) outOfCanary(p *policy.ExecPolicy, pod *v1.Pod) bool {
+	if p.Spec.Mode == policy.ModeAudit || pod == nil {
+		return false
+	}
+
+	percent, ok := n.canaries.percent(p)
+	return ok && !policy.CanaryEnforces(pod.UID, percent)
+}
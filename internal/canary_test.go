@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestOutOfCanary(t *testing.T) {
+	percent := func(p int) *int { return &p }
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{UID: "8143ee7d-5b2c-4f0e-a9d1-3c6e2b7f0a45"}}
+
+	tests := []struct {
+		name     string
+		spec     policy.ExecPolicySpec
+		override *int
+		pod      *v1.Pod
+		out      bool
+	}{
+		{name: "no canary", pod: pod},
+		{name: "canary of 0%", spec: policy.ExecPolicySpec{Canary: &policy.Canary{Percent: 0}}, pod: pod, out: true},
+		{name: "canary of 100%", spec: policy.ExecPolicySpec{Canary: &policy.Canary{Percent: 100}}, pod: pod},
+		{name: "audited policy", spec: policy.ExecPolicySpec{Mode: policy.ModeAudit, Canary: &policy.Canary{}}, pod: pod},
+		{name: "container without pod", spec: policy.ExecPolicySpec{Canary: &policy.Canary{}}},
+		{name: "canary overridden", spec: policy.ExecPolicySpec{Canary: &policy.Canary{Percent: 100}}, override: percent(0), pod: pod, out: true},
+		{name: "canary added", override: percent(0), pod: pod, out: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &policy.ExecPolicy{Spec: tt.spec}
+			p.Name = "policy"
+
+			canaries := &Canaries{}
+			if err := canaries.Set("policy", tt.override); err != nil {
+				t.Fatal(err)
+			}
+
+			n := &ContainerNotifier{canaries: canaries}
+			if out := n.outOfCanary(p, tt.pod); out != tt.out {
+				t.Errorf("out of the canary %v, expected %v", out, tt.out)
+			}
+
+			// Restoring the percentage of the policy.
+			if err := canaries.Set("policy", nil); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := canaries.percent(p); ok != (tt.spec.Canary != nil) {
+				t.Errorf("canary %v after restoring the one of the policy", ok)
+			}
+		})
+	}
+
+	for _, p := range []int{-1, 101} {
+		if err := (&Canaries{}).Set("policy", percent(p)); err == nil {
+			t.Errorf("canary of %d%% accepted", p)
+		}
+	}
+}
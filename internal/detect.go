@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	"github.com/s3rj1k/go-fanotify/fanotify"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// The detection-only modes are used when the permission events are not available, the executions are then reported
+// but not blocked.
+const (
+	// DetectionFanotify gets the fanotify notifications of the executions, sent when they are already done, when the
+	// kernel was built without CONFIG_FANOTIFY_ACCESS_PERMISSIONS.
+	DetectionFanotify = "fanotify"
+	// DetectionInotify watches the directories of the rootfs with inotify when fanotify can't be used at all, without
+	// CAP_SYS_ADMIN. Only the executables written in the container are reported, not their executions.
+	DetectionInotify = "inotify"
+)
+
+// initFanotify initializes the fanotify group getting the permission events, or returns the detection-only mode to
+// fall back to. The group is nil for the inotify mode. With kernelAudit the denials can be written to the audit log.
+func initFanotify(initGroup InitGroup, kernelAudit bool) (Group, string, error) {
+	if initGroup == nil {
+		initGroup = initKernelGroup
+	}
+
+	openFlags := os.O_RDONLY | unix.O_LARGEFILE | unix.O_CLOEXEC
+	flags := uint(unix.FAN_CLASS_CONTENT | unix.FAN_UNLIMITED_QUEUE | unix.FAN_UNLIMITED_MARKS)
+
+	if kernelAudit {
+		notifyFD, auditErr := initGroup(flags|unix.FAN_ENABLE_AUDIT, openFlags)
+		if auditErr == nil {
+			return notifyFD, "", nil
+		}
+
+		// It is EPERM as well without CAP_AUDIT_WRITE, the permission events would be available then.
+		if withoutAudit, err := initGroup(flags, openFlags); err == nil {
+			withoutAudit.Close()
+			return nil, "", fmt.Errorf("initializing fanotify with kernel audit, CAP_AUDIT_WRITE is needed: %w", auditErr)
+		}
+	}
+
+	notifyFD, err := initGroup(flags, openFlags)
+	if err == nil {
+		return notifyFD, "", nil
+	}
+
+	// The permission events give EINVAL when they are not built in the kernel, and EPERM without CAP_SYS_ADMIN.
+	if !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.EPERM) {
+		return nil, "", fmt.Errorf("initializing fanotify: %w", err)
+	}
+
+	notifyFD, notifErr := initGroup(unix.FAN_CLASS_NOTIF|unix.FAN_UNLIMITED_QUEUE|unix.FAN_UNLIMITED_MARKS, openFlags)
+	switch {
+	case notifErr == nil:
+		return notifyFD, DetectionFanotify, nil
+	case errors.Is(notifErr, unix.EPERM):
+		return nil, DetectionInotify, nil
+	default:
+		return nil, "", fmt.Errorf("initializing fanotify: %v, without permission events: %w", err, notifErr)
+	}
+}
+
+// execMask returns the event of the executions, only notified after the fact in the detection-only mode.
+func (n *ContainerNotifier) execMask() uint64 {
+	if n.detection == DetectionFanotify {
+		return unix.FAN_OPEN_EXEC
+	}
+
+	return unix.FAN_OPEN_EXEC_PERM
+}
+
+// allowEvent answers the permission event, the notifications of the detection-only mode are not answered.
+func (n *ContainerNotifier) allowEvent(data *fanotify.EventMetadata) {
+	if n.detection == "" {
+		n.NotifyFD.Respond(data, unix.FAN_ALLOW)
+	}
+}
+
+func (n *ContainerNotifier) denyEvent(data *fanotify.EventMetadata) {
+	switch {
+	case n.detection != "":
+	case n.kernelAudit:
+		n.auditDeny(data)
+	default:
+		n.NotifyFD.Respond(data, unix.FAN_DENY)
+	}
+}
+
+// auditDeny denies the execution and makes the kernel write an audit record of it.
+func (n *ContainerNotifier) auditDeny(data *fanotify.EventMetadata) {
+	if err := n.NotifyFD.Respond(data, unix.FAN_DENY|unix.FAN_AUDIT); err != nil {
+		log.Errorf("denying execution with kernel audit: %v", err)
+	}
+}
+
+// detected reports what was found in the detection-only mode, where nothing can be denied anymore.
+func (n *ContainerNotifier) detected(data *fanotify.EventMetadata, path string, req *policy.Request, reason string) {
+	n.respond(data, path, req, events.VerdictAudit, "detection only, "+reason)
+}
@@ -0,0 +1,48 @@
+package internal
+
+import "sync"
+
+// Dispatcher runs the work queued for every container in order, one at a time, while the work of different
+// containers runs concurrently. The add and remove events of a container are then handled in the order they came in,
+// even when handling the add waits for its pod.
+type Dispatcher struct {
+	lock sync.Mutex
+	// queues are the work waiting for every container, a container is in the map as long as its work is running.
+	queues map[string][]func()
+}
+
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{queues: make(map[string][]func())}
+}
+
+// Dispatch queues the work for the container, it runs once the work queued before for the container is done. It
+// never blocks.
+func (d *Dispatcher) Dispatch(cid string, work func()) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	queue, running := d.queues[cid]
+	d.queues[cid] = append(queue, work)
+
+	if !running {
+		go d.run(cid)
+	}
+}
+
+func (d *Dispatcher) run(cid string) {
+	for {
+		d.lock.Lock()
+		queue := d.queues[cid]
+		if len(queue) == 0 {
+			delete(d.queues, cid)
+			d.lock.Unlock()
+			return
+		}
+
+		work := queue[0]
+		d.queues[cid] = queue[1:]
+		d.lock.Unlock()
+
+		work()
+	}
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestDispatcherOrder checks that the work of every container runs in the order it was queued, one at a time, while
+// the containers are dispatched concurrently.
+func TestDispatcherOrder(t *testing.T) {
+	const containers, works = 8, 200
+
+	d := NewDispatcher()
+
+	var lock sync.Mutex
+	done := map[string][]int{}
+	running := make([]int32, containers)
+
+	var wg sync.WaitGroup
+	wg.Add(containers * works)
+	for c := 0; c < containers; c++ {
+		c := c
+		cid := fmt.Sprintf("c%d", c)
+
+		go func() {
+			for i := 0; i < works; i++ {
+				i := i
+				d.Dispatch(cid, func() {
+					defer wg.Done()
+
+					if atomic.AddInt32(&running[c], 1) != 1 {
+						t.Errorf("work of %s run concurrently", cid)
+					}
+					defer atomic.AddInt32(&running[c], -1)
+
+					lock.Lock()
+					done[cid] = append(done[cid], i)
+					lock.Unlock()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	for cid, order := range done {
+		for i, w := range order {
+			if w != i {
+				t.Fatalf("work %d of %s run at %d: %v", w, cid, i, order)
+			}
+		}
+	}
+
+	if len(done) != containers {
+		t.Errorf("work of %d containers run, expected %d", len(done), containers)
+	}
+}
+
+// TestDispatcherConcurrent checks that a container waiting does not hold up the others, and that its work queued in
+// the meantime runs once it is done.
+func TestDispatcherConcurrent(t *testing.T) {
+	d := NewDispatcher()
+
+	release := make(chan struct{})
+	order := make(chan string, 3)
+
+	d.Dispatch("c1", func() {
+		<-release
+		order <- "c1 add"
+	})
+	d.Dispatch("c1", func() { order <- "c1 remove" })
+	d.Dispatch("c2", func() { order <- "c2 add" })
+
+	select {
+	case w := <-order:
+		if w != "c2 add" {
+			t.Fatalf("%s run while c1 was waiting", w)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("c2 held up by c1")
+	}
+
+	close(release)
+	for _, expected := range []string{"c1 add", "c1 remove"} {
+		if w := <-order; w != expected {
+			t.Errorf("%s run, expected %s", w, expected)
+		}
+	}
+
+	// The queues are gone once empty.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.lock.Lock()
+		left := len(d.queues)
+		d.lock.Unlock()
+
+		if left == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d queues left", left)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/s3rj1k/go-fanotify/fanotify"
+	"golang.org/x/sys/unix"
+)
+
+// FakeGroup is a fanotify group in memory, so the events of the notifiers can be handled in the tests without root or
+// a kernel supporting fanotify. The events are queued with the files the caller opened, the marks and the responses
+// are recorded.
+type FakeGroup struct {
+	lock      sync.Mutex
+	marks     []FakeMark
+	responses map[*fanotify.EventMetadata]uint32
+	responded chan struct{}
+
+	events    chan *fanotify.EventMetadata
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// FakeMark is a mark added to a FakeGroup.
+type FakeMark struct {
+	Flags uint
+	Mask  uint64
+	Path  string
+}
+
+var errFakeGroupClosed = errors.New("fanotify: group closed")
+
+func NewFakeGroup() *FakeGroup {
+	return &FakeGroup{
+		responses: make(map[*fanotify.EventMetadata]uint32),
+		responded: make(chan struct{}),
+		events:    make(chan *fanotify.EventMetadata, 64),
+		closed:    make(chan struct{}),
+	}
+}
+
+// Init is the InitGroup of the notifiers using the group, they all get the same one.
+func (g *FakeGroup) Init(fanotifyFlags uint, openFlags int) (Group, error) {
+	return g, nil
+}
+
+func (g *FakeGroup) Mark(flags uint, mask uint64, dirFd int, path string) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.marks = append(g.marks, FakeMark{Flags: flags, Mask: mask, Path: path})
+	return nil
+}
+
+// Marks returns the marks added so far.
+func (g *FakeGroup) Marks() []FakeMark {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return append([]FakeMark{}, g.marks...)
+}
+
+// Queue queues an event of the process for the file, like unix.FAN_OPEN_EXEC_PERM. The FD of the file is the one of
+// the event, it is closed by the notifier once the event is handled.
+func (g *FakeGroup) Queue(f *os.File, mask uint64, pid int) (*fanotify.EventMetadata, error) {
+	// The file would close the FD when collected.
+	fd, err := unix.Dup(int(f.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	data := &fanotify.EventMetadata{FanotifyEventMetadata: unix.FanotifyEventMetadata{
+		Event_len:    unix.FAN_EVENT_METADATA_LEN,
+		Vers:         unix.FANOTIFY_METADATA_VERSION,
+		Metadata_len: unix.FAN_EVENT_METADATA_LEN,
+		Mask:         mask,
+		Fd:           int32(fd),
+		Pid:          int32(pid),
+	}}
+
+	select {
+	case g.events <- data:
+		return data, nil
+	case <-g.closed:
+		unix.Close(fd)
+		return nil, errFakeGroupClosed
+	}
+}
+
+func (g *FakeGroup) NextEvent() (*fanotify.EventMetadata, error) {
+	select {
+	case data := <-g.events:
+		return data, nil
+	case <-g.closed:
+		return nil, errFakeGroupClosed
+	}
+}
+
+func (g *FakeGroup) Respond(data *fanotify.EventMetadata, response uint32) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.responses[data] = response
+	close(g.responded)
+	g.responded = make(chan struct{})
+
+	return nil
+}
+
+// Response waits for the response to the event, it is false when it was not answered within the timeout.
+func (g *FakeGroup) Response(data *fanotify.EventMetadata, timeout time.Duration) (uint32, bool) {
+	deadline := time.After(timeout)
+	for {
+		g.lock.Lock()
+		response, ok := g.responses[data]
+		responded := g.responded
+		g.lock.Unlock()
+
+		if ok {
+			return response, true
+		}
+
+		select {
+		case <-responded:
+		case <-deadline:
+			return 0, false
+		}
+	}
+}
+
+func (g *FakeGroup) Close() error {
+	g.closeOnce.Do(func() { close(g.closed) })
+	return nil
+}
@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/s3rj1k/go-fanotify/fanotify"
+	"golang.org/x/sys/unix"
+)
+
+// Group is the fanotify group of a notifier, the events of the container are only read and answered through it. The
+// agent uses the groups of the kernel, FakeGroup lets the events be handled without root.
+type Group interface {
+	Mark(flags uint, mask uint64, dirFd int, path string) error
+	// NextEvent blocks until an event can be read.
+	NextEvent() (*fanotify.EventMetadata, error)
+	// Respond answers the permission event with FAN_ALLOW or FAN_DENY, possibly with FAN_AUDIT.
+	Respond(data *fanotify.EventMetadata, response uint32) error
+	Close() error
+}
+
+// InitGroup initializes a fanotify group with the flags of fanotify_init.
+type InitGroup func(fanotifyFlags uint, openFlags int) (Group, error)
+
+// kernelGroup is a fanotify group of the kernel.
+type kernelGroup struct {
+	*fanotify.NotifyFD
+}
+
+func initKernelGroup(fanotifyFlags uint, openFlags int) (Group, error) {
+	notifyFD, err := fanotify.Initialize(fanotifyFlags, openFlags)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kernelGroup{notifyFD}, nil
+}
+
+func (g *kernelGroup) NextEvent() (*fanotify.EventMetadata, error) {
+	return g.GetEvent()
+}
+
+func (g *kernelGroup) Respond(data *fanotify.EventMetadata, response uint32) error {
+	// This is how fanotify.NotifyFD answers, it has no way to set FAN_AUDIT.
+	err := binary.Write(g.File, binary.LittleEndian, &unix.FanotifyResponse{
+		Fd:       data.Fd,
+		Response: response,
+	})
+	if err != nil {
+		return fmt.Errorf("fanotify: response error, %w", err)
+	}
+
+	return nil
+}
+
+func (g *kernelGroup) Close() error {
+	return g.File.Close()
+}
+
+// kernelGroup returns the group of the notifier when it is one of the kernel, nil otherwise. Its FD is needed to poll
+// it, count the queued events and hand it off.
+func (n *ContainerNotifier) kernelGroup() *kernelGroup {
+	g, _ := n.NotifyFD.(*kernelGroup)
+	return g
+}
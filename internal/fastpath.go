@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"os"
+
+	"github.com/s3rj1k/go-fanotify/fanotify"
+	"golang.org/x/sys/unix"
+)
+
+// maxAllowedFiles bounds the files remembered for the fast path, they are all forgotten when it is reached.
+const maxAllowedFiles = 10000
+
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+type allowedFile struct {
+	size  int64
+	ctime unix.Timespec
+	sum   string
+}
+
+// fastPath returns the sha256sum of the file from a previous execution which was allowed, if its metadata did not
+// change since. The changes of the content or of the attributes update the change time, which can't be set from
+// userspace. The status is returned to remember the file once it is allowed, it is nil with the high paranoid level.
+func (n *ContainerNotifier) fastPath(f *os.File) (*unix.Stat_t, hashResult) {
+	if n.paranoidLevel != ParanoidLow {
+		return nil, hashResult{}
+	}
+
+	st := &unix.Stat_t{}
+	if err := unix.Fstat(int(f.Fd()), st); err != nil {
+		return nil, hashResult{}
+	}
+
+	allowed, ok := n.allowedFiles[fileID{dev: st.Dev, ino: st.Ino}]
+	if !ok || allowed.size != st.Size || allowed.ctime != st.Ctim {
+		return st, hashResult{}
+	}
+
+	return st, hashResult{sum: allowed.sum}
+}
+
+// eventStat returns the status of the file of the event, nil when it can't be read.
+func eventStat(data *fanotify.EventMetadata) *unix.Stat_t {
+	st := &unix.Stat_t{}
+	if err := unix.Fstat(int(data.Fd), st); err != nil {
+		return nil
+	}
+
+	return st
+}
+
+// rememberAllowed keeps the file for the fast path, with its status from before it was hashed: if it was modified
+// while being hashed its change time is different.
+func (n *ContainerNotifier) rememberAllowed(st *unix.Stat_t, sum string) {
+	if st == nil {
+		return
+	}
+
+	if len(n.allowedFiles) >= maxAllowedFiles {
+		n.allowedFiles = make(map[fileID]allowedFile)
+	}
+
+	n.allowedFiles[fileID{dev: st.Dev, ino: st.Ino}] = allowedFile{size: st.Size, ctime: st.Ctim, sum: sum}
+}
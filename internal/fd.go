@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// RaiseFDLimit raises the soft limit of open files to the hard limit, as every container has a fanotify FD and every
+// event opens the executed file. It returns the new limit.
+func RaiseFDLimit() (uint64, error) {
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, fmt.Errorf("getting open files limit: %w", err)
+	}
+
+	if limit.Cur < limit.Max {
+		limit.Cur = limit.Max
+		if err := unix.Setrlimit(unix.RLIMIT_NOFILE, &limit); err != nil {
+			return 0, fmt.Errorf("setting open files limit: %w", err)
+		}
+	}
+
+	return limit.Cur, nil
+}
+
+// OpenFDs returns how many files the agent has open.
+func OpenFDs() (int, error) {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, fmt.Errorf("listing open files: %w", err)
+	}
+
+	// The directory itself was open while listing it.
+	return len(entries) - 1, nil
+}
+
+// FDBudget degrades the enforcement when the agent is about to run out of file descriptors: the executions which
+// would be denied are only audited, as failing to open files breaks the notifiers and the pod watcher.
+type FDBudget struct {
+	Limit uint64
+	// Threshold is the percentage of the limit from which the enforcement is degraded. It is restored once the open
+	// files are 10% under it.
+	Threshold int
+
+	open     int64
+	degraded int32
+}
+
+// Degraded tells if the denials should only be audited.
+func (b *FDBudget) Degraded() bool {
+	return b != nil && atomic.LoadInt32(&b.degraded) == 1
+}
+
+// Open returns how many files were open on the last check.
+func (b *FDBudget) Open() int {
+	return int(atomic.LoadInt64(&b.open))
+}
+
+// Check counts the open files and degrades or restores the enforcement.
+func (b *FDBudget) Check() error {
+	open, err := OpenFDs()
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&b.open, int64(open))
+
+	percent := int(uint64(open) * 100 / b.Limit)
+
+	switch {
+	case percent >= b.Threshold && atomic.CompareAndSwapInt32(&b.degraded, 0, 1):
+		log.Errorf("%d files open out of %d, the denials are only audited until some are closed", open, b.Limit)
+	case percent < b.Threshold-10 && atomic.CompareAndSwapInt32(&b.degraded, 1, 0):
+		log.Warnf("%d files open out of %d, enforcing again", open, b.Limit)
+	}
+
+	return nil
+}
+
+// Watch checks the open files periodically.
+func (b *FDBudget) Watch(interval time.Duration) {
+	for {
+		if err := b.Check(); err != nil {
+			log.Errorf("checking open files: %v", err)
+		}
+
+		time.Sleep(interval)
+	}
+}
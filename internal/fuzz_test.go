@@ -0,0 +1,79 @@
+//go:build go1.18
+// +build go1.18
+
+package internal
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/oci"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// FuzzCanonicalPath checks that the paths resolved in a rootfs with symlinks pointing everywhere never leave it.
+func FuzzCanonicalPath(f *testing.F) {
+	root := f.TempDir()
+	for _, dir := range []string{"usr/bin", "etc", "data"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			f.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"bin":          "usr/bin",
+		"usr/bin/sh":   "/bin/../../../etc",
+		"data/escape":  "../../../../..",
+		"data/abs":     "/etc/../..",
+		"data/loop":    "loop",
+		"etc/relative": "../usr/./bin",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			f.Fatal(err)
+		}
+	}
+
+	for _, seed := range []string{"/bin/sh", "/data/escape/etc", "/data/abs/usr", "/data/loop", "../../..", "/etc/relative/sh/relative"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, name string) {
+		resolved, err := canonicalPath(root, name)
+		if err != nil {
+			return
+		}
+
+		if resolved != path.Clean(resolved) || !strings.HasPrefix(resolved, "/") {
+			t.Fatalf("canonicalPath(%q) = %q, not a clean absolute path", name, resolved)
+		}
+
+		if _, err := os.Lstat(filepath.Join(root, resolved)); err != nil {
+			t.Fatalf("canonicalPath(%q) = %q, not in the rootfs: %v", name, resolved, err)
+		}
+	})
+}
+
+// FuzzIgnoreMountPath checks that only the paths below the mounts of the container are left out of the baseline.
+func FuzzIgnoreMountPath(f *testing.F) {
+	f.Add("/data/file", "/data")
+	f.Add("/database/file", "/data")
+	f.Add("/etc/hosts", "/etc/hosts")
+	f.Add("/var/run/secrets/token", "/var/run/secrets/")
+
+	f.Fuzz(func(t *testing.T, name, destination string) {
+		if !strings.HasPrefix(name, "/") || !strings.HasPrefix(destination, "/") {
+			return
+		}
+
+		n := &ContainerNotifier{cnt: &Container{Spec: &oci.Spec{Mounts: []specs.Mount{{Destination: destination}}}}}
+
+		ignored := n.ignoreMountPath(name)
+		rel, err := filepath.Rel(path.Clean(destination), path.Clean(name))
+		below := err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+		if ignored != below {
+			t.Errorf("ignoreMountPath(%q) = %v with a mount on %q", name, ignored, destination)
+		}
+	})
+}
@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/oci"
+	"github.com/kinvolk/fanotify-poc/pkg/baseline"
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/hashpool"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	pb "github.com/kinvolk/inspektor-gadget/pkg/gadgettracermanager/api"
+	"golang.org/x/sys/unix"
+)
+
+// fakeNotifier returns a notifier of a fake group with the baseline, with the host as rootfs.
+func fakeNotifier(g *FakeGroup, p *policy.ExecPolicy, sums baseline.Map, paranoidLevel string) *ContainerNotifier {
+	return &ContainerNotifier{
+		NotifyFD:      g,
+		cnt:           &Container{&pb.ContainerDefinition{Id: "fake", Pid: uint32(os.Getpid())}, &oci.Spec{}},
+		policy:        p,
+		sha256Sums:    sums,
+		probeSums:     map[string]string{},
+		hashPool:      hashpool.New(4),
+		allowedFiles:  make(map[fileID]allowedFile),
+		paranoidLevel: paranoidLevel,
+		rootFSPath:    "/",
+		done:          make(chan struct{}),
+	}
+}
+
+// sleepExe returns the sleep executable with its symlinks resolved, like the paths of the events, and a process
+// running it: the executions come from another process than the agent.
+func sleepExe(tb testing.TB) (string, *os.Process) {
+	tb.Helper()
+
+	exe, err := exec.LookPath("sleep")
+	if err != nil {
+		tb.Skip(err)
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		tb.Fatal(err)
+	}
+
+	proc := exec.Command(exe, "60")
+	if err := proc.Start(); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		proc.Process.Kill()
+		proc.Wait()
+	})
+
+	return exe, proc.Process
+}
+
+func TestHandleEvent(t *testing.T) {
+	exe, proc := sleepExe(t)
+	sum, err := baseline.HashFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		spec     policy.ExecPolicySpec
+		sums     baseline.Map
+		deadline time.Duration
+		// busy keeps the hash pool busy while the event is handled.
+		busy     bool
+		response uint32
+		verdict  events.Verdict
+		reason   string
+	}{
+		{
+			name:     "allow",
+			sums:     baseline.Map{exe: sum},
+			response: unix.FAN_ALLOW,
+			verdict:  events.VerdictAllow,
+			reason:   "no rule, baseline match",
+		},
+		{
+			name:     "deny",
+			sums:     baseline.Map{},
+			response: unix.FAN_DENY,
+			verdict:  events.VerdictDeny,
+			reason:   "no rule, unknown file",
+		},
+		{
+			name:     "hash modified",
+			sums:     baseline.Map{exe: "0000000000000000000000000000000000000000000000000000000000000000"},
+			response: unix.FAN_DENY,
+			verdict:  events.VerdictDeny,
+			reason:   "no rule, modified file",
+		},
+		{
+			name:     "excluded path",
+			spec:     policy.ExecPolicySpec{Exclude: []string{filepath.Dir(exe) + "/**"}},
+			sums:     baseline.Map{},
+			response: unix.FAN_ALLOW,
+			verdict:  events.VerdictAllow,
+			reason:   "excluded",
+		},
+		{
+			name:     "noexec",
+			spec:     policy.ExecPolicySpec{NoExec: []string{filepath.Dir(exe)}},
+			sums:     baseline.Map{exe: sum},
+			response: unix.FAN_DENY,
+			verdict:  events.VerdictDeny,
+			reason:   "noexec mount " + filepath.Dir(exe),
+		},
+		{
+			name:     "response deadline",
+			sums:     baseline.Map{exe: sum},
+			deadline: 50 * time.Millisecond,
+			busy:     true,
+			response: unix.FAN_DENY,
+			verdict:  events.VerdictDeny,
+			reason:   "verification deadline exceeded",
+		},
+		{
+			name:     "response deadline failing open",
+			spec:     policy.ExecPolicySpec{FailureMode: policy.FailOpen},
+			sums:     baseline.Map{exe: sum},
+			deadline: 50 * time.Millisecond,
+			busy:     true,
+			response: unix.FAN_ALLOW,
+			verdict:  events.VerdictAudit,
+			reason:   "verification deadline exceeded",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewFakeGroup()
+			defer g.Close()
+
+			n := fakeNotifier(g, &policy.ExecPolicy{Spec: tt.spec}, tt.sums, ParanoidHigh)
+			n.responseDeadline = tt.deadline
+
+			decisions := make(chan *events.Event, 2)
+			n.onDecision = func(e *events.Event) { decisions <- e }
+
+			if tt.busy {
+				n.hashPool = hashpool.New(1)
+				busy, release := make(chan struct{}), make(chan struct{})
+				go n.hashPool.Do(hashpool.PriorityExec, func() {
+					close(busy)
+					<-release
+				})
+				<-busy
+				defer close(release)
+			}
+
+			f, err := os.Open(exe)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := g.Queue(f, unix.FAN_OPEN_EXEC_PERM, proc.Pid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if path, err := data.GetPath(); err != nil || path != exe {
+				t.Skipf("the event does not resolve to its file: %q, %v", path, err)
+			}
+
+			if stop, err := n.handleEvent(); stop || err != nil {
+				t.Fatalf("handling event: %v, %v", stop, err)
+			}
+
+			response, ok := g.Response(data, time.Second)
+			if !ok {
+				t.Fatal("event not answered")
+			}
+			if response != tt.response {
+				t.Errorf("response %d, expected %d", response, tt.response)
+			}
+
+			e := <-decisions
+			if e.Verdict != tt.verdict || e.Reason != tt.reason {
+				t.Errorf("decision %s (%s), expected %s (%s)", e.Verdict, e.Reason, tt.verdict, tt.reason)
+			}
+		})
+	}
+}
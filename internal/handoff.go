@@ -0,0 +1,355 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/baseline"
+	"github.com/kinvolk/fanotify-poc/pkg/peercred"
+	"github.com/s3rj1k/go-fanotify/fanotify"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// handoffVersion changes with the state sent to the new agent. The containers are enforced again from scratch
+	// when the versions differ.
+	handoffVersion = 1
+	// handoffPollTimeout is how often the event loops check if they are paused for the handoff.
+	handoffPollTimeout = 500
+	// handoffPauseTimeout is how long the event loops have to finish handling their events. The ones still busy are
+	// not handed off.
+	handoffPauseTimeout = 30 * time.Second
+)
+
+// errHandedOff stops the event loop without closing its fanotify FD, which belongs to the new agent.
+var errHandedOff = errors.New("handed off")
+
+// ErrHandoffAborted is returned when the handoff failed once the event loops were paused. They don't answer the
+// executions anymore, the agent has to exit for the kernel to allow the ones waiting in its fanotify groups.
+var ErrHandoffAborted = errors.New("handoff aborted after pausing the containers")
+
+// handoffState is sent to the new agent after the fanotify FDs, in the same order.
+type handoffState struct {
+	Version    int              `json:"version"`
+	Containers []containerState `json:"containers"`
+}
+
+type containerState struct {
+	ContainerID    string `json:"containerID"`
+	Detection      string `json:"detection,omitempty"`
+	MountIDs       []int  `json:"mountIDs,omitempty"`
+	FilesystemMark bool   `json:"filesystemMark,omitempty"`
+	Mntns          uint64 `json:"mntns,omitempty"`
+	// Baseline is nil when it was not computed yet.
+	Baseline map[string]string `json:"baseline,omitempty"`
+}
+
+// HandedOff is the fanotify group of a container enforced by the previous agent, with its marks.
+type HandedOff struct {
+	notifyFD Group
+	state    containerState
+}
+
+// Close allows the executions waiting in the group, when the container is not enforced anymore.
+func (h *HandedOff) Close() {
+	h.notifyFD.Close()
+}
+
+// waitEvent waits for an event to read, so the event loop is never blocked reading when it is paused. It is false once
+// the loop is paused for the handoff.
+func (n *ContainerNotifier) waitEvent() bool {
+	g := n.kernelGroup()
+	if g == nil {
+		// The fake groups can't be polled nor handed off.
+		return true
+	}
+
+	if rd, ok := g.Rd.(*bufio.Reader); ok && rd.Buffered() > 0 {
+		return true
+	}
+
+	for {
+		select {
+		case <-n.pause:
+			return false
+		default:
+		}
+
+		fds := []unix.PollFd{{Fd: int32(g.Fd), Events: unix.POLLIN}}
+		count, err := unix.Poll(fds, handoffPollTimeout)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+
+		// The errors are left to the read.
+		if err != nil || count > 0 {
+			return true
+		}
+	}
+}
+
+// state returns what the new agent needs to keep enforcing the container, once its event loop is paused.
+func (n *ContainerNotifier) state() containerState {
+	n.procLock.RLock()
+	state := containerState{
+		ContainerID:    n.cnt.Id,
+		Detection:      n.detection,
+		FilesystemMark: n.filesystemMark,
+		Mntns:          n.mntns,
+	}
+	n.procLock.RUnlock()
+
+	for id := range n.mountIDs {
+		state.MountIDs = append(state.MountIDs, id)
+	}
+
+	n.baselineLock.RLock()
+	if !n.firstEvent {
+		// The next agent computes the baseline again without it.
+		files, err := baseline.ToMap(n.sha256Sums)
+		if err != nil {
+			log.Errorf("reading the baseline of container %s to hand it off: %v", n.cnt.Id, err)
+		} else {
+			state.Baseline = files
+		}
+	}
+	n.baselineLock.RUnlock()
+
+	return state
+}
+
+// adopt takes over the fanotify group of the previous agent, which is already marked.
+func (n *ContainerNotifier) adopt(h *HandedOff) {
+	n.mountIDs = make(map[int]bool)
+	for _, id := range h.state.MountIDs {
+		n.mountIDs[id] = true
+	}
+
+	n.procLock.Lock()
+	n.filesystemMark = h.state.FilesystemMark
+	n.mntns = h.state.Mntns
+	n.procLock.Unlock()
+
+	if h.state.Baseline != nil {
+		n.baselineLock.Lock()
+		n.sha256Sums = n.storeSums(h.state.Baseline)
+		n.sumsChanged()
+		n.firstEvent = false
+		n.baselineLock.Unlock()
+
+		n.setBaselineReady()
+	}
+
+	log.Infof("took over the fanotify group of container %s from the previous agent", n.cnt.Id)
+}
+
+// ServeHandoff waits for a new agent running as root, then pauses the event loops of the notifiers and sends their
+// fanotify FDs and their state. The executions wait in the fanotify groups meanwhile. The agent has to exit once it
+// returns without error, without closing the FDs of the events being handled late, or with ErrHandoffAborted.
+func ServeHandoff(path string, notifiers func() []*ContainerNotifier) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("creating handoff socket dir: %w", err)
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing old handoff socket: %w", err)
+	}
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return fmt.Errorf("listening on handoff socket: %w", err)
+	}
+	defer l.Close()
+
+	if err := os.Chmod(path, 0600); err != nil {
+		return fmt.Errorf("setting handoff socket permissions: %w", err)
+	}
+
+	conn, err := acceptAgent(l)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	log.Infof("new agent connected, handing off the containers")
+	if err := sendHandoff(conn, notifiers()); err != nil {
+		return fmt.Errorf("%w: %v", ErrHandoffAborted, err)
+	}
+
+	return nil
+}
+
+// acceptAgent waits for a new agent, the peers which are not root are turned away.
+func acceptAgent(l *net.UnixListener) (*net.UnixConn, error) {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return nil, fmt.Errorf("accepting handoff: %w", err)
+		}
+
+		cred, err := peercred.Get(conn)
+		if err == nil && cred.Uid == 0 {
+			return conn, nil
+		}
+
+		if err != nil {
+			log.Warnf("handoff refused, getting the credentials of the peer: %v", err)
+		} else {
+			log.Warnf("handoff refused to uid %d, pid %d", cred.Uid, cred.Pid)
+		}
+		conn.Close()
+	}
+}
+
+// sendHandoff pauses the event loops of the notifiers and sends their fanotify FDs and state to the new agent.
+func sendHandoff(conn *net.UnixConn, notifiers []*ContainerNotifier) error {
+	paused := []*ContainerNotifier{}
+	for _, n := range notifiers {
+		// The other modes don't hold executions, they are attached again.
+		if n.kernelGroup() == nil {
+			continue
+		}
+
+		close(n.pause)
+		paused = append(paused, n)
+	}
+
+	state := handoffState{Version: handoffVersion}
+	fds := []int{}
+	timeout := time.After(handoffPauseTimeout)
+	for _, n := range paused {
+		stopped := true
+		for _, ch := range []chan struct{}{n.stopped, n.mountsStopped} {
+			select {
+			case <-ch:
+			case <-n.done:
+				stopped = false
+			case <-timeout:
+				log.Errorf("event loop of container %s still busy, it won't be handed off", n.cnt.Id)
+				stopped = false
+			}
+
+			if !stopped {
+				break
+			}
+		}
+
+		if !stopped {
+			continue
+		}
+
+		state.Containers = append(state.Containers, n.state())
+		fds = append(fds, n.kernelGroup().Fd)
+	}
+
+	// The number of FDs, then every FD with a byte, then the state.
+	if err := binary.Write(conn, binary.BigEndian, uint32(len(fds))); err != nil {
+		return fmt.Errorf("sending handoff: %w", err)
+	}
+
+	for _, fd := range fds {
+		if _, _, err := conn.WriteMsgUnix([]byte{0}, unix.UnixRights(fd), nil); err != nil {
+			return fmt.Errorf("sending fanotify FD: %w", err)
+		}
+	}
+
+	if err := json.NewEncoder(conn).Encode(&state); err != nil {
+		return fmt.Errorf("sending handoff state: %w", err)
+	}
+
+	// The new agent answers once it has everything, the FDs can then be closed.
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		return fmt.Errorf("waiting for the new agent: %w", err)
+	}
+
+	log.Infof("handed off %d containers", len(fds))
+
+	return nil
+}
+
+// ReceiveHandoff takes over the fanotify groups of the previous agent by container ID, there are none when no agent
+// is listening on the socket.
+func ReceiveHandoff(path string) (map[string]*HandedOff, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ECONNREFUSED) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connecting to previous agent: %w", err)
+	}
+	defer conn.Close()
+
+	var count uint32
+	if err := binary.Read(conn, binary.BigEndian, &count); err != nil {
+		return nil, fmt.Errorf("receiving handoff: %w", err)
+	}
+
+	// The byte of every FD is read alone, so its control message is not skipped.
+	fds := []int{}
+	closeFDs := func() {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+	}
+
+	for i := uint32(0); i < count; i++ {
+		oob := make([]byte, unix.CmsgSpace(4))
+		_, oobn, _, _, err := conn.ReadMsgUnix(make([]byte, 1), oob)
+		if err != nil {
+			closeFDs()
+			return nil, fmt.Errorf("receiving fanotify FD: %w", err)
+		}
+
+		msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil || len(msgs) != 1 {
+			closeFDs()
+			return nil, fmt.Errorf("receiving fanotify FD: invalid control message")
+		}
+
+		rights, err := unix.ParseUnixRights(&msgs[0])
+		if err != nil || len(rights) != 1 {
+			closeFDs()
+			return nil, fmt.Errorf("receiving fanotify FD: invalid rights")
+		}
+
+		fds = append(fds, rights[0])
+	}
+
+	var state handoffState
+	if err := json.NewDecoder(conn).Decode(&state); err != nil {
+		closeFDs()
+		return nil, fmt.Errorf("receiving handoff state: %w", err)
+	}
+
+	// The previous agent can exit now.
+	conn.Write([]byte{0})
+
+	if state.Version != handoffVersion || len(state.Containers) != len(fds) {
+		// The pending executions are allowed, the containers are enforced again.
+		closeFDs()
+		return nil, fmt.Errorf("unsupported handoff version %d with %d containers for %d FDs", state.Version, len(state.Containers), len(fds))
+	}
+
+	handedOff := make(map[string]*HandedOff)
+	for i, fd := range fds {
+		unix.CloseOnExec(fd)
+
+		file := os.NewFile(uintptr(fd), "")
+		handedOff[state.Containers[i].ContainerID] = &HandedOff{
+			notifyFD: &kernelGroup{&fanotify.NotifyFD{Fd: fd, File: file, Rd: bufio.NewReader(file)}},
+			state:    state.Containers[i],
+		}
+	}
+
+	log.Infof("took over %d containers from the previous agent", len(handedOff))
+
+	return handedOff, nil
+}
@@ -0,0 +1,283 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/baseline"
+	"github.com/kinvolk/fanotify-poc/pkg/config"
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/s3rj1k/go-fanotify/fanotify"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// HostEnforcer enforces the baselines of directories and systemd services of the host, for the nodes without
+// Kubernetes or container runtime.
+type HostEnforcer struct {
+	notifyFD *fanotify.NotifyFD
+	targets  []*hostTarget
+
+	// handling is when the event being answered was read, in Unix nanoseconds, 0 when waiting for events.
+	handling int64
+}
+
+type hostTarget struct {
+	config.HostTarget
+	// dirs are the paths of the target with their symlinks resolved, like the paths of the events.
+	dirs []string
+	sums map[string]string
+}
+
+// NewHostEnforcer computes the baselines of the targets with the given number of workers, and marks the mounts of
+// their files. The mounts of the whole host are marked for the services.
+func NewHostEnforcer(cfg *config.HostConfig, workers int) (*HostEnforcer, error) {
+	notifyFD, err := fanotify.Initialize(unix.FAN_CLASS_CONTENT|unix.FAN_UNLIMITED_QUEUE|unix.FAN_UNLIMITED_MARKS|unix.FAN_CLOEXEC, os.O_RDONLY|unix.O_LARGEFILE|unix.O_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("initializing fanotify: %w", err)
+	}
+
+	e := &HostEnforcer{notifyFD: notifyFD}
+
+	for _, t := range cfg.Targets {
+		target := &hostTarget{HostTarget: t, sums: make(map[string]string)}
+
+		for _, path := range t.Paths {
+			dir, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				e.Close()
+				return nil, fmt.Errorf("target %s: %w", t.Name, err)
+			}
+			target.dirs = append(target.dirs, dir)
+
+			if info, err := os.Stat(dir); err == nil && info.Mode().IsRegular() {
+				sum, err := baseline.HashFile(dir)
+				if err != nil {
+					e.Close()
+					return nil, fmt.Errorf("target %s: calculating sha256sum of %s: %w", t.Name, dir, err)
+				}
+
+				target.sums[dir] = sum
+				continue
+			}
+
+			files, err := (&baseline.Walker{Workers: workers}).Compute(dir)
+			if err != nil {
+				e.Close()
+				return nil, fmt.Errorf("computing baseline of target %s: %w", t.Name, err)
+			}
+
+			for file, sum := range files {
+				target.sums[filepath.Join(dir, file)] = sum
+			}
+		}
+
+		log.Infof("baseline of target %s: %d executables", t.Name, len(target.sums))
+		e.targets = append(e.targets, target)
+	}
+
+	if err := e.mark(); err != nil {
+		e.Close()
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (e *HostEnforcer) mark() error {
+	paths := make(map[string]bool)
+	for _, t := range e.targets {
+		for _, dir := range t.dirs {
+			paths[dir] = true
+		}
+
+		if t.Unit == "" {
+			continue
+		}
+
+		// The services could run files from anywhere, like /tmp.
+		mounts, err := readMountInfo(os.Getpid())
+		if err != nil {
+			return fmt.Errorf("reading mounts: %w", err)
+		}
+
+		for _, mnt := range mounts {
+			if !ignoreMount(mnt) {
+				paths[mnt.mountPoint] = true
+			}
+		}
+	}
+
+	for path := range paths {
+		if err := e.notifyFD.Mark(unix.FAN_MARK_ADD|unix.FAN_MARK_MOUNT, unix.FAN_OPEN_EXEC_PERM, unix.AT_FDCWD, path); err != nil {
+			return fmt.Errorf("marking %q: %w", path, err)
+		}
+
+		log.Infof("Marking %q: done", path)
+	}
+
+	return nil
+}
+
+// Run answers the executions until reading the events fails.
+func (e *HostEnforcer) Run() error {
+	for {
+		data, err := e.notifyFD.GetEvent()
+		if err != nil {
+			return fmt.Errorf("getting event: %w", err)
+		}
+
+		atomic.StoreInt64(&e.handling, time.Now().UnixNano())
+		e.handleEvent(data)
+		atomic.StoreInt64(&e.handling, 0)
+		data.Close()
+	}
+}
+
+func (e *HostEnforcer) handleEvent(data *fanotify.EventMetadata) {
+	pid := data.GetPID()
+	if pid == os.Getpid() {
+		e.notifyFD.ResponseAllow(data)
+		return
+	}
+
+	path, err := data.GetPath()
+	if err != nil {
+		log.Errorf("getting file path: %v", err)
+		e.notifyFD.ResponseDeny(data)
+		return
+	}
+
+	target := e.target(pid, path)
+	if target == nil {
+		e.notifyFD.ResponseAllow(data)
+		return
+	}
+
+	verdict := events.VerdictAllow
+	reason := "baseline match"
+
+	sum, err := hashEventFile(data)
+	switch {
+	case err != nil:
+		verdict = events.VerdictDeny
+		reason = fmt.Sprintf("hashing failed: %v", err)
+	case target.sums[path] == "":
+		verdict = events.VerdictDeny
+		reason = "unknown file"
+	case target.sums[path] != sum:
+		verdict = events.VerdictDeny
+		reason = "modified file"
+	}
+
+	if verdict == events.VerdictDeny && target.Mode == "audit" {
+		verdict = events.VerdictAudit
+	}
+
+	if verdict == events.VerdictDeny {
+		e.notifyFD.ResponseDeny(data)
+	} else {
+		e.notifyFD.ResponseAllow(data)
+	}
+
+	log.WithFields(log.Fields{
+		"target":  target.Name,
+		"path":    path,
+		"pid":     pid,
+		"verdict": verdict,
+	}).Infof("[%s]:%s: %s (%s)", strings.ToUpper(string(verdict)), target.Name, path, reason)
+}
+
+// Stuck tells if an execution has been waiting for its answer for longer than the threshold.
+func (e *HostEnforcer) Stuck(threshold time.Duration) bool {
+	since := atomic.LoadInt64(&e.handling)
+	return since != 0 && time.Since(time.Unix(0, since)) > threshold
+}
+
+// target returns the first target enforcing the execution of the file by the process, if any.
+func (e *HostEnforcer) target(pid int, path string) *hostTarget {
+	var cgroups []string
+	for _, t := range e.targets {
+		if t.Unit == "" {
+			if t.contains(path) {
+				return t
+			}
+			continue
+		}
+
+		if cgroups == nil {
+			var err error
+			if cgroups, err = readCgroups(pid); err != nil {
+				// The process is enforced by the services it could belong to.
+				log.Errorf("reading cgroups of process %d: %v", pid, err)
+				return t
+			}
+		}
+
+		if inUnit(cgroups, t.Unit) {
+			return t
+		}
+	}
+
+	return nil
+}
+
+func (t *hostTarget) contains(path string) bool {
+	for _, dir := range t.dirs {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (e *HostEnforcer) Close() {
+	e.notifyFD.File.Close()
+}
+
+func hashEventFile(data *fanotify.EventMetadata) (string, error) {
+	f := data.File()
+	if f == nil {
+		return "", fmt.Errorf("duplicating event fd")
+	}
+	defer f.Close()
+
+	return baseline.Hash(f)
+}
+
+// readCgroups returns the paths of the cgroups of the process, one by hierarchy.
+func readCgroups(pid int) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+
+	// The lines look like this, with cgroup v2:
+	// 0::/system.slice/nginx.service
+	cgroups := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) == 3 {
+			cgroups = append(cgroups, fields[2])
+		}
+	}
+
+	return cgroups, nil
+}
+
+// inUnit tells if one of the cgroups is the one of the systemd unit, or below it.
+func inUnit(cgroups []string, unit string) bool {
+	for _, cgroup := range cgroups {
+		if strings.HasSuffix(cgroup, "/"+unit) || strings.Contains(cgroup, "/"+unit+"/") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/kinvolk/fanotify-poc/pkg/baseline"
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	log "github.com/sirupsen/logrus"
+)
+
+// imageDiff is an executable of the rootfs which is not the one of the image of the container.
+type imageDiff struct {
+	path  string
+	added bool
+}
+
+// ReportImageDiff reports the executables of the rootfs modified or added before the container was attached, which
+// the baseline computed from the rootfs would trust. They are audited decisions with the attach access, taken before
+// any execution.
+func (n *ContainerNotifier) ReportImageDiff() {
+	diffs, err := n.diffImage()
+	if err != nil {
+		log.Debugf("diffing the rootfs of container %s with its image: %v", n.cnt.Id, err)
+		return
+	}
+
+	for _, diff := range diffs {
+		reason := "modified before the container was attached"
+		if diff.added {
+			reason = "added before the container was attached"
+		}
+
+		log.Warnf("[AUDIT ATTACH]:%s: %s (%s)", n.cnt.Id, diff.path, reason)
+
+		event := n.event(0, diff.path, nil, events.VerdictAudit, reason)
+		event.Access = events.AccessAttach
+		event.Drift = true
+		n.report(event)
+	}
+}
+
+// diffImage compares the executables written since the container was created, the ones of the upper layer of its
+// overlayfs, with the image: its imported baseline when the container has it, or else its lower layers. The files of
+// the upper layer with the content of the image, like the ones only chmoded, are not listed.
+func (n *ContainerNotifier) diffImage() ([]imageDiff, error) {
+	upper, lowers, err := readOverlay(n.cnt.Pid)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing can be written to a read-only rootfs.
+	if upper == "" {
+		return nil, nil
+	}
+
+	walker := &baseline.Walker{Skip: n.skipMountPath, Workers: n.baselineWorkers}
+	sums, err := walker.Compute(upper)
+	if err != nil {
+		return nil, fmt.Errorf("hashing upper layer: %w", err)
+	}
+
+	paths := make([]string, 0, len(sums))
+	for path := range sums {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	diffs := []imageDiff{}
+	for _, path := range paths {
+		var imageSum string
+		var found bool
+		if n.imageSums != nil {
+			imageSum, found = n.imageSums[path]
+		} else if imageSum, found, err = lowerSum(lowers, path); err != nil {
+			log.Debugf("hashing %s in the image of container %s: %v", path, n.cnt.Id, err)
+			continue
+		}
+
+		if !found || imageSum != sums[path] {
+			diffs = append(diffs, imageDiff{path: path, added: !found})
+		}
+	}
+
+	return diffs, nil
+}
+
+// lowerSum returns the sha256sum of the file in the topmost lower layer which has it. It is not found when that layer
+// has something else at the path, like the whiteout of a file removed from the image.
+func lowerSum(lowers []string, path string) (string, bool, error) {
+	for _, lower := range lowers {
+		lowerPath := filepath.Join(lower, path)
+		info, err := os.Lstat(lowerPath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", false, err
+		}
+
+		if !info.Mode().IsRegular() {
+			return "", false, nil
+		}
+
+		sum, err := baseline.HashFile(lowerPath)
+		if err != nil {
+			return "", false, err
+		}
+
+		return sum, true, nil
+	}
+
+	return "", false, nil
+}
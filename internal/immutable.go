@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	"github.com/s3rj1k/go-fanotify/fanotify"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// markImmutable marks the rootfs like the executions, so the opens of its files are answered by the policy: its mount,
+// or its whole filesystem with the filesystem mark mode. The volumes and the tmpfs mounts are other mounts. It is only
+// done with --immutable-rootfs, every open of the rootfs waits for the agent then, not only the ones for writing.
+func (n *ContainerNotifier) markImmutable(p *policy.ExecPolicy) error {
+	if !p.ImmutableRootfs() {
+		return nil
+	}
+
+	if !n.immutableRootfs {
+		log.Warnf("the rootfs of container %s can still be written, immutableRootfs is only enforced with --immutable-rootfs", n.cnt.Id)
+		return nil
+	}
+
+	if n.detection != "" {
+		log.Warnf("permission events not available, the rootfs of container %s can still be written", n.cnt.Id)
+		return nil
+	}
+
+	flags := uint(unix.FAN_MARK_ADD | unix.FAN_MARK_MOUNT)
+	if _, filesystem := n.filesystemMntns(); filesystem {
+		flags = unix.FAN_MARK_ADD | unix.FAN_MARK_FILESYSTEM
+	}
+
+	if err := n.NotifyFD.Mark(flags, unix.FAN_OPEN_PERM, unix.AT_FDCWD, n.root()); err != nil {
+		return err
+	}
+
+	log.Infof("Making rootfs of container %s immutable: done", n.cnt.Id)
+	return nil
+}
+
+// enforcesImmutable tells if the rootfs of the containers of the policy is immutable.
+func (n *ContainerNotifier) enforcesImmutable(p *policy.ExecPolicy) bool {
+	return n.immutableRootfs && p.ImmutableRootfs()
+}
+
+// evaluateWrite decides on the open of the file when it is a file of the rootfs opened for writing, it is false
+// otherwise. The opens which can't be told apart, like the ones of io_uring, are considered to be for writing.
+func (n *ContainerNotifier) evaluateWrite(p *policy.ExecPolicy, data *fanotify.EventMetadata, pid int) (policy.Decision, bool) {
+	inRootfs, err := n.inRootfs(data)
+	if err != nil {
+		log.Errorf("checking if the file opened by process %d is in the rootfs of container %s: %v", pid, n.cnt.Id, err)
+	}
+	if !inRootfs {
+		return policy.Decision{}, false
+	}
+
+	writing, err := processOpensForWriting(pid)
+	switch {
+	case err != nil:
+		return p.EvaluateWrite(fmt.Sprintf("opened from an unknown syscall: %v", err)), true
+	case writing:
+		return p.EvaluateWrite("opened for writing"), true
+	}
+
+	return policy.Decision{}, false
+}
+
+// inRootfs tells if the file of the event is on the overlayfs of the rootfs, the protected files of the read rules
+// can be in the volumes too.
+func (n *ContainerNotifier) inRootfs(data *fanotify.EventMetadata) (bool, error) {
+	var st, rootSt unix.Stat_t
+	if err := unix.Fstat(int(data.Fd), &st); err != nil {
+		return false, err
+	}
+
+	if err := unix.Stat(n.root(), &rootSt); err != nil {
+		return false, err
+	}
+
+	return st.Dev == rootSt.Dev, nil
+}
+
+// processOpensForWriting tells if a thread of the process is opening a file for writing. The events of the notifiers
+// only have the pid of the process, not the thread opening the file. It is an error when no thread is opening a file.
+func processOpensForWriting(pid int) (bool, error) {
+	tasks, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	if err != nil {
+		return false, fmt.Errorf("listing threads: %w", err)
+	}
+
+	var lastErr error
+	opening := false
+	for _, task := range tasks {
+		var tid int
+		if _, err := fmt.Sscanf(task.Name(), "%d", &tid); err != nil {
+			continue
+		}
+
+		writing, err := opensForWriting(tid)
+		if err != nil {
+			// The other threads are busy with other syscalls.
+			lastErr = err
+			continue
+		}
+
+		if writing {
+			return true, nil
+		}
+		opening = true
+	}
+
+	if !opening {
+		return false, lastErr
+	}
+
+	return false, nil
+}
@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/hashpool"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// inotifyMask are the events of the watched directories: the files written, moved there or made executable, and the
+// new directories to watch.
+const inotifyMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_ATTRIB | unix.IN_CREATE
+
+func (n *ContainerNotifier) initInotify() error {
+	// Non blocking, so the reads are interrupted when the file is closed.
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("initializing inotify: %w", err)
+	}
+
+	n.inotify = os.NewFile(uintptr(fd), "inotify")
+	n.watches = make(map[int]string)
+
+	return nil
+}
+
+// watchTree watches the directory and all the directories below it, except the mounts skipped by the baseline and
+// the excluded paths.
+func (n *ContainerNotifier) watchTree(dir string) error {
+	root := n.root()
+
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// The directories removed meanwhile or which can't be read are not watched.
+			log.Debugf("walking %s: %v", path, err)
+			return nil
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		cntPath := "/" + strings.TrimPrefix(strings.TrimPrefix(path, root), "/")
+		if path != dir && (n.skipMountPath(cntPath) || n.policy.Excludes(cntPath)) {
+			return filepath.SkipDir
+		}
+
+		wd, err := unix.InotifyAddWatch(int(n.inotify.Fd()), path, inotifyMask|unix.IN_ONLYDIR)
+		if errors.Is(err, unix.ENOSPC) {
+			return fmt.Errorf("watching %s, raise fs.inotify.max_user_watches: %w", cntPath, err)
+		}
+		if err != nil {
+			log.Debugf("watching %s: %v", path, err)
+			return nil
+		}
+
+		n.watchesLock.Lock()
+		n.watches[wd] = cntPath
+		n.watchesLock.Unlock()
+
+		return nil
+	})
+}
+
+// watchInotify reports the executables written in the container which are not in its baseline, until the notifier
+// is closed.
+func (n *ContainerNotifier) watchInotify() {
+	// There is no first execution to compute it on.
+	if err := n.computeBaseline(); err != nil {
+		log.Errorf("error handling event: %v", err)
+		n.recordError(err)
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		read, err := n.inotify.Read(buf)
+		if errors.Is(err, os.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Errorf("reading inotify events of container %s: %v", n.cnt.Id, err)
+			n.recordError(err)
+			n.Close()
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= read; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			name := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+
+			n.handleInotifyEvent(int(event.Wd), event.Mask, strings.TrimRight(string(name), "\x00"))
+		}
+	}
+}
+
+func (n *ContainerNotifier) handleInotifyEvent(wd int, mask uint32, name string) {
+	n.watchesLock.Lock()
+	dir, ok := n.watches[wd]
+	if mask&unix.IN_IGNORED != 0 {
+		delete(n.watches, wd)
+	}
+	n.watchesLock.Unlock()
+
+	if !ok || name == "" {
+		return
+	}
+
+	cntPath := filepath.Join(dir, name)
+	path := filepath.Join(n.root(), cntPath)
+
+	if mask&unix.IN_ISDIR != 0 {
+		if mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 && !n.policy.Excludes(cntPath) {
+			if err := n.watchTree(path); err != nil {
+				log.Errorf("error handling event: %v", err)
+				n.recordError(err)
+			}
+		}
+
+		return
+	}
+
+	// The created files are checked once they are written.
+	if mask&(unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_ATTRIB) == 0 || n.policy.Excludes(cntPath) {
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		// It was removed meanwhile.
+		log.Debugf("opening written file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil || !st.Mode().IsRegular() || st.Mode().Perm()&0o111 == 0 {
+		return
+	}
+
+	sum, err := n.hashCached(hashpool.PriorityBackground, f, cntPath)
+	if err != nil {
+		log.Errorf("calculating sha256sum of %s: %v", path, err)
+		return
+	}
+
+	status := n.baselineStatus(cntPath, sum, nil)
+	if status == policy.BaselineMatch {
+		return
+	}
+
+	baselineStatus, _ := status.MarshalText()
+	reason := fmt.Sprintf("detection only, executable written, baseline %s", baselineStatus)
+	log.Infof("[%s]:%s: %s (%s)", strings.ToUpper(string(events.VerdictAudit)), n.cnt.Id, path, reason)
+
+	event := n.event(0, path, nil, events.VerdictAudit, reason)
+	event.Drift = true
+	n.report(event)
+}
@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	v1 "k8s.io/api/core/v1"
+)
+
+// SetMode overrides the mode of the policy of the container, the mode of the policy is used again when it is empty.
+func (n *ContainerNotifier) SetMode(mode policy.Mode) error {
+	switch mode {
+	case "", policy.ModeEnforce, policy.ModeAudit:
+	default:
+		return fmt.Errorf("unknown mode %q", mode)
+	}
+
+	if n.bpf != nil {
+		return fmt.Errorf("the mode can't be changed with the eBPF LSM backend")
+	}
+
+	n.statusLock.Lock()
+	defer n.statusLock.Unlock()
+
+	n.mode = mode
+
+	return nil
+}
+
+// currentPolicy returns the policy of the container with the mode overridden, if it is.
+func (n *ContainerNotifier) currentPolicy() *policy.ExecPolicy {
+	return n.withMode(n.policy, n.pod)
+}
+
+// withMode returns the policy of the pod with the mode of the notifier when it is overridden, or in audit mode when the
+// pod is out of the canary of the policy.
+func (n *ContainerNotifier) withMode(p *policy.ExecPolicy, pod *v1.Pod) *policy.ExecPolicy {
+	n.statusLock.Lock()
+	mode := n.mode
+	n.statusLock.Unlock()
+
+	if mode == "" && n.outOfCanary(p, pod) {
+		mode = policy.ModeAudit
+	}
+
+	if mode == "" || mode == p.Spec.Mode {
+		return p
+	}
+
+	withMode := *p
+	withMode.Spec.Mode = mode
+
+	return &withMode
+}
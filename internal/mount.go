@@ -0,0 +1,329 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// mountPollTimeout is how often the mount watcher checks if it has to stop.
+const mountPollTimeout = time.Second
+
+// mountInfo is a line of /proc/PID/mountinfo.
+type mountInfo struct {
+	id           int
+	mountPoint   string
+	fsType       string
+	superOptions string
+}
+
+// readMountInfo returns the mounts of the mount namespace of the process, with their mount points as seen from its
+// root.
+func readMountInfo(pid int) ([]mountInfo, error) {
+	f, err := os.Open(mountInfoPath(pid))
+	if err != nil {
+		return nil, fmt.Errorf("opening mountinfo: %w", err)
+	}
+	defer f.Close()
+
+	return parseMountInfo(f)
+}
+
+func mountInfoPath(pid int) string {
+	return filepath.Join("/proc", strconv.Itoa(pid), "mountinfo")
+}
+
+func parseMountInfo(r io.Reader) ([]mountInfo, error) {
+	mounts := []mountInfo{}
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		// The lines look like this, the optional fields end with the "-" separator:
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+
+		if sep == -1 || sep+1 >= len(fields) {
+			return nil, fmt.Errorf("unexpected mountinfo format: %q", scanner.Text())
+		}
+
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("parsing mount id: %w", err)
+		}
+
+		mnt := mountInfo{
+			id:         id,
+			mountPoint: unescapeMountPath(fields[4]),
+			fsType:     fields[sep+1],
+		}
+
+		if sep+3 < len(fields) {
+			mnt.superOptions = fields[sep+3]
+		}
+
+		mounts = append(mounts, mnt)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading mountinfo: %w", err)
+	}
+
+	return mounts, nil
+}
+
+// unescapeMountPath decodes the octal escapes of the spaces, tabs, newlines and backslashes of the mountinfo paths.
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+
+		b.WriteByte(path[i])
+	}
+
+	return b.String()
+}
+
+// ignoreMount tells if the mount can't have executables worth enforcing.
+func ignoreMount(mnt mountInfo) bool {
+	switch mnt.fsType {
+	case "proc", "sysfs", "cgroup", "cgroup2", "devpts", "mqueue":
+		return true
+	}
+
+	switch mnt.mountPoint {
+	case "/dev/shm", "/var/run/secrets/kubernetes.io/serviceaccount":
+		return true
+	}
+
+	return false
+}
+
+// inMountNamespace runs fn in a thread which joined the mount namespace of the process, so the paths are resolved
+// like in the process.
+func inMountNamespace(pid int, fn func() error) error {
+	nsFD, err := unix.Open(filepath.Join("/proc", strconv.Itoa(pid), "ns", "mnt"), unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("opening mount namespace: %w", err)
+	}
+	defer unix.Close(nsFD)
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		// The thread is never unlocked, so it is destroyed when the goroutine returns instead of being reused by
+		// other goroutines in the wrong namespace.
+		runtime.LockOSThread()
+
+		// The mount namespace can't be changed while the thread shares its root and working directory with the
+		// others.
+		if err := unix.Unshare(unix.CLONE_FS); err != nil {
+			errCh <- fmt.Errorf("unsharing fs attributes: %w", err)
+			return
+		}
+
+		if err := unix.Setns(nsFD, unix.CLONE_NEWNS); err != nil {
+			errCh <- fmt.Errorf("joining mount namespace: %w", err)
+			return
+		}
+
+		errCh <- fn()
+	}()
+
+	return <-errCh
+}
+
+// markNamespaceMounts marks all the mounts of the container from inside its mount namespace, including the ones which
+// only exist there like the tmpfs volumes.
+func (n *ContainerNotifier) markNamespaceMounts() error {
+	mounts, err := readMountInfo(int(n.pid()))
+	if err != nil {
+		return err
+	}
+
+	return n.markMounts(mounts)
+}
+
+// recordMounts remembers the mounts of the container without marking them.
+func (n *ContainerNotifier) recordMounts() error {
+	mounts, err := readMountInfo(int(n.pid()))
+	if err != nil {
+		return err
+	}
+
+	n.mountIDs = make(map[int]bool)
+	for _, mnt := range mounts {
+		n.mountIDs[mnt.id] = true
+	}
+
+	return nil
+}
+
+// markMounts marks the mounts which were not marked yet, the ones gone are forgotten.
+func (n *ContainerNotifier) markMounts(mounts []mountInfo) error {
+	known := n.mountIDs
+	n.mountIDs = make(map[int]bool)
+
+	newMounts := []mountInfo{}
+	for _, mnt := range mounts {
+		n.mountIDs[mnt.id] = true
+
+		if known[mnt.id] || ignoreMount(mnt) || n.policy.Excludes(mnt.mountPoint) || n.ignoresVolume(mnt.mountPoint) {
+			continue
+		}
+
+		newMounts = append(newMounts, mnt)
+	}
+
+	if len(newMounts) == 0 {
+		return nil
+	}
+
+	mark := func(root string) error {
+		for _, mnt := range newMounts {
+			path := filepath.Join(root, mnt.mountPoint)
+
+			var err error
+			if n.detection == DetectionInotify {
+				err = n.watchTree(path)
+			} else {
+				err = n.NotifyFD.Mark(unix.FAN_MARK_ADD|unix.FAN_MARK_MOUNT, n.eventMask()|unix.FAN_EVENT_ON_CHILD, unix.AT_FDCWD, path)
+			}
+			if err != nil {
+				return fmt.Errorf("marking %q: %w", path, err)
+			}
+
+			log.Infof("Marking %q of container %s: done", mnt.mountPoint, n.cnt.Id)
+		}
+
+		return nil
+	}
+
+	// The inotify watches are kept by container path, relative to the root.
+	if n.markMode == MarkModeNamespace && n.detection != DetectionInotify {
+		return inMountNamespace(int(n.pid()), func() error {
+			return mark("/")
+		})
+	}
+
+	// The mounts of the container are reachable from the host through its root.
+	return mark(n.root())
+}
+
+// watchMounts marks the mounts which appear in the container after it was attached, like the volumes mounted later or
+// the mounts propagated from the host, until the notifier is closed. The container is marked again when it is
+// restarted.
+func (n *ContainerNotifier) watchMounts() {
+	defer close(n.mountsStopped)
+
+	for n.watchProcessMounts() {
+	}
+}
+
+// watchProcessMounts watches the mounts of the current main process of the container, it tells if the container was
+// restarted once it exited.
+func (n *ContainerNotifier) watchProcessMounts() bool {
+	pid := n.pid()
+
+	f, err := os.Open(mountInfoPath(int(pid)))
+	if err != nil {
+		log.Errorf("watching mounts of container %s: %v", n.cnt.Id, err)
+		return false
+	}
+	atomic.AddInt64(&n.openFDs, 1)
+	defer func() {
+		f.Close()
+		atomic.AddInt64(&n.openFDs, -1)
+	}()
+
+	fds := []unix.PollFd{{Fd: int32(f.Fd()), Events: unix.POLLPRI}}
+
+	// The pidfd is readable when the process exits, it can't be confused with another process reusing the PID. It
+	// needs Linux 5.3, before the process is checked on every timeout.
+	pidFD, err := unix.PidfdOpen(int(pid), 0)
+	if err == nil {
+		atomic.AddInt64(&n.openFDs, 1)
+		defer func() {
+			unix.Close(pidFD)
+			atomic.AddInt64(&n.openFDs, -1)
+		}()
+		fds = append(fds, unix.PollFd{Fd: int32(pidFD), Events: unix.POLLIN})
+	}
+
+	for {
+		// The kernel reports a change of the mount table as a priority event, the timeout is only there to notice
+		// when the notifier is closed.
+		for i := range fds {
+			fds[i].Revents = 0
+		}
+		_, err := unix.Poll(fds, int(mountPollTimeout/time.Millisecond))
+
+		select {
+		case <-n.done:
+			return false
+		case <-n.pause:
+			return false
+		default:
+		}
+
+		if err == unix.EINTR {
+			continue
+		}
+
+		if err != nil {
+			log.Errorf("watching mounts of container %s: %v", n.cnt.Id, err)
+			return false
+		}
+
+		if (len(fds) > 1 && fds[1].Revents != 0) || (len(fds) == 1 && !ProcessExists(pid)) {
+			return n.refreshProcess()
+		}
+
+		if fds[0].Revents&(unix.POLLPRI|unix.POLLERR) == 0 {
+			continue
+		}
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			log.Errorf("watching mounts of container %s: %v", n.cnt.Id, err)
+			return false
+		}
+
+		mounts, err := parseMountInfo(f)
+		if err != nil {
+			log.Errorf("reading mounts of container %s: %v", n.cnt.Id, err)
+			continue
+		}
+
+		if err := n.markMounts(mounts); err != nil {
+			log.Errorf("marking new mounts of container %s: %v", n.cnt.Id, err)
+			n.recordError(err)
+		}
+	}
+}
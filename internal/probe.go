@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kinvolk/fanotify-poc/pkg/hashpool"
+	"github.com/kinvolk/fanotify-poc/pkg/k8s"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// This is what runc uses when the image does not set a PATH.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// hashProbeBinaries calculates the sha256sum of every binary run by the exec probes of the container. Kubelet runs
+// these periodically and if they are denied the pod is restarted, so they are allowed as long as they are not modified
+// after the container was started.
+func (n *ContainerNotifier) hashProbeBinaries(cntSpec *v1.Container) error {
+	if cntSpec == nil {
+		return nil
+	}
+
+	for _, cmd := range k8s.ExecProbeCommands(cntSpec) {
+		path, err := n.resolveBinary(cmd[0])
+		if err != nil {
+			// The probe will fail anyway, so there is nothing to allow.
+			log.Errorf("resolving probe command %q: %v", cmd[0], err)
+			continue
+		}
+
+		sha256sum, err := n.hashPool.HashFile(hashpool.PriorityBackground, path)
+		if err != nil {
+			return fmt.Errorf("calculating sha256sum of %s: %w", path, err)
+		}
+
+		log.Infof("allowing exec probe binary: %s", path)
+		n.probeSums[strings.TrimPrefix(path, n.root())] = sha256sum
+	}
+
+	return nil
+}
+
+// resolveBinary finds the binary the same way runc does for the container process and returns its path under the
+// rootfs path, without symlinks so it matches the paths of the events.
+func (n *ContainerNotifier) resolveBinary(name string) (string, error) {
+	cwd, envPath := "/", defaultPath
+
+	if n.cnt.Process != nil {
+		if n.cnt.Process.Cwd != "" {
+			cwd = n.cnt.Process.Cwd
+		}
+
+		for _, env := range n.cnt.Process.Env {
+			if strings.HasPrefix(env, "PATH=") {
+				envPath = strings.TrimPrefix(env, "PATH=")
+			}
+		}
+	}
+
+	if strings.Contains(name, "/") {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(cwd, name)
+		}
+
+		cntPath, err := canonicalPath(n.root(), name)
+		if err != nil {
+			return "", err
+		}
+
+		return filepath.Join(n.root(), cntPath), nil
+	}
+
+	for _, dir := range filepath.SplitList(envPath) {
+		cntPath, err := canonicalPath(n.root(), filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(n.root(), cntPath)
+
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+			continue
+		}
+
+		return path, nil
+	}
+
+	return "", fmt.Errorf("executable not found in %s", envPath)
+}
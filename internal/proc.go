@@ -0,0 +1,352 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// procStat holds the fields of /proc/PID/stat used for the decisions.
+type procStat struct {
+	ppid  int
+	ttyNr int
+}
+
+func readProcStat(pid int) (*procStat, error) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return nil, fmt.Errorf("reading stat: %w", err)
+	}
+
+	// The file looks like this:
+	// 49190 (touch) S 49181 49190 49181 34816 ...
+	// The command name can have spaces and parenthesis, so the fields are looked for after the last one.
+	i := strings.LastIndexByte(string(data), ')')
+	if i == -1 {
+		return nil, fmt.Errorf("unexpected stat format: %q", data)
+	}
+
+	// Here fields[0] is the state.
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 5 {
+		return nil, fmt.Errorf("unexpected stat format: %q", data)
+	}
+
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("parsing ppid: %w", err)
+	}
+
+	ttyNr, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("parsing tty_nr: %w", err)
+	}
+
+	return &procStat{ppid: ppid, ttyNr: ttyNr}, nil
+}
+
+// readMntns returns the inode of the mount namespace of the process.
+func readMntns(pid int) (uint64, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(filepath.Join("/proc", strconv.Itoa(pid), "ns", "mnt"), &st); err != nil {
+		return 0, fmt.Errorf("reading mount namespace: %w", err)
+	}
+
+	return st.Ino, nil
+}
+
+// isInteractive tells if the process has a controlling terminal or if its stdin is a terminal.
+func isInteractive(pid int) (bool, error) {
+	stat, err := readProcStat(pid)
+	if err != nil {
+		return false, err
+	}
+
+	if stat.ttyNr != 0 {
+		return true, nil
+	}
+
+	// The path of the terminal depends on the mount namespace of the process, so look at the device instead.
+	var st unix.Stat_t
+	if err := unix.Stat(filepath.Join("/proc", strconv.Itoa(pid), "fd", "0"), &st); err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			// There is no stdin.
+			return false, nil
+		}
+
+		return false, fmt.Errorf("checking stdin: %w", err)
+	}
+
+	if st.Mode&unix.S_IFMT != unix.S_IFCHR {
+		return false, nil
+	}
+
+	return isTerminalMajor(unix.Major(st.Rdev)), nil
+}
+
+func isTerminalMajor(major uint32) bool {
+	switch {
+	// Virtual consoles, serial ports and /dev/tty, /dev/console, /dev/ptmx.
+	case major == 4 || major == 5:
+		return true
+	// Pseudo terminals from devpts.
+	case major >= 136 && major <= 143:
+		return true
+	}
+
+	return false
+}
+
+// isExecSession tells if the process was started with runc exec (kubectl exec, exec probes) instead of being part of the
+// process tree of the container's init process.
+func (n *ContainerNotifier) isExecSession(pid int) (bool, error) {
+	cntPid := int(n.pid())
+
+	for pid > 1 {
+		if pid == cntPid {
+			return false, nil
+		}
+
+		stat, err := readProcStat(pid)
+		if err != nil {
+			return false, fmt.Errorf("getting parent of %d: %w", pid, err)
+		}
+
+		pid = stat.ppid
+	}
+
+	// We walked up to the host init process, so the container's init process is not an ancestor. The runc exec
+	// processes are children of the container shim.
+	return true, nil
+}
+
+// processInfo is what is known about the process requesting an execution.
+type processInfo struct {
+	pid         int
+	ppid        int
+	exe         string
+	parentExe   string
+	uid         uint32
+	gid         uint32
+	execSession bool
+	interactive bool
+}
+
+// inspectProcess gathers the process information used for the decisions. It errs on the side of caution: if something
+// cannot be found out the process is considered as part of an interactive exec session.
+func (n *ContainerNotifier) inspectProcess(pid int) *processInfo {
+	info := &processInfo{pid: pid, execSession: true, interactive: true}
+
+	stat, err := readProcStat(pid)
+	if err != nil {
+		// The process is gone or it can't be inspected, so don't give it any exemption.
+		log.Errorf("inspecting process %d: %v", pid, err)
+		return info
+	}
+
+	info.ppid = stat.ppid
+
+	if info.exe, err = readExe(pid); err != nil {
+		log.Errorf("inspecting process %d: %v", pid, err)
+	}
+
+	if info.parentExe, err = readExe(stat.ppid); err != nil {
+		log.Errorf("inspecting parent of process %d: %v", pid, err)
+	}
+
+	// When the ids can't be read they stay as root.
+	if info.uid, info.gid, err = readIDs(pid); err != nil {
+		log.Errorf("inspecting process %d: %v", pid, err)
+	}
+
+	if info.execSession, err = n.isExecSession(pid); err != nil {
+		log.Errorf("checking for exec session: %v", err)
+		info.execSession = true
+	}
+
+	if info.interactive, err = isInteractive(pid); err != nil {
+		log.Errorf("checking for terminal: %v", err)
+		info.interactive = true
+	}
+
+	return info
+}
+
+// readExe returns the path of the executable of the process. For the processes of a container the path is relative to
+// its root, e.g. /usr/bin/nginx.
+func readExe(pid int) (string, error) {
+	exe, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "exe"))
+	if err != nil {
+		return "", fmt.Errorf("reading exe: %w", err)
+	}
+
+	return strings.TrimSuffix(exe, " (deleted)"), nil
+}
+
+// readIDs returns the effective uid and gid of the process as seen from inside its user namespace.
+func readIDs(pid int) (uint32, uint32, error) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "status"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("reading status: %w", err)
+	}
+
+	var uid, gid uint32
+	var foundUID, foundGID bool
+
+	for _, line := range strings.Split(string(data), "\n") {
+		// The lines look like this:
+		// Uid:	1000	1000	1000	1000
+		// with the real, effective, saved set and filesystem ids.
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+
+		switch fields[0] {
+		case "Uid:":
+			uid, foundUID = parseID(fields[2])
+		case "Gid:":
+			gid, foundGID = parseID(fields[2])
+		}
+	}
+
+	if !foundUID || !foundGID {
+		return 0, 0, fmt.Errorf("no uid or gid in status")
+	}
+
+	if uid, err = mapID(pid, "uid_map", uid); err != nil {
+		return 0, 0, err
+	}
+
+	if gid, err = mapID(pid, "gid_map", gid); err != nil {
+		return 0, 0, err
+	}
+
+	return uid, gid, nil
+}
+
+func parseID(s string) (uint32, bool) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint32(id), err == nil
+}
+
+// mapID translates an id from the host to the user namespace of the process. Without user namespaces the map is the
+// identity.
+func mapID(pid int, mapFile string, id uint32) (uint32, error) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), mapFile))
+	if err != nil {
+		return 0, fmt.Errorf("reading %s: %w", mapFile, err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		// The lines look like this:
+		//          0     100000      65536
+		// with the first id inside the namespace, the first id outside of it and the length of the range.
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+
+		inside, ok1 := parseID(fields[0])
+		outside, ok2 := parseID(fields[1])
+		count, ok3 := parseID(fields[2])
+		if !ok1 || !ok2 || !ok3 {
+			continue
+		}
+
+		if id >= outside && uint64(id) < uint64(outside)+uint64(count) {
+			return inside + (id - outside), nil
+		}
+	}
+
+	return 0, fmt.Errorf("id %d is not mapped in %s", id, mapFile)
+}
+
+// ProcessExists tells if the process is still running.
+func ProcessExists(pid uint32) bool {
+	err := unix.Kill(int(pid), 0)
+	return err == nil || errors.Is(err, unix.EPERM)
+}
+
+// creatFlags stands for the flags of creat, which always writes.
+const creatFlags = -1
+
+// openSyscalls are the syscalls opening files by number, with the index of their flags argument. The ones of
+// the architecture are added in proc_$GOARCH.go.
+var openSyscalls = map[int]int{
+	unix.SYS_OPENAT:            2,
+	unix.SYS_OPEN_BY_HANDLE_AT: 2,
+	// The flags are in the struct open_how pointed by the argument.
+	unix.SYS_OPENAT2: 2,
+}
+
+// execSyscalls open the executed files, only for reading.
+var execSyscalls = map[int]bool{
+	unix.SYS_EXECVE:   true,
+	unix.SYS_EXECVEAT: true,
+}
+
+// opensForWriting tells if the thread is opening a file for writing, from the syscall it is blocked in. It is an error
+// when it is not blocked in a known syscall, like the io_uring workers.
+func opensForWriting(tid int) (bool, error) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(tid), "syscall"))
+	if err != nil {
+		return false, fmt.Errorf("reading syscall: %w", err)
+	}
+
+	// The file looks like this, with the number of the syscall, its arguments, the stack pointer and the program
+	// counter:
+	// 257 0xffffff9c 0x7ffd2c5e4f10 0x241 0x1b6 0x0 0x0 0x7ffd2c5e4e28 0x7f0e4a2f1b3e
+	fields := strings.Fields(string(data))
+	if len(fields) < 7 {
+		return false, fmt.Errorf("not in a syscall: %q", data)
+	}
+
+	nr, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return false, fmt.Errorf("parsing syscall number: %w", err)
+	}
+
+	if execSyscalls[nr] {
+		return false, nil
+	}
+
+	arg, ok := openSyscalls[nr]
+	if !ok {
+		return false, fmt.Errorf("unknown syscall %d", nr)
+	}
+
+	if arg == creatFlags {
+		return true, nil
+	}
+
+	flags, err := strconv.ParseUint(strings.TrimPrefix(fields[1+arg], "0x"), 16, 64)
+	if err != nil {
+		return false, fmt.Errorf("parsing syscall flags: %w", err)
+	}
+
+	if nr == unix.SYS_OPENAT2 {
+		mem, err := os.Open(filepath.Join("/proc", strconv.Itoa(tid), "mem"))
+		if err != nil {
+			return false, fmt.Errorf("reading open_how: %w", err)
+		}
+		defer mem.Close()
+
+		// The flags are the first field.
+		buf := make([]byte, 8)
+		if _, err := mem.ReadAt(buf, int64(flags)); err != nil {
+			return false, fmt.Errorf("reading open_how: %w", err)
+		}
+
+		flags = binary.LittleEndian.Uint64(buf)
+	}
+
+	return flags&(unix.O_WRONLY|unix.O_RDWR|unix.O_TRUNC) != 0, nil
+}
@@ -0,0 +1,8 @@
+package internal
+
+import "golang.org/x/sys/unix"
+
+func init() {
+	openSyscalls[unix.SYS_OPEN] = 1
+	openSyscalls[unix.SYS_CREAT] = creatFlags
+}
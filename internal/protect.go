@@ -0,0 +1,321 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/s3rj1k/go-fanotify/fanotify"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// protectedMask are the events of the protected files: the opens are answered, and the writes to the files opened
+// before are reported.
+const protectedMask = unix.FAN_OPEN_PERM | unix.FAN_MODIFY
+
+// protectedDirMask are the events of the directories of the protected files, which can't be denied: the files are
+// replaced, removed or their permissions changed.
+const protectedDirMask = unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_CREATE | unix.IN_ATTRIB
+
+// socketWait is how long the protector waits for the agent to create its sockets before watching them, so their
+// creation is not reported.
+const socketWait = 10 * time.Second
+
+// Protector denies the writes to the binary, the configuration and the baselines of the agent by the other
+// processes, and reports them with the replacements of these files and of the sockets of the agent.
+type Protector struct {
+	// OnTampering reports the attempts, which are also logged.
+	OnTampering func(*events.Event)
+
+	notifyFD *fanotify.NotifyFD
+	inotify  *os.File
+	created  time.Time
+
+	lock sync.Mutex
+	// files are the protected paths, with true for the directories whose files are all protected.
+	files map[string]bool
+	// dirs are the directories of the protected paths by watch descriptor.
+	dirs    map[int]string
+	sockets []string
+}
+
+func NewProtector() (*Protector, error) {
+	// The thread ids tell what the opens are for.
+	notifyFD, err := fanotify.Initialize(unix.FAN_CLASS_CONTENT|unix.FAN_REPORT_TID|unix.FAN_UNLIMITED_QUEUE|unix.FAN_CLOEXEC, os.O_RDONLY|unix.O_LARGEFILE|unix.O_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("initializing fanotify: %w", err)
+	}
+
+	// Non blocking, so the reads are interrupted when the file is closed.
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		notifyFD.File.Close()
+		return nil, fmt.Errorf("initializing inotify: %w", err)
+	}
+
+	return &Protector{
+		notifyFD: notifyFD,
+		inotify:  os.NewFile(uintptr(fd), "inotify"),
+		created:  time.Now(),
+		files:    make(map[string]bool),
+		dirs:     make(map[int]string),
+	}, nil
+}
+
+// Protect protects the file, or all the files of the directory.
+func (p *Protector) Protect(path string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.protect(filepath.Clean(path))
+}
+
+// ProtectSocket reports the replacements of the socket, once the agent created it.
+func (p *Protector) ProtectSocket(path string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.sockets = append(p.sockets, filepath.Clean(path))
+}
+
+func (p *Protector) protect(path string) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("protecting %s: %w", path, err)
+	}
+
+	switch {
+	case st.IsDir():
+		if err := p.notifyFD.Mark(unix.FAN_MARK_ADD, protectedMask|unix.FAN_EVENT_ON_CHILD, unix.AT_FDCWD, path); err != nil {
+			return fmt.Errorf("protecting %s: %w", path, err)
+		}
+
+		if err := p.watch(path); err != nil {
+			return err
+		}
+	case st.Mode().IsRegular():
+		if err := p.notifyFD.Mark(unix.FAN_MARK_ADD, protectedMask, unix.AT_FDCWD, path); err != nil {
+			return fmt.Errorf("protecting %s: %w", path, err)
+		}
+	}
+
+	p.files[path] = st.IsDir()
+
+	return p.watch(filepath.Dir(path))
+}
+
+func (p *Protector) watch(dir string) error {
+	wd, err := unix.InotifyAddWatch(int(p.inotify.Fd()), dir, protectedDirMask)
+	if err != nil {
+		return fmt.Errorf("watching %s: %w", dir, err)
+	}
+
+	p.dirs[wd] = dir
+
+	return nil
+}
+
+// Run answers the opens of the protected files and reports the attempts until the protector is closed.
+func (p *Protector) Run() {
+	go p.watchSockets()
+	go p.watchDirs()
+
+	for {
+		data, err := p.notifyFD.GetEvent()
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.Errorf("self-protection stopped: %v", err)
+			}
+			return
+		}
+
+		if data != nil {
+			p.handleEvent(data)
+		}
+	}
+}
+
+func (p *Protector) handleEvent(data *fanotify.EventMetadata) {
+	defer data.Close()
+
+	tid := data.GetPID()
+	path, err := data.GetPath()
+	if err != nil {
+		path = "unknown file"
+	}
+
+	// The agent writes its own baselines.
+	own := isOwnThread(tid)
+
+	if !data.MatchMask(unix.FAN_OPEN_PERM) {
+		if !own {
+			p.tampering(tid, path, events.VerdictAudit, "written")
+		}
+		return
+	}
+
+	if own {
+		p.notifyFD.ResponseAllow(data)
+		return
+	}
+
+	writing, err := opensForWriting(tid)
+	if err == nil && !writing {
+		p.notifyFD.ResponseAllow(data)
+		return
+	}
+
+	reason := "opened for writing"
+	if err != nil {
+		reason = fmt.Sprintf("opened from an unknown syscall: %v", err)
+	}
+
+	if err := p.notifyFD.ResponseDeny(data); err != nil {
+		log.Errorf("denying open of %s: %v", path, err)
+	}
+
+	p.tampering(tid, path, events.VerdictDeny, reason)
+}
+
+// watchDirs reports the changes of the directory entries of the protected files, and protects the files replacing
+// them.
+func (p *Protector) watchDirs() {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := p.inotify.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.Errorf("self-protection stopped watching directories: %v", err)
+			}
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			name := strings.TrimRight(string(buf[offset+unix.SizeofInotifyEvent:offset+unix.SizeofInotifyEvent+int(event.Len)]), "\x00")
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+
+			p.handleDirEvent(int(event.Wd), event.Mask, name)
+		}
+	}
+}
+
+func (p *Protector) handleDirEvent(wd int, mask uint32, name string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	dir, ok := p.dirs[wd]
+	if !ok || name == "" {
+		return
+	}
+
+	path := filepath.Join(dir, name)
+	_, protected := p.files[path]
+	switch {
+	case protected:
+	case p.files[dir]:
+		// The agent adds files to the protected directories.
+		if mask&unix.IN_CREATE != 0 {
+			return
+		}
+	default:
+		return
+	}
+
+	reason := ""
+	switch {
+	case mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0:
+		reason = "removed"
+	case mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+		reason = "replaced"
+		if !p.files[dir] {
+			// It is the new file which is protected now.
+			if err := p.protect(path); err != nil {
+				log.Errorf("protecting the replaced file: %v", err)
+			}
+		}
+	case mask&unix.IN_ATTRIB != 0:
+		reason = "attributes changed"
+	}
+
+	// The process is unknown with inotify.
+	p.tampering(0, path, events.VerdictAudit, reason)
+}
+
+// watchSockets protects the sockets once the agent created them.
+func (p *Protector) watchSockets() {
+	p.lock.Lock()
+	sockets := p.sockets
+	p.lock.Unlock()
+
+	deadline := time.Now().Add(socketWait)
+	for _, socket := range sockets {
+		for time.Now().Before(deadline) && !p.socketReady(socket) {
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		if !p.socketReady(socket) {
+			log.Warnf("socket %s not created after %s, watching it anyway", socket, socketWait)
+		}
+
+		p.lock.Lock()
+		p.files[socket] = false
+		if err := p.watch(filepath.Dir(socket)); err != nil {
+			log.Errorf("protecting socket: %v", err)
+		}
+		p.lock.Unlock()
+	}
+}
+
+// socketReady tells if the socket was created by the agent, which then restricts its permissions to root or its group.
+func (p *Protector) socketReady(path string) bool {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return false
+	}
+
+	ctime := time.Unix(st.Ctim.Unix())
+	return st.Mode&unix.S_IFMT == unix.S_IFSOCK && st.Mode&0o007 == 0 && !ctime.Before(p.created)
+}
+
+func (p *Protector) tampering(pid int, path string, verdict events.Verdict, reason string) {
+	by := "unknown process"
+	if pid != 0 {
+		comm, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "comm"))
+		by = fmt.Sprintf("%s (pid %d)", strings.TrimSpace(string(comm)), pid)
+		if err != nil {
+			by = fmt.Sprintf("pid %d", pid)
+		}
+	}
+
+	log.Errorf("[TAMPERING %s]: %s %s by %s", strings.ToUpper(string(verdict)), path, reason, by)
+
+	if p.OnTampering != nil {
+		p.OnTampering(&events.Event{
+			Time:    time.Now(),
+			Path:    path,
+			PID:     pid,
+			Verdict: verdict,
+			Reason:  "self-protection, " + reason,
+		})
+	}
+}
+
+// Close stops protecting the files.
+func (p *Protector) Close() {
+	p.notifyFD.File.Close()
+	p.inotify.Close()
+}
+
+func isOwnThread(tid int) bool {
+	_, err := os.Stat(filepath.Join("/proc/self/task", strconv.Itoa(tid)))
+	return err == nil
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+)
+
+// Quarantine counts the denials of every container, and quarantines the ones reaching Denials of them within Window,
+// once per container.
+type Quarantine struct {
+	Denials int
+	// Window is how long the denials are counted for, 0 counts them since the container started.
+	Window time.Duration
+	// OnQuarantine is called with the last denial of the container quarantined and how many there were, it can block.
+	OnQuarantine func(e *events.Event, denials int)
+
+	lock sync.Mutex
+	// containers are the denials of every container, oldest first.
+	containers  map[string]*denials
+	quarantined int64
+}
+
+type denials struct {
+	times       []time.Time
+	counts      []int
+	total       int
+	quarantined bool
+}
+
+// Record counts the decision if it is a denial, it can be used as a sink.
+func (q *Quarantine) Record(e *events.Event) {
+	if e.Verdict != events.VerdictDeny || q.Denials <= 0 {
+		return
+	}
+
+	// A summary of identical denials stands for all of them.
+	count := 1
+	if e.Count > 0 {
+		count = e.Count
+	}
+
+	q.lock.Lock()
+	if q.containers == nil {
+		q.containers = make(map[string]*denials)
+	}
+
+	d := q.containers[e.ContainerID]
+	if d == nil {
+		d = &denials{}
+		q.containers[e.ContainerID] = d
+	}
+
+	if d.quarantined {
+		q.lock.Unlock()
+		return
+	}
+
+	d.times = append(d.times, e.Time)
+	d.counts = append(d.counts, count)
+	d.total += count
+
+	if q.Window > 0 {
+		for len(d.times) > 0 && e.Time.Sub(d.times[0]) >= q.Window {
+			d.total -= d.counts[0]
+			d.times, d.counts = d.times[1:], d.counts[1:]
+		}
+	} else {
+		// Only the total is needed.
+		d.times, d.counts = d.times[:0], d.counts[:0]
+	}
+
+	total := d.total
+	quarantine := total >= q.Denials
+	if quarantine {
+		d.quarantined = true
+		d.times, d.counts = nil, nil
+	}
+	q.lock.Unlock()
+
+	if quarantine {
+		atomic.AddInt64(&q.quarantined, 1)
+		go q.OnQuarantine(e, total)
+	}
+}
+
+// Forget forgets the denials of the container which stopped.
+func (q *Quarantine) Forget(cid string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	delete(q.containers, cid)
+}
+
+// Quarantined returns how many containers were quarantined since the agent started.
+func (q *Quarantine) Quarantined() int64 {
+	return atomic.LoadInt64(&q.quarantined)
+}
@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	"github.com/s3rj1k/go-fanotify/fanotify"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// readMask are the events of the files protected by the read rules, the reads are answered too in case the file was
+// opened before it was marked.
+const readMask = unix.FAN_OPEN_PERM | unix.FAN_ACCESS_PERM
+
+// tokenMountPaths are where the service account token is mounted in the containers.
+var tokenMountPaths = []string{"/var/run/secrets/kubernetes.io/serviceaccount", "/run/secrets/kubernetes.io/serviceaccount"}
+
+// markToken marks the mount of the service account token, so its opens are answered by the policy. The mount only
+// holds the token, the CA and the namespace. The agent never opens them, its own events are not answered.
+func (n *ContainerNotifier) markToken(p *policy.ExecPolicy) error {
+	if !p.ProtectsToken() {
+		return nil
+	}
+
+	if n.detection != "" {
+		log.Warnf("permission events not available, the service account token of container %s is not protected", n.cnt.Id)
+		return nil
+	}
+
+	for _, mnt := range n.cnt.Mounts {
+		if !isTokenMount(mnt.Destination) {
+			continue
+		}
+
+		// The rootfs would be marked instead of the token if it was not mounted.
+		path := filepath.Join(n.root(), mnt.Destination)
+		if err := n.NotifyFD.Mark(unix.FAN_MARK_ADD|unix.FAN_MARK_MOUNT, unix.FAN_OPEN_PERM, unix.AT_FDCWD, path); err != nil {
+			return err
+		}
+
+		log.Infof("Protecting service account token of container %s: done", n.cnt.Id)
+	}
+
+	return nil
+}
+
+func isTokenFile(path string) bool {
+	for _, p := range tokenMountPaths {
+		if strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isTokenMount(path string) bool {
+	for _, p := range tokenMountPaths {
+		if path == p {
+			return true
+		}
+	}
+
+	return false
+}
+
+// markReads marks the files protected by the read rules, so their opens and reads are answered by the policy. The
+// globs are resolved in the mount namespace of the container, the symlinks can't lead to the files of the host.
+func (n *ContainerNotifier) markReads(p *policy.ExecPolicy) error {
+	globs := p.ReadPaths()
+	if len(globs) == 0 {
+		return nil
+	}
+
+	if n.detection != "" {
+		log.Warnf("permission events not available, the reads of container %s are not protected", n.cnt.Id)
+		return nil
+	}
+
+	return inMountNamespace(int(n.pid()), func() error {
+		for _, glob := range globs {
+			if err := n.markRead(glob); err != nil {
+				return fmt.Errorf("marking %q: %w", glob, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// markRead marks the file, or the directories holding the files, matching the glob. The files created later are only
+// protected in the marked directories.
+func (n *ContainerNotifier) markRead(glob string) error {
+	if dir := strings.TrimSuffix(glob, "/**"); dir != glob {
+		return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			if err != nil || !d.IsDir() {
+				return err
+			}
+
+			return n.NotifyFD.Mark(unix.FAN_MARK_ADD|unix.FAN_MARK_ONLYDIR, readMask|unix.FAN_EVENT_ON_CHILD, unix.AT_FDCWD, path)
+		})
+	}
+
+	if !strings.ContainsAny(glob, `*?[\`) {
+		info, err := os.Stat(glob)
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Debugf("protected file %q of container %s not found", glob, n.cnt.Id)
+			return nil
+		}
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		return n.NotifyFD.Mark(unix.FAN_MARK_ADD, readMask, unix.AT_FDCWD, glob)
+	}
+
+	dirs, err := filepath.Glob(filepath.Dir(glob))
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+
+		if err := n.NotifyFD.Mark(unix.FAN_MARK_ADD|unix.FAN_MARK_ONLYDIR, readMask|unix.FAN_EVENT_ON_CHILD, unix.AT_FDCWD, dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleOpen answers the open or the read of a file of the container: a protected file can only be read by the
+// allowed programs, and the files of an immutable rootfs can't be opened for writing.
+func (n *ContainerNotifier) handleOpen(data *fanotify.EventMetadata) {
+	pid := data.GetPID()
+
+	cntPath, err := data.GetPath()
+	if err != nil {
+		log.Errorf("getting path of the file opened by process %d: %v", pid, err)
+		n.denyEvent(data)
+		return
+	}
+
+	// The file can't be read without knowing by what.
+	exe, err := readExe(pid)
+	if err != nil {
+		log.Errorf("inspecting process %d opening %s: %v", pid, cntPath, err)
+	}
+
+	p, _ := n.policyOf(pid)
+
+	if n.enforcesImmutable(p) && data.MatchMask(unix.FAN_OPEN_PERM) {
+		if decision, writing := n.evaluateWrite(p, data, pid); writing {
+			n.answerOpen(data, pid, cntPath, exe, events.AccessWrite, decision)
+			return
+		}
+	}
+
+	var decision policy.Decision
+	if isTokenFile(cntPath) && p.ProtectsToken() {
+		decision = p.EvaluateTokenRead(exe)
+	} else {
+		d, ok := p.EvaluateRead(cntPath, exe)
+		if !ok {
+			// The other files of the marked directories and of the rootfs.
+			n.allowEvent(data)
+			return
+		}
+		decision = d
+	}
+
+	n.answerOpen(data, pid, cntPath, exe, events.AccessRead, decision)
+}
+
+func (n *ContainerNotifier) answerOpen(data *fanotify.EventMetadata, pid int, cntPath, exe, access string, decision policy.Decision) {
+	verdict := events.VerdictAllow
+	degraded := n.degraded()
+	switch {
+	case !decision.Allow && degraded != "":
+		verdict = events.VerdictAudit
+		decision.Reason = degraded + ", " + decision.Reason
+	case !decision.Allow:
+		verdict = events.VerdictDeny
+	case decision.Audited:
+		verdict = events.VerdictAudit
+	}
+
+	if verdict == events.VerdictDeny {
+		n.denyEvent(data)
+	} else {
+		n.allowEvent(data)
+	}
+
+	// The allowed programs read the files all the time.
+	if verdict == events.VerdictAllow {
+		log.Debugf("[ALLOW %s]:%s: %s by %s", strings.ToUpper(access), n.cnt.Id, cntPath, exe)
+		return
+	}
+
+	log.Infof("[%s %s]:%s: %s (%s)", strings.ToUpper(string(verdict)), strings.ToUpper(access), n.cnt.Id, cntPath, decision.Reason)
+
+	event := n.event(pid, cntPath, nil, verdict, decision.Reason)
+	event.Access = access
+	n.report(event)
+}
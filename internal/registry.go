@@ -0,0 +1,344 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/status"
+)
+
+// removedRetention is how long the removed containers are remembered, so their add event handled late is ignored.
+const removedRetention = 10 * time.Minute
+
+// ErrNotFound is returned for the containers without notifier.
+var ErrNotFound = errors.New("container not found")
+
+// Registry owns the notifiers of the enforced containers. The add and remove events of the containers are handled
+// concurrently, in any order and possibly more than once.
+type Registry struct {
+	lock      sync.Mutex
+	notifiers map[string]*ContainerNotifier
+	// shared are the containers enforced by the notifier of another container of their mount namespace.
+	shared map[string]*ContainerNotifier
+	// pending are the containers whose notifier is being created.
+	pending map[string]bool
+	// removed are the containers removed before their notifier was added, by time of removal.
+	removed map[string]time.Time
+	// failed are the containers which could not be enforced, they are reported until they are removed.
+	failed map[string]status.Container
+
+	created int
+	closed  int
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		notifiers: make(map[string]*ContainerNotifier),
+		shared:    make(map[string]*ContainerNotifier),
+		pending:   make(map[string]bool),
+		removed:   make(map[string]time.Time),
+		failed:    make(map[string]status.Container),
+	}
+}
+
+// Reserve tells if a notifier has to be created for the container. It is false when the container already has one, is
+// having one created, or was removed. Add or Abort have to follow once it is true.
+func (r *Registry) Reserve(cid string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.notifiers[cid]; ok || r.pending[cid] {
+		return false
+	}
+
+	if _, ok := r.shared[cid]; ok {
+		return false
+	}
+
+	if _, ok := r.removed[cid]; ok {
+		return false
+	}
+
+	r.pending[cid] = true
+	return true
+}
+
+// Abort releases the reservation of the container whose notifier could not be created.
+func (r *Registry) Abort(cid string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.pending, cid)
+}
+
+// Add registers the notifier of the reserved container. The notifier is closed and false is returned when the
+// container was removed meanwhile.
+func (r *Registry) Add(cid string, n *ContainerNotifier) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.pending, cid)
+	delete(r.failed, cid)
+
+	if _, ok := r.removed[cid]; ok {
+		n.Close()
+		return false
+	}
+
+	r.notifiers[cid] = n
+	r.created++
+
+	return true
+}
+
+// Fail releases the reservation of the container which could not be enforced, it is reported with the given state
+// until it is removed.
+func (r *Registry) Fail(cid string, cnt status.Container) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.pending, cid)
+
+	if _, ok := r.removed[cid]; ok {
+		return
+	}
+
+	cnt.EnforcementFailed = true
+	r.failed[cid] = cnt
+}
+
+// Failed tells if the container could not be enforced.
+func (r *Registry) Failed(cid string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	_, ok := r.failed[cid]
+	return ok
+}
+
+// Has tells if the container has a notifier, shares the one of another container or is having one created.
+func (r *Registry) Has(cid string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	_, ok := r.notifiers[cid]
+	_, shared := r.shared[cid]
+	return ok || shared || r.pending[cid]
+}
+
+// Sharing returns the notifier of the mount namespace of the process, nil when the process has its own mount
+// namespace.
+func (r *Registry) Sharing(pid uint32) *ContainerNotifier {
+	for _, n := range r.Notifiers() {
+		if n.SharesMounts(pid) {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// AddShared registers the reserved container enforced by the notifier of another container, see Sharing. It is false
+// when that notifier was closed meanwhile, the container is still reserved then.
+func (r *Registry) AddShared(cid string, n *ContainerNotifier) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.registered(n) {
+		n.unshare(cid)
+		return false
+	}
+
+	delete(r.pending, cid)
+
+	if _, ok := r.removed[cid]; ok {
+		n.unshare(cid)
+		return true
+	}
+
+	r.shared[cid] = n
+	return true
+}
+
+func (r *Registry) registered(n *ContainerNotifier) bool {
+	for _, registered := range r.notifiers {
+		if registered == n {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Remove closes and forgets the notifier of the container, it is closed once added when it is being created. The other
+// containers the notifier enforced are returned, they have to be enforced again.
+func (r *Registry) Remove(cid string) []*SharedContainer {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	for id, at := range r.removed {
+		if now.Sub(at) > removedRetention {
+			delete(r.removed, id)
+		}
+	}
+
+	delete(r.failed, cid)
+
+	if n, ok := r.shared[cid]; ok {
+		n.unshare(cid)
+		delete(r.shared, cid)
+		return nil
+	}
+
+	n, ok := r.notifiers[cid]
+	if !ok {
+		// The add event is not handled yet.
+		r.removed[cid] = now
+		return nil
+	}
+
+	n.Close()
+	delete(r.notifiers, cid)
+	r.closed++
+
+	for id, shared := range r.shared {
+		if shared == n {
+			delete(r.shared, id)
+		}
+	}
+
+	return n.sharedContainers()
+}
+
+// Forget forgets the removal of the container, for the runtimes starting the stopped containers again with the same
+// ID.
+func (r *Registry) Forget(cid string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.removed, cid)
+}
+
+// Replace replaces the notifier of the container, it is false when the container was removed meanwhile. The
+// container is forgotten when the new notifier is nil, the other containers the old notifier enforced are returned
+// then, like by Remove.
+func (r *Registry) Replace(cid string, old, n *ContainerNotifier) ([]*SharedContainer, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.notifiers[cid] != old {
+		return nil, false
+	}
+
+	for id, shared := range r.shared {
+		if shared != old {
+			continue
+		}
+
+		if n == nil {
+			delete(r.shared, id)
+		} else {
+			r.shared[id] = n
+		}
+	}
+
+	if n == nil {
+		delete(r.notifiers, cid)
+		r.closed++
+		return old.sharedContainers(), true
+	}
+
+	r.notifiers[cid] = n
+	r.closed++
+	r.created++
+
+	return nil, true
+}
+
+// Find returns the notifier of the container, the ID can be shortened as long as it is not ambiguous. The containers
+// sharing a mount namespace share their notifier.
+func (r *Registry) Find(cntID string) (*ContainerNotifier, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var found *ContainerNotifier
+	matches := 0
+	for _, notifiers := range []map[string]*ContainerNotifier{r.notifiers, r.shared} {
+		for cid, n := range notifiers {
+			if cntID == "" || !strings.HasPrefix(cid, cntID) {
+				continue
+			}
+
+			matches++
+			found = n
+		}
+	}
+
+	if matches > 1 {
+		return nil, fmt.Errorf("container ID %q is ambiguous", cntID)
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, cntID)
+	}
+
+	return found, nil
+}
+
+// Notifiers returns the registered notifiers.
+func (r *Registry) Notifiers() []*ContainerNotifier {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	notifiers := make([]*ContainerNotifier, 0, len(r.notifiers))
+	for _, n := range r.notifiers {
+		notifiers = append(notifiers, n)
+	}
+
+	return notifiers
+}
+
+// Containers returns the state of the enforced containers, and of the ones which could not be enforced.
+func (r *Registry) Containers() []status.Container {
+	cnts := []status.Container{}
+	for _, n := range r.Notifiers() {
+		cnts = append(cnts, n.Status())
+		cnts = append(cnts, n.sharedStatus()...)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, cnt := range r.failed {
+		cnts = append(cnts, cnt)
+	}
+
+	return cnts
+}
+
+// RegistryStats counts the notifiers of the registry.
+type RegistryStats struct {
+	Active  int
+	Pending int
+	Failed  int
+	// Created and Closed count the notifiers since the agent started, including the ones restarted.
+	Created int
+	Closed  int
+}
+
+func (r *Registry) Stats() RegistryStats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return RegistryStats{
+		Active:  len(r.notifiers),
+		Pending: len(r.pending),
+		Failed:  len(r.failed),
+		Created: r.created,
+		Closed:  r.closed,
+	}
+}
@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/containerd/containerd/oci"
+	pb "github.com/kinvolk/inspektor-gadget/pkg/gadgettracermanager/api"
+)
+
+func newTestNotifier(cid string) *ContainerNotifier {
+	return &ContainerNotifier{
+		cnt:  &Container{&pb.ContainerDefinition{Id: cid}, &oci.Spec{}},
+		done: make(chan struct{}),
+	}
+}
+
+func closed(n *ContainerNotifier) bool {
+	select {
+	case <-n.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// addShared registers the container as enforced by the notifier of another container.
+func addShared(t *testing.T, r *Registry, n *ContainerNotifier, cid string) {
+	t.Helper()
+
+	if !r.Reserve(cid) {
+		t.Fatalf("container %s not reserved", cid)
+	}
+
+	n.shared = map[string]*SharedContainer{cid: {Container: &pb.ContainerDefinition{Id: cid}}}
+	if !r.AddShared(cid, n) {
+		t.Fatalf("container %s not shared", cid)
+	}
+}
+
+func TestRegistryAdd(t *testing.T) {
+	tests := []struct {
+		name string
+		// before is done with the registry before the container is reserved and added.
+		before   func(r *Registry)
+		reserved bool
+	}{
+		{
+			name:     "new",
+			before:   func(r *Registry) {},
+			reserved: true,
+		},
+		{
+			name: "duplicate",
+			before: func(r *Registry) {
+				r.Reserve("a")
+				r.Add("a", newTestNotifier("a"))
+			},
+		},
+		{
+			name:   "being added",
+			before: func(r *Registry) { r.Reserve("a") },
+		},
+		{
+			name:   "removed before added",
+			before: func(r *Registry) { r.Remove("a") },
+		},
+		{
+			name: "removed and forgotten",
+			before: func(r *Registry) {
+				r.Remove("a")
+				r.Forget("a")
+			},
+			reserved: true,
+		},
+		{
+			name: "aborted",
+			before: func(r *Registry) {
+				r.Reserve("a")
+				r.Abort("a")
+			},
+			reserved: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistry()
+			tt.before(r)
+
+			if reserved := r.Reserve("a"); reserved != tt.reserved {
+				t.Fatalf("reserved %v, expected %v", reserved, tt.reserved)
+			}
+			if !tt.reserved {
+				return
+			}
+
+			n := newTestNotifier("a")
+			if !r.Add("a", n) || closed(n) {
+				t.Fatalf("notifier not added")
+			}
+			if found, err := r.Find("a"); err != nil || found != n {
+				t.Errorf("found %v, %v", found, err)
+			}
+		})
+	}
+}
+
+// TestRegistryRemoveWhileAdding checks that the notifier of a container removed while it was being created is closed.
+func TestRegistryRemoveWhileAdding(t *testing.T) {
+	r := NewRegistry()
+	if !r.Reserve("a") {
+		t.Fatal("container not reserved")
+	}
+
+	if shared := r.Remove("a"); shared != nil {
+		t.Errorf("containers %v returned", shared)
+	}
+
+	n := newTestNotifier("a")
+	if r.Add("a", n) {
+		t.Error("removed container added")
+	}
+	if !closed(n) {
+		t.Error("notifier of the removed container not closed")
+	}
+	if r.Has("a") {
+		t.Error("removed container registered")
+	}
+}
+
+func TestRegistryRemove(t *testing.T) {
+	r := NewRegistry()
+	n := newTestNotifier("a")
+	r.Reserve("a")
+	r.Add("a", n)
+	addShared(t, r, n, "b")
+
+	shared := r.Remove("a")
+	if len(shared) != 1 || shared[0].Container.Id != "b" {
+		t.Errorf("containers %v returned, expected b", shared)
+	}
+	if !closed(n) {
+		t.Error("notifier not closed")
+	}
+	if r.Has("a") || r.Has("b") {
+		t.Error("containers still registered")
+	}
+
+	stats := r.Stats()
+	if stats.Active != 0 || stats.Created != 1 || stats.Closed != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestRegistryReplace(t *testing.T) {
+	tests := []struct {
+		name string
+		// remove removes the container before its notifier is replaced.
+		remove   bool
+		restart  bool
+		replaced bool
+		// shared tells if the container sharing the notifier is returned to be enforced again.
+		shared bool
+	}{
+		{name: "restarted", restart: true, replaced: true},
+		{name: "not restarted", replaced: true, shared: true},
+		{name: "restarted after remove", remove: true, restart: true},
+		{name: "not restarted after remove", remove: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistry()
+			old := newTestNotifier("a")
+			r.Reserve("a")
+			r.Add("a", old)
+			addShared(t, r, old, "b")
+
+			if tt.remove {
+				r.Remove("a")
+			}
+
+			var restarted *ContainerNotifier
+			if tt.restart {
+				restarted = newTestNotifier("a")
+			}
+
+			shared, replaced := r.Replace("a", old, restarted)
+			if replaced != tt.replaced {
+				t.Fatalf("replaced %v, expected %v", replaced, tt.replaced)
+			}
+			if (len(shared) == 1 && shared[0].Container.Id == "b") != tt.shared || len(shared) > 1 {
+				t.Errorf("containers %v returned", shared)
+			}
+			if !tt.replaced {
+				return
+			}
+
+			found, err := r.Find("b")
+			if tt.restart && (err != nil || found != restarted) {
+				t.Errorf("shared container found with %v, %v", found, err)
+			}
+			if !tt.restart && (r.Has("a") || r.Has("b")) {
+				t.Error("containers still registered")
+			}
+		})
+	}
+}
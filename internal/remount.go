@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// keptMountFlags are the flags of the mounts kept when they are remounted, they would be cleared otherwise. The statfs
+// flags have the same values as the mount ones.
+const keptMountFlags = unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC | unix.MS_NOATIME | unix.MS_NODIRATIME | unix.MS_RELATIME
+
+// errNoRemount is returned when the policy of the container doesn't remount it read-only.
+var errNoRemount = errors.New("the policy of the container doesn't remount it read-only")
+
+// RemountReadOnly remounts the rootfs and the selected mounts of the container read-only, once its pod is ready. It is
+// only done once, and not at all when the policy doesn't ask for it or the mounts were made writable with SetReadOnly.
+func (n *ContainerNotifier) RemountReadOnly() error {
+	n.statusLock.Lock()
+	skip := n.policy.Spec.RemountReadOnly == nil || n.remounted || n.breakGlass
+	n.remounted = true
+	n.statusLock.Unlock()
+
+	if skip {
+		return nil
+	}
+
+	if err := n.remount(true); err != nil {
+		n.recordError(err)
+		return err
+	}
+
+	n.statusLock.Lock()
+	n.readOnly = true
+	n.statusLock.Unlock()
+
+	log.Infof("Remounting container %s read-only: done", n.cnt.Id)
+	return nil
+}
+
+// SetReadOnly remounts the mounts of the container read-only, or writable again for a break-glass access. They are not
+// remounted read-only anymore when the pod is ready once they were made writable.
+func (n *ContainerNotifier) SetReadOnly(readOnly bool) error {
+	if n.policy.Spec.RemountReadOnly == nil {
+		return errNoRemount
+	}
+
+	if err := n.remount(readOnly); err != nil {
+		return err
+	}
+
+	n.statusLock.Lock()
+	n.remounted = true
+	n.readOnly = readOnly
+	n.breakGlass = !readOnly
+	n.statusLock.Unlock()
+
+	if !readOnly {
+		log.Warnf("container %s is writable again, break-glass access", n.cnt.Id)
+	}
+
+	return nil
+}
+
+// remount changes the rootfs and the selected mounts from inside the mount namespace of the container, only the mounts
+// of the container are changed and not the filesystems.
+func (n *ContainerNotifier) remount(readOnly bool) error {
+	targets := append([]string{"/"}, n.policy.Spec.RemountReadOnly.Mounts...)
+
+	return inMountNamespace(int(n.pid()), func() error {
+		for _, target := range targets {
+			var st unix.Statfs_t
+			if err := unix.Statfs(target, &st); err != nil {
+				return fmt.Errorf("reading flags of mount %s: %w", target, err)
+			}
+
+			flags := uintptr(unix.MS_REMOUNT|unix.MS_BIND) | uintptr(st.Flags)&keptMountFlags
+			if readOnly {
+				flags |= unix.MS_RDONLY
+			}
+
+			if err := unix.Mount("", target, "", flags, ""); err != nil {
+				return fmt.Errorf("remounting %s: %w", target, err)
+			}
+		}
+
+		return nil
+	})
+}
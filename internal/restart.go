@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// restartTimeout is how long the runtime is given to restart the main process of the container after it exited.
+	restartTimeout  = time.Minute
+	restartInterval = time.Second
+)
+
+// procRoot returns the path of the root of the process as seen from the host, it looks like this: /proc/49190/root
+func procRoot(pid uint32) string {
+	return filepath.Join("/proc", strconv.Itoa(int(pid)), "root")
+}
+
+// pid returns the PID of the main process of the container.
+func (n *ContainerNotifier) pid() uint32 {
+	n.procLock.RLock()
+	defer n.procLock.RUnlock()
+
+	return n.cnt.Pid
+}
+
+// root returns the path of the rootfs of the container as seen from the host.
+func (n *ContainerNotifier) root() string {
+	n.procLock.RLock()
+	root, preStart := n.rootFSPath, n.preStart
+	n.procLock.RUnlock()
+
+	if !preStart || !pivoted(n.pid(), root) {
+		return root
+	}
+
+	n.procLock.Lock()
+	defer n.procLock.Unlock()
+
+	if n.preStart {
+		log.Debugf("container %s pivoted to its rootfs", n.cnt.Id)
+		n.rootFSPath = procRoot(n.cnt.Pid)
+		n.preStart = false
+	}
+
+	return n.rootFSPath
+}
+
+// pivoted tells if the process attached before it started pivoted to the rootfs: the root of the process is the
+// rootfs, or the rootfs is not reachable anymore once the old root was detached.
+func pivoted(pid uint32, rootfs string) bool {
+	info, err := os.Stat(rootfs)
+	if err != nil {
+		return true
+	}
+
+	rootInfo, err := os.Stat(procRoot(pid))
+	return err == nil && os.SameFile(info, rootInfo)
+}
+
+// filesystemMntns returns the mount namespace of the container when its filesystem is marked.
+func (n *ContainerNotifier) filesystemMntns() (uint64, bool) {
+	n.procLock.RLock()
+	defer n.procLock.RUnlock()
+
+	return n.mntns, n.filesystemMark
+}
+
+// refreshProcess looks up the main process of the container in the runtime after it exited. When the container was
+// restarted the paths are updated and it is marked again, it tells if the container is running again.
+func (n *ContainerNotifier) refreshProcess() bool {
+	old := n.pid()
+	timeout := time.After(restartTimeout)
+
+	for {
+		pid, err := n.cfg.runtime().TaskPID(n.cnt.Id)
+		if err == nil && pid != old && pid != 0 && ProcessExists(pid) {
+			n.restarted(pid)
+			return true
+		}
+
+		select {
+		case <-n.done:
+			return false
+		case <-timeout:
+			log.Debugf("container %s was not restarted", n.cnt.Id)
+			return false
+		case <-time.After(restartInterval):
+		}
+	}
+}
+
+func (n *ContainerNotifier) restarted(pid uint32) {
+	n.procLock.Lock()
+	n.cnt.Pid = pid
+	n.rootFSPath = procRoot(pid)
+	n.preStart = false
+	n.filesystemMark = false
+	n.procLock.Unlock()
+
+	log.Infof("container %s restarted with pid %d, marking it again", n.cnt.Id, pid)
+
+	// The rootfs is kept across restarts, so is the baseline.
+	if err := n.mark(); err != nil {
+		log.Errorf("marking restarted container %s: %v", n.cnt.Id, err)
+		n.recordError(err)
+	}
+}
@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/hashpool"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	"github.com/kinvolk/fanotify-poc/pkg/seccomp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// BackendSeccomp answers the seccomp user notifications of execve and execveat, for the containers whose seccomp
+// profile sends them to the agent.
+const BackendSeccomp = "seccomp"
+
+// seccompTakeTimeout is how long a notifier waits for the runtime to send the notification FD of its container.
+const seccompTakeTimeout = seccomp.OrphanTimeout
+
+// watchSeccomp answers the executions of the container until the notifier is closed or the container exits.
+func (n *ContainerNotifier) watchSeccomp() {
+	defer n.Close()
+
+	l, err := n.seccomp.Take(n.cnt.Id, seccompTakeTimeout)
+	if err != nil {
+		log.Errorf("error handling event: %v", err)
+		n.recordError(err)
+		return
+	}
+	defer l.Close()
+
+	atomic.AddInt64(&n.openFDs, 1)
+	defer atomic.AddInt64(&n.openFDs, -1)
+
+	go func() {
+		<-n.done
+		l.Close()
+	}()
+
+	log.Infof("enforcing container %s with seccomp user notifications", n.cnt.Id)
+
+	for {
+		req, err := l.Receive()
+		if errors.Is(err, seccomp.ErrClosed) {
+			return
+		}
+
+		if err != nil {
+			log.Errorf("error handling event: %v", err)
+			n.recordError(err)
+			continue
+		}
+
+		n.handleSeccomp(l, req)
+	}
+}
+
+func (n *ContainerNotifier) handleSeccomp(l *seccomp.Listener, r *seccomp.Request) {
+	answer := func(path string, req *policy.Request, verdict events.Verdict, reason string, errno unix.Errno) {
+		if verdict == events.VerdictDeny && n.fdBudget.Degraded() {
+			verdict, reason = events.VerdictAudit, "fd budget exceeded, "+reason
+		}
+
+		log.Infof("[%s]:%s: %s (%s)", strings.ToUpper(string(verdict)), n.cnt.Id, path, reason)
+
+		if err := l.Respond(r, verdict != events.VerdictDeny, errno); err != nil {
+			log.Errorf("answering execution of %s: %v", path, err)
+		}
+
+		n.report(n.event(r.PID, path, req, verdict, reason))
+	}
+
+	failed := func(path, reason string) {
+		if n.policy.FailsOpen() {
+			answer(path, nil, events.VerdictAudit, reason, 0)
+		} else {
+			answer(path, nil, events.VerdictDeny, reason, unix.EPERM)
+		}
+	}
+
+	// The execution fails the same way when the file can't be found or opened, the kernel is not asked to try again
+	// in case it appears meanwhile.
+	unavailable := func(path string, err error) {
+		errno := unix.EACCES
+		if errors.Is(err, os.ErrNotExist) {
+			errno = unix.ENOENT
+		}
+
+		log.Debugf("opening executed file %s: %v", path, err)
+		if err := l.Respond(r, false, errno); err != nil {
+			log.Errorf("answering execution of %s: %v", path, err)
+		}
+	}
+
+	// Unlike the paths of the fanotify events, the executed path can go through symlinks, like /bin/sh.
+	cntPath, err := canonicalPath(n.root(), r.Path)
+	if err != nil {
+		unavailable(r.Path, err)
+		return
+	}
+	path := filepath.Join(n.root(), cntPath)
+
+	if err := n.computeBaseline(); err != nil {
+		log.Errorf("error handling event: %v", err)
+		n.recordError(err)
+		answer(path, nil, events.VerdictDeny, "baseline failed", unix.EPERM)
+		return
+	}
+
+	if n.policy.Excludes(cntPath) {
+		answer(path, nil, events.VerdictAllow, "excluded", 0)
+		return
+	}
+
+	// The executions fail like on a noexec mount.
+	if decision, ok := n.currentPolicy().EvaluateNoExec(cntPath); ok {
+		answer(path, nil, verdictOf(decision), decision.Reason, unix.EACCES)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		unavailable(path, err)
+		return
+	}
+
+	// For the hard links of the executables of the baseline.
+	st := &unix.Stat_t{}
+	if err := unix.Fstat(int(f.Fd()), st); err != nil {
+		st = nil
+	}
+	format := n.identify(f, cntPath)
+
+	type result struct {
+		sum string
+		err error
+	}
+
+	sums := make(chan result, 1)
+	go func() {
+		defer f.Close()
+
+		sum, err := n.hashCached(hashpool.PriorityExec, f, cntPath)
+		sums <- result{sum, err}
+	}()
+
+	var sum result
+	select {
+	case sum = <-sums:
+	case <-deadline(n.responseDeadline):
+		failed(path, "verification deadline exceeded")
+		return
+	}
+
+	if sum.err != nil {
+		log.Errorf("calculating sha256sum of %s: %v", path, sum.err)
+		failed(path, "hashing failed")
+		return
+	}
+
+	verdict, reason, req := n.decide(r.PID, cntPath, sum.sum, st, format)
+	answer(path, req, verdict, reason, unix.EPERM)
+}
@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// openTreeClone is OPEN_TREE_CLONE, which x/sys does not have.
+const openTreeClone = 1
+
+// detachedRoot clones the mount of the rootfs of the container without attaching it anywhere, and returns the path of
+// the clone as seen from the agent with the function releasing it. The mounts below the rootfs are cloned too, for the
+// volumes walked with it. The files opened through the clone are on another
+// mount than the marked one: hashing them does not queue open events that the agent would only answer to itself. It
+// needs Linux 5.2.
+func (n *ContainerNotifier) detachedRoot() (string, func(), error) {
+	root, err := unix.BytePtrFromString("/")
+	if err != nil {
+		return "", nil, err
+	}
+
+	fd := -1
+	// Only the mounts of the current mount namespace can be cloned.
+	err = inMountNamespace(int(n.pid()), func() error {
+		dirfd := unix.AT_FDCWD
+		r, _, errno := unix.Syscall(unix.SYS_OPEN_TREE, uintptr(dirfd), uintptr(unsafe.Pointer(root)), openTreeClone|unix.AT_RECURSIVE|unix.O_CLOEXEC)
+		if errno != 0 {
+			return fmt.Errorf("cloning rootfs mount: %w", errno)
+		}
+
+		fd = int(r)
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	// The clone is unmounted once its last FD is closed.
+	return filepath.Join("/proc/self/fd", strconv.Itoa(fd)), func() { unix.Close(fd) }, nil
+}
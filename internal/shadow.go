@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	log "github.com/sirupsen/logrus"
+)
+
+// shadowOf returns the shadow policy of the container of the process with the counter of the decisions it took
+// differently, the policy is nil when there is none.
+func (n *ContainerNotifier) shadowOf(pid int) (*policy.ExecPolicy, *int64) {
+	if s := n.sharedContainerOf(pid); s != nil {
+		return s.Config.Shadow, &s.shadowDivergences
+	}
+
+	return n.shadow, &n.shadowDivergences
+}
+
+// evaluateShadow evaluates the shadow policy of the container of the process on the request, and reports when it
+// would not have taken the decision of the enforced policy. Only denying or not is compared, the shadow policy denying
+// in audit mode denies too.
+func (n *ContainerNotifier) evaluateShadow(pid int, req *policy.Request, verdict events.Verdict, reason string) {
+	shadow, divergences := n.shadowOf(pid)
+	if shadow == nil {
+		return
+	}
+
+	d := shadow.Evaluate(req)
+	denied := !d.Allow || d.Audited
+	if denied == (verdict != events.VerdictAllow) {
+		return
+	}
+
+	atomic.AddInt64(divergences, 1)
+
+	shadowVerdict := events.VerdictAllow
+	if denied {
+		shadowVerdict = events.VerdictDeny
+	}
+
+	log.Warnf("[SHADOW %s]:%s: %s (%s), %s by the enforced policy (%s)", strings.ToUpper(string(shadowVerdict)), n.cnt.Id, req.Path, d.Reason, verdict, reason)
+}
@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	"github.com/kinvolk/fanotify-poc/pkg/status"
+	pb "github.com/kinvolk/inspektor-gadget/pkg/gadgettracermanager/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// SharedContainer is a container enforced by the notifier of another container of its mount namespace. The marks of
+// the notifier already cover its files, only the decisions are its own.
+type SharedContainer struct {
+	Container *pb.ContainerDefinition
+	Config    *NotifierConfig
+
+	// cgroups tell its processes apart from the ones of the other containers of the mount namespace.
+	cgroups []string
+	volumes []volume
+	// shadowDivergences counts the decisions its shadow policy took differently.
+	shadowDivergences int64
+}
+
+// canShare tells if the notifier can enforce other containers, the eBPF LSM and the seccomp backends enforce a single
+// container, and inotify only watches the rootfs.
+func (n *ContainerNotifier) canShare() bool {
+	return n.bpf == nil && n.seccomp == nil && n.detection != DetectionInotify
+}
+
+// SharesMounts tells if the process is in the mount namespace of the container and can be enforced by its notifier.
+func (n *ContainerNotifier) SharesMounts(pid uint32) bool {
+	if !n.canShare() || pid == n.pid() {
+		return false
+	}
+
+	mntns, err := readMntns(int(pid))
+	if err != nil {
+		return false
+	}
+
+	cntMntns, err := readMntns(int(n.pid()))
+	if err != nil {
+		return false
+	}
+
+	return mntns == cntMntns
+}
+
+// Share makes the notifier decide on the executions of the other container of its mount namespace with the policy of
+// that container. The mode override of the notifier applies to it too.
+func (n *ContainerNotifier) Share(cnt *pb.ContainerDefinition, cfg *NotifierConfig) error {
+	cgroups, err := readCgroups(int(cnt.Pid))
+	if err != nil {
+		return fmt.Errorf("reading cgroups of container %s: %w", cnt.Id, err)
+	}
+
+	own, err := readCgroups(int(n.pid()))
+	if err != nil {
+		return fmt.Errorf("reading cgroups of container %s: %w", n.cnt.Id, err)
+	}
+
+	if inCgroups(cgroups, own) || inCgroups(own, cgroups) {
+		return fmt.Errorf("containers %s and %s can't be told apart by their cgroups", n.cnt.Id, cnt.Id)
+	}
+
+	// The files protected by its policy are not necessarily protected by the policy of the notifier.
+	if err := n.markToken(cfg.Policy); err != nil {
+		return fmt.Errorf("marking service account token: %w", err)
+	}
+
+	if err := n.markReads(cfg.Policy); err != nil {
+		return fmt.Errorf("marking protected files: %w", err)
+	}
+
+	if err := n.markImmutable(cfg.Policy); err != nil {
+		return fmt.Errorf("marking immutable rootfs: %w", err)
+	}
+
+	n.sharedLock.Lock()
+	defer n.sharedLock.Unlock()
+
+	if n.shared == nil {
+		n.shared = make(map[string]*SharedContainer)
+	}
+	n.shared[cnt.Id] = &SharedContainer{
+		Container: cnt,
+		Config:    cfg,
+		cgroups:   cgroups,
+		volumes:   containerVolumes(cfg.Policy, cfg.Pod, cfg.ContainerSpec),
+	}
+
+	log.Infof("container %s shares the mount namespace of container %s, enforcing it with the same notifier", cnt.Id, n.cnt.Id)
+	return nil
+}
+
+// unshare stops deciding on the executions of the container, it is false when the container was not shared.
+func (n *ContainerNotifier) unshare(cid string) bool {
+	n.sharedLock.Lock()
+	defer n.sharedLock.Unlock()
+
+	if _, ok := n.shared[cid]; !ok {
+		return false
+	}
+
+	delete(n.shared, cid)
+	return true
+}
+
+// sharedContainers returns the other containers enforced by the notifier.
+func (n *ContainerNotifier) sharedContainers() []*SharedContainer {
+	n.sharedLock.RLock()
+	defer n.sharedLock.RUnlock()
+
+	shared := make([]*SharedContainer, 0, len(n.shared))
+	for _, s := range n.shared {
+		shared = append(shared, s)
+	}
+
+	return shared
+}
+
+// sharedContainerOf returns the other container of the mount namespace the process is in, it is nil for the processes
+// of the container of the notifier.
+func (n *ContainerNotifier) sharedContainerOf(pid int) *SharedContainer {
+	n.sharedLock.RLock()
+	defer n.sharedLock.RUnlock()
+
+	if len(n.shared) == 0 {
+		return nil
+	}
+
+	cgroups, err := readCgroups(pid)
+	if err != nil {
+		// The process exited, its container does not matter anymore.
+		return nil
+	}
+
+	for _, s := range n.shared {
+		if inCgroups(cgroups, s.cgroups) {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// policyOf returns the policy of the container of the process with the mode overridden, and if the container is an
+// ephemeral one.
+func (n *ContainerNotifier) policyOf(pid int) (*policy.ExecPolicy, bool) {
+	if s := n.sharedContainerOf(pid); s != nil {
+		return n.withMode(s.Config.Policy, s.Config.Pod), s.Config.Ephemeral
+	}
+
+	return n.currentPolicy(), n.ephemeral
+}
+
+// sharedStatus returns the state of the other containers enforced by the notifier.
+func (n *ContainerNotifier) sharedStatus() []status.Container {
+	shared := n.sharedContainers()
+	if len(shared) == 0 {
+		return nil
+	}
+
+	own := n.Status()
+
+	cnts := []status.Container{}
+	for _, s := range shared {
+		cnt := own
+		cnt.ID = s.Container.Id
+		cnt.Policy = s.Config.Policy.Name
+		cnt.SharesMountsWith = own.ID
+		cnt.Namespace, cnt.Pod, cnt.PodUID, cnt.Name = "", "", "", ""
+		cnt.Unlisted = s.Config.Unlisted
+		cnt.ShadowPolicy = ""
+		if s.Config.Shadow != nil {
+			cnt.ShadowPolicy = s.Config.Shadow.Name
+		}
+		cnt.ShadowDivergences = int(atomic.LoadInt64(&s.shadowDivergences))
+
+		cnt.Mode = string(policy.ModeEnforce)
+		if mode := n.withMode(s.Config.Policy, s.Config.Pod).Spec.Mode; mode != "" {
+			cnt.Mode = string(mode)
+		}
+		cnt.OutOfCanary = !cnt.ModeOverride && n.outOfCanary(s.Config.Policy, s.Config.Pod)
+
+		if pod := s.Config.Pod; pod != nil {
+			cnt.Namespace = pod.Namespace
+			cnt.Pod = pod.Name
+			cnt.PodUID = string(pod.UID)
+		}
+
+		if s.Config.ContainerSpec != nil {
+			cnt.Name = s.Config.ContainerSpec.Name
+		}
+
+		cnts = append(cnts, cnt)
+	}
+
+	return cnts
+}
+
+// inCgroups tells if the cgroups of a process are the given ones, or below them.
+func inCgroups(cgroups, of []string) bool {
+	if len(cgroups) == 0 || len(cgroups) != len(of) {
+		return false
+	}
+
+	for i, cgroup := range cgroups {
+		if cgroup != of[i] && !strings.HasPrefix(cgroup, strings.TrimSuffix(of[i], "/")+"/") {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"sync/atomic"
+
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	"github.com/kinvolk/fanotify-poc/pkg/status"
+)
+
+func (n *ContainerNotifier) setBaselineReady() {
+	n.statusLock.Lock()
+	defer n.statusLock.Unlock()
+
+	n.baselineReady = true
+}
+
+func (n *ContainerNotifier) setBaselineProgress(hashed, total int) {
+	n.statusLock.Lock()
+	defer n.statusLock.Unlock()
+
+	n.baselineHashed = hashed
+	n.baselineFiles = total
+}
+
+func (n *ContainerNotifier) recordError(err error) {
+	n.statusLock.Lock()
+	defer n.statusLock.Unlock()
+
+	n.errors++
+	n.lastError = err.Error()
+}
+
+// Status returns the enforcement state of the container.
+func (n *ContainerNotifier) Status() status.Container {
+	pending, age := n.Backlog()
+	current := n.currentPolicy()
+	outOfCanary := n.outOfCanary(n.policy, n.pod)
+
+	n.statusLock.Lock()
+	defer n.statusLock.Unlock()
+
+	cnt := status.Container{
+		ID:            n.cnt.Id,
+		Policy:        n.policy.Name,
+		BaselineReady: n.baselineReady,
+		Errors:        n.errors,
+		LastError:     n.lastError,
+		OpenFDs:       int(atomic.LoadInt64(&n.openFDs)),
+
+		BaselineFiles:  n.baselineFiles,
+		BaselineHashed: n.baselineHashed,
+
+		Detection: n.detection,
+		Restarts:  n.restarts,
+
+		Mode:         string(policy.ModeEnforce),
+		ModeOverride: n.mode != "",
+
+		ReadOnly:   n.readOnly,
+		BreakGlass: n.breakGlass,
+
+		PendingEvents:  pending,
+		BacklogSeconds: age.Seconds(),
+		Backpressure:   n.backpressured(),
+
+		ShadowDivergences: int(atomic.LoadInt64(&n.shadowDivergences)),
+	}
+
+	if n.shadow != nil {
+		cnt.ShadowPolicy = n.shadow.Name
+	}
+
+	if current.Spec.Mode != "" {
+		cnt.Mode = string(current.Spec.Mode)
+	}
+	cnt.OutOfCanary = n.mode == "" && outOfCanary
+
+	if n.pod != nil {
+		cnt.Namespace = n.pod.Namespace
+		cnt.Pod = n.pod.Name
+		cnt.PodUID = string(n.pod.UID)
+		cnt.Unlisted = n.unlisted
+	}
+
+	if n.cntSpec != nil {
+		cnt.Name = n.cntSpec.Name
+	}
+
+	return cnt
+}
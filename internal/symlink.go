@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSymlinks is how many symlinks are followed when resolving a path, like the kernel does.
+const maxSymlinks = 40
+
+// canonicalPath resolves the symlinks of the path inside the container whose rootfs is seen from the host under root.
+// The absolute targets are relative to root and ".." never goes above it, so the files of the host can't be reached.
+// It returns the path inside the container without symlinks, like /usr/bin/sh for /bin/sh, which is how the baseline
+// and the fanotify events name the files.
+func canonicalPath(root, path string) (string, error) {
+	resolved := "/"
+	rest := path
+	links := 0
+
+	for rest != "" {
+		name := rest
+		rest = ""
+		if i := strings.IndexByte(name, '/'); i != -1 {
+			name, rest = name[:i], name[i+1:]
+		}
+
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, name)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+
+		if info.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("resolving %s: %w", path, unix.ELOOP)
+		}
+
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		rest = target + "/" + rest
+	}
+
+	return resolved, nil
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"github.com/kinvolk/fanotify-poc/pkg/baseline"
+	"github.com/kinvolk/fanotify-poc/pkg/hashpool"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	"github.com/s3rj1k/go-fanotify/fanotify"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// invalidSum is the sha256sum of the files removed from the baseline, it never matches.
+const invalidSum = ""
+
+// eventMask returns the events the marks report, the written files are only reported when the baseline follows them.
+func (n *ContainerNotifier) eventMask() uint64 {
+	if n.policy.Spec.BaselineUpdates != "" {
+		return n.execMask() | unix.FAN_CLOSE_WRITE
+	}
+
+	return n.execMask()
+}
+
+// handleWrite updates the baseline entry of the file closed after being written, according to the policy.
+func (n *ContainerNotifier) handleWrite(data *fanotify.EventMetadata) {
+	if cntMntns, ok := n.filesystemMntns(); ok {
+		// The process is often gone already, the write is then kept.
+		if mntns, err := readMntns(data.GetPID()); err == nil && mntns != cntMntns {
+			return
+		}
+	}
+
+	cntPath, err := data.GetPath()
+	if err != nil {
+		log.Errorf("getting written file path: %v", err)
+		return
+	}
+
+	if n.policy.Excludes(cntPath) {
+		return
+	}
+
+	n.baselineLock.RLock()
+	computed := !n.firstEvent
+	_, inBaseline := n.sha256Sums.Get(cntPath)
+	n.baselineLock.RUnlock()
+
+	// The baseline will be computed with the written file.
+	if !computed {
+		return
+	}
+
+	var st unix.Stat_t
+	if err := unix.Fstat(int(data.File().Fd()), &st); err != nil {
+		log.Errorf("getting status of written file %s: %v", cntPath, err)
+		return
+	}
+
+	// Most of the written files are not executables, nothing to update.
+	if !inBaseline && (st.Mode&unix.S_IFMT != unix.S_IFREG || st.Mode&0111 == 0) {
+		return
+	}
+
+	switch n.policy.Spec.BaselineUpdates {
+	case policy.UpdateFlag:
+		log.Infof("executable written in container %s, removing it from the baseline: %s", n.cnt.Id, cntPath)
+		n.setSum(cntPath, invalidSum)
+
+	case policy.UpdateTrust:
+		sum, err := n.hashCached(hashpool.PriorityBackground, data.File(), cntPath)
+		if err != nil {
+			log.Errorf("calculating sha256sum of written file %s: %v", cntPath, err)
+			n.setSum(cntPath, invalidSum)
+			return
+		}
+
+		log.Infof("executable written in container %s, trusting it: %s", n.cnt.Id, cntPath)
+		n.setSum(cntPath, sum)
+	}
+}
+
+// setSum updates a file of the baseline. The baseline shared with the other containers of the image, or on disk, is
+// overlaid with the updated files.
+func (n *ContainerNotifier) setSum(cntPath, sum string) {
+	n.baselineLock.Lock()
+	defer n.baselineLock.Unlock()
+
+	n.sumsChanged()
+	if files, ok := n.sha256Sums.(baseline.Map); ok && n.sharedBaseline == "" {
+		files[cntPath] = sum
+		return
+	}
+
+	overlay, ok := n.sha256Sums.(*baseline.Overlay)
+	if !ok {
+		overlay = &baseline.Overlay{Base: n.sha256Sums, Files: baseline.Map{}}
+		n.sha256Sums = overlay
+	}
+
+	overlay.Files[cntPath] = sum
+}
@@ -2,21 +2,47 @@
 package internal
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
-	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/containerd/containerd/oci"
+	"github.com/kinvolk/fanotify-poc/pkg/baseline"
+	"github.com/kinvolk/fanotify-poc/pkg/bpflsm"
 	"github.com/kinvolk/fanotify-poc/pkg/containerd"
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/hashpool"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	"github.com/kinvolk/fanotify-poc/pkg/seccomp"
 	pb "github.com/kinvolk/inspektor-gadget/pkg/gadgettracermanager/api"
 	"github.com/s3rj1k/go-fanotify/fanotify"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// ParanoidHigh hashes the executed files every time.
+	ParanoidHigh = "high"
+	// ParanoidLow does not hash the files allowed before again as long as their size, change time and inode are the
+	// same.
+	ParanoidLow = "low"
+)
+
+const (
+	// MarkModeMount marks the mount of the container rootfs.
+	MarkModeMount = "mount"
+	// MarkModeNamespace marks all the mounts of the container from inside its mount namespace.
+	MarkModeNamespace = "namespace"
+	// MarkModeFilesystem marks the whole filesystem of the container rootfs, i.e. its overlayfs, so its files can't
+	// be run through another mount of it. It needs Linux 4.20.
+	MarkModeFilesystem = "filesystem"
 )
 
 type Container struct {
@@ -24,19 +50,214 @@ type Container struct {
 	*oci.Spec
 }
 
+// NotifierConfig is what is known about the container from Kubernetes when it is attached.
+type NotifierConfig struct {
+	Pod           *v1.Pod
+	ContainerSpec *v1.Container
+	Policy        *policy.ExecPolicy
+	// Shadow is evaluated alongside Policy without deciding, nil when the policy has no shadow.
+	Shadow *policy.ExecPolicy
+	// Canaries has the canary percentages of the policies changed at runtime.
+	Canaries *Canaries
+	// Unlisted is set when the container is not in the spec of the pod, ContainerSpec only has its name then.
+	Unlisted  bool
+	Ephemeral bool
+	MarkMode  string
+
+	// Baselines has the imported baselines, the one of the image of the container is used instead of walking its
+	// rootfs.
+	Baselines *baseline.Store
+
+	// OnDecision is called with every decision taken on the executions of the container.
+	OnDecision func(*events.Event)
+
+	// FDBudget only audits the denials when the agent is running out of file descriptors.
+	FDBudget *FDBudget
+
+	// HashPool is shared by all the containers of the node.
+	HashPool *hashpool.Pool
+	// BaselineCache shares the baselines computed from the rootfs between the containers of the same image.
+	BaselineCache *baseline.Cache
+	// WarmBaselines has the baselines computed from the images pulled, used instead of walking the rootfs.
+	WarmBaselines *baseline.WarmCache
+	// BaselineTables keeps the large baselines on disk, they are kept in memory without it.
+	BaselineTables *baseline.Tables
+	// ParanoidLevel is ParanoidHigh to hash the files on every execution.
+	ParanoidLevel string
+	// XattrCache keeps the sha256sums of the files in their xattrs in the overlayfs layers of the rootfs.
+	XattrCache bool
+	// BaselineWorkers is how many files of the rootfs are hashed at once when computing the baseline.
+	BaselineWorkers int
+	// KernelAudit makes the kernel write an audit record for every denied execution.
+	KernelAudit bool
+	// InitFanotify initializes the fanotify group of the container, nil for a group of the kernel.
+	InitFanotify InitGroup
+	// Runtime is where the container is looked up, nil for the containerd socket.
+	Runtime containerd.Runtime
+	// AnalyzeBinaries looks for what is suspicious in the executed binaries which don't match the baseline.
+	AnalyzeBinaries bool
+	// ImmutableRootfs enforces the immutableRootfs of the policies, every open of the files of the rootfs waits for
+	// the agent then.
+	ImmutableRootfs bool
+	// BPF enforces the container with the eBPF LSM programs instead of fanotify when it is set.
+	BPF *bpflsm.Enforcer
+	// Seccomp answers the seccomp user notifications of the container instead of fanotify when it is set.
+	Seccomp *seccomp.Agent
+	// HandedOff is the fanotify group of the container taken over from the previous agent, if any.
+	HandedOff *HandedOff
+
+	// ResponseDeadline is how long an execution can wait for its file to be verified, 0 to wait as long as it takes.
+	ResponseDeadline time.Duration
+
+	// PreStartRootFS is the path of the rootfs of the container attached by the OCI hook, before its main process
+	// runs and pivots to it. The path is resolved in the mount namespace of the container.
+	PreStartRootFS string
+}
+
+// runtime returns the runtime the container is looked up in.
+func (c *NotifierConfig) runtime() containerd.Runtime {
+	if c.Runtime == nil {
+		return &containerd.Containerd{Namespace: containerd.ContainerdNamespace}
+	}
+
+	return c.Runtime
+}
+
 type ContainerNotifier struct {
-	NotifyFD   *fanotify.NotifyFD
+	// NotifyFD is nil in the inotify detection-only mode.
+	NotifyFD   Group
 	cnt        *Container
-	firstEvent bool
-	sha256Sums map[string]string
+	pod        *v1.Pod
+	cntSpec    *v1.Container
+	unlisted   bool
+	probeSums  map[string]string
+	policy     *policy.ExecPolicy
+	ephemeral  bool
+	onDecision func(*events.Event)
+	markMode   string
+	fdBudget   *FDBudget
+	hashPool   *hashpool.Pool
+
+	// volumes are the volumes of the container handled by a volume rule of the policy.
+	volumes []volume
+
+	baselineWorkers int
+
+	xattrCache      bool
+	kernelAudit     bool
+	analyzeBinaries bool
+	immutableRootfs bool
+
+	// allowedFiles are the files allowed before with their metadata at the time, with the low paranoid level they
+	// are not hashed again while it does not change. It is only used by the event loop.
+	paranoidLevel string
+	allowedFiles  map[fileID]allowedFile
+	// layers are the overlayfs layers of the rootfs where the sha256sums are cached, from the top to the bottom.
+	layers []string
+
+	responseDeadline time.Duration
+
+	// With the eBPF LSM backend, the container is found by its cgroup.
+	bpf      *bpflsm.Enforcer
+	cgroupID uint64
+	seccomp  *seccomp.Agent
+
+	// detection is the detection-only mode when the permission events are not available, empty when enforcing.
+	detection string
+	// In the inotify mode, watches are the directories watched in the container by watch descriptor.
+	inotify     *os.File
+	watchesLock sync.Mutex
+	watches     map[int]string
+
+	// openFDs counts the fanotify or inotify FD, the FDs of the events being handled and the ones of the mount watcher.
+	openFDs int64
+	// bufferedEvents are the events read from the fanotify FD which are not handled yet.
+	bufferedEvents int64
+	// behind is set while the notifier is falling behind, backpressure when its denials are only audited then.
+	behind       int32
+	backpressure int32
+
+	canaries *Canaries
+
+	// shadow is the shadow policy of the container, shadowDivergences counts the decisions it took differently.
+	shadow            *policy.ExecPolicy
+	shadowDivergences int64
+
+	// These are the mounts of the container already seen, the new ones are marked when they appear.
+	mountIDs map[int]bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// pause stops the event loop and the mount watcher for the handoff to a new agent, they close stopped and
+	// mountsStopped then.
+	pause         chan struct{}
+	stopped       chan struct{}
+	mountsStopped chan struct{}
+
+	image       string
+	imageDigest string
+	// imageSums are the files of the imported baseline of the image, if any.
+	imageSums map[string]string
+
+	// The main process of the container changes when it is restarted, these are updated then.
+	procLock   sync.RWMutex
 	rootFSPath string
+	// When the filesystem is marked, the events of the processes outside of the container mount namespace are
+	// received too.
+	filesystemMark bool
+	mntns          uint64
+	// preStart is set while the container attached by the OCI hook has not pivoted to its rootfs yet, rootFSPath is
+	// the rootfs in the mount namespace of the container then.
+	preStart bool
+
+	// The baseline can be imported while the events are handled.
+	baselineLock sync.RWMutex
+	firstEvent   bool
+	// sha256Sums can be shared with the other containers of the image, it is overlaid instead of being modified.
+	sha256Sums baseline.Sums
+	// sharedBaseline is the key of sha256Sums in the baseline cache when it is shared.
+	sharedBaseline string
+	baselineCache  *baseline.Cache
+	// inodes are the paths of the executables of the rootfs by inode, for their hard links made later.
+	inodes map[baseline.Inode]string
+	// baselineTree is the Merkle tree of sha256Sums, computed when it is asked for. sumsVersion changes with
+	// sha256Sums.
+	baselineTree *baseline.Tree
+	sumsVersion  int
+
+	// These are read when reporting the status.
+	statusLock     sync.Mutex
+	baselineReady  bool
+	baselineFiles  int
+	baselineHashed int
+	errors         int
+	lastError      string
+	// busy is the permission event being handled, for the watchdog.
+	busy     busyEvent
+	restarts int
+	// behindSince is when the notifier last had nothing pending, as of the last look at its backlog.
+	behindSince time.Time
+	// mode overrides the mode of the policy when it is set.
+	mode policy.Mode
+	// remounted is set once the mounts were remounted read-only after the pod was ready, even if it failed.
+	// breakGlass is set when they were made writable again through the admin API.
+	remounted  bool
+	readOnly   bool
+	breakGlass bool
+
+	// shared are the other containers of the mount namespace enforced by the notifier, by ID.
+	sharedLock sync.RWMutex
+	shared     map[string]*SharedContainer
+
+	// cfg is kept to restart the notifier.
+	cfg *NotifierConfig
 }
 
 func (n *ContainerNotifier) markDirs(paths []string) error {
 	for _, path := range paths {
-		err := n.NotifyFD.Mark(unix.FAN_MARK_ADD|unix.FAN_MARK_MOUNT, unix.FAN_OPEN_EXEC_PERM|unix.FAN_EVENT_ON_CHILD, unix.AT_FDCWD, path)
+		err := n.NotifyFD.Mark(unix.FAN_MARK_ADD|unix.FAN_MARK_MOUNT, n.eventMask()|unix.FAN_EVENT_ON_CHILD, unix.AT_FDCWD, path)
 		if err != nil {
-			n.NotifyFD.File.Close()
 			log.Errorf("Marking %q: %s", path, err)
 			return err
 		}
@@ -49,9 +270,8 @@ func (n *ContainerNotifier) markDirs(paths []string) error {
 
 func (n *ContainerNotifier) markFiles(paths []string) error {
 	for _, path := range paths {
-		err := n.NotifyFD.Mark(unix.FAN_MARK_ADD, unix.FAN_OPEN_EXEC_PERM, unix.AT_FDCWD, path)
+		err := n.NotifyFD.Mark(unix.FAN_MARK_ADD, n.execMask(), unix.AT_FDCWD, path)
 		if err != nil {
-			n.NotifyFD.File.Close()
 			log.Errorf("Marking %q: %s", path, err)
 			return err
 		}
@@ -62,14 +282,61 @@ func (n *ContainerNotifier) markFiles(paths []string) error {
 	return nil
 }
 
-// path looks like this: /proc/49190/root/usr/bin/touch
-func (n *ContainerNotifier) ignoreMountPath(path string) bool {
-	// Here the path looks like: /usr/bin/touch
-	path = strings.TrimPrefix(path, n.rootFSPath)
+// markFilesystem marks the filesystem of the rootfs instead of its mount. The host mounts are still marked by mount,
+// otherwise the executions of the whole host filesystem would be reported.
+func (n *ContainerNotifier) markFilesystem() error {
+	mntns, err := readMntns(int(n.pid()))
+	if err != nil {
+		return err
+	}
+
+	root := n.root()
+
+	err = n.NotifyFD.Mark(unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, n.eventMask()|unix.FAN_EVENT_ON_CHILD, unix.AT_FDCWD, root)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Marking filesystem of %q: done", root)
+
+	n.procLock.Lock()
+	n.filesystemMark = true
+	n.mntns = mntns
+	n.procLock.Unlock()
+
+	return nil
+}
+
+// markExcluded sets ignore masks on the excluded files of the policy, so their executions are not even reported. The
+// directories can't be excluded this way as the ignore mask would only apply to the directory itself.
+func (n *ContainerNotifier) markExcluded() {
+	root := n.root()
 
+	for _, path := range n.policy.ExcludedFiles() {
+		path = filepath.Join(root, path)
+
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		// The mask survives modifications, otherwise it is cleared when the file is written.
+		err = n.NotifyFD.Mark(unix.FAN_MARK_ADD|unix.FAN_MARK_IGNORED_MASK|unix.FAN_MARK_IGNORED_SURV_MODIFY, n.eventMask(), unix.AT_FDCWD, path)
+		if err != nil {
+			// The executions are still allowed when they are reported.
+			log.Errorf("Excluding %q: %s", path, err)
+			continue
+		}
+
+		log.Infof("Excluding %q: done", path)
+	}
+}
+
+// path looks like this: /usr/bin/touch
+func (n *ContainerNotifier) ignoreMountPath(path string) bool {
 	for _, mnt := range n.cnt.Mounts {
-		// Check if the path starts with one of the mount paths.
-		if strings.HasPrefix(path, mnt.Destination) {
+		// Check if the path is below one of the mount paths.
+		if policy.InDir(path, mnt.Destination) {
 			return true
 		}
 	}
@@ -79,183 +346,459 @@ func (n *ContainerNotifier) ignoreMountPath(path string) bool {
 
 func (n *ContainerNotifier) handleEvent() (bool, error) {
 	// This is a blocking call.
-	data, err := n.NotifyFD.GetEvent(os.Getpid())
+	if !n.waitEvent() {
+		return true, errHandedOff
+	}
+
+	data, err := n.NotifyFD.NextEvent()
 	if err != nil {
 		return true, fmt.Errorf("getting event: %w", err)
 	}
 
-	if data == nil {
+	atomic.AddInt64(&n.openFDs, 1)
+	n.countBuffered()
+
+	// The file is kept open when it is still being hashed after the deadline.
+	verifyingLate := false
+	defer func() {
+		if !verifyingLate {
+			n.closeEvent(data)
+		}
+	}()
+
+	// The agent opens the files of the protected directories when hashing them, it would wait for itself forever if
+	// its own opens were not answered.
+	if data.GetPID() == os.Getpid() {
+		if !data.MatchMask(unix.FAN_CLOSE_WRITE) {
+			n.allowEvent(data)
+		}
+		return false, nil
+	}
+
+	n.setBusy(data.GetPID(), "reading the event")
+	defer n.setIdle()
+
+	if data.MatchMask(unix.FAN_CLOSE_WRITE) {
+		// Nothing waits for these.
+		n.handleWrite(data)
+		return false, nil
+	}
+
+	// The opens of the protected files and of the immutable rootfs are not executions, the exec of a file is reported
+	// with FAN_OPEN_EXEC_PERM in another event.
+	if data.MatchMask(unix.FAN_OPEN_PERM) || data.MatchMask(unix.FAN_ACCESS_PERM) {
+		n.setStage("answering the open of a file")
+		n.handleOpen(data)
 		return false, nil
 	}
 
-	defer data.Close()
-
-	// TODO: What if the container was already started, so any modifications done to the container FS won't be encountered here.
-	if n.firstEvent {
-		log.Infof("first notification received, walking over %s", n.rootFSPath)
-
-		// Make a list of all the executables in the rootfs and create a map of file path and its SHA256
-		// store this map in the object.
-		// NOTE: If there is no trailing front slash then this function does not walk on the dir.
-		err := filepath.WalkDir(n.rootFSPath+"/",
-			func(path string, dirEntry os.DirEntry, err error) error {
-				if err != nil && os.IsNotExist(err) {
-					return nil
-				} else if err != nil {
-					return fmt.Errorf("default error: %v", err)
-				}
-
-				// Figure out if the file is not a dir.
-				// Calculate its SHA256sum.
-				if dirEntry.IsDir() {
-					return nil
-				}
-
-				info, err := dirEntry.Info()
-				if err != nil && os.IsNotExist(err) {
-					return nil
-				} else if err != nil {
-					return fmt.Errorf("getting info: %w", err)
-				}
-
-				// Ignore the mounted volumes checks.
-				if n.ignoreMountPath(path) {
-					return nil
-				}
-
-				// Ignore sym-links.
-				if info.Mode()&fs.ModeSymlink != 0 {
-					return nil
-				}
-
-				// Check if the file is neither user executabe (0100) nor group executable (0010) nor other executable (0001).
-				// We don't have any concern for non-executables.
-				if !(info.Mode()&0100 != 0 || info.Mode()&0010 != 0 || info.Mode()&0001 != 0) {
-					return nil
-				}
-
-				sha256sum, err := calculateSHA256Sum(path)
-				if err != nil {
-					return fmt.Errorf("calculating sha256sum of %s: %w", path, err)
-				}
-
-				n.sha256Sums[path] = sha256sum
-
-				return nil
-			})
+	if cntMntns, ok := n.filesystemMntns(); ok {
+		n.setStage("reading the mount namespace")
+		mntns, err := readMntns(data.GetPID())
 		if err != nil {
-			return false, fmt.Errorf("walking the container rootfs: %w", err)
+			n.denyEvent(data)
+			return false, err
+		}
+
+		if mntns != cntMntns {
+			log.Debugf("allowing execution from outside of container %s: pid %d", n.cnt.Id, data.GetPID())
+			n.allowEvent(data)
+			return false, nil
 		}
+	}
 
-		n.firstEvent = false
+	n.setStage("computing the baseline")
+	if err := n.computeBaseline(); err != nil {
+		// The event has to be answered or the process hangs.
+		n.denyEvent(data)
+		return false, err
 	}
 
 	// The path will look like this:
 	// /usr/bin/touch
+	// The kernel resolved the symlinks, like the baseline it has none.
 	path, err := data.GetPath()
 	if err != nil {
 		log.Errorf("getting file path: %v", err)
-		n.NotifyFD.ResponseDeny(data)
+		n.denyEvent(data)
 		return false, nil
 	}
 
 	// This will look something like this:
 	// /proc/49190/root/usr/bin/touch
-	path = filepath.Join(n.rootFSPath, path)
+	cntPath := path
+	path = filepath.Join(n.root(), path)
 
-	currentSum, err := calculateSHA256SumWithFileObject(data.File())
-	if err != nil {
-		log.Errorf("calculating sha256sum of %s: %v", path, err)
-		log.Infof("[DENY]:%s: %s", n.cnt.Id, path)
-		n.NotifyFD.ResponseDeny(data)
+	p, _ := n.policyOf(data.GetPID())
+	if p.Excludes(cntPath) {
+		n.respond(data, path, nil, events.VerdictAllow, "excluded")
 		return false, nil
 	}
 
-	predeterminedSum, ok := n.sha256Sums[path]
-	if !ok {
-		// This means it is a new file that is called for execution so deny it.
-		log.Infof("[DENY]:%s: %s", n.cnt.Id, path)
-		n.NotifyFD.ResponseDeny(data)
+	// Nothing has to be hashed to deny them.
+	if decision, ok := p.EvaluateNoExec(cntPath); ok {
+		if verdict := verdictOf(decision); verdict == events.VerdictDeny {
+			n.deny(data, path, nil, decision.Reason)
+		} else {
+			n.respond(data, path, nil, verdict, decision.Reason)
+		}
 		return false, nil
 	}
 
-	if predeterminedSum != currentSum {
-		// This means that the file was modified.
-		log.Infof("[DENY]:%s: %s", n.cnt.Id, path)
-		n.NotifyFD.ResponseDeny(data)
+	if verdict, reason, ok := n.volumeVerdict(data.GetPID(), cntPath); ok {
+		if verdict == events.VerdictDeny {
+			n.deny(data, path, nil, reason)
+		} else {
+			n.respond(data, path, nil, verdict, reason)
+		}
 		return false, nil
 	}
 
-	log.Infof("[ALLOW]:%s: %s", n.cnt.Id, path)
-	n.NotifyFD.ResponseAllow(data)
+	n.setStage("hashing " + cntPath)
+	st, sum := n.fastPath(data.File())
+	if sum.sum == "" {
+		sums := n.hash(data, cntPath)
+
+		select {
+		case sum = <-sums:
+		case <-deadline(n.responseDeadline):
+			n.failed(data, path, "verification deadline exceeded")
+
+			verifyingLate = true
+			go n.verifyLate(data, path, cntPath, sums)
+			return false, nil
+		}
+	}
+
+	if sum.err != nil {
+		log.Errorf("calculating sha256sum of %s: %v", path, sum.err)
+		n.failed(data, path, "hashing failed")
+		return false, nil
+	}
+
+	n.setStage("evaluating the policy on " + cntPath)
+	if st == nil {
+		st = eventStat(data)
+	}
+
+	verdict, reason, req := n.decide(data.GetPID(), cntPath, sum.sum, st, n.identify(fdReaderAt(data.Fd), cntPath))
+	if verdict == events.VerdictDeny {
+		n.deny(data, path, req, reason)
+	} else {
+		n.respond(data, path, req, verdict, reason)
+	}
+
+	if verdict == events.VerdictAllow {
+		n.rememberAllowed(st, sum.sum)
+	}
+
 	return false, nil
 }
 
+// deny denies the execution, unless the agent is running out of file descriptors, the notifier is falling behind or it
+// only detects the executions.
+func (n *ContainerNotifier) deny(data *fanotify.EventMetadata, path string, req *policy.Request, reason string) {
+	if n.detection != "" {
+		n.detected(data, path, req, reason)
+		return
+	}
+
+	if degraded := n.degraded(); degraded != "" {
+		n.respond(data, path, req, events.VerdictAudit, degraded+", "+reason)
+		return
+	}
+
+	n.respond(data, path, req, events.VerdictDeny, reason)
+}
+
+// respond answers the permission event, then logs and reports the decision. req is nil when the policy was not
+// evaluated.
+func (n *ContainerNotifier) respond(data *fanotify.EventMetadata, path string, req *policy.Request, verdict events.Verdict, reason string) {
+	event := n.event(data.GetPID(), path, req, verdict, reason)
+
+	executed := path
+	if req != nil && req.Interpreter != "" {
+		executed += " run by " + req.Interpreter
+	}
+	log.Infof("[%s]:%s: %s (%s)", strings.ToUpper(string(verdict)), event.ContainerID, executed, reason)
+
+	if verdict == events.VerdictDeny {
+		n.denyEvent(data)
+	} else {
+		n.allowEvent(data)
+	}
+
+	n.report(event)
+}
+
+// event returns the decision taken on the execution of the file by the process.
+func (n *ContainerNotifier) event(pid int, path string, req *policy.Request, verdict events.Verdict, reason string) *events.Event {
+	event := &events.Event{
+		Time:        time.Now(),
+		ContainerID: n.cnt.Id,
+		Policy:      n.policy.Name,
+		Path:        strings.TrimPrefix(path, n.root()),
+		PID:         pid,
+		Verdict:     verdict,
+		Reason:      reason,
+		Drift:       req != nil && req.Baseline != policy.BaselineMatch,
+		Request:     req,
+	}
+
+	if n.pod != nil {
+		event.Namespace = n.pod.Namespace
+		event.Pod = n.pod.Name
+	}
+
+	if n.cntSpec != nil {
+		event.Container = n.cntSpec.Name
+	}
+
+	// The other containers of the mount namespace are reported as themselves.
+	if s := n.sharedContainerOf(pid); s != nil {
+		event.ContainerID = s.Container.Id
+		event.Policy = s.Config.Policy.Name
+		event.Namespace, event.Pod, event.Container = "", "", ""
+		if s.Config.Pod != nil {
+			event.Namespace = s.Config.Pod.Namespace
+			event.Pod = s.Config.Pod.Name
+		}
+		if s.Config.ContainerSpec != nil {
+			event.Container = s.Config.ContainerSpec.Name
+		}
+	}
+
+	return event
+}
+
+func (n *ContainerNotifier) report(event *events.Event) {
+	if n.onDecision != nil {
+		n.onDecision(event)
+	}
+}
+
 func WatchContainerFANotifyEvents(notifier *ContainerNotifier) {
+	if notifier.bpf != nil {
+		// Nothing is marked.
+		notifier.enforceBPF()
+		return
+	}
+
+	if notifier.seccomp != nil {
+		notifier.watchSeccomp()
+		return
+	}
+
+	go notifier.watchMounts()
+
+	if notifier.detection == DetectionInotify {
+		notifier.watchInotify()
+		return
+	}
+
 	for {
 		stop, err := notifier.handleEvent()
+		if errors.Is(err, errHandedOff) {
+			// The fanotify FD is kept open for the new agent.
+			close(notifier.stopped)
+			return
+		}
+
 		if err != nil {
 			log.Errorf("error handling event: %v", err)
+			notifier.recordError(err)
 		}
 
 		if stop {
-			notifier.NotifyFD.File.Close()
+			notifier.Close()
 			return
 		}
 
 	}
 }
 
-func calculateSHA256Sum(path string) (string, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return "", fmt.Errorf("opening file: %w", err)
-	}
-	defer f.Close()
-
-	return calculateSHA256SumWithFileObject(f)
-}
-
-func calculateSHA256SumWithFileObject(f *os.File) (string, error) {
-	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return "", fmt.Errorf("copying data: %w", err)
-	}
+// Close stops enforcing the container.
+func (n *ContainerNotifier) Close() {
+	n.closeOnce.Do(func() {
+		close(n.done)
+		if n.NotifyFD != nil {
+			n.NotifyFD.Close()
+		} else if n.inotify != nil {
+			n.inotify.Close()
+		}
 
-	return hex.EncodeToString(h.Sum(nil)), nil
+		n.baselineLock.Lock()
+		n.releaseBaseline()
+		n.baselineLock.Unlock()
+	})
 }
 
-func NewContainerNotifier(cntIG *pb.ContainerDefinition) (*ContainerNotifier, error) {
-	oci, err := containerd.GetOCISpec(cntIG.Id, containerd.ContainerdNamespace)
+func NewContainerNotifier(cntIG *pb.ContainerDefinition, cfg *NotifierConfig) (*ContainerNotifier, error) {
+	oci, err := ociSpec(cfg.runtime(), cntIG.Id)
 	if err != nil {
 		return nil, fmt.Errorf("getting containerd definition of container: %v", err)
 	}
 
 	cnt := getContainer(cntIG, oci)
 
-	fanotifyFlags := uint(unix.FAN_CLASS_CONTENT | unix.FAN_UNLIMITED_QUEUE | unix.FAN_UNLIMITED_MARKS)
-	openFlags := os.O_RDONLY | unix.O_LARGEFILE | unix.O_CLOEXEC
-
-	containerNotify, err := fanotify.Initialize(fanotifyFlags, openFlags)
-	if err != nil {
-		return nil, err
+	var containerNotify Group
+	detection := ""
+	if cfg.HandedOff != nil {
+		containerNotify, detection = cfg.HandedOff.notifyFD, cfg.HandedOff.state.Detection
+	} else if cfg.BPF == nil && cfg.Seccomp == nil {
+		if containerNotify, detection, err = initFanotify(cfg.InitFanotify, cfg.KernelAudit); err != nil {
+			return nil, err
+		}
 	}
 
 	n := &ContainerNotifier{
 		cnt:        cnt,
+		pod:        cfg.Pod,
+		cntSpec:    cfg.ContainerSpec,
+		unlisted:   cfg.Unlisted,
 		firstEvent: true,
-		sha256Sums: make(map[string]string),
+		sha256Sums: baseline.Map{},
+		probeSums:  make(map[string]string),
+		policy:     cfg.Policy,
+		shadow:     cfg.Shadow,
+		canaries:   cfg.Canaries,
+		ephemeral:  cfg.Ephemeral,
+		volumes:    containerVolumes(cfg.Policy, cfg.Pod, cfg.ContainerSpec),
+		onDecision: cfg.OnDecision,
+		markMode:   cfg.MarkMode,
+		fdBudget:   cfg.FDBudget,
+		hashPool:   cfg.HashPool,
+		openFDs:    1,
 		NotifyFD:   containerNotify,
+		done:       make(chan struct{}),
+
+		pause:         make(chan struct{}),
+		stopped:       make(chan struct{}),
+		mountsStopped: make(chan struct{}),
+
+		rootFSPath: procRoot(cnt.Pid),
+
+		responseDeadline: cfg.ResponseDeadline,
+		baselineWorkers:  cfg.BaselineWorkers,
+		baselineCache:    cfg.BaselineCache,
+		xattrCache:       cfg.XattrCache,
+		kernelAudit:      cfg.KernelAudit,
+		analyzeBinaries:  cfg.AnalyzeBinaries,
+		immutableRootfs:  cfg.ImmutableRootfs,
+		paranoidLevel:    cfg.ParanoidLevel,
+		allowedFiles:     make(map[fileID]allowedFile),
+		detection:        detection,
+		bpf:              cfg.BPF,
+		seccomp:          cfg.Seccomp,
+		cfg:              cfg,
+	}
+
+	if cfg.PreStartRootFS != "" {
+		n.rootFSPath = filepath.Join(n.rootFSPath, cfg.PreStartRootFS)
+		n.preStart = true
+	}
+
+	if n.bpf != nil {
+		// There is no fanotify FD.
+		n.openFDs = 0
+		if n.cgroupID, err = cgroupID(int(cnt.Pid)); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.seccomp != nil {
+		// The notification FD is counted once the runtime sends it.
+		n.openFDs = 0
+	}
 
-		// This path looks something like this:
-		// /proc/49190/root
-		rootFSPath: filepath.Join("/proc", fmt.Sprintf("%d", cnt.Pid), "root"),
+	switch detection {
+	case DetectionFanotify:
+		log.Warnf("permission events not available, only detecting the executions of container %s", cnt.Id)
+		// Nothing waits for the verdicts.
+		n.responseDeadline = 0
+	case DetectionInotify:
+		log.Warnf("fanotify not available, only detecting the executables written in container %s", cnt.Id)
+		if err := n.initInotify(); err != nil {
+			return nil, err
+		}
 	}
 
-	markFolders := []string{n.rootFSPath}
+	if cfg.HandedOff != nil {
+		n.adopt(cfg.HandedOff)
+	} else if err := n.mark(); err != nil {
+		n.Close()
+		return nil, err
+	}
+
+	if n.xattrCache {
+		// The sha256sums are still read from the xattrs, they are just not cached anymore.
+		if n.layers, err = readLayers(cnt.Pid); err != nil {
+			log.Warnf("reading overlayfs layers of container %s: %v", cnt.Id, err)
+		}
+	}
+
+	if err := n.hashProbeBinaries(cfg.ContainerSpec); err != nil {
+		n.Close()
+		return nil, fmt.Errorf("hashing exec probe binaries: %w", err)
+	}
+
+	if cfg.HandedOff == nil || cfg.HandedOff.state.Baseline == nil {
+		n.loadImageBaseline(cfg.Baselines)
+	}
+
+	return n, nil
+}
+
+// mark places the marks on the container according to the mark mode.
+func (n *ContainerNotifier) mark() error {
+	if n.bpf != nil || n.seccomp != nil {
+		return nil
+	}
+
+	if n.detection == DetectionInotify {
+		if err := n.recordMounts(); err != nil {
+			log.Warnf("reading mounts of container %s, the new ones won't be watched: %v", n.cnt.Id, err)
+		}
+
+		return n.watchTree(n.root())
+	}
+
+	root := n.root()
+
+	markFolders := []string{}
 	markFiles := []string{}
 
-	for _, mnt := range cnt.Mounts {
+	switch n.markMode {
+	case MarkModeNamespace:
+		// All the mounts are new for a restarted container.
+		n.mountIDs = nil
+		if err := n.markNamespaceMounts(); err != nil {
+			return fmt.Errorf("marking mounts: %w", err)
+		}
+
+	case MarkModeFilesystem:
+		if err := n.markFilesystem(); err != nil {
+			log.Warnf("marking filesystem of container %s, marking its mount instead: %v", n.cnt.Id, err)
+			markFolders = append(markFolders, root)
+		}
+
+	default:
+		markFolders = append(markFolders, root)
+	}
+
+	if n.markMode != MarkModeNamespace {
+		// The mounts which are there already are marked below, only the later ones are marked from the namespace.
+		if err := n.recordMounts(); err != nil {
+			log.Warnf("reading mounts of container %s, the new ones won't be marked: %v", n.cnt.Id, err)
+		}
+	}
+
+	for _, mnt := range n.cnt.Mounts {
+		if n.markMode == MarkModeNamespace {
+			// They were all marked from the namespace.
+			break
+		}
+
 		// Ignore list
 		switch mnt.Destination {
 		case "/dev/shm", "/var/run/secrets/kubernetes.io/serviceaccount":
@@ -266,21 +809,54 @@ func NewContainerNotifier(cntIG *pb.ContainerDefinition) (*ContainerNotifier, er
 			continue
 		}
 
-		// Also mark the host mounted dirs.
-		if mnt.Type == "bind" {
+		// Also mark the host mounted dirs, unless the policy ignores them.
+		if mnt.Type == "bind" && !n.ignoresVolume(mnt.Destination) {
 			markFolders = append(markFolders, mnt.Source)
 		}
 	}
 
 	if err := n.markDirs(markFolders); err != nil {
-		return nil, fmt.Errorf("marking dirs: %w", err)
+		return fmt.Errorf("marking dirs: %w", err)
 	}
 
 	if err := n.markFiles(markFiles); err != nil {
-		return nil, fmt.Errorf("marking files: %w", err)
+		return fmt.Errorf("marking files: %w", err)
 	}
 
-	return n, nil
+	n.markExcluded()
+
+	if err := n.markToken(n.policy); err != nil {
+		return fmt.Errorf("marking service account token: %w", err)
+	}
+
+	if err := n.markReads(n.policy); err != nil {
+		return fmt.Errorf("marking protected files: %w", err)
+	}
+
+	if err := n.markImmutable(n.policy); err != nil {
+		return fmt.Errorf("marking immutable rootfs: %w", err)
+	}
+
+	return nil
+}
+
+// ociSpecBackoff is how the OCI spec of a container is looked up again, the runtime may not have it yet when the
+// container is seen starting.
+var ociSpecBackoff = wait.Backoff{Duration: 100 * time.Millisecond, Factor: 2, Steps: 6}
+
+func ociSpec(runtime containerd.Runtime, cntID string) (*oci.Spec, error) {
+	var spec *oci.Spec
+	var err error
+	wait.ExponentialBackoff(ociSpecBackoff, func() (bool, error) {
+		if spec, err = runtime.OCISpec(cntID); err != nil {
+			log.Debugf("getting OCI spec of container %s, retrying: %v", cntID, err)
+			return false, nil
+		}
+
+		return true, nil
+	})
+
+	return spec, err
 }
 
 func getContainer(cntIG *pb.ContainerDefinition, oci *oci.Spec) *Container {
@@ -288,3 +864,29 @@ func getContainer(cntIG *pb.ContainerDefinition, oci *oci.Spec) *Container {
 		cntIG, oci,
 	}
 }
+
+// loadImageBaseline uses the imported baseline of the image of the container, if any.
+func (n *ContainerNotifier) loadImageBaseline(baselines *baseline.Store) {
+	var err error
+	n.image, n.imageDigest, err = n.cfg.runtime().Image(n.cnt.Id)
+	if err != nil {
+		log.Debugf("getting image of container %s: %v", n.cnt.Id, err)
+		return
+	}
+
+	if baselines == nil {
+		return
+	}
+
+	b, err := baselines.Get(n.imageDigest)
+	if err != nil {
+		log.Errorf("getting baseline of image %s: %v", n.image, err)
+		return
+	}
+
+	if b != nil {
+		log.Infof("using the imported baseline of image %s for container %s", n.image, n.cnt.Id)
+		n.imageSums = b.Files
+		n.SetBaseline(b)
+	}
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/binfmt"
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/hashpool"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	"github.com/s3rj1k/go-fanotify/fanotify"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+type hashResult struct {
+	sum string
+	err error
+}
+
+// hash calculates the sha256sum of the executed file in the background.
+func (n *ContainerNotifier) hash(data *fanotify.EventMetadata, cntPath string) <-chan hashResult {
+	sums := make(chan hashResult, 1)
+
+	go func() {
+		sum, err := n.hashCached(hashpool.PriorityExec, data.File(), cntPath)
+		sums <- hashResult{sum: sum, err: err}
+	}()
+
+	return sums
+}
+
+// deadline returns a channel which is never ready when there is no deadline.
+func deadline(d time.Duration) <-chan time.Time {
+	if d <= 0 {
+		return nil
+	}
+
+	return time.After(d)
+}
+
+// decide evaluates the policy on the execution of the file with the given sha256sum. req is nil when the policy was
+// not evaluated.
+func (n *ContainerNotifier) decide(pid int, cntPath, sum string, st *unix.Stat_t, format *binfmt.Format) (events.Verdict, string, *policy.Request) {
+	proc := n.inspectProcess(pid)
+
+	// The exec probes are allowed even if they are not part of the rootfs, e.g. scripts from a config map volume.
+	if probeSum, ok := n.probeSums[cntPath]; ok && proc.execSession && probeSum == sum {
+		return events.VerdictAllow, "exec probe", nil
+	}
+
+	req := &policy.Request{
+		Path:        cntPath,
+		Baseline:    n.baselineStatus(cntPath, sum, st),
+		ProcessExe:  proc.exe,
+		ParentExe:   proc.parentExe,
+		UID:         proc.uid,
+		GID:         proc.gid,
+		ExecSession: proc.execSession,
+		Interactive: proc.interactive,
+		Writable:    n.writableLocation(cntPath),
+	}
+	setFormat(req, format)
+	req.Interpreter = n.interpreter(format)
+
+	p, ephemeral := n.policyOf(pid)
+	req.Ephemeral = ephemeral
+	decision := p.Evaluate(req)
+
+	verdict := verdictOf(decision)
+	n.evaluateShadow(pid, req, verdict, decision.Reason)
+
+	return verdict, decision.Reason, req
+}
+
+// verdictOf returns the verdict of the decision of the policy.
+func verdictOf(decision policy.Decision) events.Verdict {
+	switch {
+	case !decision.Allow:
+		return events.VerdictDeny
+	case decision.Audited:
+		return events.VerdictAudit
+	default:
+		return events.VerdictAllow
+	}
+}
+
+// failed answers the execution of a file which could not be verified according to the failure mode of the policy.
+func (n *ContainerNotifier) failed(data *fanotify.EventMetadata, path, reason string) {
+	if p, _ := n.policyOf(data.GetPID()); p.FailsOpen() {
+		n.respond(data, path, nil, events.VerdictAudit, reason)
+		return
+	}
+
+	n.deny(data, path, nil, reason)
+}
+
+// verifyLate waits for the file answered after the deadline to be hashed, and reports what the decision would have
+// been.
+func (n *ContainerNotifier) verifyLate(data *fanotify.EventMetadata, path, cntPath string, sums <-chan hashResult) {
+	defer n.closeEvent(data)
+
+	sum := <-sums
+	if sum.err != nil {
+		log.Errorf("calculating sha256sum of %s: %v", path, sum.err)
+		return
+	}
+
+	verdict, reason, req := n.decide(data.GetPID(), cntPath, sum.sum, eventStat(data), n.identify(fdReaderAt(data.Fd), cntPath))
+	log.Infof("[LATE %s]:%s: %s (%s)", strings.ToUpper(string(verdict)), n.cnt.Id, path, reason)
+
+	event := n.event(data.GetPID(), path, req, verdict, reason)
+	event.Late = true
+	n.report(event)
+}
+
+func (n *ContainerNotifier) closeEvent(data *fanotify.EventMetadata) {
+	data.Close()
+	atomic.AddInt64(&n.openFDs, -1)
+}
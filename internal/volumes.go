@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	v1 "k8s.io/api/core/v1"
+)
+
+// volume is a volume of the pod mounted in the container which a volume rule of the policy matches.
+type volume struct {
+	policy.Volume
+	action policy.VolumeAction
+	reason string
+}
+
+// containerVolumes returns the volumes of the container matched by the volume rules of the policy. The pod and the
+// container spec are needed to know the volumes, there are none without them.
+func containerVolumes(p *policy.ExecPolicy, pod *v1.Pod, cntSpec *v1.Container) []volume {
+	if pod == nil || cntSpec == nil || len(p.Spec.Volumes) == 0 {
+		return nil
+	}
+
+	types := make(map[string]string, len(pod.Spec.Volumes))
+	for i := range pod.Spec.Volumes {
+		types[pod.Spec.Volumes[i].Name] = policy.VolumeType(&pod.Spec.Volumes[i].VolumeSource)
+	}
+
+	vols := []volume{}
+	for _, mnt := range cntSpec.VolumeMounts {
+		vol := volume{Volume: policy.Volume{Name: mnt.Name, Type: types[mnt.Name], MountPath: mnt.MountPath}}
+
+		var ok bool
+		if vol.action, vol.reason, ok = p.VolumeAction(&vol.Volume); ok {
+			vols = append(vols, vol)
+		}
+	}
+
+	return vols
+}
+
+// volumeAt returns the volume the path inside the container is in, nil when it is in none of the volumes.
+func volumeAt(vols []volume, path string) *volume {
+	var found *volume
+	for i, vol := range vols {
+		if !policy.InDir(path, vol.MountPath) {
+			continue
+		}
+
+		// The volumes can be mounted below other ones.
+		if found == nil || len(vol.MountPath) > len(found.MountPath) {
+			found = &vols[i]
+		}
+	}
+
+	return found
+}
+
+// ignoresVolume tells if the mount is a volume of the container which is not enforced, it is not marked then.
+func (n *ContainerNotifier) ignoresVolume(mountPath string) bool {
+	vol := volumeAt(n.volumes, mountPath)
+	return vol != nil && vol.MountPath == mountPath && vol.action == policy.VolumeIgnore
+}
+
+// skipMountPath tells if the path inside the container is left out of the baseline: the mounts are, except the volumes
+// walked with the rootfs.
+func (n *ContainerNotifier) skipMountPath(path string) bool {
+	if !n.ignoreMountPath(path) {
+		return false
+	}
+
+	vol := volumeAt(n.volumes, path)
+	return vol == nil || vol.action != policy.VolumeBaseline
+}
+
+// walksVolumes tells if the baseline of the container has files of its volumes.
+func (n *ContainerNotifier) walksVolumes() bool {
+	for _, vol := range n.volumes {
+		if vol.action == policy.VolumeBaseline {
+			return true
+		}
+	}
+
+	return false
+}
+
+// volumeVerdict answers the executions of the files of the volumes which are ignored or where nothing can be run,
+// without hashing them. It is false when the file has to be verified.
+func (n *ContainerNotifier) volumeVerdict(pid int, cntPath string) (events.Verdict, string, bool) {
+	vols, p, pod := n.volumes, n.policy, n.pod
+	if s := n.sharedContainerOf(pid); s != nil {
+		vols, p, pod = s.volumes, s.Config.Policy, s.Config.Pod
+	}
+
+	vol := volumeAt(vols, cntPath)
+	if vol == nil {
+		return "", "", false
+	}
+
+	switch vol.action {
+	case policy.VolumeIgnore:
+		return events.VerdictAllow, vol.reason, true
+
+	case policy.VolumeDeny:
+		decision := n.withMode(p, pod).EvaluateVolumeExec(vol.reason)
+		return verdictOf(decision), decision.Reason, true
+	}
+
+	return "", "", false
+}
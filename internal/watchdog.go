@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxRestarts is how many times a notifier is restarted by the watchdog, its container is then left unenforced.
+const maxRestarts = 3
+
+// busyEvent is the permission event being handled by the event loop.
+type busyEvent struct {
+	since time.Time
+	pid   int
+	stage string
+}
+
+func (n *ContainerNotifier) setBusy(pid int, stage string) {
+	n.statusLock.Lock()
+	defer n.statusLock.Unlock()
+
+	n.busy = busyEvent{since: time.Now(), pid: pid, stage: stage}
+}
+
+func (n *ContainerNotifier) setStage(stage string) {
+	n.statusLock.Lock()
+	defer n.statusLock.Unlock()
+
+	n.busy.stage = stage
+}
+
+func (n *ContainerNotifier) setIdle() {
+	n.statusLock.Lock()
+	defer n.statusLock.Unlock()
+
+	n.busy = busyEvent{}
+}
+
+// stuck returns the event being handled for longer than the threshold.
+func (n *ContainerNotifier) stuck(threshold time.Duration) (busyEvent, bool) {
+	n.statusLock.Lock()
+	defer n.statusLock.Unlock()
+
+	busy := n.busy
+	return busy, !busy.since.IsZero() && time.Since(busy.since) > threshold
+}
+
+// Restart returns a new notifier of the container, the old one is closed.
+func (n *ContainerNotifier) Restart() (*ContainerNotifier, error) {
+	n.Close()
+
+	// The fanotify group taken over from the previous agent was closed.
+	cfg := *n.cfg
+	cfg.HandedOff = nil
+
+	restarted, err := NewContainerNotifier(n.cnt.ContainerDefinition, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	n.statusLock.Lock()
+	restarted.restarts = n.restarts + 1
+	n.statusLock.Unlock()
+
+	for _, s := range n.sharedContainers() {
+		if err := restarted.Share(s.Container, s.Config); err != nil {
+			log.Errorf("enforcing container %s with the restarted notifier: %v", s.Container.Id, err)
+		}
+	}
+
+	return restarted, nil
+}
+
+// Watchdog fails open the notifiers whose event loop is stuck on a permission event, instead of leaving the
+// executions of their container hanging, and restarts them.
+type Watchdog struct {
+	// Threshold is how long a permission event can be handled before the event loop is stuck.
+	Threshold time.Duration
+	// Notifiers returns the running notifiers.
+	Notifiers func() []*ContainerNotifier
+	// OnRestart replaces the stuck notifier with the restarted one, which is nil when the container is left
+	// unenforced.
+	OnRestart func(stuck, restarted *ContainerNotifier)
+}
+
+// Run checks the notifiers at every interval.
+func (w *Watchdog) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, n := range w.Notifiers() {
+			// Nothing waits for the verdicts of the detection-only modes and the other backends.
+			if n.NotifyFD == nil || n.detection != "" {
+				continue
+			}
+
+			if busy, ok := n.stuck(w.Threshold); ok {
+				w.recover(n, busy)
+			}
+		}
+	}
+}
+
+func (w *Watchdog) recover(n *ContainerNotifier, busy busyEvent) {
+	err := fmt.Errorf("event loop stuck for %s %s for the execution by pid %d", time.Since(busy.since).Round(time.Second), busy.stage, busy.pid)
+	log.Errorf("watchdog: container %s: %v", n.cnt.Id, err)
+	n.recordError(err)
+	w.dump(n)
+
+	// The kernel allows the pending executions once the fanotify FD is closed.
+	if n.Status().Restarts >= maxRestarts {
+		log.Errorf("watchdog: container %s restarted %d times, leaving it unenforced", n.cnt.Id, maxRestarts)
+		n.Close()
+		w.OnRestart(n, nil)
+		return
+	}
+
+	restarted, err := n.Restart()
+	if err != nil {
+		log.Errorf("watchdog: restarting notifier of container %s, leaving it unenforced: %v", n.cnt.Id, err)
+		w.OnRestart(n, nil)
+		return
+	}
+
+	log.Warnf("watchdog: notifier of container %s restarted", n.cnt.Id)
+	w.OnRestart(n, restarted)
+}
+
+// dump logs the processes of the container waiting for their executions to be answered and the stacks of the agent.
+func (w *Watchdog) dump(n *ContainerNotifier) {
+	if mntns, err := readMntns(int(n.pid())); err == nil {
+		for _, pid := range waitingProcesses(mntns) {
+			comm, _ := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "comm"))
+			log.Errorf("watchdog: container %s: process %d (%s) waiting for fanotify", n.cnt.Id, pid, strings.TrimSpace(string(comm)))
+		}
+	}
+
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	log.Errorf("watchdog: goroutines:\n%s", buf)
+}
+
+// waitingProcesses returns the processes of the mount namespace sleeping in fanotify.
+func waitingProcesses(mntns uint64) []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	pids := []int{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		if ns, err := readMntns(pid); err != nil || ns != mntns {
+			continue
+		}
+
+		wchan, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "wchan"))
+		if err == nil && strings.Contains(string(wchan), "fanotify") {
+			pids = append(pids, pid)
+		}
+	}
+
+	return pids
+}
@@ -0,0 +1,31 @@
+package internal
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// writableLocation tells where the file inside the container is that anything can write to: on a tmpfs, like /dev/shm,
+// or below a world-writable directory, like /tmp. It is empty for the other locations.
+func (n *ContainerNotifier) writableLocation(cntPath string) string {
+	root := n.root()
+
+	// The path is not opened, there is no event for it.
+	var fs unix.Statfs_t
+	if err := unix.Statfs(filepath.Join(root, cntPath), &fs); err == nil && (fs.Type == unix.TMPFS_MAGIC || fs.Type == unix.RAMFS_MAGIC) {
+		return "tmpfs"
+	}
+
+	// The files could have been put in a directory created in the world-writable one.
+	for dir := path.Dir(cntPath); dir != "/"; dir = path.Dir(dir) {
+		info, err := os.Lstat(filepath.Join(root, dir))
+		if err == nil && info.IsDir() && info.Mode().Perm()&0o002 != 0 {
+			return "world-writable directory " + dir
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/baseline"
+	"github.com/kinvolk/fanotify-poc/pkg/hashpool"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// sumXattr holds the sha256sum of the file with what is needed to know if it is still valid. It is in the trusted
+	// namespace so only the host can set it.
+	sumXattr = "trusted.fanotify-mon.sha256"
+	// sumXattrVersion is the format of the value: version size mtime hashed-at sha256sum.
+	sumXattrVersion = "v1"
+
+	// Setting the xattr changes the ctime of the file, a later ctime means the file was changed since it was hashed.
+	ctimeSlack = time.Second
+)
+
+// cachedSum is the value of the xattr.
+type cachedSum struct {
+	size     int64
+	mtime    int64
+	hashedAt int64
+	sum      string
+}
+
+func (c *cachedSum) String() string {
+	return fmt.Sprintf("%s %d %d %d %s", sumXattrVersion, c.size, c.mtime, c.hashedAt, c.sum)
+}
+
+func parseCachedSum(value string) (*cachedSum, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 5 || fields[0] != sumXattrVersion {
+		return nil, fmt.Errorf("unsupported format %q", value)
+	}
+
+	c := &cachedSum{sum: fields[4]}
+	for i, field := range []*int64{&c.size, &c.mtime, &c.hashedAt} {
+		n, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %q: %w", value, err)
+		}
+		*field = n
+	}
+
+	return c, nil
+}
+
+// valid tells if the file was not modified since it was hashed.
+func (c *cachedSum) valid(st *unix.Stat_t) bool {
+	return c.size == st.Size &&
+		c.mtime == st.Mtim.Nano() &&
+		st.Ctim.Nano() <= c.hashedAt+ctimeSlack.Nanoseconds()
+}
+
+// hashCached returns the sha256sum of the file from its xattr if it is still valid. Otherwise it is hashed and, if the
+// file is found in the overlayfs layers of the container, the xattr is set there so the other containers of the image
+// and the restarted ones don't have to hash it again. Setting it through the overlayfs would copy the file up.
+func (n *ContainerNotifier) hashCached(prio hashpool.Priority, f *os.File, cntPath string) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &st); err != nil {
+		return "", fmt.Errorf("getting file status: %w", err)
+	}
+
+	// The file is not even read when it is too large.
+	if n.hashPool != nil && n.hashPool.MaxFileSize > 0 && st.Size > n.hashPool.MaxFileSize {
+		return "", fmt.Errorf("%w: %d bytes", baseline.ErrTooLarge, st.Size)
+	}
+
+	if !n.xattrCache {
+		return n.hashPool.Hash(prio, f)
+	}
+
+	buf := make([]byte, 256)
+	if size, err := unix.Fgetxattr(int(f.Fd()), sumXattr, buf); err == nil {
+		c, err := parseCachedSum(string(buf[:size]))
+		if err == nil && c.valid(&st) {
+			return c.sum, nil
+		}
+	}
+
+	hashedAt := time.Now()
+
+	sum, err := n.hashPool.Hash(prio, f)
+	if err != nil {
+		return "", err
+	}
+
+	c := &cachedSum{
+		size:     st.Size,
+		mtime:    st.Mtim.Nano(),
+		hashedAt: hashedAt.UnixNano(),
+		sum:      sum,
+	}
+
+	if err := n.storeCachedSum(cntPath, &st, c); err != nil {
+		log.Debugf("caching sha256sum of %s in container %s: %v", cntPath, n.cnt.Id, err)
+	}
+
+	return sum, nil
+}
+
+func (n *ContainerNotifier) storeCachedSum(cntPath string, st *unix.Stat_t, c *cachedSum) error {
+	path := n.layerPath(cntPath)
+	if path == "" {
+		return fmt.Errorf("not found in the overlayfs layers")
+	}
+
+	// The file seen through the overlayfs has the attributes of the one in the layer.
+	var layerSt unix.Stat_t
+	if err := unix.Stat(path, &layerSt); err != nil {
+		return fmt.Errorf("getting file status: %w", err)
+	}
+
+	if layerSt.Size != st.Size || layerSt.Mtim != st.Mtim {
+		return fmt.Errorf("%s is not the executed file", path)
+	}
+
+	return unix.Setxattr(path, sumXattr, []byte(c.String()), 0)
+}
+
+// layerPath returns the path of the file in the topmost overlayfs layer of the rootfs which has it.
+func (n *ContainerNotifier) layerPath(cntPath string) string {
+	for _, layer := range n.layers {
+		path := filepath.Join(layer, cntPath)
+		if _, err := os.Lstat(path); err == nil {
+			return path
+		}
+	}
+
+	return ""
+}
+
+// readLayers returns the upper and lower dirs of the overlayfs of the container rootfs, from the top to the bottom.
+func readLayers(pid uint32) ([]string, error) {
+	upper, lowers, err := readOverlay(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	layers := []string{}
+	if upper != "" {
+		layers = append(layers, upper)
+	}
+
+	return append(layers, lowers...), nil
+}
+
+// readOverlay returns the upper dir of the overlayfs of the container rootfs, empty when it is read-only, and its
+// lower dirs from the top to the bottom.
+func readOverlay(pid uint32) (string, []string, error) {
+	mounts, err := readMountInfo(int(pid))
+	if err != nil {
+		return "", nil, err
+	}
+
+	// The last mount of the root is the one seen by the container.
+	var root *mountInfo
+	for i := range mounts {
+		if mounts[i].mountPoint == "/" {
+			root = &mounts[i]
+		}
+	}
+
+	if root == nil {
+		return "", nil, fmt.Errorf("rootfs mount not found")
+	}
+
+	if root.fsType != "overlay" {
+		return "", nil, fmt.Errorf("the rootfs is %s, not overlay", root.fsType)
+	}
+
+	var upper string
+	var lowers []string
+
+	for _, option := range strings.Split(root.superOptions, ",") {
+		switch {
+		case strings.HasPrefix(option, "upperdir="):
+			upper = strings.TrimPrefix(option, "upperdir=")
+		case strings.HasPrefix(option, "lowerdir="):
+			lowers = strings.Split(strings.TrimPrefix(option, "lowerdir="), ":")
+		}
+	}
+
+	return upper, lowers, nil
+}
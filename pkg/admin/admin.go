@@ -0,0 +1,521 @@
+// Package admin has the API of the node agent, served on a unix socket so it is only reachable from the node, and
+// optionally as a gRPC service over mutual TLS for the remote clients.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/baseline"
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/eventstore"
+	"github.com/kinvolk/fanotify-poc/pkg/peercred"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	"github.com/kinvolk/fanotify-poc/pkg/status"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	EventsPath   = "/v1/events"
+	BaselinePath = "/v1/baseline"
+	StatusPath   = "/v1/status"
+	ModePath     = "/v1/mode"
+	VerifyPath   = "/v1/verify"
+	TreePath     = "/v1/baseline/tree"
+	RemountPath  = "/v1/remount"
+	CanaryPath   = "/v1/canary"
+)
+
+// NoGroup only lets root use the API.
+const NoGroup = -1
+
+// VerifyResult lists the files of the baseline of a container which changed since it was computed or imported.
+type VerifyResult struct {
+	Container string   `json:"container"`
+	Files     int      `json:"files"`
+	Modified  []string `json:"modified"`
+	Missing   []string `json:"missing"`
+
+	// Path is the directory whose files were verified, empty for the whole baseline.
+	Path string `json:"path,omitempty"`
+}
+
+// ErrNotFound is returned by the functions of the server when the container is not enforced.
+var ErrNotFound = errors.New("container not found")
+
+type Server struct {
+	// Events queries the event store, it is nil when the events are not stored.
+	Events func(q *eventstore.Query) ([]events.Event, error)
+
+	// Baseline returns the baseline of the container.
+	Baseline func(cntID string) (*baseline.Baseline, error)
+	// ImportBaseline replaces the baseline of the container or, if cntID is empty, stores it for the containers of
+	// its image.
+	ImportBaseline func(cntID string, b *baseline.Baseline) error
+
+	// Status returns the state of the enforced containers.
+	Status func() []status.Container
+	// SetMode overrides the mode of the policy of the container, an empty mode restores the one of the policy.
+	SetMode func(cntID string, mode policy.Mode) error
+	// Verify hashes the files of the baseline of the container under dir again, all of them when it is empty.
+	Verify func(cntID, dir string) (*VerifyResult, error)
+	// BaselineTree returns the directory of the Merkle tree of the baseline of the container, nil if there is no
+	// executable under it.
+	BaselineTree func(cntID, dir string) (*baseline.TreeNode, error)
+	// SetReadOnly remounts the container read-only, or writable again for a break-glass access.
+	SetReadOnly func(cntID string, readOnly bool) error
+	// SetCanary changes the percentage of the pods the policy is enforced on, nil restores the one of the policy.
+	SetCanary func(policyName string, percent *int) error
+
+	// Group is the group whose members can use the API besides root, NoGroup for none. The peers are identified
+	// with SO_PEERCRED.
+	Group int
+}
+
+type peerKey struct{}
+
+// Run serves the API on the unix socket until it fails. A socket left by a previous run is replaced.
+func (s *Server) Run(socket string) error {
+	if err := os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+		return fmt.Errorf("creating socket dir: %w", err)
+	}
+
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing old socket: %w", err)
+	}
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("listening: %w", err)
+	}
+	defer l.Close()
+
+	// The peers are checked anyway, the permissions only keep the others from connecting.
+	mode := os.FileMode(0600)
+	if s.Group != NoGroup {
+		if err := os.Chown(socket, 0, s.Group); err != nil {
+			return fmt.Errorf("setting socket group: %w", err)
+		}
+		mode = 0660
+	}
+
+	if err := os.Chmod(socket, mode); err != nil {
+		return fmt.Errorf("setting socket permissions: %w", err)
+	}
+
+	server := &http.Server{
+		Handler: s.authorize(s.handler()),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			cred, err := peercred.Get(c)
+			if err != nil {
+				log.Errorf("admin API: getting peer credentials: %v", err)
+				return ctx
+			}
+
+			return context.WithValue(ctx, peerKey{}, cred)
+		},
+	}
+
+	log.Infof("serving the admin API on %s", socket)
+	return server.Serve(l)
+}
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(EventsPath, s.handleEvents)
+	mux.HandleFunc(BaselinePath, s.handleBaseline)
+	mux.HandleFunc(StatusPath, s.handleStatus)
+	mux.HandleFunc(ModePath, s.handleMode)
+	mux.HandleFunc(VerifyPath, s.handleVerify)
+	mux.HandleFunc(TreePath, s.handleTree)
+	mux.HandleFunc(RemountPath, s.handleRemount)
+	mux.HandleFunc(CanaryPath, s.handleCanary)
+
+	return mux
+}
+
+// authorize only lets root and the members of the group through, the changes are logged with the peer.
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred, ok := r.Context().Value(peerKey{}).(*unix.Ucred)
+		if !ok || !s.allowed(cred) {
+			if ok {
+				log.Warnf("admin API: %s %s denied to uid %d, pid %d", r.Method, r.URL.Path, cred.Uid, cred.Pid)
+			}
+
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			log.Infof("admin API: %s %s by uid %d, pid %d", r.Method, r.URL.RequestURI(), cred.Uid, cred.Pid)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) allowed(cred *unix.Ucred) bool {
+	if cred.Uid == 0 {
+		return true
+	}
+
+	if s.Group == NoGroup {
+		return false
+	}
+
+	if int(cred.Gid) == s.Group {
+		return true
+	}
+
+	// SO_PEERCRED only has the primary group.
+	groups, err := processGroups(int(cred.Pid))
+	if err != nil {
+		log.Warnf("admin API: reading groups of pid %d: %v", cred.Pid, err)
+		return false
+	}
+
+	for _, gid := range groups {
+		if gid == s.Group {
+			return true
+		}
+	}
+
+	return false
+}
+
+// processGroups returns the supplementary groups of the process.
+func processGroups(pid int) ([]int, error) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "status"))
+	if err != nil {
+		return nil, err
+	}
+
+	// The line looks like this: Groups:	4 24 27 998
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+
+		groups := []int{}
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "Groups:")) {
+			gid, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("parsing groups: %w", err)
+			}
+			groups = append(groups, gid)
+		}
+
+		return groups, nil
+	}
+
+	return nil, fmt.Errorf("no groups in status")
+}
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if s.Events == nil {
+		http.Error(w, "the events are not stored", http.StatusNotFound)
+		return
+	}
+
+	q, err := decodeQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	evs, err := s.Events(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, evs)
+}
+
+func (s *Server) handleBaseline(w http.ResponseWriter, r *http.Request) {
+	cntID := r.URL.Query().Get("container")
+
+	switch r.Method {
+	case http.MethodGet:
+		b, err := s.Baseline(cntID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, b)
+
+	case http.MethodPost:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("reading body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		b, err := baseline.Decode(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.ImportBaseline(cntID, b); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cnts, err := s.containers(r.URL.Query().Get("container"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, cnts)
+}
+
+// containers returns the state of the containers whose ID starts with cntID, by namespace, pod and name.
+func (s *Server) containers(cntID string) ([]status.Container, error) {
+	cnts := []status.Container{}
+	for _, cnt := range s.Status() {
+		if strings.HasPrefix(cnt.ID, cntID) {
+			cnts = append(cnts, cnt)
+		}
+	}
+
+	if cntID != "" && len(cnts) == 0 {
+		return nil, ErrNotFound
+	}
+
+	sort.Slice(cnts, func(i, j int) bool {
+		if cnts[i].Namespace != cnts[j].Namespace {
+			return cnts[i].Namespace < cnts[j].Namespace
+		}
+
+		if cnts[i].Pod != cnts[j].Pod {
+			return cnts[i].Pod < cnts[j].Pod
+		}
+
+		return cnts[i].Name < cnts[j].Name
+	})
+
+	return cnts, nil
+}
+
+func (s *Server) handleMode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	mode := policy.Mode(q.Get("mode"))
+	if err := checkMode(mode); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.SetMode(q.Get("container"), mode); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func checkMode(mode policy.Mode) error {
+	switch mode {
+	case "", policy.ModeEnforce, policy.ModeAudit:
+		return nil
+	default:
+		return fmt.Errorf("unknown mode %q", mode)
+	}
+}
+
+func (s *Server) handleVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	res, err := s.Verify(r.URL.Query().Get("container"), r.URL.Query().Get("path"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, res)
+}
+
+func (s *Server) handleTree(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	node, err := s.BaselineTree(r.URL.Query().Get("container"), r.URL.Query().Get("path"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, node)
+}
+
+func (s *Server) handleRemount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	readOnly, err := strconv.ParseBool(q.Get("readOnly"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid readOnly %q", q.Get("readOnly")), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.SetReadOnly(q.Get("container"), readOnly); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleCanary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+
+	var percent *int
+	if v := q.Get("percent"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || !validPercent(p) {
+			http.Error(w, fmt.Sprintf("invalid percent %q", v), http.StatusBadRequest)
+			return
+		}
+		percent = &p
+	}
+
+	if err := s.SetCanary(q.Get("policy"), percent); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func validPercent(p int) bool {
+	return p >= 0 && p <= 100
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	if errors.Is(err, ErrNotFound) {
+		code = http.StatusNotFound
+	}
+
+	http.Error(w, err.Error(), code)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("writing response: %v", err)
+	}
+}
+
+func encodeQuery(q *eventstore.Query) url.Values {
+	v := url.Values{}
+	if !q.Since.IsZero() {
+		v.Set("since", q.Since.Format(time.RFC3339Nano))
+	}
+	if !q.Until.IsZero() {
+		v.Set("until", q.Until.Format(time.RFC3339Nano))
+	}
+	if q.Namespace != "" {
+		v.Set("namespace", q.Namespace)
+	}
+	if q.Pod != "" {
+		v.Set("pod", q.Pod)
+	}
+	if q.Path != "" {
+		v.Set("path", q.Path)
+	}
+	if q.Verdict != "" {
+		v.Set("verdict", string(q.Verdict))
+	}
+	if q.Drift {
+		v.Set("drift", "true")
+	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+
+	return v
+}
+
+func decodeQuery(v url.Values) (*eventstore.Query, error) {
+	q := &eventstore.Query{
+		Namespace: v.Get("namespace"),
+		Pod:       v.Get("pod"),
+		Path:      v.Get("path"),
+		Verdict:   events.Verdict(v.Get("verdict")),
+	}
+
+	var err error
+	if since := v.Get("since"); since != "" {
+		if q.Since, err = time.Parse(time.RFC3339Nano, since); err != nil {
+			return nil, fmt.Errorf("invalid since: %w", err)
+		}
+	}
+
+	if until := v.Get("until"); until != "" {
+		if q.Until, err = time.Parse(time.RFC3339Nano, until); err != nil {
+			return nil, fmt.Errorf("invalid until: %w", err)
+		}
+	}
+
+	if drift := v.Get("drift"); drift != "" {
+		if q.Drift, err = strconv.ParseBool(drift); err != nil {
+			return nil, fmt.Errorf("invalid drift: %w", err)
+		}
+	}
+
+	if limit := v.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil {
+			return nil, fmt.Errorf("invalid limit: %w", err)
+		}
+	}
+
+	return q, nil
+}
@@ -0,0 +1,206 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/kinvolk/fanotify-poc/pkg/baseline"
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/eventstore"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	"github.com/kinvolk/fanotify-poc/pkg/status"
+)
+
+// API is the admin API of an agent, reached by the Client on the node or by the RemoteClient.
+type API interface {
+	Events(ctx context.Context, q *eventstore.Query) ([]events.Event, error)
+	Baseline(ctx context.Context, cntID string) (*baseline.Baseline, error)
+	ImportBaseline(ctx context.Context, cntID string, b *baseline.Baseline) error
+	Status(ctx context.Context, cntID string) ([]status.Container, error)
+	SetMode(ctx context.Context, cntID string, mode policy.Mode) error
+	Verify(ctx context.Context, cntID, dir string) (*VerifyResult, error)
+	BaselineTree(ctx context.Context, cntID, dir string) (*baseline.TreeNode, error)
+	SetReadOnly(ctx context.Context, cntID string, readOnly bool) error
+	SetCanary(ctx context.Context, policyName string, percent *int) error
+}
+
+// Client talks to the admin API of the agent running on the node, on its socket.
+type Client struct {
+	http *http.Client
+	// base is prepended to the paths of the requests.
+	base string
+}
+
+func NewClient(socket string) *Client {
+	return &Client{
+		base: "http://fanotify-mon",
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+func (c *Client) Events(ctx context.Context, q *eventstore.Query) ([]events.Event, error) {
+	evs := []events.Event{}
+	if err := c.get(ctx, EventsPath+"?"+encodeQuery(q).Encode(), &evs); err != nil {
+		return nil, fmt.Errorf("getting events: %w", err)
+	}
+
+	return evs, nil
+}
+
+func (c *Client) Baseline(ctx context.Context, cntID string) (*baseline.Baseline, error) {
+	b := &baseline.Baseline{}
+	if err := c.get(ctx, BaselinePath+"?"+url.Values{"container": {cntID}}.Encode(), b); err != nil {
+		return nil, fmt.Errorf("getting baseline: %w", err)
+	}
+
+	return b, nil
+}
+
+// ImportBaseline replaces the baseline of the container or, if cntID is empty, stores it for the containers of its
+// image.
+func (c *Client) ImportBaseline(ctx context.Context, cntID string, b *baseline.Baseline) error {
+	if err := c.post(ctx, BaselinePath+"?"+url.Values{"container": {cntID}}.Encode(), b); err != nil {
+		return fmt.Errorf("importing baseline: %w", err)
+	}
+
+	return nil
+}
+
+// Status returns the state of the enforced containers, or of the containers whose ID starts with cntID.
+func (c *Client) Status(ctx context.Context, cntID string) ([]status.Container, error) {
+	cnts := []status.Container{}
+	if err := c.get(ctx, StatusPath+"?"+url.Values{"container": {cntID}}.Encode(), &cnts); err != nil {
+		return nil, fmt.Errorf("getting status: %w", err)
+	}
+
+	return cnts, nil
+}
+
+// SetMode overrides the mode of the policy of the container, an empty mode restores the one of the policy.
+func (c *Client) SetMode(ctx context.Context, cntID string, mode policy.Mode) error {
+	if err := c.post(ctx, ModePath+"?"+url.Values{"container": {cntID}, "mode": {string(mode)}}.Encode(), nil); err != nil {
+		return fmt.Errorf("setting mode: %w", err)
+	}
+
+	return nil
+}
+
+// Verify hashes the files of the baseline of the container under dir again, all of them when it is empty.
+func (c *Client) Verify(ctx context.Context, cntID, dir string) (*VerifyResult, error) {
+	res := &VerifyResult{}
+	if err := c.call(ctx, http.MethodPost, VerifyPath+"?"+url.Values{"container": {cntID}, "path": {dir}}.Encode(), nil, res); err != nil {
+		return nil, fmt.Errorf("verifying baseline: %w", err)
+	}
+
+	return res, nil
+}
+
+// BaselineTree returns the directory of the Merkle tree of the baseline of the container, nil if there is no
+// executable under it.
+func (c *Client) BaselineTree(ctx context.Context, cntID, dir string) (*baseline.TreeNode, error) {
+	var node *baseline.TreeNode
+	if err := c.get(ctx, TreePath+"?"+url.Values{"container": {cntID}, "path": {dir}}.Encode(), &node); err != nil {
+		return nil, fmt.Errorf("getting baseline tree: %w", err)
+	}
+
+	return node, nil
+}
+
+// SetReadOnly remounts the container read-only, or writable again for a break-glass access.
+func (c *Client) SetReadOnly(ctx context.Context, cntID string, readOnly bool) error {
+	q := url.Values{"container": {cntID}, "readOnly": {strconv.FormatBool(readOnly)}}
+	if err := c.post(ctx, RemountPath+"?"+q.Encode(), nil); err != nil {
+		return fmt.Errorf("remounting container: %w", err)
+	}
+
+	return nil
+}
+
+// SetCanary changes the percentage of the pods the policy is enforced on, nil restores the one of the policy.
+func (c *Client) SetCanary(ctx context.Context, policyName string, percent *int) error {
+	q := url.Values{"policy": {policyName}}
+	if percent != nil {
+		q.Set("percent", strconv.Itoa(*percent))
+	}
+
+	if err := c.post(ctx, CanaryPath+"?"+q.Encode(), nil); err != nil {
+		return fmt.Errorf("setting canary: %w", err)
+	}
+
+	return nil
+}
+
+// get decodes the JSON response of the path into v.
+func (c *Client) get(ctx context.Context, path string, v interface{}) error {
+	return c.call(ctx, http.MethodGet, path, nil, v)
+}
+
+// post sends body as JSON to the path.
+func (c *Client) post(ctx context.Context, path string, body interface{}) error {
+	return c.call(ctx, http.MethodPost, path, body, nil)
+}
+
+// call sends body as JSON, if any, and decodes the JSON response into v, if any.
+func (c *Client) call(ctx context.Context, method, path string, body, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, r)
+	if err != nil {
+		return err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if v == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// do sends the request and fails if the response is not successful.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,220 @@
+package admin
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/kinvolk/fanotify-poc/pkg/baseline"
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/eventstore"
+	"github.com/kinvolk/fanotify-poc/pkg/grpcjson"
+	"github.com/kinvolk/fanotify-poc/pkg/mtls"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	"github.com/kinvolk/fanotify-poc/pkg/status"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+// ServiceName is the gRPC service of the admin API served to the remote clients, see api/admin.proto. The messages
+// are encoded as JSON, see grpcjson.
+const ServiceName = "fanotifymon.admin.v1.Admin"
+
+// ContainerRequest names the container of the methods which only take it.
+type ContainerRequest struct {
+	Container string `json:"container"`
+}
+
+type EventsReply struct {
+	Events []events.Event `json:"events"`
+}
+
+type ImportBaselineRequest struct {
+	Container string `json:"container,omitempty"`
+	// Baseline is decoded and validated like the imported files, see baseline.Decode.
+	Baseline json.RawMessage `json:"baseline"`
+}
+
+type StatusReply struct {
+	Containers []status.Container `json:"containers"`
+}
+
+type SetModeRequest struct {
+	Container string      `json:"container"`
+	Mode      policy.Mode `json:"mode,omitempty"`
+}
+
+// PathRequest names a directory of the baseline of the container.
+type PathRequest struct {
+	Container string `json:"container"`
+	Path      string `json:"path,omitempty"`
+}
+
+type TreeReply struct {
+	// Node is nil if there is no executable under the directory.
+	Node *baseline.TreeNode `json:"node"`
+}
+
+type SetReadOnlyRequest struct {
+	Container string `json:"container"`
+	ReadOnly  bool   `json:"readOnly"`
+}
+
+type SetCanaryRequest struct {
+	Policy  string `json:"policy"`
+	Percent *int   `json:"percent,omitempty"`
+}
+
+// Empty is the reply of the methods which return nothing.
+type Empty struct{}
+
+// change is implemented by the requests of the methods making changes, they are logged with the client.
+type change interface {
+	target() string
+}
+
+func (r *ImportBaselineRequest) target() string { return "container " + r.Container }
+func (r *SetModeRequest) target() string        { return "container " + r.Container }
+func (r *PathRequest) target() string           { return "container " + r.Container }
+func (r *SetReadOnlyRequest) target() string    { return "container " + r.Container }
+func (r *SetCanaryRequest) target() string      { return "policy " + r.Policy }
+
+// method returns the method of the service, handled by the server.
+func method(name string, newRequest func() interface{}, handle func(s *Server, req interface{}) (interface{}, error)) grpc.MethodDesc {
+	return grpcjson.Method(ServiceName, name, newRequest, func(_ context.Context, srv, req interface{}) (interface{}, error) {
+		reply, err := handle(srv.(*Server), req)
+		if err != nil {
+			return nil, grpcError(err)
+		}
+
+		return reply, nil
+	})
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	// The functions of the server are its fields, there is no interface to check.
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		method("Events", func() interface{} { return &eventstore.Query{} }, func(s *Server, req interface{}) (interface{}, error) {
+			if s.Events == nil {
+				return nil, grpcstatus.Error(codes.NotFound, "the events are not stored")
+			}
+
+			evs, err := s.Events(req.(*eventstore.Query))
+			if err != nil {
+				return nil, err
+			}
+
+			return &EventsReply{Events: evs}, nil
+		}),
+		method("Baseline", func() interface{} { return &ContainerRequest{} }, func(s *Server, req interface{}) (interface{}, error) {
+			return s.Baseline(req.(*ContainerRequest).Container)
+		}),
+		method("ImportBaseline", func() interface{} { return &ImportBaselineRequest{} }, func(s *Server, req interface{}) (interface{}, error) {
+			r := req.(*ImportBaselineRequest)
+			b, err := baseline.Decode(r.Baseline)
+			if err != nil {
+				return nil, grpcstatus.Error(codes.InvalidArgument, err.Error())
+			}
+
+			return &Empty{}, s.ImportBaseline(r.Container, b)
+		}),
+		method("Status", func() interface{} { return &ContainerRequest{} }, func(s *Server, req interface{}) (interface{}, error) {
+			cnts, err := s.containers(req.(*ContainerRequest).Container)
+			if err != nil {
+				return nil, err
+			}
+
+			return &StatusReply{Containers: cnts}, nil
+		}),
+		method("SetMode", func() interface{} { return &SetModeRequest{} }, func(s *Server, req interface{}) (interface{}, error) {
+			r := req.(*SetModeRequest)
+			if err := checkMode(r.Mode); err != nil {
+				return nil, grpcstatus.Error(codes.InvalidArgument, err.Error())
+			}
+
+			return &Empty{}, s.SetMode(r.Container, r.Mode)
+		}),
+		method("Verify", func() interface{} { return &PathRequest{} }, func(s *Server, req interface{}) (interface{}, error) {
+			r := req.(*PathRequest)
+			return s.Verify(r.Container, r.Path)
+		}),
+		method("BaselineTree", func() interface{} { return &PathRequest{} }, func(s *Server, req interface{}) (interface{}, error) {
+			r := req.(*PathRequest)
+			node, err := s.BaselineTree(r.Container, r.Path)
+			if err != nil {
+				return nil, err
+			}
+
+			return &TreeReply{Node: node}, nil
+		}),
+		method("SetReadOnly", func() interface{} { return &SetReadOnlyRequest{} }, func(s *Server, req interface{}) (interface{}, error) {
+			r := req.(*SetReadOnlyRequest)
+			return &Empty{}, s.SetReadOnly(r.Container, r.ReadOnly)
+		}),
+		method("SetCanary", func() interface{} { return &SetCanaryRequest{} }, func(s *Server, req interface{}) (interface{}, error) {
+			r := req.(*SetCanaryRequest)
+			if r.Percent != nil && !validPercent(*r.Percent) {
+				return nil, grpcstatus.Errorf(codes.InvalidArgument, "invalid percent %d", *r.Percent)
+			}
+
+			return &Empty{}, s.SetCanary(r.Policy, r.Percent)
+		}),
+	},
+}
+
+func grpcError(err error) error {
+	if errors.Is(err, ErrNotFound) {
+		return grpcstatus.Error(codes.NotFound, err.Error())
+	}
+
+	return err
+}
+
+// RunTLS serves the API as a gRPC service on the address until it fails, for the remote clients. The config must
+// require the client certificates, see mtls.ServerConfig: every client whose certificate is accepted can use the whole
+// API.
+func (s *Server) RunTLS(addr string, config *tls.Config) error {
+	if config.ClientAuth == tls.NoClientCert {
+		return fmt.Errorf("the remote admin API needs client certificates")
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(config)), grpcjson.ServerOption(), grpc.UnaryInterceptor(authorizeTLS))
+	server.RegisterService(&serviceDesc, s)
+
+	log.Infof("serving the admin API over TLS on %s", addr)
+	return server.Serve(l)
+}
+
+// authorizeTLS logs the changes with the identities of the client certificate, the clients were checked during the
+// handshake.
+func authorizeTLS(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, grpcstatus.Error(codes.PermissionDenied, "forbidden")
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return nil, grpcstatus.Error(codes.PermissionDenied, "forbidden")
+	}
+
+	if c, ok := req.(change); ok {
+		log.Infof("admin API: %s %s by %v from %s", info.FullMethod, c.target(), mtls.Identities(tlsInfo.State.PeerCertificates[0]), p.Addr)
+	}
+
+	return handler(ctx, req)
+}
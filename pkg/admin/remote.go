@@ -0,0 +1,127 @@
+package admin
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+
+	"github.com/kinvolk/fanotify-poc/pkg/baseline"
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/eventstore"
+	"github.com/kinvolk/fanotify-poc/pkg/grpcjson"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	"github.com/kinvolk/fanotify-poc/pkg/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// RemoteClient talks to the gRPC service of the admin API of a remote agent, over mutual TLS.
+type RemoteClient struct {
+	conn *grpc.ClientConn
+}
+
+// NewRemoteClient returns a client of the agent at the address, host:port. The connection is established on the first
+// call.
+func NewRemoteClient(addr string, config *tls.Config) (*RemoteClient, error) {
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(credentials.NewTLS(config)), grpcjson.DialOption())
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", addr, err)
+	}
+
+	return &RemoteClient{conn: conn}, nil
+}
+
+func (c *RemoteClient) Events(ctx context.Context, q *eventstore.Query) ([]events.Event, error) {
+	reply := &EventsReply{}
+	if err := c.invoke(ctx, "Events", q, reply); err != nil {
+		return nil, fmt.Errorf("getting events: %w", err)
+	}
+
+	if reply.Events == nil {
+		reply.Events = []events.Event{}
+	}
+
+	return reply.Events, nil
+}
+
+func (c *RemoteClient) Baseline(ctx context.Context, cntID string) (*baseline.Baseline, error) {
+	b := &baseline.Baseline{}
+	if err := c.invoke(ctx, "Baseline", &ContainerRequest{Container: cntID}, b); err != nil {
+		return nil, fmt.Errorf("getting baseline: %w", err)
+	}
+
+	return b, nil
+}
+
+func (c *RemoteClient) ImportBaseline(ctx context.Context, cntID string, b *baseline.Baseline) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return fmt.Errorf("importing baseline: %w", err)
+	}
+
+	if err := c.invoke(ctx, "ImportBaseline", &ImportBaselineRequest{Container: cntID, Baseline: data}, &Empty{}); err != nil {
+		return fmt.Errorf("importing baseline: %w", err)
+	}
+
+	return nil
+}
+
+func (c *RemoteClient) Status(ctx context.Context, cntID string) ([]status.Container, error) {
+	reply := &StatusReply{}
+	if err := c.invoke(ctx, "Status", &ContainerRequest{Container: cntID}, reply); err != nil {
+		return nil, fmt.Errorf("getting status: %w", err)
+	}
+
+	if reply.Containers == nil {
+		reply.Containers = []status.Container{}
+	}
+
+	return reply.Containers, nil
+}
+
+func (c *RemoteClient) SetMode(ctx context.Context, cntID string, mode policy.Mode) error {
+	if err := c.invoke(ctx, "SetMode", &SetModeRequest{Container: cntID, Mode: mode}, &Empty{}); err != nil {
+		return fmt.Errorf("setting mode: %w", err)
+	}
+
+	return nil
+}
+
+func (c *RemoteClient) Verify(ctx context.Context, cntID, dir string) (*VerifyResult, error) {
+	res := &VerifyResult{}
+	if err := c.invoke(ctx, "Verify", &PathRequest{Container: cntID, Path: dir}, res); err != nil {
+		return nil, fmt.Errorf("verifying baseline: %w", err)
+	}
+
+	return res, nil
+}
+
+func (c *RemoteClient) BaselineTree(ctx context.Context, cntID, dir string) (*baseline.TreeNode, error) {
+	reply := &TreeReply{}
+	if err := c.invoke(ctx, "BaselineTree", &PathRequest{Container: cntID, Path: dir}, reply); err != nil {
+		return nil, fmt.Errorf("getting baseline tree: %w", err)
+	}
+
+	return reply.Node, nil
+}
+
+func (c *RemoteClient) SetReadOnly(ctx context.Context, cntID string, readOnly bool) error {
+	if err := c.invoke(ctx, "SetReadOnly", &SetReadOnlyRequest{Container: cntID, ReadOnly: readOnly}, &Empty{}); err != nil {
+		return fmt.Errorf("remounting container: %w", err)
+	}
+
+	return nil
+}
+
+func (c *RemoteClient) SetCanary(ctx context.Context, policyName string, percent *int) error {
+	if err := c.invoke(ctx, "SetCanary", &SetCanaryRequest{Policy: policyName, Percent: percent}, &Empty{}); err != nil {
+		return fmt.Errorf("setting canary: %w", err)
+	}
+
+	return nil
+}
+
+func (c *RemoteClient) invoke(ctx context.Context, method string, req, reply interface{}) error {
+	return c.conn.Invoke(ctx, "/"+ServiceName+"/"+method, req, reply)
+}
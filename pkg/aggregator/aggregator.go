@@ -0,0 +1,237 @@
+// Package aggregator has the cluster-level service which receives the reports of the node agents, so the violations
+// of all the nodes can be queried in a single place.
+//
+// The reports are sent over gRPC, with TLS and the client certificates of the agents or without it. The violations and
+// the nodes are queried with the same service, or as JSON over HTTP.
+package aggregator
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/status"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ViolationsPath = "/v1/violations"
+	NodesPath      = "/v1/nodes"
+
+	// DefaultMaxViolations is how many distinct violations are kept, the least recently seen are dropped first.
+	DefaultMaxViolations = 10000
+)
+
+// Report is what a node agent sends periodically.
+type Report struct {
+	Node       string                  `json:"node"`
+	Time       time.Time               `json:"time"`
+	Status     status.NodeStatusStatus `json:"status"`
+	Violations []events.Event          `json:"violations,omitempty"`
+}
+
+// Violation is a violation reported once or more, the repeated ones are only counted.
+type Violation struct {
+	events.Event
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// Node is the last report of a node.
+type Node struct {
+	Name       string                  `json:"name"`
+	LastReport time.Time               `json:"lastReport"`
+	Status     status.NodeStatusStatus `json:"status"`
+	// Stale is set when the agent of the node did not report since StaleAfter.
+	Stale bool `json:"stale,omitempty"`
+}
+
+type Server struct {
+	// MaxViolations defaults to DefaultMaxViolations.
+	MaxViolations int
+	// TLS serves gRPC over TLS and HTTPS when set.
+	TLS *tls.Config
+	// StaleAfter is how long a node can go without reporting before it is stale, 0 to never mark them.
+	StaleAfter time.Duration
+
+	lock       sync.Mutex
+	nodes      map[string]*Node
+	violations map[string]*Violation
+}
+
+// Run serves the HTTP queries until it fails.
+func (s *Server) Run(addr string) error {
+	if s.TLS == nil {
+		log.Infof("serving the aggregator queries on %s", addr)
+		return http.ListenAndServe(addr, s.Handler())
+	}
+
+	// The errors of the handshakes, like the clients not allowed, are logged by the server.
+	server := &http.Server{Addr: addr, Handler: s.Handler(), TLSConfig: s.TLS}
+	log.Infof("serving the aggregator queries over TLS on %s", addr)
+	return server.ListenAndServeTLS("", "")
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ViolationsPath, s.handleViolations)
+	mux.HandleFunc(NodesPath, s.handleNodes)
+
+	return mux
+}
+
+// Add stores the report of a node.
+func (s *Server) Add(r *Report) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.nodes == nil {
+		s.nodes = make(map[string]*Node)
+		s.violations = make(map[string]*Violation)
+	}
+
+	s.nodes[r.Node] = &Node{Name: r.Node, LastReport: r.Time, Status: r.Status}
+
+	for _, e := range r.Violations {
+		e.Node = r.Node
+		s.addViolation(e)
+	}
+
+	s.evict()
+}
+
+// AddDecision stores a decision sent by the grpc sink of an agent, if it is a violation. The node is not reported by
+// it, only its violations are counted.
+func (s *Server) AddDecision(e *events.Event) {
+	if !e.IsViolation() {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.nodes == nil {
+		s.nodes = make(map[string]*Node)
+		s.violations = make(map[string]*Violation)
+	}
+
+	s.addViolation(*e)
+	s.evict()
+}
+
+func (s *Server) addViolation(e events.Event) {
+	// The summaries of sink.Dedup stand for several violations.
+	count := 1
+	if e.Count > 1 {
+		count = e.Count
+	}
+
+	key := violationKey(&e)
+	if v, ok := s.violations[key]; ok {
+		v.Count += count
+		if e.Time.After(v.LastSeen) {
+			v.LastSeen = e.Time
+			v.PID = e.PID
+		}
+
+		return
+	}
+
+	s.violations[key] = &Violation{Event: e, Count: count, FirstSeen: e.Time, LastSeen: e.Time}
+}
+
+// violationKey is what makes two violations the same one.
+func violationKey(e *events.Event) string {
+	return fmt.Sprintf("%s|%s|%s|%s|%s", e.Node, e.ContainerID, e.Path, e.Verdict, e.Reason)
+}
+
+// evict drops the least recently seen violations above the maximum.
+func (s *Server) evict() {
+	max := s.MaxViolations
+	if max <= 0 {
+		max = DefaultMaxViolations
+	}
+
+	if len(s.violations) <= max {
+		return
+	}
+
+	keys := make([]string, 0, len(s.violations))
+	for key := range s.violations {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return s.violations[keys[i]].LastSeen.Before(s.violations[keys[j]].LastSeen)
+	})
+
+	for _, key := range keys[:len(keys)-max] {
+		delete(s.violations, key)
+	}
+}
+
+// Violations returns the violations matching the filter, the most recently seen first. The empty fields of the filter
+// match everything.
+func (s *Server) Violations(node, namespace, pod string) []Violation {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	violations := []Violation{}
+	for _, v := range s.violations {
+		if (node != "" && v.Node != node) ||
+			(namespace != "" && v.Namespace != namespace) ||
+			(pod != "" && v.Pod != pod) {
+			continue
+		}
+
+		violations = append(violations, *v)
+	}
+
+	sort.Slice(violations, func(i, j int) bool {
+		return violations[i].LastSeen.After(violations[j].LastSeen)
+	})
+
+	return violations
+}
+
+// Nodes returns the last report of every node, by name.
+func (s *Server) Nodes() []Node {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	nodes := []Node{}
+	for _, n := range s.nodes {
+		node := *n
+		node.Stale = s.StaleAfter > 0 && now.Sub(node.LastReport) > s.StaleAfter
+		nodes = append(nodes, node)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+
+	return nodes
+}
+
+func (s *Server) handleViolations(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	writeJSON(w, s.Violations(q.Get("node"), q.Get("namespace"), q.Get("pod")))
+}
+
+func (s *Server) handleNodes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.Nodes())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("writing response: %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package aggregator
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/grpcjson"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Client sends the reports of a node agent to the gRPC service of the aggregator, and queries it.
+type Client struct {
+	// URL is the address of the gRPC service, e.g. http://fanotify-mon-aggregator:9090, or https:// for TLS.
+	URL string
+	// TLS is used for the https URLs, the system CAs are used without it.
+	TLS *tls.Config
+
+	once sync.Once
+	conn *grpc.ClientConn
+	err  error
+}
+
+// dial connects to the aggregator once, the connection is established again by gRPC when it breaks.
+func (c *Client) dial() (*grpc.ClientConn, error) {
+	c.once.Do(func() {
+		u, err := url.Parse(c.URL)
+		if err != nil {
+			c.err = fmt.Errorf("parsing aggregator URL: %w", err)
+			return
+		}
+
+		creds := grpc.WithInsecure()
+		switch u.Scheme {
+		case "http":
+		case "https":
+			config := c.TLS
+			if config == nil {
+				config = &tls.Config{}
+			}
+			creds = grpc.WithTransportCredentials(credentials.NewTLS(config))
+		default:
+			c.err = fmt.Errorf("unsupported aggregator URL scheme %q", u.Scheme)
+			return
+		}
+
+		if c.conn, err = grpc.Dial(u.Host, creds, grpcjson.DialOption()); err != nil {
+			c.err = fmt.Errorf("connecting to %s: %w", u.Host, err)
+		}
+	})
+
+	return c.conn, c.err
+}
+
+func (c *Client) Send(ctx context.Context, report *Report) error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	if err := conn.Invoke(ctx, ReportMethod, report, &Empty{}); err != nil {
+		return fmt.Errorf("sending report: %w", err)
+	}
+
+	return nil
+}
+
+// Violations returns all the violations the aggregator keeps.
+func (c *Client) Violations(ctx context.Context) ([]Violation, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &ViolationsReply{}
+	if err := conn.Invoke(ctx, ViolationsMethod, &ViolationsRequest{}, reply); err != nil {
+		return nil, fmt.Errorf("getting violations: %w", err)
+	}
+
+	if reply.Violations == nil {
+		reply.Violations = []Violation{}
+	}
+
+	return reply.Violations, nil
+}
+
+// Buffer keeps the violations of a node agent until they are sent. When it is full the oldest are dropped.
+type Buffer struct {
+	Max int
+
+	lock       sync.Mutex
+	violations []events.Event
+	dropped    int
+}
+
+func (b *Buffer) Add(e *events.Event) {
+	if !e.IsViolation() {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.violations = append(b.violations, *e)
+	b.trim()
+}
+
+// Take empties the buffer, returning its violations and how many were dropped since the last call.
+func (b *Buffer) Take() ([]events.Event, int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	violations, dropped := b.violations, b.dropped
+	b.violations, b.dropped = nil, 0
+
+	return violations, dropped
+}
+
+// Return puts back the violations which could not be sent, before the ones added since they were taken.
+func (b *Buffer) Return(violations []events.Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.violations = append(violations, b.violations...)
+	b.trim()
+}
+
+func (b *Buffer) trim() {
+	if b.Max > 0 && len(b.violations) > b.Max {
+		b.dropped += len(b.violations) - b.Max
+		b.violations = b.violations[len(b.violations)-b.Max:]
+	}
+}
@@ -0,0 +1,117 @@
+package aggregator
+
+import (
+	"context"
+	"net"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/grpcjson"
+	"github.com/kinvolk/fanotify-poc/pkg/sink"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// The gRPC service of the aggregator, see api/aggregator.proto. The messages are encoded as JSON, see grpcjson.
+const (
+	ServiceName      = "fanotifymon.aggregator.v1.Aggregator"
+	ReportMethod     = "/" + ServiceName + "/Report"
+	ViolationsMethod = "/" + ServiceName + "/Violations"
+	NodesMethod      = "/" + ServiceName + "/Nodes"
+)
+
+// ViolationsRequest filters the violations, the empty fields match everything.
+type ViolationsRequest struct {
+	Node      string `json:"node,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+}
+
+type ViolationsReply struct {
+	Violations []Violation `json:"violations"`
+}
+
+type NodesRequest struct{}
+
+type NodesReply struct {
+	Nodes []Node `json:"nodes"`
+}
+
+// Empty is the reply of the methods which return nothing.
+type Empty struct{}
+
+// service is what the ServiceDesc checks the server implements.
+type service interface {
+	Add(r *Report)
+	Violations(node, namespace, pod string) []Violation
+	Nodes() []Node
+}
+
+// decisions is what the ServiceDesc of the decisions checks the server implements.
+type decisions interface {
+	AddDecision(e *events.Event)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*service)(nil),
+	Methods: []grpc.MethodDesc{
+		grpcjson.Method(ServiceName, "Report", func() interface{} { return &Report{} }, func(_ context.Context, srv, req interface{}) (interface{}, error) {
+			report := req.(*Report)
+			if report.Node == "" {
+				return nil, status.Error(codes.InvalidArgument, "missing node name")
+			}
+
+			srv.(*Server).Add(report)
+			return &Empty{}, nil
+		}),
+		grpcjson.Method(ServiceName, "Violations", func() interface{} { return &ViolationsRequest{} }, func(_ context.Context, srv, req interface{}) (interface{}, error) {
+			q := req.(*ViolationsRequest)
+			return &ViolationsReply{Violations: srv.(*Server).Violations(q.Node, q.Namespace, q.Pod)}, nil
+		}),
+		grpcjson.Method(ServiceName, "Nodes", func() interface{} { return &NodesRequest{} }, func(_ context.Context, srv, req interface{}) (interface{}, error) {
+			return &NodesReply{Nodes: srv.(*Server).Nodes()}, nil
+		}),
+	},
+}
+
+// decisionsDesc receives the decisions of the grpc sinks of the agents, see sink.GRPC.
+var decisionsDesc = grpc.ServiceDesc{
+	ServiceName: sink.GRPCService,
+	HandlerType: (*decisions)(nil),
+	Methods: []grpc.MethodDesc{
+		grpcjson.Method(sink.GRPCService, "Send", func() interface{} { return &events.Event{} }, func(_ context.Context, srv, req interface{}) (interface{}, error) {
+			e := req.(*events.Event)
+			if e.Node == "" {
+				return nil, status.Error(codes.InvalidArgument, "missing node name")
+			}
+
+			srv.(*Server).AddDecision(e)
+			return &Empty{}, nil
+		}),
+	},
+}
+
+// RunGRPC serves the gRPC service the agents report to, and the one of the decisions of their grpc sinks, until it
+// fails. It is served over TLS when it is set.
+func (s *Server) RunGRPC(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	opts := []grpc.ServerOption{grpcjson.ServerOption()}
+	if s.TLS != nil {
+		// The handshakes are checked as for HTTPS, with the client certificates.
+		opts = append(opts, grpc.Creds(credentials.NewTLS(s.TLS)))
+	}
+
+	server := grpc.NewServer(opts...)
+	server.RegisterService(&serviceDesc, s)
+	server.RegisterService(&decisionsDesc, s)
+
+	log.Infof("serving the aggregator gRPC service on %s", addr)
+	return server.Serve(l)
+}
@@ -0,0 +1,233 @@
+// Package alert fires alerts to Alertmanager from threshold rules on the decisions of the node agent, without
+// Prometheus rules.
+package alert
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// evalInterval is how often the rules are evaluated, besides when a decision reaches the count of one.
+	evalInterval = 15 * time.Second
+	// resendInterval is how often the firing alerts are sent again, before the resolve timeout of Alertmanager
+	// resolves them.
+	resendInterval = time.Minute
+)
+
+// Engine counts the decisions of every rule, and sends the alerts of the groups reaching their count to Alertmanager
+// until they are resolved.
+type Engine struct {
+	node   string
+	rules  []*Rule
+	client *Client
+
+	lock   sync.Mutex
+	groups map[string]*group
+	nudge  chan struct{}
+}
+
+// group are the decisions of a rule with the same labels.
+type group struct {
+	rule   *Rule
+	labels map[string]string
+
+	// times and counts are the decisions within the window, oldest first, total is their sum.
+	times  []time.Time
+	counts []int
+	total  int
+	last   *events.Event
+
+	firing   bool
+	startsAt time.Time
+	sentAt   time.Time
+	// summary and description are the annotations of the alert, set when it started firing.
+	summary, description string
+}
+
+// NewEngine returns the engine of the rules, the alerts are labeled with the node.
+func NewEngine(node string, rules []*Rule, client *Client) *Engine {
+	return &Engine{
+		node:   node,
+		rules:  rules,
+		client: client,
+		groups: make(map[string]*group),
+		nudge:  make(chan struct{}, 1),
+	}
+}
+
+// Record counts the decision in the rules it matches, it can be used as a sink.
+func (en *Engine) Record(e *events.Event) {
+	// A summary of identical decisions stands for all of them.
+	count := 1
+	if e.Count > 0 {
+		count = e.Count
+	}
+
+	en.lock.Lock()
+	defer en.lock.Unlock()
+
+	for _, r := range en.rules {
+		if !r.matches(e) {
+			continue
+		}
+
+		labels := r.labels(e)
+		key := groupKey(r.Name, labels)
+		g := en.groups[key]
+		if g == nil {
+			g = &group{rule: r, labels: labels}
+			en.groups[key] = g
+		}
+
+		g.times = append(g.times, e.Time)
+		g.counts = append(g.counts, count)
+		g.total += count
+		g.last = e
+
+		if !g.firing && g.total >= r.Count {
+			select {
+			case en.nudge <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func groupKey(name string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k, v := range labels {
+		keys = append(keys, k+"="+v)
+	}
+	sort.Strings(keys)
+
+	return name + "{" + strings.Join(keys, ",") + "}"
+}
+
+// Run evaluates the rules every evalInterval, and as soon as a group reaches the count of its rule.
+func (en *Engine) Run() {
+	ticker := time.NewTicker(evalInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-en.nudge:
+		}
+
+		if alerts := en.evaluate(time.Now()); len(alerts) > 0 {
+			if err := en.client.Send(alerts); err != nil {
+				log.Errorf("sending %d alerts: %v", len(alerts), err)
+			}
+		}
+	}
+}
+
+// evaluate returns the alerts to send: the ones which started firing, the firing ones to send again and the resolved
+// ones. The groups without decisions in the window are forgotten.
+func (en *Engine) evaluate(now time.Time) []Alert {
+	en.lock.Lock()
+	defer en.lock.Unlock()
+
+	alerts := []Alert{}
+	for key, g := range en.groups {
+		for len(g.times) > 0 && now.Sub(g.times[0]) >= g.rule.Window {
+			g.total -= g.counts[0]
+			g.times, g.counts = g.times[1:], g.counts[1:]
+		}
+
+		switch {
+		case !g.firing && g.total >= g.rule.Count:
+			g.firing, g.startsAt, g.sentAt = true, now, now
+			g.summary, g.description = en.summary(g), describe(g.last)
+			log.Warnf("alert %s firing: %s", g.rule.Name, g.summary)
+			alerts = append(alerts, en.alert(g, time.Time{}))
+
+		case g.firing && g.total < g.rule.Count:
+			g.firing = false
+			log.Infof("alert %s resolved", g.rule.Name)
+			alerts = append(alerts, en.alert(g, now))
+
+		case g.firing && now.Sub(g.sentAt) >= resendInterval:
+			g.sentAt = now
+			alerts = append(alerts, en.alert(g, time.Time{}))
+		}
+
+		if !g.firing && len(g.times) == 0 {
+			delete(en.groups, key)
+		}
+	}
+
+	return alerts
+}
+
+func (en *Engine) summary(g *group) string {
+	var what []string
+	for _, by := range g.rule.By {
+		what = append(what, fmt.Sprintf("%s %s", by, g.labels[by]))
+	}
+
+	verdicts := make([]string, 0, len(g.rule.Verdicts))
+	for _, v := range g.rule.Verdicts {
+		verdicts = append(verdicts, string(v))
+	}
+
+	return fmt.Sprintf("%d %s decisions in %s on node %s, %s", g.total, strings.Join(verdicts, "/"), g.rule.Window, en.node, strings.Join(what, ", "))
+}
+
+// describe tells about the last decision which fired the alert.
+func describe(e *events.Event) string {
+	desc := fmt.Sprintf("The last one was %s of %s in container %s of pod %s/%s", e.Verdict, e.Path, e.Container, e.Namespace, e.Pod)
+	if e.Reason != "" {
+		desc += ": " + e.Reason
+	}
+
+	return desc
+}
+
+// alert returns the alert of the group, resolved at endsAt unless it is zero.
+func (en *Engine) alert(g *group, endsAt time.Time) Alert {
+	labels := map[string]string{
+		"alertname": g.rule.Name,
+		"severity":  g.rule.Severity,
+		"node":      en.node,
+	}
+	for k, v := range g.labels {
+		labels[k] = v
+	}
+
+	a := Alert{
+		Labels: labels,
+		Annotations: map[string]string{
+			"summary":     g.summary,
+			"description": g.description,
+		},
+		StartsAt: g.startsAt.UTC().Format(time.RFC3339),
+	}
+	if !endsAt.IsZero() {
+		a.EndsAt = endsAt.UTC().Format(time.RFC3339)
+	}
+
+	return a
+}
+
+// Firing returns how many alerts are firing.
+func (en *Engine) Firing() int {
+	en.lock.Lock()
+	defer en.lock.Unlock()
+
+	n := 0
+	for _, g := range en.groups {
+		if g.firing {
+			n++
+		}
+	}
+
+	return n
+}
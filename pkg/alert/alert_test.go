@@ -0,0 +1,131 @@
+package alert
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+)
+
+// TestEngine records the decisions and evaluates the rules at given times, the clock of the engine.
+func TestEngine(t *testing.T) {
+	start := time.Date(2022, 4, 1, 12, 0, 0, 0, time.UTC)
+	rule := &Rule{
+		Name:     "TooManyDenials",
+		Verdicts: []events.Verdict{events.VerdictDeny},
+		Count:    3,
+		Window:   10 * time.Minute,
+		By:       []string{"namespace"},
+		Severity: "warning",
+	}
+
+	type decision struct {
+		namespace string
+		verdict   events.Verdict
+		count     int
+	}
+
+	steps := []struct {
+		name string
+		at   time.Duration
+		// decisions are recorded at the time, before the rules are evaluated.
+		decisions []decision
+		// firing and resolved are the namespaces of the alerts sent.
+		firing   []string
+		resolved []string
+	}{
+		{
+			name:      "under the count",
+			decisions: []decision{{"prod", events.VerdictDeny, 0}, {"prod", events.VerdictDeny, 0}},
+		},
+		{
+			name:      "other verdicts and groups not counted",
+			at:        time.Minute,
+			decisions: []decision{{"prod", events.VerdictAllow, 0}, {"prod", events.VerdictAudit, 0}, {"dev", events.VerdictDeny, 0}},
+		},
+		{
+			name:      "count reached",
+			at:        2 * time.Minute,
+			decisions: []decision{{"prod", events.VerdictDeny, 0}},
+			firing:    []string{"prod"},
+		},
+		{
+			name: "not sent again before the resend interval",
+			at:   2*time.Minute + 30*time.Second,
+		},
+		{
+			name:   "sent again after the resend interval",
+			at:     3 * time.Minute,
+			firing: []string{"prod"},
+		},
+		{
+			name:      "summary counted as its decisions",
+			at:        3*time.Minute + 30*time.Second,
+			decisions: []decision{{"dev", events.VerdictDeny, 2}},
+			firing:    []string{"dev"},
+		},
+		{
+			name:     "first decisions out of the window",
+			at:       10 * time.Minute,
+			firing:   []string{"dev"},
+			resolved: []string{"prod"},
+		},
+		{
+			name:     "all the decisions out of the window",
+			at:       14 * time.Minute,
+			resolved: []string{"dev"},
+		},
+		{
+			name: "nothing left",
+			at:   time.Hour,
+		},
+	}
+
+	en := NewEngine("node1", []*Rule{rule}, nil)
+	for _, step := range steps {
+		now := start.Add(step.at)
+		for _, d := range step.decisions {
+			en.Record(&events.Event{Time: now, Namespace: d.namespace, Verdict: d.verdict, Count: d.count, Path: "/bin/sh"})
+		}
+
+		alerts := en.evaluate(now)
+
+		firing, resolved := []string{}, []string{}
+		for _, a := range alerts {
+			if a.Labels["alertname"] != rule.Name || a.Labels["node"] != "node1" || a.Labels["severity"] != "warning" {
+				t.Errorf("%s: unexpected labels %v", step.name, a.Labels)
+			}
+
+			if a.EndsAt == "" {
+				firing = append(firing, a.Labels["namespace"])
+			} else {
+				resolved = append(resolved, a.Labels["namespace"])
+			}
+		}
+
+		sort.Strings(firing)
+		sort.Strings(resolved)
+		if !sameNames(firing, step.firing) || !sameNames(resolved, step.resolved) {
+			t.Errorf("%s: firing %v and resolved %v, expected %v and %v", step.name, firing, resolved, step.firing, step.resolved)
+		}
+	}
+
+	if en.Firing() != 0 || len(en.groups) != 0 {
+		t.Errorf("%d alerts firing and %d groups left", en.Firing(), len(en.groups))
+	}
+}
+
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
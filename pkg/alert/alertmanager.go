@@ -0,0 +1,57 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const sendTimeout = 10 * time.Second
+
+// Alert is an alert of the Alertmanager API v2.
+type Alert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	StartsAt    string            `json:"startsAt,omitempty"`
+	EndsAt      string            `json:"endsAt,omitempty"`
+}
+
+// Client posts the alerts to Alertmanager, or to a webhook compatible with its API.
+type Client struct {
+	URL string
+
+	client *http.Client
+}
+
+// NewClient returns the client of the Alertmanager at the URL, /api/v2/alerts is added to it unless it has a path.
+func NewClient(url string) *Client {
+	if i := strings.Index(url, "://"); i >= 0 && !strings.Contains(url[i+3:], "/") {
+		url += "/api/v2/alerts"
+	}
+
+	return &Client{URL: url, client: &http.Client{Timeout: sendTimeout}}
+}
+
+func (c *Client) Send(alerts []Alert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return fmt.Errorf("encoding alerts: %w", err)
+	}
+
+	resp, err := c.client.Post(c.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("posting alerts: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("posting alerts: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package alert
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+)
+
+const (
+	defaultWindow   = 5 * time.Minute
+	defaultSeverity = "warning"
+)
+
+// Rule fires once Count decisions matching it are taken within Window, for every group of decisions with the same
+// values of the By labels.
+type Rule struct {
+	Name       string
+	Verdicts   []events.Verdict
+	Namespaces []string
+	Count      int
+	Window     time.Duration
+	// By are the labels grouping the decisions: namespace, pod or container.
+	By       []string
+	Severity string
+}
+
+func (r *Rule) matches(e *events.Event) bool {
+	found := false
+	for _, v := range r.Verdicts {
+		found = found || v == e.Verdict
+	}
+	if !found {
+		return false
+	}
+
+	if len(r.Namespaces) == 0 {
+		return true
+	}
+
+	for _, ns := range r.Namespaces {
+		if ns == e.Namespace {
+			return true
+		}
+	}
+
+	return false
+}
+
+// labels returns the values of the By labels of the decision.
+func (r *Rule) labels(e *events.Event) map[string]string {
+	labels := make(map[string]string, len(r.By))
+	for _, by := range r.By {
+		switch by {
+		case "namespace":
+			labels[by] = e.Namespace
+		case "pod":
+			labels[by] = e.Pod
+		case "container":
+			labels[by] = e.Container
+		}
+	}
+
+	return labels
+}
+
+// ParseRule returns the rule of the spec, its name followed by space separated options: count is how many decisions
+// fire it, within window, 5m by default. verdict and namespace select the decisions with comma separated values, the
+// denials by default, by the comma separated labels grouping them, the namespace by default, and severity is the
+// label of the alert, warning by default. For example:
+//
+//	TooManyDenials count=10 window=5m by=namespace,pod severity=critical
+func ParseRule(spec string) (*Rule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty alert rule")
+	}
+
+	r := &Rule{Name: fields[0], Window: defaultWindow, Severity: defaultSeverity}
+	if strings.Contains(r.Name, "=") {
+		return nil, fmt.Errorf("alert rule %q has no name", spec)
+	}
+
+	for _, opt := range fields[1:] {
+		i := strings.Index(opt, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("alert rule %s: option %q is not key=value", r.Name, opt)
+		}
+
+		key, value := opt[:i], opt[i+1:]
+		switch key {
+		case "count":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("alert rule %s: invalid count %q", r.Name, value)
+			}
+			r.Count = n
+		case "window":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("alert rule %s: invalid window %q", r.Name, value)
+			}
+			r.Window = d
+		case "verdict":
+			for _, v := range strings.Split(value, ",") {
+				switch verdict := events.Verdict(v); verdict {
+				case events.VerdictAllow, events.VerdictDeny, events.VerdictAudit:
+					r.Verdicts = append(r.Verdicts, verdict)
+				default:
+					return nil, fmt.Errorf("alert rule %s: unknown verdict %q", r.Name, v)
+				}
+			}
+		case "namespace":
+			r.Namespaces = append(r.Namespaces, strings.Split(value, ",")...)
+		case "by":
+			for _, by := range strings.Split(value, ",") {
+				switch by {
+				case "namespace", "pod", "container":
+					r.By = append(r.By, by)
+				default:
+					return nil, fmt.Errorf("alert rule %s: unknown label %q, it can be namespace, pod or container", r.Name, by)
+				}
+			}
+		case "severity":
+			r.Severity = value
+		default:
+			return nil, fmt.Errorf("alert rule %s: unknown option %q", r.Name, key)
+		}
+	}
+
+	if r.Count == 0 {
+		return nil, fmt.Errorf("alert rule %s needs a count", r.Name)
+	}
+	if len(r.Verdicts) == 0 {
+		r.Verdicts = []events.Verdict{events.VerdictDeny}
+	}
+	if r.By == nil {
+		r.By = []string{"namespace"}
+	}
+
+	return r, nil
+}
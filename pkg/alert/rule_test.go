@@ -0,0 +1,72 @@
+package alert
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		spec string
+		rule *Rule
+		err  string
+	}{
+		{
+			spec: "TooManyDenials count=10",
+			rule: &Rule{
+				Name:     "TooManyDenials",
+				Verdicts: []events.Verdict{events.VerdictDeny},
+				Count:    10,
+				Window:   5 * time.Minute,
+				By:       []string{"namespace"},
+				Severity: "warning",
+			},
+		},
+		{
+			spec: "Audits count=3 window=1m verdict=audit,deny namespace=prod,dev by=pod,container severity=critical",
+			rule: &Rule{
+				Name:       "Audits",
+				Verdicts:   []events.Verdict{events.VerdictAudit, events.VerdictDeny},
+				Namespaces: []string{"prod", "dev"},
+				Count:      3,
+				Window:     time.Minute,
+				By:         []string{"pod", "container"},
+				Severity:   "critical",
+			},
+		},
+		{spec: "", err: "empty alert rule"},
+		{spec: "count=10", err: "has no name"},
+		{spec: "Denials", err: "needs a count"},
+		{spec: "Denials count", err: `option "count" is not key=value`},
+		{spec: "Denials count=0", err: "invalid count"},
+		{spec: "Denials count=ten", err: "invalid count"},
+		{spec: "Denials count=1 window=-1m", err: "invalid window"},
+		{spec: "Denials count=1 window=5", err: "invalid window"},
+		{spec: "Denials count=1 verdict=block", err: `unknown verdict "block"`},
+		{spec: "Denials count=1 by=node", err: `unknown label "node"`},
+		{spec: "Denials count=1 for=5m", err: `unknown option "for"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			rule, err := ParseRule(tt.spec)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, expected %q", err, tt.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rule, tt.rule) {
+				t.Errorf("rule %+v, expected %+v", rule, tt.rule)
+			}
+		})
+	}
+}
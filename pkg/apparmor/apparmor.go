@@ -0,0 +1,80 @@
+// Package apparmor generates AppArmor profiles allowing the executions observed in a container, to be applied with
+// the pod annotations next to the enforcement of the agent.
+package apparmor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+)
+
+// AnnotationPrefix is followed by the name of the container, the value is localhost/ followed by the profile name.
+const AnnotationPrefix = "container.apparmor.security.beta.kubernetes.io/"
+
+// Profile only allows the given files to be executed, everything else is allowed as in the default profile of the
+// runtime.
+type Profile struct {
+	Name  string
+	Execs []string
+}
+
+// FromEvents returns the profile allowing the executions of the events which were not denied.
+func FromEvents(name string, evs []events.Event) *Profile {
+	p := &Profile{Name: name}
+
+	seen := make(map[string]bool)
+	for _, e := range evs {
+		if e.Verdict == events.VerdictDeny || seen[e.Path] {
+			continue
+		}
+
+		seen[e.Path] = true
+		p.Execs = append(p.Execs, e.Path)
+	}
+
+	sort.Strings(p.Execs)
+
+	return p
+}
+
+// Annotation returns the annotation applying the profile, once loaded on the nodes, to the container.
+func (p *Profile) Annotation(container string) string {
+	return fmt.Sprintf("%s%s: localhost/%s", AnnotationPrefix, container, p.Name)
+}
+
+func (p *Profile) String() string {
+	b := &strings.Builder{}
+
+	fmt.Fprintf(b, "#include <tunables/global>\n\n")
+	fmt.Fprintf(b, "profile %s flags=(attach_disconnected,mediate_deleted) {\n", p.Name)
+	fmt.Fprintf(b, "  #include <abstractions/base>\n\n")
+	fmt.Fprintf(b, "  network,\n  capability,\n  signal,\n  unix,\n  ptrace (read),\n\n")
+	// The files can be accessed as usual, they just can't be executed.
+	fmt.Fprintf(b, "  /** rwlkm,\n\n")
+	fmt.Fprintf(b, "  # Observed executions.\n")
+	for _, path := range p.Execs {
+		fmt.Fprintf(b, "  %s ix,\n", quote(path))
+	}
+	fmt.Fprintf(b, "\n  deny @{PROC}/sysrq-trigger rwklx,\n  deny /sys/firmware/** rwklx,\n}\n")
+
+	return b.String()
+}
+
+// quote escapes the characters of the path which are globs for AppArmor, the path is quoted if it has spaces.
+func quote(path string) string {
+	b := &strings.Builder{}
+	for _, c := range path {
+		if strings.ContainsRune(`*?[]{}^\"`, c) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+
+	if strings.ContainsAny(path, " \t") {
+		return `"` + b.String() + `"`
+	}
+
+	return b.String()
+}
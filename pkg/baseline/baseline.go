@@ -0,0 +1,406 @@
+// Package baseline has the executables trusted in a container, as computed from its rootfs or its image.
+package baseline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const Version = "v1"
+
+// hashBufferSize is how much of a file is read at once when hashing it.
+const hashBufferSize = 64 << 10
+
+var hashBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, hashBufferSize)
+		return &buf
+	},
+}
+
+// ErrTooLarge is returned when a file is larger than the size allowed to be hashed.
+var ErrTooLarge = errors.New("file too large")
+
+// Baseline is what is written to the baseline files.
+type Baseline struct {
+	Version string    `json:"version"`
+	Created time.Time `json:"created"`
+
+	// Image and ImageDigest are set when the baseline was computed from an image.
+	Image       string `json:"image,omitempty"`
+	ImageDigest string `json:"imageDigest,omitempty"`
+
+	// Files are the sha256sums of the executables by their path in the container.
+	Files map[string]string `json:"files"`
+}
+
+func New(files map[string]string) *Baseline {
+	return &Baseline{
+		Version: Version,
+		Created: time.Now().UTC(),
+		Files:   files,
+	}
+}
+
+// Walker computes the baseline of a rootfs.
+type Walker struct {
+	// Skip ignores the paths in the container for which it returns true.
+	Skip func(path string) bool
+	// Hash is HashFile if it is not set.
+	Hash func(path string) (string, error)
+	// Workers is how many files are hashed at once, at least one.
+	Workers int
+	// Progress is called after every file hashed with the number of files hashed and the total to hash.
+	Progress func(hashed, total int)
+}
+
+// Inode identifies a file whatever its path, the hard links of a file have the same.
+type Inode struct {
+	Dev uint64
+	Ino uint64
+}
+
+// file is an executable to hash.
+type file struct {
+	path    string
+	cntPath string
+	inode   Inode
+	// links are the other paths of the file in the container, it is hashed once for all of them.
+	links []string
+	sum   string
+	err   error
+}
+
+// Compute walks the rootfs and returns the sha256sums of the executables by their path in the container. Symlinks
+// are ignored, the executables are only listed under their canonical path, the one without symlinks. The files are
+// listed first, then hashed by the workers. The hard links of a file are hashed once.
+func (w *Walker) Compute(root string) (map[string]string, error) {
+	sums, _, err := w.ComputeInodes(root)
+	return sums, err
+}
+
+// ComputeInodes is Compute also returning the paths of the executables by inode, see Inodes.
+func (w *Walker) ComputeInodes(root string) (map[string]string, map[Inode]string, error) {
+	files, err := w.list(root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hash := w.Hash
+	if hash == nil {
+		hash = HashFile
+	}
+
+	workers := w.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	// The workers and the feeder stop when the hashing fails.
+	done := make(chan struct{})
+	defer close(done)
+
+	todo := make(chan file)
+	hashed := make(chan file)
+
+	go func() {
+		defer close(todo)
+
+		for _, f := range files {
+			select {
+			case todo <- f:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for f := range todo {
+				f.sum, f.err = hash(f.path)
+
+				select {
+				case hashed <- f:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	sums := make(map[string]string, len(files))
+	for i := range files {
+		f := <-hashed
+		switch {
+		case errors.Is(f.err, ErrTooLarge):
+			// The files too large to be hashed are not trusted.
+		case f.err != nil:
+			return nil, nil, fmt.Errorf("calculating sha256sum of %s: %w", f.path, f.err)
+		default:
+			sums[f.cntPath] = f.sum
+			for _, link := range f.links {
+				sums[link] = f.sum
+			}
+		}
+
+		if w.Progress != nil {
+			w.Progress(i+1, len(files))
+		}
+	}
+
+	return sums, inodes(files), nil
+}
+
+// Inodes lists the executables of the rootfs without hashing them, and returns one of their paths in the container by
+// inode. The executables run through a hard link made later have the inode of a file of the baseline.
+func (w *Walker) Inodes(root string) (map[Inode]string, error) {
+	files, err := w.list(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return inodes(files), nil
+}
+
+func inodes(files []file) map[Inode]string {
+	paths := make(map[Inode]string, len(files))
+	for _, f := range files {
+		if f.inode != (Inode{}) {
+			paths[f.inode] = f.cntPath
+		}
+	}
+
+	return paths
+}
+
+// list returns the executables of the rootfs, the hard links of a file are only listed once.
+func (w *Walker) list(root string) ([]file, error) {
+	files := []file{}
+	// linked are the indexes of the files with hard links by inode.
+	linked := map[Inode]int{}
+
+	// NOTE: If there is no trailing front slash then this function does not walk on the dir.
+	err := filepath.WalkDir(root+"/",
+		func(path string, dirEntry os.DirEntry, err error) error {
+			if err != nil && os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("default error: %v", err)
+			}
+
+			// Figure out if the file is not a dir.
+			if dirEntry.IsDir() {
+				return nil
+			}
+
+			info, err := dirEntry.Info()
+			if err != nil && os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("getting info: %w", err)
+			}
+
+			// Here the path looks like: /usr/bin/touch
+			cntPath := "/" + strings.TrimPrefix(path, root+"/")
+
+			if w.Skip != nil && w.Skip(cntPath) {
+				return nil
+			}
+
+			// Ignore sym-links.
+			if info.Mode()&fs.ModeSymlink != 0 {
+				return nil
+			}
+
+			// Check if the file is neither user executabe (0100) nor group executable (0010) nor other executable (0001).
+			// We don't have any concern for non-executables.
+			if !(info.Mode()&0100 != 0 || info.Mode()&0010 != 0 || info.Mode()&0001 != 0) {
+				return nil
+			}
+
+			f := file{path: path, cntPath: cntPath}
+			if st, ok := info.Sys().(*syscall.Stat_t); ok {
+				f.inode = Inode{Dev: uint64(st.Dev), Ino: uint64(st.Ino)}
+
+				if st.Nlink > 1 {
+					if i, ok := linked[f.inode]; ok {
+						files[i].links = append(files[i].links, cntPath)
+						return nil
+					}
+					linked[f.inode] = len(files)
+				}
+			}
+
+			files = append(files, f)
+
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("opening file: %w", err)
+	}
+	defer f.Close()
+
+	return Hash(f)
+}
+
+func Hash(r io.Reader) (string, error) {
+	return HashLimit(r, 0)
+}
+
+// HashLimit hashes at most max bytes, 0 for no limit. It fails with ErrTooLarge if there are more. The data is read
+// in chunks with buffers reused between the calls.
+func HashLimit(r io.Reader, max int64) (string, error) {
+	buf := hashBuffers.Get().(*[]byte)
+	defer hashBuffers.Put(buf)
+
+	h := sha256.New()
+	var size int64
+
+	for {
+		n, err := r.Read(*buf)
+		if n > 0 {
+			size += int64(n)
+			if max > 0 && size > max {
+				return "", fmt.Errorf("%w: more than %d bytes", ErrTooLarge, max)
+			}
+
+			h.Write((*buf)[:n])
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("reading data: %w", err)
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ReadFile reads a baseline written by WriteFile.
+func ReadFile(path string) (*Baseline, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading baseline: %w", err)
+	}
+
+	return Decode(data)
+}
+
+func Decode(data []byte) (*Baseline, error) {
+	b := &Baseline{}
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, fmt.Errorf("decoding baseline: %w", err)
+	}
+
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *Baseline) Validate() error {
+	if b.Version != Version {
+		return fmt.Errorf("unsupported baseline version %q", b.Version)
+	}
+
+	for path, sum := range b.Files {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("path %q is not absolute", path)
+		}
+
+		if _, err := hex.DecodeString(sum); err != nil || len(sum) != sha256.Size*2 {
+			return fmt.Errorf("invalid sha256sum of %q", path)
+		}
+	}
+
+	return nil
+}
+
+// WriteFile writes the baseline as JSON, to the standard output if path is "-".
+func (b *Baseline) WriteFile(path string) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding baseline: %w", err)
+	}
+	data = append(data, '\n')
+
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = os.WriteFile(path, data, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("writing baseline: %w", err)
+	}
+
+	return nil
+}
+
+// Store keeps the imported baselines by the digest of their image, so they can be used instead of walking the rootfs
+// of the containers of the image.
+type Store struct {
+	Dir string
+
+	lock      sync.Mutex
+	evictions map[string]int
+}
+
+func (s *Store) path(digest string) string {
+	return filepath.Join(s.Dir, strings.ReplaceAll(digest, ":", "-")+".json")
+}
+
+// Get returns the baseline of the image, nil if there is none. The modification time of its file is when it was last
+// used, the least recently used baselines are removed first by GC.
+func (s *Store) Get(digest string) (*Baseline, error) {
+	path := s.path(digest)
+	b, err := ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The baseline is used anyway when it can't be touched, it is only evicted sooner.
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+
+	return b, nil
+}
+
+func (s *Store) Put(b *Baseline) error {
+	if b.ImageDigest == "" {
+		return fmt.Errorf("the baseline has no image digest")
+	}
+
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return fmt.Errorf("creating baseline store: %w", err)
+	}
+
+	return b.WriteFile(s.path(b.ImageDigest))
+}
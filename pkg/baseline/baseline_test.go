@@ -0,0 +1,75 @@
+package baseline
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// BenchmarkHash measures the hashing of the executed files by size.
+func BenchmarkHash(b *testing.B) {
+	for _, size := range []int64{64 << 10, 1 << 20, 16 << 20} {
+		f, err := os.CreateTemp(b.TempDir(), "exe")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer f.Close()
+
+		if err := f.Truncate(size); err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := Hash(f); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCompute measures the computation of the baseline of rootfs with more and more executables, of 256 KiB
+// each.
+func BenchmarkCompute(b *testing.B) {
+	for _, count := range []int{100, 1000, 5000} {
+		root := b.TempDir()
+		for i := 0; i < count; i++ {
+			dir := filepath.Join(root, "usr", fmt.Sprintf("bin%d", i/100))
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				b.Fatal(err)
+			}
+
+			f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("exe%d", i)), os.O_CREATE|os.O_WRONLY, 0755)
+			if err != nil {
+				b.Fatal(err)
+			}
+			// Different contents, the executables with the same one would not cost the same.
+			fmt.Fprintf(f, "%d", i)
+			err = f.Truncate(256 << 10)
+			f.Close()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		b.Run(fmt.Sprintf("%d-files", count), func(b *testing.B) {
+			w := &Walker{Workers: 4}
+			for i := 0; i < b.N; i++ {
+				sums, err := w.Compute(root)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(sums) != count {
+					b.Fatalf("got %d executables, expected %d", len(sums), count)
+				}
+			}
+		})
+	}
+}
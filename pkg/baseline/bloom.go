@@ -0,0 +1,60 @@
+package baseline
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+const (
+	// bloomBitsPerFile and bloomHashes give about 1% of false positives.
+	bloomBitsPerFile = 10
+	bloomHashes      = 7
+)
+
+// bloom tells the paths which are definitely not in a table, without reading it.
+type bloom struct {
+	words  []uint64
+	hashes uint32
+}
+
+func newBloom(files int) *bloom {
+	words := (files*bloomBitsPerFile + 63) / 64
+	if words == 0 {
+		words = 1
+	}
+
+	return &bloom{words: make([]uint64, words), hashes: bloomHashes}
+}
+
+// positions calls fn with the bits of the path, derived from two halves of its hash.
+func (b *bloom) positions(path string, fn func(bit uint64) bool) {
+	h := fnv.New64a()
+	h.Write([]byte(path))
+	sum := h.Sum64()
+
+	h1, h2 := sum&math.MaxUint32, sum>>32|1
+	bits := uint64(len(b.words)) * 64
+	for i := uint64(0); i < uint64(b.hashes); i++ {
+		if !fn((h1 + i*h2) % bits) {
+			return
+		}
+	}
+}
+
+func (b *bloom) add(path string) {
+	b.positions(path, func(bit uint64) bool {
+		b.words[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+}
+
+// mayContain returns false when the path was never added.
+func (b *bloom) mayContain(path string) bool {
+	found := true
+	b.positions(path, func(bit uint64) bool {
+		found = b.words[bit/64]&(1<<(bit%64)) != 0
+		return found
+	})
+
+	return found
+}
@@ -0,0 +1,86 @@
+package baseline
+
+import (
+	"io"
+	"sync"
+)
+
+// Cache shares the files of the baselines computed from the rootfs of the containers running the same image, so the
+// rootfs of every replica is not walked and hashed again. The files are never modified once computed, the containers
+// whose baseline changes overlay their changes. They are dropped once no container uses them, and closed when they are
+// a Table.
+type Cache struct {
+	lock    sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	refs  int
+	ready chan struct{}
+	files Sums
+	err   error
+}
+
+// Get returns the files of the baseline with the key, computing them with compute if no other container did. The
+// containers computing the same key at the same time wait for the first one. Release has to be called once the files
+// are not used anymore, unless there was an error.
+func (c *Cache) Get(key string, compute func() (Sums, error)) (Sums, error) {
+	c.lock.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]*cacheEntry)
+	}
+
+	e, ok := c.entries[key]
+	if !ok {
+		e = &cacheEntry{ready: make(chan struct{})}
+		c.entries[key] = e
+	}
+	e.refs++
+	c.lock.Unlock()
+
+	if !ok {
+		e.files, e.err = compute()
+		close(e.ready)
+	}
+
+	<-e.ready
+
+	if e.err != nil {
+		c.lock.Lock()
+		// The next container tries again.
+		if c.entries[key] == e {
+			delete(c.entries, key)
+		}
+		c.lock.Unlock()
+
+		return nil, e.err
+	}
+
+	return e.files, nil
+}
+
+func (c *Cache) Release(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+
+	e.refs--
+	if e.refs <= 0 {
+		delete(c.entries, key)
+		if closer, ok := e.files.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+// Len returns how many baselines are shared.
+func (c *Cache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.entries)
+}
@@ -0,0 +1,140 @@
+package baseline
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The reasons the baselines are evicted from the store.
+const (
+	EvictQuota        = "quota"
+	EvictImageRemoved = "image-removed"
+)
+
+// StoreStats are the baselines in the store and the ones evicted since the agent started, by reason.
+type StoreStats struct {
+	Baselines int
+	Bytes     int64
+	Evictions map[string]int
+}
+
+type storedBaseline struct {
+	digest   string
+	path     string
+	size     int64
+	lastUsed time.Time
+}
+
+// list returns the baselines in the store, the least recently used first.
+func (s *Store) list() ([]storedBaseline, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing baseline store: %w", err)
+	}
+
+	baselines := []storedBaseline{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			// Removed in the meantime.
+			continue
+		}
+
+		baselines = append(baselines, storedBaseline{
+			// The first dash of the file name is the colon of the digest, see path.
+			digest:   strings.Replace(strings.TrimSuffix(name, ".json"), "-", ":", 1),
+			path:     filepath.Join(s.Dir, name),
+			size:     info.Size(),
+			lastUsed: info.ModTime(),
+		})
+	}
+
+	sort.Slice(baselines, func(i, j int) bool {
+		return baselines[i].lastUsed.Before(baselines[j].lastUsed)
+	})
+
+	return baselines, nil
+}
+
+// GC removes the baselines of the images which are not in images and were not used for grace, then the least
+// recently used baselines until the store fits in quota bytes. A nil images keeps the baselines of the images which
+// are not on the node, a quota of 0 does not limit the size of the store.
+func (s *Store) GC(quota int64, images map[string]bool, grace time.Duration) error {
+	baselines, err := s.list()
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	for _, b := range baselines {
+		size += b.size
+	}
+
+	now := time.Now()
+	for _, b := range baselines {
+		reason := ""
+		switch {
+		case images != nil && !images[b.digest] && now.Sub(b.lastUsed) > grace:
+			reason = EvictImageRemoved
+		case quota > 0 && size > quota:
+			reason = EvictQuota
+		default:
+			continue
+		}
+
+		if err := os.Remove(b.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("removing baseline of image %s: %w", b.digest, err)
+		}
+
+		size -= b.size
+		s.evicted(reason)
+	}
+
+	return nil
+}
+
+func (s *Store) evicted(reason string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.evictions == nil {
+		s.evictions = make(map[string]int)
+	}
+	s.evictions[reason]++
+}
+
+// Stats returns the baselines in the store and the ones evicted.
+func (s *Store) Stats() (StoreStats, error) {
+	baselines, err := s.list()
+	if err != nil {
+		return StoreStats{}, err
+	}
+
+	stats := StoreStats{Baselines: len(baselines), Evictions: map[string]int{}}
+	for _, b := range baselines {
+		stats.Bytes += b.size
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for reason, n := range s.evictions {
+		stats.Evictions[reason] = n
+	}
+
+	return stats, nil
+}
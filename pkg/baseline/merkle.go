@@ -0,0 +1,245 @@
+package baseline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"sort"
+	"strings"
+)
+
+// TreeNode is a directory of the Merkle tree of a baseline. Its hash covers the names and the hashes of its entries,
+// the sums of the files and the hashes of the subdirectories, so two directories with the same hash have the same
+// files and the ones which differ can be found by only comparing the subdirectories whose hashes differ.
+type TreeNode struct {
+	Path    string      `json:"path"`
+	Hash    string      `json:"hash"`
+	Entries []TreeEntry `json:"entries"`
+}
+
+// TreeEntry is a file or a subdirectory of a directory of the tree.
+type TreeEntry struct {
+	Name string `json:"name"`
+	// Hash is the sum of a file or the hash of a subdirectory.
+	Hash string `json:"hash"`
+	Dir  bool   `json:"dir,omitempty"`
+}
+
+// Tree is the Merkle tree of the directories of a baseline.
+type Tree struct {
+	dirs map[string]*TreeNode
+}
+
+// NewTree computes the tree of the files of the baseline.
+func NewTree(sums Sums) (*Tree, error) {
+	t := &Tree{dirs: map[string]*TreeNode{"/": {Path: "/"}}}
+
+	// dir returns the node of the directory, adding it to its parents.
+	var dir func(p string) *TreeNode
+	dir = func(p string) *TreeNode {
+		if node, ok := t.dirs[p]; ok {
+			return node
+		}
+
+		node := &TreeNode{Path: p}
+		t.dirs[p] = node
+		parent := dir(path.Dir(p))
+		parent.Entries = append(parent.Entries, TreeEntry{Name: path.Base(p), Dir: true})
+
+		return node
+	}
+
+	err := sums.Range(func(p, sum string) bool {
+		p = path.Clean("/" + p)
+		if p == "/" {
+			return true
+		}
+
+		parent := dir(path.Dir(p))
+		parent.Entries = append(parent.Entries, TreeEntry{Name: path.Base(p), Hash: sum})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The subdirectories are hashed before their parent.
+	paths := make([]string, 0, len(t.dirs))
+	for p := range t.dirs {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return strings.Count(paths[i], "/") > strings.Count(paths[j], "/")
+	})
+
+	for _, p := range paths {
+		node := t.dirs[p]
+		sort.Slice(node.Entries, func(i, j int) bool {
+			return node.Entries[i].Name < node.Entries[j].Name
+		})
+
+		for i := range node.Entries {
+			if node.Entries[i].Dir {
+				node.Entries[i].Hash = t.dirs[path.Join(p, node.Entries[i].Name)].Hash
+			}
+		}
+
+		node.Hash = hashEntries(node.Entries)
+	}
+
+	return t, nil
+}
+
+func hashEntries(entries []TreeEntry) string {
+	h := sha256.New()
+	for _, e := range entries {
+		kind := "f"
+		if e.Dir {
+			kind = "d"
+		}
+
+		h.Write([]byte(kind + e.Name + "\x00" + e.Hash + "\n"))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Root returns the hash of the whole baseline.
+func (t *Tree) Root() string {
+	return t.dirs["/"].Hash
+}
+
+// Node returns the directory of the tree, nil if there is no executable under it.
+func (t *Tree) Node(dir string) *TreeNode {
+	return t.dirs[path.Clean("/"+dir)]
+}
+
+// Source returns the directories of the tree.
+func (t *Tree) Source() NodeSource {
+	return func(dir string) (*TreeNode, error) {
+		return t.Node(dir), nil
+	}
+}
+
+// NodeSource returns a directory of a tree, nil if there is no executable under it. It can fetch it from a remote
+// agent, see Compare.
+type NodeSource func(dir string) (*TreeNode, error)
+
+// Diff lists the files added, removed and modified between two baselines.
+type Diff struct {
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Modified []string `json:"modified"`
+}
+
+// Empty tells if the baselines have the same files.
+func (d *Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+// Compare returns the files which changed from the baseline before to the one after under dir. Only the directories whose
+// hashes differ are looked at, the sources are called once with every one of them.
+func Compare(before, after NodeSource, dir string) (*Diff, error) {
+	d := &Diff{Added: []string{}, Removed: []string{}, Modified: []string{}}
+	if err := d.compare(before, after, path.Clean("/"+dir)); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Modified)
+
+	return d, nil
+}
+
+func (d *Diff) compare(before, after NodeSource, dir string) error {
+	oldNode, err := before(dir)
+	if err != nil {
+		return err
+	}
+
+	newNode, err := after(dir)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case oldNode == nil && newNode == nil:
+		return nil
+	case oldNode == nil:
+		return listNode(after, newNode, &d.Added)
+	case newNode == nil:
+		return listNode(before, oldNode, &d.Removed)
+	case oldNode.Hash == newNode.Hash:
+		return nil
+	}
+
+	oldEntries := map[string]TreeEntry{}
+	for _, e := range oldNode.Entries {
+		oldEntries[e.Name] = e
+	}
+
+	for _, e := range newNode.Entries {
+		p := path.Join(dir, e.Name)
+		o, ok := oldEntries[e.Name]
+		delete(oldEntries, e.Name)
+
+		switch {
+		case ok && o.Hash == e.Hash && o.Dir == e.Dir:
+		case ok && o.Dir && e.Dir:
+			if err := d.compare(before, after, p); err != nil {
+				return err
+			}
+		case ok && !o.Dir && !e.Dir:
+			d.Modified = append(d.Modified, p)
+		default:
+			// Added, or a file replaced by a directory or the other way around.
+			if ok {
+				if err := listEntry(before, p, o, &d.Removed); err != nil {
+					return err
+				}
+			}
+			if err := listEntry(after, p, e, &d.Added); err != nil {
+				return err
+			}
+		}
+	}
+
+	for name, o := range oldEntries {
+		if err := listEntry(before, path.Join(dir, name), o, &d.Removed); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listEntry appends the file, or the files under the directory.
+func listEntry(source NodeSource, p string, e TreeEntry, files *[]string) error {
+	if !e.Dir {
+		*files = append(*files, p)
+		return nil
+	}
+
+	node, err := source(p)
+	if err != nil {
+		return err
+	}
+
+	return listNode(source, node, files)
+}
+
+// listNode appends the files under the directory.
+func listNode(source NodeSource, node *TreeNode, files *[]string) error {
+	if node == nil {
+		return nil
+	}
+
+	for _, e := range node.Entries {
+		if err := listEntry(source, path.Join(node.Path, e.Name), e, files); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package baseline
+
+// Sums are the files of a baseline, by path in the rootfs. They are never modified once computed, see Overlay.
+type Sums interface {
+	// Get returns the sum of the file, false if it is not in the baseline.
+	Get(path string) (string, bool)
+	// Len returns how many files are in the baseline.
+	Len() int
+	// Range calls fn with every file of the baseline until it returns false.
+	Range(fn func(path, sum string) bool) error
+}
+
+// Map are the files of a baseline kept in memory.
+type Map map[string]string
+
+func (m Map) Get(path string) (string, bool) {
+	sum, ok := m[path]
+	return sum, ok
+}
+
+func (m Map) Len() int {
+	return len(m)
+}
+
+func (m Map) Range(fn func(path, sum string) bool) error {
+	for path, sum := range m {
+		if !fn(path, sum) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Overlay are the files of a baseline changed over the ones it was computed with, which can be shared. Only its
+// Files are modified.
+type Overlay struct {
+	Base  Sums
+	Files Map
+}
+
+func (o *Overlay) Get(path string) (string, bool) {
+	if sum, ok := o.Files[path]; ok {
+		return sum, true
+	}
+
+	return o.Base.Get(path)
+}
+
+func (o *Overlay) Len() int {
+	n := o.Base.Len()
+	for path := range o.Files {
+		if _, ok := o.Base.Get(path); !ok {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (o *Overlay) Range(fn func(path, sum string) bool) error {
+	stopped := false
+	for path, sum := range o.Files {
+		if !fn(path, sum) {
+			stopped = true
+			break
+		}
+	}
+	if stopped {
+		return nil
+	}
+
+	return o.Base.Range(func(path, sum string) bool {
+		if _, ok := o.Files[path]; ok {
+			return true
+		}
+
+		return fn(path, sum)
+	})
+}
+
+// ToMap returns the files of the baseline in memory, they must not be modified.
+func ToMap(sums Sums) (map[string]string, error) {
+	if m, ok := sums.(Map); ok {
+		return m, nil
+	}
+
+	files := make(map[string]string, sums.Len())
+	err := sums.Range(func(path, sum string) bool {
+		files[path] = sum
+		return true
+	})
+
+	return files, err
+}
@@ -0,0 +1,445 @@
+package baseline
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
+)
+
+const (
+	// tableBlockSize is how many files of a table share an entry of its index, a lookup reads up to as many records.
+	tableBlockSize = 64
+	// minTableFiles is the size of the smallest baseline written to a table, the smaller ones are kept in memory.
+	minTableFiles = 256
+)
+
+// Tables writes the large baselines to disk, so the memory of the agent does not grow with the executables of the
+// containers. The files of the tables are removed as soon as they are created, they go away with the agent.
+type Tables struct {
+	Dir string
+	// Hot is how many lookups are kept in memory by every table.
+	Hot int
+}
+
+// Store returns the files as a table, or as they are when they are too few. The files are kept in memory when the
+// table can't be written.
+func (t *Tables) Store(files map[string]string) (Sums, error) {
+	if t == nil || len(files) < minTableFiles {
+		return Map(files), nil
+	}
+
+	table, err := t.Write(files)
+	if err != nil {
+		return Map(files), err
+	}
+
+	return table, nil
+}
+
+// Write writes the files to a new table.
+func (t *Tables) Write(files map[string]string) (*Table, error) {
+	if err := os.MkdirAll(t.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating baseline table directory: %w", err)
+	}
+
+	f, err := os.CreateTemp(t.Dir, "baseline-*.table")
+	if err != nil {
+		return nil, fmt.Errorf("creating baseline table: %w", err)
+	}
+
+	// The table is only reached through its descriptor.
+	if err := os.Remove(f.Name()); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unlinking baseline table: %w", err)
+	}
+
+	if err := writeTable(f, files); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("writing baseline table: %w", err)
+	}
+
+	table, err := openTable(f, t.Hot)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return table, nil
+}
+
+// The tables start with their header, followed by the files sorted by path, the words of their bloom filter and their
+// index. A file is the length of the prefix of its path shared with the previous file, the rest of its path and its
+// sum, 32 bytes for the sha256 sums: the first file of every block shares nothing, so it can be read on its own. The
+// index has the offset and the path of the first file of every block. The integers are little endian or uvarints.
+const (
+	tableMagic   = "FMBT"
+	tableVersion = 1
+)
+
+type tableHeader struct {
+	Magic       [4]byte
+	Version     uint32
+	Files       uint64
+	BlockSize   uint32
+	BloomHashes uint32
+	BloomOffset uint64
+	BloomWords  uint64
+	IndexOffset uint64
+}
+
+// The kinds of sums of the files.
+const (
+	sumSHA256 = 0
+	sumRaw    = 1
+)
+
+func writeTable(f *os.File, files map[string]string) error {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	header := tableHeader{Version: tableVersion, Files: uint64(len(paths)), BlockSize: tableBlockSize}
+	copy(header.Magic[:], tableMagic)
+	offset := int64(binary.Size(header))
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	filter := newBloom(len(paths))
+	index := []byte{}
+	record := []byte{}
+	previous := ""
+	for i, path := range paths {
+		shared := 0
+		if i%tableBlockSize == 0 {
+			index = appendString(appendUvarint(index, uint64(offset)), path)
+		} else {
+			shared = sharedPrefix(previous, path)
+		}
+
+		record = appendUvarint(record[:0], uint64(shared))
+		record = appendString(record, path[shared:])
+		record = appendSum(record, files[path])
+		if _, err := w.Write(record); err != nil {
+			return err
+		}
+
+		offset += int64(len(record))
+		filter.add(path)
+		previous = path
+	}
+
+	header.BloomHashes = filter.hashes
+	header.BloomOffset = uint64(offset)
+	header.BloomWords = uint64(len(filter.words))
+	if err := binary.Write(w, binary.LittleEndian, filter.words); err != nil {
+		return err
+	}
+
+	header.IndexOffset = header.BloomOffset + header.BloomWords*8
+	if _, err := w.Write(index); err != nil {
+		return err
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return binary.Write(f, binary.LittleEndian, &header)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendUvarint(b, uint64(len(s))), s...)
+}
+
+// appendSum appends the sha256 sums in binary, the others like the removed files as they are.
+func appendSum(b []byte, sum string) []byte {
+	if len(sum) == sha256.Size*2 {
+		if raw, err := hex.DecodeString(sum); err == nil && hex.EncodeToString(raw) == sum {
+			return append(append(b, sumSHA256), raw...)
+		}
+	}
+
+	return appendString(append(b, sumRaw), sum)
+}
+
+func sharedPrefix(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+
+	return i
+}
+
+func readString(r *bufio.Reader) (string, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// readRecord reads the next file of the table, after the previous one.
+func readRecord(r *bufio.Reader, previous string) (path, sum string, err error) {
+	shared, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", "", err
+	}
+	if shared > uint64(len(previous)) {
+		return "", "", fmt.Errorf("corrupted baseline table")
+	}
+
+	suffix, err := readString(r)
+	if err != nil {
+		return "", "", err
+	}
+	path = previous[:shared] + suffix
+
+	kind, err := r.ReadByte()
+	if err != nil {
+		return "", "", err
+	}
+
+	switch kind {
+	case sumSHA256:
+		raw := make([]byte, sha256.Size)
+		if _, err := io.ReadFull(r, raw); err != nil {
+			return "", "", err
+		}
+		sum = hex.EncodeToString(raw)
+	case sumRaw:
+		if sum, err = readString(r); err != nil {
+			return "", "", err
+		}
+	default:
+		return "", "", fmt.Errorf("corrupted baseline table")
+	}
+
+	return path, sum, nil
+}
+
+type tableBlock struct {
+	first  string
+	offset int64
+}
+
+// Table are the files of a baseline on disk, sorted by path. Only the bloom filter of the paths and the first path of
+// every block of files are kept in memory, with the last lookups: the paths which are not in the baseline are mostly
+// told without reading the disk.
+type Table struct {
+	f     *os.File
+	n     int
+	start int64
+	end   int64
+	index []tableBlock
+	bloom *bloom
+	hot   *hotCache
+}
+
+// openTable reads the header, the bloom filter and the index of the table.
+func openTable(f *os.File, hot int) (*Table, error) {
+	var header tableHeader
+	if err := binary.Read(io.NewSectionReader(f, 0, int64(binary.Size(header))), binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("reading baseline table header: %w", err)
+	}
+
+	if string(header.Magic[:]) != tableMagic || header.Version != tableVersion {
+		return nil, fmt.Errorf("not a baseline table of version %d", tableVersion)
+	}
+
+	filter := &bloom{words: make([]uint64, header.BloomWords), hashes: header.BloomHashes}
+	if err := binary.Read(io.NewSectionReader(f, int64(header.BloomOffset), int64(header.BloomWords*8)), binary.LittleEndian, filter.words); err != nil {
+		return nil, fmt.Errorf("reading baseline table bloom filter: %w", err)
+	}
+
+	t := &Table{
+		f:     f,
+		n:     int(header.Files),
+		start: int64(binary.Size(header)),
+		end:   int64(header.BloomOffset),
+		bloom: filter,
+		hot:   newHotCache(hot),
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(f, int64(header.IndexOffset), math.MaxInt64-int64(header.IndexOffset)))
+	for {
+		offset, err := binary.ReadUvarint(r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading baseline table index: %w", err)
+		}
+
+		first, err := readString(r)
+		if err != nil {
+			return nil, fmt.Errorf("reading baseline table index: %w", err)
+		}
+
+		t.index = append(t.index, tableBlock{first: first, offset: int64(offset)})
+	}
+
+	return t, nil
+}
+
+func (t *Table) Get(path string) (string, bool) {
+	if !t.bloom.mayContain(path) {
+		return "", false
+	}
+
+	if sum, ok, found := t.hot.get(path); found {
+		return sum, ok
+	}
+
+	sum, ok, err := t.lookup(path)
+	if err != nil {
+		// The file is unknown then, like a new one.
+		return "", false
+	}
+
+	t.hot.put(path, sum, ok)
+	return sum, ok
+}
+
+// lookup reads the block of the table which would have the path.
+func (t *Table) lookup(path string) (string, bool, error) {
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].first > path }) - 1
+	if i < 0 {
+		return "", false, nil
+	}
+
+	end := t.end
+	if i+1 < len(t.index) {
+		end = t.index[i+1].offset
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(t.f, t.index[i].offset, end-t.index[i].offset))
+	previous := ""
+	for {
+		p, sum, err := readRecord(r, previous)
+		if errors.Is(err, io.EOF) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, fmt.Errorf("reading baseline table: %w", err)
+		}
+
+		if p == path {
+			return sum, true, nil
+		}
+		if p > path {
+			return "", false, nil
+		}
+		previous = p
+	}
+}
+
+func (t *Table) Len() int {
+	return t.n
+}
+
+func (t *Table) Range(fn func(path, sum string) bool) error {
+	r := bufio.NewReader(io.NewSectionReader(t.f, t.start, t.end-t.start))
+	previous := ""
+	for {
+		path, sum, err := readRecord(r, previous)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading baseline table: %w", err)
+		}
+
+		if !fn(path, sum) {
+			return nil
+		}
+		previous = path
+	}
+}
+
+// Close releases the table, it can't be used anymore.
+func (t *Table) Close() error {
+	return t.f.Close()
+}
+
+// hotCache keeps the last lookups of a table, the files found and the ones which are not.
+type hotCache struct {
+	max int
+
+	lock    sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type hotEntry struct {
+	path string
+	sum  string
+	ok   bool
+}
+
+func newHotCache(max int) *hotCache {
+	return &hotCache{max: max, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *hotCache) get(path string) (sum string, ok, found bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, found := c.entries[path]
+	if !found {
+		return "", false, false
+	}
+
+	c.order.MoveToFront(e)
+	entry := e.Value.(*hotEntry)
+	return entry.sum, entry.ok, true
+}
+
+func (c *hotCache) put(path, sum string, ok bool) {
+	if c.max <= 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if e, found := c.entries[path]; found {
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[path] = c.order.PushFront(&hotEntry{path: path, sum: sum, ok: ok})
+	for c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*hotEntry).path)
+	}
+}
@@ -0,0 +1,223 @@
+package baseline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// tableFiles returns n files with their sha256 sums, and one with a raw sum.
+func tableFiles(n int) map[string]string {
+	files := map[string]string{"/usr/bin/removed": "removed"}
+	for i := 0; i < n; i++ {
+		path := fmt.Sprintf("/usr/bin/exe%04d", i)
+		sum := sha256.Sum256([]byte(path))
+		files[path] = hex.EncodeToString(sum[:])
+	}
+
+	return files
+}
+
+func writeTestTable(t *testing.T, files map[string]string, hot int) *Table {
+	t.Helper()
+
+	table, err := (&Tables{Dir: t.TempDir(), Hot: hot}).Write(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { table.Close() })
+
+	return table
+}
+
+func TestTableGet(t *testing.T) {
+	files := tableFiles(3*tableBlockSize + 10)
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	tests := []struct {
+		name  string
+		path  string
+		found bool
+	}{
+		{name: "first", path: paths[0], found: true},
+		{name: "last", path: paths[len(paths)-1], found: true},
+		{name: "last of a block", path: paths[tableBlockSize-1], found: true},
+		{name: "first of a block", path: paths[tableBlockSize], found: true},
+		{name: "after the first of a block", path: paths[2*tableBlockSize+1], found: true},
+		{name: "raw sum", path: "/usr/bin/removed", found: true},
+		{name: "before the first", path: "/bin/sh"},
+		{name: "after the last", path: "/usr/sbin/init"},
+		{name: "between two blocks", path: paths[tableBlockSize-1] + "x"},
+		{name: "inside a block", path: paths[10] + "x"},
+		{name: "prefix of a file", path: "/usr/bin/exe"},
+	}
+
+	for _, hot := range []int{0, 4} {
+		table := writeTestTable(t, files, hot)
+
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s hot %d", tt.name, hot), func(t *testing.T) {
+				// The second lookup may be answered by the hot cache.
+				for i := 0; i < 2; i++ {
+					sum, ok := table.Get(tt.path)
+					if ok != tt.found || sum != files[tt.path] {
+						t.Fatalf("got %q, %v, expected %q, %v", sum, ok, files[tt.path], tt.found)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestTableRange(t *testing.T) {
+	files := tableFiles(2*tableBlockSize + 1)
+	table := writeTestTable(t, files, 0)
+
+	if table.Len() != len(files) {
+		t.Errorf("length %d, expected %d", table.Len(), len(files))
+	}
+
+	ranged := map[string]string{}
+	previous := ""
+	err := table.Range(func(path, sum string) bool {
+		if path <= previous {
+			t.Errorf("%q after %q", path, previous)
+		}
+		previous = path
+		ranged[path] = sum
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ranged) != len(files) {
+		t.Fatalf("%d files ranged, expected %d", len(ranged), len(files))
+	}
+	for path, sum := range files {
+		if ranged[path] != sum {
+			t.Errorf("sum of %s %q, expected %q", path, ranged[path], sum)
+		}
+	}
+
+	n := 0
+	if err := table.Range(func(path, sum string) bool { n++; return n < 3 }); err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("range went on after false, %d files", n)
+	}
+}
+
+func TestBloom(t *testing.T) {
+	const n = 10000
+
+	filter := newBloom(n)
+	for i := 0; i < n; i++ {
+		filter.add(fmt.Sprintf("/usr/bin/exe%d", i))
+	}
+
+	for i := 0; i < n; i++ {
+		if path := fmt.Sprintf("/usr/bin/exe%d", i); !filter.mayContain(path) {
+			t.Fatalf("false negative %s", path)
+		}
+	}
+
+	positives := 0
+	for i := 0; i < n; i++ {
+		if filter.mayContain(fmt.Sprintf("/usr/sbin/exe%d", i)) {
+			positives++
+		}
+	}
+	if positives > n/20 {
+		t.Errorf("%d false positives out of %d", positives, n)
+	}
+}
+
+func TestTableCorrupted(t *testing.T) {
+	files := tableFiles(minTableFiles)
+	first := "/usr/bin/exe0000"
+
+	tests := []struct {
+		name string
+		// offset is the byte of the first record which is overwritten.
+		offset func(table *Table) int64
+		value  byte
+	}{
+		{
+			name:   "shared prefix longer than the previous path",
+			offset: func(table *Table) int64 { return table.start },
+			value:  5,
+		},
+		{
+			name: "unknown sum kind",
+			// The shared prefix and the length of the path take a byte each.
+			offset: func(table *Table) int64 { return table.start + 2 + int64(len(first)) },
+			value:  9,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := writeTestTable(t, files, 0)
+			if _, err := table.f.WriteAt([]byte{tt.value}, tt.offset(table)); err != nil {
+				t.Fatal(err)
+			}
+
+			err := table.Range(func(path, sum string) bool { return true })
+			if err == nil || !strings.Contains(err.Error(), "corrupted baseline table") {
+				t.Errorf("range error %v, expected a corrupted baseline table", err)
+			}
+
+			// The files of the corrupted block are unknown, the others are still found.
+			if _, ok := table.Get(first); ok {
+				t.Errorf("%s found in the corrupted block", first)
+			}
+			path := fmt.Sprintf("/usr/bin/exe%04d", tableBlockSize)
+			if sum, ok := table.Get(path); !ok || sum != files[path] {
+				t.Errorf("%s not found after the corrupted block", path)
+			}
+		})
+	}
+}
+
+func TestOpenTableHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset int64
+		value  []byte
+	}{
+		{name: "magic", offset: 0, value: []byte("ELF\x7f")},
+		{name: "version", offset: 4, value: []byte{tableVersion + 1, 0, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Create(filepath.Join(t.TempDir(), "baseline.table"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			if err := writeTable(f, tableFiles(minTableFiles)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.WriteAt(tt.value, tt.offset); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := openTable(f, 0); err == nil || !strings.Contains(err.Error(), "not a baseline table") {
+				t.Errorf("open error %v, expected not a baseline table", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package baseline
+
+import "sync"
+
+// WarmCache keeps the files of the baselines computed from the images ahead of their containers, by image digest, so
+// the first container of an image does not walk its rootfs. Only the last Max images are kept.
+type WarmCache struct {
+	Max int
+
+	lock  sync.Mutex
+	files map[string]map[string]string
+	// order has the digests from the oldest to the newest.
+	order []string
+}
+
+// Put keeps the files of the baseline of the image, it drops the oldest image past the maximum.
+func (c *WarmCache) Put(digest string, files map[string]string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.files == nil {
+		c.files = make(map[string]map[string]string)
+	}
+
+	if _, ok := c.files[digest]; !ok {
+		c.order = append(c.order, digest)
+	}
+	c.files[digest] = files
+
+	for len(c.order) > c.Max {
+		delete(c.files, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+// Get returns the files of the baseline of the image, nil if it was not computed. They must not be modified.
+func (c *WarmCache) Get(digest string) map[string]string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.files[digest]
+}
+
+// Len returns how many images have their baseline computed.
+func (c *WarmCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.files)
+}
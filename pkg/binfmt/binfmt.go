@@ -0,0 +1,204 @@
+// Package binfmt identifies the format of the executed files from their headers, without running them.
+package binfmt
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+)
+
+// maxShebang is how much of the first line of the scripts the kernel reads for their interpreter.
+const maxShebang = 256
+
+// upxMagic is in the header of the UPX packer, in the first page of the binaries it packed.
+var upxMagic = []byte("UPX!")
+
+// Format is what the headers of an executed file tell about it.
+type Format struct {
+	// ELF is false for the other files, like the scripts, and for the ELF binaries whose headers can't be parsed.
+	ELF bool
+	// Machine is the architecture the ELF binary was built for.
+	Machine elf.Machine
+	// Static is set for the ELF binaries without program interpreter, which are not linked with any shared library.
+	Static bool
+
+	// Interpreter is the interpreter of the scripts from their shebang, like /bin/sh, with its argument, all the
+	// words after it like the kernel passes them. It is empty for the other files.
+	Interpreter    string
+	InterpreterArg string
+
+	// Findings are what looks suspicious in the binary, they are only set by Analyze.
+	Findings []string
+}
+
+// nativeMachines are the architectures of the binaries the nodes run without emulation, by GOARCH.
+var nativeMachines = map[string][]elf.Machine{
+	"amd64":   {elf.EM_X86_64, elf.EM_386},
+	"386":     {elf.EM_386},
+	"arm64":   {elf.EM_AARCH64, elf.EM_ARM},
+	"arm":     {elf.EM_ARM},
+	"ppc64le": {elf.EM_PPC64},
+	"s390x":   {elf.EM_S390},
+	"riscv64": {elf.EM_RISCV},
+}
+
+// Identify reads the headers of the file.
+func Identify(r io.ReaderAt) (*Format, error) {
+	f, format, err := identify(r)
+	if f != nil {
+		f.Close()
+	}
+
+	return format, err
+}
+
+// Analyze identifies the file like Identify and inspects the ELF binaries for what packed or hand crafted binaries look
+// like: a packer, headers which can't be parsed, segments both writable and executable, an executable stack or an entry
+// point outside of the executable code. These are only hints for the triage, the compilers produce some of them too.
+func Analyze(r io.ReaderAt) (*Format, error) {
+	f, format, err := identify(r)
+	if err != nil {
+		var formatErr *elf.FormatError
+		if errors.As(err, &formatErr) {
+			return &Format{Findings: []string{"malformed ELF headers: " + formatErr.Error()}}, nil
+		}
+
+		return nil, err
+	}
+
+	if f == nil {
+		return format, nil
+	}
+	defer f.Close()
+
+	head := make([]byte, 4096)
+	n, err := r.ReadAt(head, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	if bytes.Contains(head[:n], upxMagic) || f.Section("UPX0") != nil || f.Section("UPX1") != nil {
+		format.Findings = append(format.Findings, "packed with UPX")
+	}
+
+	if len(f.Sections) == 0 {
+		format.Findings = append(format.Findings, "no section headers")
+	}
+
+	entryMapped := false
+	for _, prog := range f.Progs {
+		switch prog.Type {
+		case elf.PT_LOAD:
+			if prog.Flags&elf.PF_X == 0 {
+				continue
+			}
+
+			if prog.Flags&elf.PF_W != 0 {
+				format.Findings = append(format.Findings, fmt.Sprintf("writable and executable segment at %#x", prog.Vaddr))
+			}
+
+			if prog.Filesz == 0 && prog.Memsz > 0 {
+				format.Findings = append(format.Findings, fmt.Sprintf("executable segment at %#x empty in the file", prog.Vaddr))
+			}
+
+			if f.Entry >= prog.Vaddr && f.Entry < prog.Vaddr+prog.Memsz {
+				entryMapped = true
+			}
+
+		case elf.PT_GNU_STACK:
+			if prog.Flags&elf.PF_X != 0 {
+				format.Findings = append(format.Findings, "executable stack")
+			}
+		}
+	}
+
+	if !entryMapped && (f.Type == elf.ET_EXEC || f.Type == elf.ET_DYN) {
+		format.Findings = append(format.Findings, fmt.Sprintf("entry point %#x outside of the executable segments", f.Entry))
+	}
+
+	return format, nil
+}
+
+// identify returns the parsed ELF file with its format, the file is nil for the other files.
+func identify(r io.ReaderAt) (*elf.File, *Format, error) {
+	magic := make([]byte, len(elf.ELFMAG))
+	if _, err := r.ReadAt(magic, 0); errors.Is(err, io.EOF) {
+		return nil, &Format{}, nil
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	if strings.HasPrefix(string(magic), "#!") {
+		format, err := shebang(r)
+		return nil, format, err
+	}
+
+	if string(magic) != elf.ELFMAG {
+		return nil, &Format{}, nil
+	}
+
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ELF headers: %w", err)
+	}
+
+	format := &Format{ELF: true, Machine: f.Machine, Static: true}
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			format.Static = false
+			break
+		}
+	}
+
+	return f, format, nil
+}
+
+// shebang reads the interpreter of the script from its first line.
+func shebang(r io.ReaderAt) (*Format, error) {
+	buf := make([]byte, maxShebang)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("reading shebang: %w", err)
+	}
+
+	line := string(buf[2:n])
+	if i := strings.IndexByte(line, '\n'); i != -1 {
+		line = line[:i]
+	}
+
+	// Like the kernel, the interpreter ends at the first space or tab and the rest is a single argument.
+	line = strings.Trim(line, " \t")
+	format := &Format{Interpreter: line}
+	if i := strings.IndexAny(line, " \t"); i != -1 {
+		format.Interpreter = line[:i]
+		format.InterpreterArg = strings.TrimLeft(line[i:], " \t")
+	}
+
+	return format, nil
+}
+
+// Arch returns the architecture of the ELF binary, like x86_64.
+func (f *Format) Arch() string {
+	return strings.ToLower(strings.TrimPrefix(f.Machine.String(), "EM_"))
+}
+
+// Native tells if the ELF binary was built for the architecture of the node. The architectures the node can't tell are
+// native.
+func (f *Format) Native() bool {
+	machines, ok := nativeMachines[runtime.GOARCH]
+	if !ok {
+		return true
+	}
+
+	for _, m := range machines {
+		if m == f.Machine {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,150 @@
+package bpflsm
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The registers of the BPF machine: r0 has the return values, r1-r5 the arguments of the calls, r6-r9 are kept by
+// the calls and r10 is the read-only frame pointer.
+const (
+	r0 = iota
+	r1
+	r2
+	r3
+	r4
+	r5
+	r6
+	r7
+	r8
+	r9
+	r10
+)
+
+// The helpers called by the programs, see include/uapi/linux/bpf.h.
+const (
+	helperMapLookupElem      = 1
+	helperMapDeleteElem      = 3
+	helperGetCurrentPIDTGID  = 14
+	helperGetCurrentCgroupID = 80
+	helperMapPushElem        = 87
+	helperProbeReadKernelStr = 115
+)
+
+// pseudoMapFD marks the loads of the file descriptors of maps, the kernel replaces them with the maps.
+const pseudoMapFD = 1
+
+type instruction struct {
+	op   uint8
+	dst  uint8
+	src  uint8
+	off  int16
+	imm  int32
+	jump string
+}
+
+// program assembles the instructions, the jumps go to labels resolved when it is encoded.
+type program struct {
+	insns  []instruction
+	labels map[string]int
+}
+
+func (p *program) add(insns ...instruction) {
+	p.insns = append(p.insns, insns...)
+}
+
+func (p *program) label(name string) {
+	if p.labels == nil {
+		p.labels = make(map[string]int)
+	}
+
+	p.labels[name] = len(p.insns)
+}
+
+func (p *program) encode() ([]byte, error) {
+	buf := make([]byte, len(p.insns)*8)
+	for i, insn := range p.insns {
+		if insn.jump != "" {
+			target, ok := p.labels[insn.jump]
+			if !ok {
+				return nil, fmt.Errorf("unknown label %s", insn.jump)
+			}
+			insn.off = int16(target - i - 1)
+		}
+
+		b := buf[i*8:]
+		b[0] = insn.op
+		b[1] = insn.src<<4 | insn.dst
+		binary.LittleEndian.PutUint16(b[2:], uint16(insn.off))
+		binary.LittleEndian.PutUint32(b[4:], uint32(insn.imm))
+	}
+
+	return buf, nil
+}
+
+func movReg(dst, src uint8) instruction {
+	return instruction{op: 0xbf, dst: dst, src: src}
+}
+
+func movImm(dst uint8, imm int32) instruction {
+	return instruction{op: 0xb7, dst: dst, imm: imm}
+}
+
+func addImm(dst uint8, imm int32) instruction {
+	return instruction{op: 0x07, dst: dst, imm: imm}
+}
+
+func rshImm(dst uint8, imm int32) instruction {
+	return instruction{op: 0x77, dst: dst, imm: imm}
+}
+
+func andImm(dst uint8, imm int32) instruction {
+	return instruction{op: 0x57, dst: dst, imm: imm}
+}
+
+// loadDW loads 8 bytes from src+off.
+func loadDW(dst, src uint8, off int16) instruction {
+	return instruction{op: 0x79, dst: dst, src: src, off: off}
+}
+
+// loadW loads 4 bytes from src+off.
+func loadW(dst, src uint8, off int16) instruction {
+	return instruction{op: 0x61, dst: dst, src: src, off: off}
+}
+
+// storeDW stores the 8 bytes of src at dst+off.
+func storeDW(dst uint8, off int16, src uint8) instruction {
+	return instruction{op: 0x7b, dst: dst, src: src, off: off}
+}
+
+func storeW(dst uint8, off int16, src uint8) instruction {
+	return instruction{op: 0x63, dst: dst, src: src, off: off}
+}
+
+func storeImmW(dst uint8, off int16, imm int32) instruction {
+	return instruction{op: 0x62, dst: dst, off: off, imm: imm}
+}
+
+// loadMap loads the map, it takes two instructions.
+func loadMap(dst uint8, fd int) []instruction {
+	return []instruction{
+		{op: 0x18, dst: dst, src: pseudoMapFD, imm: int32(fd)},
+		{},
+	}
+}
+
+func jumpEqImm(dst uint8, imm int32, label string) instruction {
+	return instruction{op: 0x15, dst: dst, imm: imm, jump: label}
+}
+
+func jumpNeImm(dst uint8, imm int32, label string) instruction {
+	return instruction{op: 0x55, dst: dst, imm: imm, jump: label}
+}
+
+func call(helper int32) instruction {
+	return instruction{op: 0x85, imm: helper}
+}
+
+func exit() instruction {
+	return instruction{op: 0x95}
+}
@@ -0,0 +1,421 @@
+// Package bpflsm enforces the executions with eBPF programs attached to the LSM hooks, instead of fanotify. The
+// executions are decided in the kernel against an allowlist of files filled by the agent, without waiting for it.
+//
+// The files are identified by their device and inode and allowed in the cgroups of the containers, they are denied in
+// all of them as soon as they are opened for writing. The kernel needs CONFIG_BPF_LSM with bpf in the lsm= boot
+// parameter, BTF, and the containers have to be in cgroup v2.
+package bpflsm
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Mode is how the executions of the files which are not allowed are handled in a cgroup.
+type Mode uint32
+
+const (
+	// ModeEnforce denies the executions.
+	ModeEnforce Mode = 1
+	// ModeAudit allows the executions, they are still reported.
+	ModeAudit Mode = 2
+)
+
+const (
+	maxCgroups = 4096
+	maxFiles   = 1 << 20
+	maxEvents  = 1024
+
+	filenameSize = 128
+)
+
+// fmodeWrite is FMODE_WRITE, set in the mode of the files opened for writing.
+const fmodeWrite = 0x2
+
+// fileKey is a file like the kernel sees it.
+type fileKey struct {
+	ino uint64
+	dev uint32
+	_   uint32
+}
+
+// allowKey is the key of the allowlist, a file allowed in a cgroup.
+type allowKey struct {
+	cgroupID uint64
+	file     fileKey
+}
+
+// rawEvent is pushed by the program for the executions of the files which are not allowed.
+type rawEvent struct {
+	cgroupID uint64
+	ino      uint64
+	dev      uint32
+	mode     uint32
+	pid      uint32
+	_        uint32
+	filename [filenameSize]byte
+}
+
+// Event is an execution of a file which was not allowed.
+type Event struct {
+	CgroupID uint64
+	PID      int
+	// Filename is the path given to exec, it can be relative to the working directory of the process.
+	Filename string
+	// Audited is set when the execution was allowed because the cgroup is only audited.
+	Audited bool
+}
+
+// Enforcer has the programs and the maps shared by all the enforced containers of the node.
+type Enforcer struct {
+	// enforced has the mode of every enforced cgroup, allowed the files which can be executed in every cgroup and
+	// unmodified the allowed files which were not opened for writing since.
+	enforced   int
+	allowed    int
+	unmodified int
+	events     int
+
+	progs []int
+	links []int
+
+	lock     sync.Mutex
+	handlers map[uint64]func(*Event)
+	// files are the files allowed in every cgroup, they are removed with it. refs counts the cgroups of every file, it
+	// is removed from unmodified with the last one.
+	files map[uint64]map[fileKey]bool
+	refs  map[fileKey]int
+}
+
+// offsets are the offsets of the fields read by the programs in the running kernel.
+type offsets struct {
+	bprmFile, bprmFilename int16
+	fileInode, fileMode    int16
+	inodeIno, inodeSB      int16
+	sbDev                  int16
+}
+
+// Load loads and attaches the programs, they are detached when the enforcer is closed.
+func Load() (*Enforcer, error) {
+	b, err := loadBTF(vmlinuxBTF)
+	if err != nil {
+		return nil, err
+	}
+
+	var off offsets
+	for _, field := range []struct {
+		offset        *int16
+		structName, n string
+	}{
+		{&off.bprmFile, "linux_binprm", "file"},
+		{&off.bprmFilename, "linux_binprm", "filename"},
+		{&off.fileInode, "file", "f_inode"},
+		{&off.fileMode, "file", "f_mode"},
+		{&off.inodeIno, "inode", "i_ino"},
+		{&off.inodeSB, "inode", "i_sb"},
+		{&off.sbDev, "super_block", "s_dev"},
+	} {
+		if *field.offset, err = b.offset(field.structName, field.n); err != nil {
+			return nil, err
+		}
+	}
+
+	e := &Enforcer{
+		enforced:   -1,
+		allowed:    -1,
+		unmodified: -1,
+		events:     -1,
+		handlers:   make(map[uint64]func(*Event)),
+		files:      make(map[uint64]map[fileKey]bool),
+		refs:       make(map[fileKey]int),
+	}
+
+	if err := e.load(b, &off); err != nil {
+		e.Close()
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (e *Enforcer) load(b *btf, off *offsets) error {
+	var err error
+	if e.enforced, err = createMap(unix.BPF_MAP_TYPE_HASH, 8, 4, maxCgroups, 0); err != nil {
+		return err
+	}
+
+	// The files are allocated when they are added, there can be a lot of them.
+	if e.allowed, err = createMap(unix.BPF_MAP_TYPE_HASH, uint32(unsafe.Sizeof(allowKey{})), 1, maxFiles, unix.BPF_F_NO_PREALLOC); err != nil {
+		return err
+	}
+
+	if e.unmodified, err = createMap(unix.BPF_MAP_TYPE_HASH, uint32(unsafe.Sizeof(fileKey{})), 1, maxFiles, unix.BPF_F_NO_PREALLOC); err != nil {
+		return err
+	}
+
+	if e.events, err = createMap(unix.BPF_MAP_TYPE_QUEUE, 0, uint32(unsafe.Sizeof(rawEvent{})), maxEvents, 0); err != nil {
+		return err
+	}
+
+	for _, prog := range []struct {
+		name string
+		hook string
+		p    *program
+	}{
+		// The writes are tracked before any execution is enforced.
+		{"fanotify_mon_wr", "bpf_lsm_file_open", e.fileOpen(off)},
+		{"fanotify_mon_ex", "bpf_lsm_bprm_check_security", e.bprmCheck(off)},
+	} {
+		hook, err := b.find(btfKindFunc, prog.hook)
+		if err != nil {
+			return fmt.Errorf("finding LSM hook, is CONFIG_BPF_LSM set: %w", err)
+		}
+
+		fd, err := loadProgram(prog.name, prog.p, hook)
+		if err != nil {
+			return err
+		}
+		e.progs = append(e.progs, fd)
+
+		link, err := attach(fd)
+		if err != nil {
+			return fmt.Errorf("attaching %s, is bpf in the lsm= boot parameter: %w", prog.hook, err)
+		}
+		e.links = append(e.links, link)
+	}
+
+	return nil
+}
+
+// bprmCheck returns the program of the executions: the ones of the enforced cgroups are allowed only if the file is
+// in the allowlist of the cgroup and unmodified, the others are reported.
+func (e *Enforcer) bprmCheck(off *offsets) *program {
+	const (
+		// key is the allowKey, its file starts at file.
+		key      = -24
+		file     = key + 8
+		cgroupID = -32
+		event    = cgroupID - int16(unsafe.Sizeof(rawEvent{}))
+	)
+
+	p := &program{}
+
+	// The first argument of the hook is the struct linux_binprm.
+	p.add(loadDW(r6, r1, 0))
+
+	p.add(call(helperGetCurrentCgroupID), storeDW(r10, cgroupID, r0))
+	p.add(loadMap(r1, e.enforced)...)
+	p.add(movReg(r2, r10), addImm(r2, cgroupID), call(helperMapLookupElem))
+	p.add(jumpEqImm(r0, 0, "allow"))
+	p.add(loadW(r7, r0, 0))
+
+	// bprm->file->f_inode
+	p.add(loadDW(r1, r10, cgroupID), storeDW(r10, key, r1))
+	p.add(loadDW(r8, r6, off.bprmFile), loadDW(r8, r8, off.fileInode))
+	p.add(loadDW(r1, r8, off.inodeIno), storeDW(r10, file, r1))
+	p.add(loadDW(r9, r8, off.inodeSB), loadW(r1, r9, off.sbDev), storeW(r10, file+8, r1), storeImmW(r10, file+12, 0))
+	p.add(loadMap(r1, e.unmodified)...)
+	p.add(movReg(r2, r10), addImm(r2, file), call(helperMapLookupElem))
+	p.add(jumpEqImm(r0, 0, "deny"))
+	p.add(loadMap(r1, e.allowed)...)
+	p.add(movReg(r2, r10), addImm(r2, key), call(helperMapLookupElem))
+	p.add(jumpNeImm(r0, 0, "allow"))
+
+	p.label("deny")
+	p.add(loadDW(r1, r10, cgroupID), storeDW(r10, event, r1))
+	p.add(loadDW(r1, r10, file), storeDW(r10, event+8, r1))
+	p.add(loadW(r1, r10, file+8), storeW(r10, event+16, r1))
+	p.add(storeW(r10, event+20, r7))
+	p.add(call(helperGetCurrentPIDTGID), rshImm(r0, 32), storeW(r10, event+24, r0), storeImmW(r10, event+28, 0))
+	p.add(movReg(r1, r10), addImm(r1, int32(event+32)), movImm(r2, filenameSize), loadDW(r3, r6, off.bprmFilename))
+	p.add(call(helperProbeReadKernelStr))
+	p.add(loadMap(r1, e.events)...)
+	p.add(movReg(r2, r10), addImm(r2, int32(event)), movImm(r3, 0), call(helperMapPushElem))
+
+	p.add(jumpEqImm(r7, int32(ModeAudit), "allow"))
+	p.add(movImm(r0, -int32(unix.EPERM)), exit())
+
+	p.label("allow")
+	p.add(movImm(r0, 0), exit())
+
+	return p
+}
+
+// fileOpen returns the program removing the files opened for writing from the unmodified ones, they are denied in all
+// the cgroups.
+func (e *Enforcer) fileOpen(off *offsets) *program {
+	const key = -16
+
+	p := &program{}
+
+	// The first argument of the hook is the struct file.
+	p.add(loadDW(r6, r1, 0))
+	p.add(loadW(r1, r6, off.fileMode), andImm(r1, fmodeWrite), jumpEqImm(r1, 0, "out"))
+
+	p.add(loadDW(r7, r6, off.fileInode))
+	p.add(loadDW(r1, r7, off.inodeIno), storeDW(r10, key, r1))
+	p.add(loadDW(r8, r7, off.inodeSB), loadW(r1, r8, off.sbDev), storeW(r10, key+8, r1), storeImmW(r10, key+12, 0))
+	p.add(loadMap(r1, e.unmodified)...)
+	p.add(movReg(r2, r10), addImm(r2, key), call(helperMapDeleteElem))
+
+	p.label("out")
+	p.add(movImm(r0, 0), exit())
+
+	return p
+}
+
+// newFileKey returns the key of the file with the device of stat(2).
+func newFileKey(dev, ino uint64) fileKey {
+	// The kernel encodes the devices as major << 20 | minor.
+	return fileKey{ino: ino, dev: unix.Major(dev)<<20 | unix.Minor(dev)}
+}
+
+// Allow allows the file, with the device and the inode of stat(2), to be executed in the cgroup. The file must have
+// been verified just before. When it was written since it was allowed in other cgroups, it stays denied in them.
+func (e *Enforcer) Allow(cgroupID, dev, ino uint64) error {
+	key := allowKey{cgroupID: cgroupID, file: newFileKey(dev, ino)}
+	value := uint8(1)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.refs[key.file] > 0 {
+		var present uint8
+		if err := mapLookup(e.unmodified, unsafe.Pointer(&key.file), unsafe.Pointer(&present)); errors.Is(err, unix.ENOENT) {
+			e.revoke(key.file)
+		}
+	}
+
+	if err := mapUpdate(e.unmodified, unsafe.Pointer(&key.file), unsafe.Pointer(&value)); err != nil {
+		return fmt.Errorf("allowing file: %w", err)
+	}
+
+	if err := mapUpdate(e.allowed, unsafe.Pointer(&key), unsafe.Pointer(&value)); err != nil {
+		if e.refs[key.file] == 0 {
+			mapDelete(e.unmodified, unsafe.Pointer(&key.file))
+		}
+		return fmt.Errorf("allowing file: %w", err)
+	}
+
+	// The hard links of a file are allowed once.
+	if e.files[cgroupID][key.file] {
+		return nil
+	}
+
+	if e.files[cgroupID] == nil {
+		e.files[cgroupID] = make(map[fileKey]bool)
+	}
+	e.files[cgroupID][key.file] = true
+	e.refs[key.file]++
+
+	return nil
+}
+
+// revoke removes the file from the allowlists of all the cgroups, it was written since it was allowed.
+func (e *Enforcer) revoke(file fileKey) {
+	for cgroupID, files := range e.files {
+		if !files[file] {
+			continue
+		}
+
+		key := allowKey{cgroupID: cgroupID, file: file}
+		mapDelete(e.allowed, unsafe.Pointer(&key))
+		delete(files, file)
+	}
+
+	delete(e.refs, file)
+}
+
+// Enforce starts enforcing the cgroup, the handler gets the executions of the files which are not allowed.
+func (e *Enforcer) Enforce(cgroupID uint64, mode Mode, handler func(*Event)) error {
+	e.lock.Lock()
+	e.handlers[cgroupID] = handler
+	e.lock.Unlock()
+
+	if err := mapUpdate(e.enforced, unsafe.Pointer(&cgroupID), unsafe.Pointer(&mode)); err != nil {
+		return fmt.Errorf("enforcing cgroup: %w", err)
+	}
+
+	return nil
+}
+
+// Forget stops enforcing the cgroup and removes its files from the allowlist.
+func (e *Enforcer) Forget(cgroupID uint64) {
+	if err := mapDelete(e.enforced, unsafe.Pointer(&cgroupID)); err != nil && !errors.Is(err, unix.ENOENT) {
+		log.Errorf("removing cgroup %d: %v", cgroupID, err)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for file := range e.files[cgroupID] {
+		key := allowKey{cgroupID: cgroupID, file: file}
+		mapDelete(e.allowed, unsafe.Pointer(&key))
+
+		e.refs[file]--
+		if e.refs[file] == 0 {
+			delete(e.refs, file)
+			// It is gone already when it was written.
+			mapDelete(e.unmodified, unsafe.Pointer(&file))
+		}
+	}
+
+	delete(e.files, cgroupID)
+	delete(e.handlers, cgroupID)
+}
+
+// Run reports the executions which were not allowed every interval, until the enforcer is closed.
+func (e *Enforcer) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for {
+			var raw rawEvent
+			err := mapPop(e.events, unsafe.Pointer(&raw))
+			if errors.Is(err, unix.ENOENT) {
+				break
+			}
+			if err != nil {
+				// The map is closed.
+				if errors.Is(err, unix.EBADF) {
+					return
+				}
+
+				log.Errorf("reading executions from the LSM program: %v", err)
+				break
+			}
+
+			e.lock.Lock()
+			handler := e.handlers[raw.cgroupID]
+			e.lock.Unlock()
+
+			if handler != nil {
+				handler(&Event{
+					CgroupID: raw.cgroupID,
+					PID:      int(raw.pid),
+					Filename: unix.ByteSliceToString(raw.filename[:]),
+					Audited:  Mode(raw.mode) == ModeAudit,
+				})
+			}
+		}
+	}
+}
+
+// Close detaches the programs, nothing is enforced anymore.
+func (e *Enforcer) Close() {
+	for _, fd := range append(e.links, e.progs...) {
+		unix.Close(fd)
+	}
+
+	for _, fd := range []int{e.enforced, e.allowed, e.unmodified, e.events} {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+	}
+}
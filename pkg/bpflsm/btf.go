@@ -0,0 +1,220 @@
+package bpflsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// vmlinuxBTF has the types of the running kernel, the offsets of the fields read by the programs are taken from there
+// so they don't have to be compiled for every kernel.
+const vmlinuxBTF = "/sys/kernel/btf/vmlinux"
+
+const btfMagic = 0xeb9f
+
+// The kinds of BTF types, see include/uapi/linux/btf.h.
+const (
+	btfKindInt      = 1
+	btfKindArray    = 3
+	btfKindStruct   = 4
+	btfKindUnion    = 5
+	btfKindEnum     = 6
+	btfKindTypedef  = 8
+	btfKindVolatile = 9
+	btfKindConst    = 10
+	btfKindRestrict = 11
+	btfKindFunc     = 12
+	btfKindProto    = 13
+	btfKindVar      = 14
+	btfKindDatasec  = 15
+	btfKindDeclTag  = 17
+	btfKindTypeTag  = 18
+	btfKindEnum64   = 19
+)
+
+type btfHeader struct {
+	Magic   uint16
+	Version uint8
+	Flags   uint8
+	HdrLen  uint32
+	TypeOff uint32
+	TypeLen uint32
+	StrOff  uint32
+	StrLen  uint32
+}
+
+type btfMember struct {
+	name   string
+	typeID uint32
+	// offset is in bits.
+	offset uint32
+}
+
+type btfType struct {
+	name    string
+	kind    uint32
+	typeID  uint32
+	members []btfMember
+}
+
+// btf holds the types of the kernel, by id.
+type btf struct {
+	types []btfType
+}
+
+func loadBTF(path string) (*btf, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading BTF: %w", err)
+	}
+
+	return parseBTF(data)
+}
+
+func parseBTF(data []byte) (*btf, error) {
+	var hdr btfHeader
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("reading BTF header: %w", err)
+	}
+
+	if hdr.Magic != btfMagic {
+		return nil, fmt.Errorf("invalid BTF magic %#x, only little endian is supported", hdr.Magic)
+	}
+
+	typesStart, strStart := int(hdr.HdrLen+hdr.TypeOff), int(hdr.HdrLen+hdr.StrOff)
+	if typesStart+int(hdr.TypeLen) > len(data) || strStart+int(hdr.StrLen) > len(data) {
+		return nil, errors.New("truncated BTF")
+	}
+
+	types := data[typesStart : typesStart+int(hdr.TypeLen)]
+	strs := data[strStart : strStart+int(hdr.StrLen)]
+
+	name := func(off uint32) string {
+		if int(off) >= len(strs) {
+			return ""
+		}
+
+		s := strs[off:]
+		if i := bytes.IndexByte(s, 0); i >= 0 {
+			s = s[:i]
+		}
+
+		return string(s)
+	}
+
+	// The ids start at 1, 0 is void.
+	b := &btf{types: []btfType{{}}}
+	for off := 0; off+12 <= len(types); {
+		nameOff := binary.LittleEndian.Uint32(types[off:])
+		info := binary.LittleEndian.Uint32(types[off+4:])
+		sizeOrType := binary.LittleEndian.Uint32(types[off+8:])
+		off += 12
+
+		t := btfType{name: name(nameOff), kind: (info >> 24) & 0x1f, typeID: sizeOrType}
+		vlen := int(info & 0xffff)
+		kindFlag := info>>31 == 1
+
+		switch t.kind {
+		case btfKindInt, btfKindVar, btfKindDeclTag:
+			off += 4
+		case btfKindArray:
+			off += 12
+		case btfKindStruct, btfKindUnion:
+			for i := 0; i < vlen; i++ {
+				if off+12 > len(types) {
+					return nil, errors.New("truncated BTF")
+				}
+
+				m := btfMember{
+					name:   name(binary.LittleEndian.Uint32(types[off:])),
+					typeID: binary.LittleEndian.Uint32(types[off+4:]),
+					offset: binary.LittleEndian.Uint32(types[off+8:]),
+				}
+				if kindFlag {
+					// The upper bits are the size of the bitfield.
+					m.offset &= 0xffffff
+				}
+
+				t.members = append(t.members, m)
+				off += 12
+			}
+		case btfKindEnum, btfKindProto:
+			off += 8 * vlen
+		case btfKindDatasec, btfKindEnum64:
+			off += 12 * vlen
+		}
+
+		b.types = append(b.types, t)
+	}
+
+	return b, nil
+}
+
+// find returns the id of the type of the given kind and name.
+func (b *btf) find(kind uint32, name string) (uint32, error) {
+	for id, t := range b.types {
+		if t.kind == kind && t.name == name {
+			return uint32(id), nil
+		}
+	}
+
+	return 0, fmt.Errorf("type %s not found in the kernel BTF", name)
+}
+
+// offset returns the offset in bytes of the field of the struct, it can be in an anonymous struct or union.
+func (b *btf) offset(structName, field string) (int16, error) {
+	id, err := b.find(btfKindStruct, structName)
+	if err != nil {
+		return 0, err
+	}
+
+	bits, ok := b.memberOffset(id, field)
+	if !ok {
+		return 0, fmt.Errorf("field %s of struct %s not found in the kernel BTF", field, structName)
+	}
+
+	if bits%8 != 0 {
+		return 0, fmt.Errorf("field %s of struct %s is a bitfield", field, structName)
+	}
+
+	return int16(bits / 8), nil
+}
+
+func (b *btf) memberOffset(id uint32, field string) (uint32, bool) {
+	for _, m := range b.types[id].members {
+		if m.name == field {
+			return m.offset, true
+		}
+
+		if m.name != "" {
+			continue
+		}
+
+		anonymous := b.resolve(m.typeID)
+		if kind := b.types[anonymous].kind; kind != btfKindStruct && kind != btfKindUnion {
+			continue
+		}
+
+		if off, ok := b.memberOffset(anonymous, field); ok {
+			return m.offset + off, true
+		}
+	}
+
+	return 0, false
+}
+
+// resolve skips the typedefs and the qualifiers.
+func (b *btf) resolve(id uint32) uint32 {
+	for int(id) < len(b.types) {
+		switch b.types[id].kind {
+		case btfKindTypedef, btfKindVolatile, btfKindConst, btfKindRestrict, btfKindTypeTag:
+			id = b.types[id].typeID
+		default:
+			return id
+		}
+	}
+
+	return id
+}
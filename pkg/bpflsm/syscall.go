@@ -0,0 +1,165 @@
+package bpflsm
+
+import (
+	"bytes"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The attributes of the bpf syscall, see union bpf_attr in include/uapi/linux/bpf.h. The kernel checks that the bytes
+// after what it knows are 0. The pointers are 64 bits, like the fields of the kernel, so only 64 bits architectures
+// are supported.
+
+type mapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	mapFlags   uint32
+}
+
+type mapElemAttr struct {
+	mapFD uint32
+	_     uint32
+	key   unsafe.Pointer
+	value unsafe.Pointer
+	flags uint64
+}
+
+type progLoadAttr struct {
+	progType           uint32
+	insnCnt            uint32
+	insns              unsafe.Pointer
+	license            unsafe.Pointer
+	logLevel           uint32
+	logSize            uint32
+	logBuf             unsafe.Pointer
+	kernVersion        uint32
+	progFlags          uint32
+	progName           [16]byte
+	progIfindex        uint32
+	expectedAttachType uint32
+	progBTFFD          uint32
+	funcInfoRecSize    uint32
+	funcInfo           uint64
+	funcInfoCnt        uint32
+	lineInfoRecSize    uint32
+	lineInfo           uint64
+	lineInfoCnt        uint32
+	attachBTFID        uint32
+}
+
+type rawTracepointOpenAttr struct {
+	name   uint64
+	progFD uint32
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+
+	return int(fd), nil
+}
+
+func createMap(mapType, keySize, valueSize, maxEntries, flags uint32) (int, error) {
+	attr := mapCreateAttr{mapType: mapType, keySize: keySize, valueSize: valueSize, maxEntries: maxEntries, mapFlags: flags}
+
+	fd, err := bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, fmt.Errorf("creating map: %w", err)
+	}
+
+	return fd, nil
+}
+
+func mapUpdate(fd int, key, value unsafe.Pointer) error {
+	attr := mapElemAttr{mapFD: uint32(fd), key: key, value: value}
+
+	_, err := bpf(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// mapLookup copies the value of the key, it fails with ENOENT when the key is not in the map.
+func mapLookup(fd int, key, value unsafe.Pointer) error {
+	attr := mapElemAttr{mapFD: uint32(fd), key: key, value: value}
+
+	_, err := bpf(unix.BPF_MAP_LOOKUP_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+func mapDelete(fd int, key unsafe.Pointer) error {
+	attr := mapElemAttr{mapFD: uint32(fd), key: key}
+
+	_, err := bpf(unix.BPF_MAP_DELETE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// mapPop pops the value from the queue, it fails with ENOENT when the queue is empty.
+func mapPop(fd int, value unsafe.Pointer) error {
+	attr := mapElemAttr{mapFD: uint32(fd), value: value}
+
+	_, err := bpf(unix.BPF_MAP_LOOKUP_AND_DELETE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// loadProgram loads the LSM program for the hook of the given BTF id. When it fails it is loaded again to get the log
+// of the verifier in the error.
+func loadProgram(name string, p *program, attachBTFID uint32) (int, error) {
+	insns, err := p.encode()
+	if err != nil {
+		return -1, err
+	}
+
+	fd, err := loadProgramLog(name, insns, attachBTFID, nil)
+	if err == nil {
+		return fd, nil
+	}
+
+	log := make([]byte, 1024*1024)
+	if _, logErr := loadProgramLog(name, insns, attachBTFID, log); logErr != nil {
+		if i := bytes.IndexByte(log, 0); i > 0 {
+			return -1, fmt.Errorf("loading program %s: %w: %s", name, err, log[:i])
+		}
+	}
+
+	return -1, fmt.Errorf("loading program %s: %w", name, err)
+}
+
+func loadProgramLog(name string, insns []byte, attachBTFID uint32, log []byte) (int, error) {
+	// Some of the helpers are only for GPL programs.
+	license := []byte("GPL\x00")
+
+	attr := progLoadAttr{
+		progType:           unix.BPF_PROG_TYPE_LSM,
+		insnCnt:            uint32(len(insns) / 8),
+		insns:              unsafe.Pointer(&insns[0]),
+		license:            unsafe.Pointer(&license[0]),
+		expectedAttachType: unix.BPF_LSM_MAC,
+		attachBTFID:        attachBTFID,
+	}
+	copy(attr.progName[:len(attr.progName)-1], name)
+
+	if log != nil {
+		attr.logLevel = 1
+		attr.logSize = uint32(len(log))
+		attr.logBuf = unsafe.Pointer(&log[0])
+	}
+
+	return bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// attach attaches the LSM program to its hook, until the returned link is closed.
+func attach(progFD int) (int, error) {
+	attr := rawTracepointOpenAttr{progFD: uint32(progFD)}
+
+	fd, err := bpf(unix.BPF_RAW_TRACEPOINT_OPEN, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, fmt.Errorf("attaching program: %w", err)
+	}
+
+	return fd, nil
+}
@@ -0,0 +1,470 @@
+// Package config has the configuration of the node agent. It is read from a YAML file, then overridden by the
+// environment and then by the command line flags.
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// EnvPrefix is the prefix of the environment variables overriding the options, e.g. FANOTIFY_MON_STATUS_INTERVAL
+// for the status-interval flag. The options with multiple values are separated by EnvSeparator.
+const (
+	EnvPrefix    = "FANOTIFY_MON_"
+	EnvSeparator = ";"
+)
+
+// Config has the options of the agent. The flag tag is the name of the command line flag of every option.
+type Config struct {
+	Hostname     string   `json:"hostname,omitempty" flag:"hostname"`
+	Runtime      string   `json:"runtime,omitempty" flag:"runtime"`
+	Kubeconfig   string   `json:"kubeconfig,omitempty" flag:"kubeconfig"`
+	PolicyFile   string   `json:"policyFile,omitempty" flag:"policy-file"`
+	PodSelectors []string `json:"podSelectors,omitempty" flag:"pod-selector"`
+	DockerLabels []string `json:"dockerLabels,omitempty" flag:"docker-label"`
+	MarkMode     string   `json:"markMode,omitempty" flag:"mark-mode"`
+	// ContainerSource is how the containers starting and stopping are found.
+	ContainerSource string          `json:"containerSource,omitempty" flag:"container-source"`
+	StatusInterval  metav1.Duration `json:"statusInterval,omitempty" flag:"status-interval"`
+	AdminSocket     string          `json:"adminSocket,omitempty" flag:"admin-socket"`
+	AdminGroup      int             `json:"adminGroup,omitempty" flag:"admin-group"`
+	AggregatorURL   string          `json:"aggregatorURL,omitempty" flag:"aggregator-url"`
+
+	AggregatorCAFile   string `json:"aggregatorCAFile,omitempty" flag:"aggregator-ca-file"`
+	AggregatorCertFile string `json:"aggregatorCertFile,omitempty" flag:"aggregator-cert-file"`
+	AggregatorKeyFile  string `json:"aggregatorKeyFile,omitempty" flag:"aggregator-key-file"`
+
+	// AdminAddr serves the admin API over mutual TLS besides the socket, for the remote clients.
+	AdminAddr           string   `json:"adminAddr,omitempty" flag:"admin-addr"`
+	AdminCertFile       string   `json:"adminCertFile,omitempty" flag:"admin-tls-cert-file"`
+	AdminKeyFile        string   `json:"adminKeyFile,omitempty" flag:"admin-tls-key-file"`
+	AdminClientCAFile   string   `json:"adminClientCAFile,omitempty" flag:"admin-client-ca-file"`
+	AdminAllowedClients []string `json:"adminAllowedClients,omitempty" flag:"admin-allowed-client"`
+
+	// Sinks are where the decisions are sent, see sink.Parse.
+	Sinks []string `json:"sinks,omitempty" flag:"sink"`
+	// AlertRules fire to AlertmanagerURL, see alert.ParseRule.
+	AlertmanagerURL string   `json:"alertmanagerURL,omitempty" flag:"alertmanager-url"`
+	AlertRules      []string `json:"alertRules,omitempty" flag:"alert-rule"`
+	// DedupWindow is the window in which the identical consecutive decisions are collapsed, see sink.Dedup.
+	DedupWindow metav1.Duration `json:"dedupWindow,omitempty" flag:"dedup-window"`
+
+	EventDir       string          `json:"eventDir,omitempty" flag:"event-dir"`
+	EventRetention metav1.Duration `json:"eventRetention,omitempty" flag:"event-retention"`
+	// EventAnchorInterval is how often the head of the hash chain of the event store is logged.
+	EventAnchorInterval metav1.Duration `json:"eventAnchorInterval,omitempty" flag:"event-anchor-interval"`
+	// ExportURL is the bucket the complete hours of the event store are uploaded to every ExportInterval.
+	ExportURL      string          `json:"exportURL,omitempty" flag:"export-url"`
+	ExportRegion   string          `json:"exportRegion,omitempty" flag:"export-region"`
+	ExportInterval metav1.Duration `json:"exportInterval,omitempty" flag:"export-interval"`
+	BaselineDir    string          `json:"baselineDir,omitempty" flag:"baseline-dir"`
+	MetricsAddr    string          `json:"metricsAddr,omitempty" flag:"metrics-addr"`
+	DashboardAddr  string          `json:"dashboardAddr,omitempty" flag:"dashboard-addr"`
+	FDThreshold    int             `json:"fdThreshold,omitempty" flag:"fd-threshold"`
+	HashWorkers    int             `json:"hashWorkers,omitempty" flag:"hash-workers"`
+	MaxFileSize    int64           `json:"maxFileSize,omitempty" flag:"max-file-size"`
+
+	// The labels of the metrics in MetricsDropLabels are removed, the values of the ones in MetricsHashLabels are
+	// hashed and the others are truncated to MetricsMaxLabelLength, see metrics.LabelPolicy.
+	MetricsDropLabels     []string `json:"metricsDropLabels,omitempty" flag:"metrics-drop-label"`
+	MetricsHashLabels     []string `json:"metricsHashLabels,omitempty" flag:"metrics-hash-label"`
+	MetricsMaxLabelLength int      `json:"metricsMaxLabelLength,omitempty" flag:"metrics-max-label-length"`
+
+	BaselineWorkers int  `json:"baselineWorkers,omitempty" flag:"baseline-workers"`
+	XattrCache      bool `json:"xattrCache,omitempty" flag:"xattr-cache"`
+	KernelAudit     bool `json:"kernelAudit,omitempty" flag:"kernel-audit"`
+	AnalyzeBinaries bool `json:"analyzeBinaries,omitempty" flag:"analyze-binaries"`
+	SelfProtection  bool `json:"selfProtection,omitempty" flag:"self-protection"`
+
+	// The stored events and the baselines of BaselineDir are evicted past their quota in bytes, the baselines every
+	// BaselineGCInterval, see eventstore.Open and baseline.Store.GC.
+	EventQuota         int64           `json:"eventQuota,omitempty" flag:"event-quota"`
+	BaselineQuota      int64           `json:"baselineQuota,omitempty" flag:"baseline-quota"`
+	BaselineGCInterval metav1.Duration `json:"baselineGCInterval,omitempty" flag:"baseline-gc-interval"`
+
+	// BaselineTableDir is where the large baselines are written instead of being kept in memory, see baseline.Tables.
+	BaselineTableDir string `json:"baselineTableDir,omitempty" flag:"baseline-table-dir"`
+
+	// BaselineWarmupImages is how many of the images pulled have their baseline computed ahead of their containers.
+	BaselineWarmupImages int `json:"baselineWarmupImages,omitempty" flag:"baseline-warmup-images"`
+
+	// ImmutableRootfs enforces the immutableRootfs of the policies. Every open of the rootfs of their containers waits
+	// for the agent then, not only the ones for writing.
+	ImmutableRootfs bool `json:"immutableRootfs,omitempty" flag:"immutable-rootfs"`
+
+	// AttachDiff reports the executables of the rootfs of the containers which are not the ones of their image when
+	// they are attached.
+	AttachDiff bool `json:"attachDiff,omitempty" flag:"attach-diff"`
+
+	Backend       string `json:"backend,omitempty" flag:"backend"`
+	SeccompSocket string `json:"seccompSocket,omitempty" flag:"seccomp-socket"`
+	HandoffSocket string `json:"handoffSocket,omitempty" flag:"handoff-socket"`
+
+	// HookSocket is where the OCI hooks send the containers about to start, see ocihook.Server.
+	HookSocket  string          `json:"hookSocket,omitempty" flag:"hook-socket"`
+	HookTimeout metav1.Duration `json:"hookTimeout,omitempty" flag:"hook-timeout"`
+
+	ParanoidLevel string `json:"paranoidLevel,omitempty" flag:"paranoid-level"`
+
+	// EvictOnFailure evicts the pods whose containers could not be enforced.
+	EvictOnFailure bool `json:"evictOnFailure,omitempty" flag:"evict-on-failure"`
+
+	// QuarantineDenials is how many denials of a container within QuarantineWindow quarantine its pod, and its node
+	// with QuarantineNode.
+	QuarantineDenials int             `json:"quarantineDenials,omitempty" flag:"quarantine-denials"`
+	QuarantineWindow  metav1.Duration `json:"quarantineWindow,omitempty" flag:"quarantine-window"`
+	QuarantineNode    bool            `json:"quarantineNode,omitempty" flag:"quarantine-node"`
+	// Isolation is the kind of network policy cutting the quarantined pods from the network, see k8s.NewIsolator.
+	Isolation string `json:"isolation,omitempty" flag:"isolation"`
+
+	ResponseDeadline  metav1.Duration `json:"responseDeadline,omitempty" flag:"response-deadline"`
+	WatchdogThreshold metav1.Duration `json:"watchdogThreshold,omitempty" flag:"watchdog-threshold"`
+
+	// A notifier is falling behind from BackpressureQueue pending events or once its oldest one waits for
+	// BackpressureAge, BackpressureActions are then taken until it catches up.
+	BackpressureQueue   int             `json:"backpressureQueue,omitempty" flag:"backpressure-queue"`
+	BackpressureAge     metav1.Duration `json:"backpressureAge,omitempty" flag:"backpressure-age"`
+	BackpressureActions []string        `json:"backpressureActions,omitempty" flag:"backpressure-action"`
+}
+
+func Default() *Config {
+	return &Config{
+		Runtime:             "docker",
+		Kubeconfig:          "$HOME/.kube/config",
+		PodSelectors:        []string{"enforce.k8s.io=deny-third-party-execution"},
+		MarkMode:            "mount",
+		ContainerSource:     "container-collection",
+		Backend:             "fanotify",
+		StatusInterval:      metav1.Duration{Duration: 30 * time.Second},
+		AdminSocket:         "/run/fanotify-mon/admin.sock",
+		AdminGroup:          -1,
+		SeccompSocket:       "/run/fanotify-mon/seccomp.sock",
+		HandoffSocket:       "/run/fanotify-mon/handoff.sock",
+		HookTimeout:         metav1.Duration{Duration: 5 * time.Second},
+		EventDir:            "/var/lib/fanotify-mon/events",
+		EventRetention:      metav1.Duration{Duration: 7 * 24 * time.Hour},
+		EventAnchorInterval: metav1.Duration{Duration: 5 * time.Minute},
+		ExportRegion:        "us-east-1",
+		ExportInterval:      metav1.Duration{Duration: 10 * time.Minute},
+		BaselineDir:         "/var/lib/fanotify-mon/baselines",
+		BaselineTableDir:    "/var/lib/fanotify-mon/tables",
+		FDThreshold:         90,
+
+		BaselineWorkers: 4,
+		SelfProtection:  true,
+
+		EventQuota:         1 << 30,
+		BaselineQuota:      256 << 20,
+		BaselineGCInterval: metav1.Duration{Duration: 10 * time.Minute},
+
+		ParanoidLevel: "high",
+
+		ResponseDeadline:  metav1.Duration{Duration: 10 * time.Second},
+		WatchdogThreshold: metav1.Duration{Duration: 2 * time.Minute},
+
+		BackpressureActions: []string{"alert"},
+	}
+}
+
+// LoadFile reads the file over the default configuration. Unknown options are an error.
+func LoadFile(path string) (*Config, error) {
+	c := Default()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, fmt.Errorf("decoding config: %w", err)
+	}
+
+	return c, nil
+}
+
+// ApplyEnv overrides the options set in the environment.
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	for _, flag := range c.Flags() {
+		name := EnvPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+		if value, ok := lookup(name); ok {
+			if err := c.Set(flag, strings.Split(value, EnvSeparator)...); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Flags returns the flag names of all the options.
+func (c *Config) Flags() []string {
+	flags := []string{}
+
+	t := reflect.TypeOf(c).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		flags = append(flags, t.Field(i).Tag.Get("flag"))
+	}
+
+	return flags
+}
+
+// Set sets the option of the flag from its string values. The options with a single value take the last one.
+func (c *Config) Set(flag string, values ...string) error {
+	if len(values) == 0 {
+		return fmt.Errorf("no value for option %q", flag)
+	}
+	value := values[len(values)-1]
+
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("flag") != flag {
+			continue
+		}
+
+		switch field := v.Field(i).Addr().Interface().(type) {
+		case *string:
+			*field = value
+		case *[]string:
+			*field = values
+		case *int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid number %q: %w", value, err)
+			}
+
+			*field = n
+		case *bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid boolean %q: %w", value, err)
+			}
+
+			*field = b
+		case *int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid number %q: %w", value, err)
+			}
+
+			*field = n
+		case *metav1.Duration:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid duration %q: %w", value, err)
+			}
+
+			field.Duration = d
+		default:
+			return fmt.Errorf("unsupported type of option %q", flag)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("unknown option %q", flag)
+}
+
+func (c *Config) Validate() error {
+	switch c.Runtime {
+	case "docker", "containerd":
+	default:
+		return fmt.Errorf("unsupported runtime %q", c.Runtime)
+	}
+
+	if len(c.DockerLabels) > 0 && c.Runtime != "docker" {
+		return fmt.Errorf("docker labels need the docker runtime")
+	}
+
+	switch c.ContainerSource {
+	case "container-collection":
+	case "containerd":
+		if c.Runtime != "containerd" {
+			return fmt.Errorf("the containerd container source needs the containerd runtime")
+		}
+	case "nri":
+		if c.Runtime != "containerd" || c.HookSocket == "" {
+			return fmt.Errorf("the nri container source needs the containerd runtime and a hook socket")
+		}
+	default:
+		return fmt.Errorf("unsupported container source %q", c.ContainerSource)
+	}
+
+	switch c.MarkMode {
+	case "mount", "namespace", "filesystem":
+	default:
+		return fmt.Errorf("unsupported mark mode %q", c.MarkMode)
+	}
+
+	switch c.Backend {
+	case "fanotify", "bpf-lsm", "seccomp":
+	default:
+		return fmt.Errorf("unsupported backend %q", c.Backend)
+	}
+
+	switch c.ParanoidLevel {
+	case "high", "low":
+	default:
+		return fmt.Errorf("unsupported paranoid level %q", c.ParanoidLevel)
+	}
+
+	if c.StatusInterval.Duration < 0 {
+		return fmt.Errorf("negative status interval")
+	}
+
+	if c.EventRetention.Duration < 0 {
+		return fmt.Errorf("negative event retention")
+	}
+
+	if c.QuarantineDenials < 0 {
+		return fmt.Errorf("negative quarantine denials")
+	}
+
+	if c.QuarantineWindow.Duration < 0 {
+		return fmt.Errorf("negative quarantine window")
+	}
+
+	switch c.Isolation {
+	case "", "networkpolicy", "cilium", "calico":
+	default:
+		return fmt.Errorf("unknown isolation %q, it can be networkpolicy, cilium or calico", c.Isolation)
+	}
+
+	if c.Isolation != "" && c.QuarantineDenials == 0 {
+		return fmt.Errorf("the isolation needs the quarantine denials")
+	}
+
+	if c.DedupWindow.Duration < 0 {
+		return fmt.Errorf("negative dedup window")
+	}
+
+	if c.EventAnchorInterval.Duration < 0 {
+		return fmt.Errorf("negative event anchor interval")
+	}
+
+	if c.ResponseDeadline.Duration < 0 {
+		return fmt.Errorf("negative response deadline")
+	}
+
+	if c.WatchdogThreshold.Duration < 0 {
+		return fmt.Errorf("negative watchdog threshold")
+	}
+
+	// The verifications missing the deadline are already answered.
+	if c.WatchdogThreshold.Duration > 0 && c.ResponseDeadline.Duration > 0 && c.WatchdogThreshold.Duration <= c.ResponseDeadline.Duration {
+		return fmt.Errorf("watchdog threshold %s is not longer than the response deadline %s", c.WatchdogThreshold.Duration, c.ResponseDeadline.Duration)
+	}
+
+	if c.BackpressureQueue < 0 {
+		return fmt.Errorf("negative backpressure queue")
+	}
+
+	if c.BackpressureAge.Duration < 0 {
+		return fmt.Errorf("negative backpressure age")
+	}
+
+	for _, action := range c.BackpressureActions {
+		switch action {
+		case "audit", "alert":
+		default:
+			return fmt.Errorf("unsupported backpressure action %q", action)
+		}
+	}
+
+	if c.HashWorkers < 0 {
+		return fmt.Errorf("negative hash workers")
+	}
+
+	if c.MetricsMaxLabelLength < 0 {
+		return fmt.Errorf("negative metrics max label length")
+	}
+
+	if c.MaxFileSize < 0 {
+		return fmt.Errorf("negative max file size")
+	}
+
+	if c.BaselineWorkers < 1 {
+		return fmt.Errorf("at least one baseline worker is needed")
+	}
+
+	if c.EventQuota < 0 {
+		return fmt.Errorf("negative event quota")
+	}
+
+	if c.BaselineQuota < 0 {
+		return fmt.Errorf("negative baseline quota")
+	}
+
+	if c.BaselineGCInterval.Duration < 0 {
+		return fmt.Errorf("negative baseline GC interval")
+	}
+
+	if c.BaselineWarmupImages < 0 {
+		return fmt.Errorf("negative baseline warm-up images")
+	}
+
+	if c.BaselineWarmupImages > 0 && c.Runtime != "containerd" {
+		return fmt.Errorf("the baseline warm-up needs the containerd runtime")
+	}
+
+	if c.FDThreshold <= 10 || c.FDThreshold > 100 {
+		return fmt.Errorf("fd threshold %d is not a percentage between 11 and 100", c.FDThreshold)
+	}
+
+	if c.AdminSocket == "" {
+		return fmt.Errorf("no admin socket")
+	}
+
+	if c.AdminGroup < -1 {
+		return fmt.Errorf("invalid admin group %d", c.AdminGroup)
+	}
+
+	if (c.AggregatorCertFile == "") != (c.AggregatorKeyFile == "") {
+		return fmt.Errorf("the aggregator certificate and key go together")
+	}
+
+	if c.AggregatorURL != "" && !strings.HasPrefix(c.AggregatorURL, "http://") && !strings.HasPrefix(c.AggregatorURL, "https://") {
+		return fmt.Errorf("the aggregator URL must be http:// or https://")
+	}
+
+	if (c.AggregatorCAFile != "" || c.AggregatorCertFile != "") && !strings.HasPrefix(c.AggregatorURL, "https://") {
+		return fmt.Errorf("the aggregator TLS files need an https aggregator URL")
+	}
+
+	if c.AdminAddr != "" && (c.AdminCertFile == "" || c.AdminKeyFile == "" || c.AdminClientCAFile == "") {
+		return fmt.Errorf("the remote admin API needs a certificate, a key and a client CA")
+	}
+
+	if c.AdminAddr == "" && (c.AdminCertFile != "" || c.AdminClientCAFile != "" || len(c.AdminAllowedClients) > 0) {
+		return fmt.Errorf("the admin TLS files and clients need an admin address")
+	}
+
+	if c.HookSocket != "" && (c.Backend != "fanotify" || c.MarkMode == "namespace") {
+		return fmt.Errorf("the OCI hooks need the fanotify backend with the mount or filesystem mark mode")
+	}
+
+	if c.HookTimeout.Duration <= 0 {
+		return fmt.Errorf("invalid hook timeout %s", c.HookTimeout.Duration)
+	}
+
+	if c.Backend == "seccomp" && c.SeccompSocket == "" {
+		return fmt.Errorf("no seccomp socket")
+	}
+
+	for _, selector := range c.PodSelectors {
+		if _, err := labels.Parse(selector); err != nil {
+			return fmt.Errorf("invalid pod selector %q: %w", selector, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"sigs.k8s.io/yaml"
+)
+
+// HostConfig has what the host mode enforces on the nodes without Kubernetes, read from a YAML file.
+type HostConfig struct {
+	Targets []HostTarget `json:"targets"`
+}
+
+// HostTarget is a set of host directories whose executables are trusted, and optionally the systemd service only
+// allowed to run them.
+type HostTarget struct {
+	Name string `json:"name"`
+
+	// Paths are the directories whose executables are the baseline, or single files, hashed when the agent starts.
+	// Without Unit, the executions of their files are verified against it whatever runs them.
+	Paths []string `json:"paths"`
+
+	// Unit is the systemd service, like nginx.service. The executions of its processes are verified against the
+	// baseline wherever the files are, the ones of the other processes are not enforced.
+	Unit string `json:"unit,omitempty"`
+
+	// Mode is enforce by default, audit only reports the executions which would be denied.
+	Mode string `json:"mode,omitempty"`
+}
+
+// LoadHostConfig reads the file of the host mode. Unknown options are an error.
+func LoadHostConfig(path string) (*HostConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading host config: %w", err)
+	}
+
+	c := &HostConfig{}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, fmt.Errorf("decoding host config: %w", err)
+	}
+
+	return c, nil
+}
+
+func (c *HostConfig) Validate() error {
+	if len(c.Targets) == 0 {
+		return fmt.Errorf("no targets")
+	}
+
+	names := make(map[string]bool)
+	for i, t := range c.Targets {
+		if t.Name == "" {
+			return fmt.Errorf("target %d: no name", i)
+		}
+
+		if names[t.Name] {
+			return fmt.Errorf("target %s: duplicate name", t.Name)
+		}
+		names[t.Name] = true
+
+		if len(t.Paths) == 0 {
+			return fmt.Errorf("target %s: no paths", t.Name)
+		}
+
+		for _, path := range t.Paths {
+			if !filepath.IsAbs(path) {
+				return fmt.Errorf("target %s: path %q is not absolute", t.Name, path)
+			}
+		}
+
+		switch t.Mode {
+		case "", "enforce", "audit":
+		default:
+			return fmt.Errorf("target %s: unknown mode %q", t.Name, t.Mode)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package containerd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+	log "github.com/sirupsen/logrus"
+)
+
+// clientCheckInterval is how often a shared client is checked to be still serving before it is used.
+const clientCheckInterval = 10 * time.Second
+
+// clients are the containerd clients shared by the lookups of the containers, one per namespace, instead of
+// connecting to the socket for every lookup.
+var clients = &clientPool{clients: make(map[string]*sharedClient)}
+
+type clientPool struct {
+	lock    sync.Mutex
+	clients map[string]*sharedClient
+}
+
+type sharedClient struct {
+	*containerd.Client
+	// checked is when the client was last known to be serving.
+	checked time.Time
+}
+
+// get returns the client of the namespace. It is connected again when containerd stopped serving it, like after a
+// restart of containerd.
+func (p *clientPool) get(ctx context.Context, namespace string) (*containerd.Client, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if c, ok := p.clients[namespace]; ok {
+		if time.Since(c.checked) < clientCheckInterval {
+			return c.Client, nil
+		}
+
+		serving, err := c.IsServing(ctx)
+		if err == nil && serving {
+			c.checked = time.Now()
+			return c.Client, nil
+		}
+
+		log.Infof("containerd client of namespace %s not serving, connecting again: %v", namespace, err)
+		c.Close()
+		delete(p.clients, namespace)
+	}
+
+	client, err := containerd.New(ContainerdSocket, containerd.WithDefaultNamespace(namespace))
+	if err != nil {
+		return nil, fmt.Errorf("creating containerd client: %w", err)
+	}
+
+	p.clients[namespace] = &sharedClient{Client: client, checked: time.Now()}
+	return client, nil
+}
+
+// invalidate makes the client of the namespace be checked before it is used again, after it failed.
+func (p *clientPool) invalidate(namespace string, client *containerd.Client) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if c, ok := p.clients[namespace]; ok && c.Client == client {
+		c.checked = time.Time{}
+	}
+}
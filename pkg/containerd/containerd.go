@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/oci"
 	"github.com/kinvolk/fanotify-poc/pkg/docker"
 	pb "github.com/kinvolk/inspektor-gadget/pkg/gadgettracermanager/api"
@@ -30,34 +31,28 @@ func SetContainerdNamespace(hostRuntime string) {
 	}
 }
 
-func GetContainerFromID(id, containerdNamespace string) (containerd.Container, func(), error) {
-	client, err := containerd.New(ContainerdSocket, containerd.WithDefaultNamespace(containerdNamespace))
-	if err != nil {
-		return nil, func() {}, fmt.Errorf("creating containerd client: %w", err)
-	}
-
-	closer := func() {
-		client.Close()
-	}
-
+// GetContainerFromID looks the container up with the client shared by the lookups of the namespace.
+func GetContainerFromID(id, containerdNamespace string) (containerd.Container, error) {
 	ctx := context.Background()
 
-	cnts, err := client.Containers(ctx, "id=="+id)
+	client, err := clients.get(ctx, containerdNamespace)
 	if err != nil {
-		return nil, closer, fmt.Errorf("listing containers: %w", err)
+		return nil, err
 	}
 
-	if len(cnts) == 0 {
-		return nil, closer, fmt.Errorf("no container found")
+	cnt, err := client.LoadContainer(ctx, id)
+	if err != nil {
+		if !errdefs.IsNotFound(err) {
+			clients.invalidate(containerdNamespace, client)
+		}
+		return nil, fmt.Errorf("loading container: %w", err)
 	}
 
-	return cnts[0], closer, nil
-
+	return cnt, nil
 }
 
 func GetOCISpec(cntID, containerdNamespace string) (*oci.Spec, error) {
-	cnt, closer, err := GetContainerFromID(cntID, containerdNamespace)
-	defer closer()
+	cnt, err := GetContainerFromID(cntID, containerdNamespace)
 	if err != nil {
 		return nil, fmt.Errorf("getting container from id: %w", err)
 	}
@@ -70,7 +65,7 @@ func GetOCISpec(cntID, containerdNamespace string) (*oci.Spec, error) {
 	return cntSpec, nil
 }
 
-func GetContainerName(cnt pb.ContainerDefinition, hostRuntime string) (string, error) {
+func GetContainerName(cnt *pb.ContainerDefinition, hostRuntime string) (string, error) {
 	if hostRuntime == docker.RuntimeDocker {
 		cntName := cnt.Name
 		// The list has names saved without the restart count like this:
@@ -82,8 +77,7 @@ func GetContainerName(cnt pb.ContainerDefinition, hostRuntime string) (string, e
 	// From here it is assumed that the container runtime is containerd.
 
 	// Talk to the containerd API and get the container.
-	c, closer, err := GetContainerFromID(cnt.Id, ContainerdNamespace)
-	defer closer()
+	c, err := GetContainerFromID(cnt.Id, ContainerdNamespace)
 	if err != nil {
 		return "", fmt.Errorf("getting container from id: %w", err)
 	}
@@ -112,3 +106,70 @@ func GetContainerName(cnt pb.ContainerDefinition, hostRuntime string) (string, e
 
 	return "k8s_" + podName + "_" + cntName + "_" + podNamespace + "_" + podUID, nil
 }
+
+// GetImage returns the name and digest of the image of the container.
+func GetImage(cntID, containerdNamespace string) (string, string, error) {
+	cnt, err := GetContainerFromID(cntID, containerdNamespace)
+	if err != nil {
+		return "", "", fmt.Errorf("getting container from id: %w", err)
+	}
+
+	img, err := cnt.Image(context.Background())
+	if err != nil {
+		return "", "", fmt.Errorf("getting container image: %w", err)
+	}
+
+	return img.Name(), img.Target().Digest.String(), nil
+}
+
+// GetImageDigest returns the digest of the image of the store.
+func GetImageDigest(ref, containerdNamespace string) (string, error) {
+	ctx := context.Background()
+	client, err := clients.get(ctx, containerdNamespace)
+	if err != nil {
+		return "", err
+	}
+
+	img, err := client.GetImage(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("getting image: %w", err)
+	}
+
+	return img.Target().Digest.String(), nil
+}
+
+// ListImageDigests returns the digests of the images on the node.
+func ListImageDigests(containerdNamespace string) (map[string]bool, error) {
+	ctx := context.Background()
+	client, err := clients.get(ctx, containerdNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := client.ListImages(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing images: %w", err)
+	}
+
+	digests := make(map[string]bool, len(images))
+	for _, img := range images {
+		digests[img.Target().Digest.String()] = true
+	}
+
+	return digests, nil
+}
+
+// GetTaskPID returns the PID of the main process of the container, it changes when the container is restarted.
+func GetTaskPID(cntID, containerdNamespace string) (uint32, error) {
+	cnt, err := GetContainerFromID(cntID, containerdNamespace)
+	if err != nil {
+		return 0, fmt.Errorf("getting container from id: %w", err)
+	}
+
+	task, err := cnt.Task(context.Background(), nil)
+	if err != nil {
+		return 0, fmt.Errorf("getting container task: %w", err)
+	}
+
+	return task.Pid(), nil
+}
@@ -0,0 +1,138 @@
+package containerd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd"
+	apievents "github.com/containerd/containerd/api/events"
+	"github.com/containerd/typeurl"
+	pb "github.com/kinvolk/inspektor-gadget/pkg/gadgettracermanager/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// WatchTasks calls fn with the containers whose task is running, then with the ones whose task starts or exits, from
+// the event stream of containerd, until the context is done or the stream fails. Only the containers are known, not
+// their pods.
+func WatchTasks(ctx context.Context, containerdNamespace string, fn func(cnt *pb.ContainerDefinition, started bool)) error {
+	client, err := clients.get(ctx, containerdNamespace)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The events are received from before the containers are listed, so none is missed. A container can be seen
+	// twice.
+	envelopes, errs := client.Subscribe(ctx,
+		fmt.Sprintf(`namespace==%q,topic=="/tasks/start"`, containerdNamespace),
+		fmt.Sprintf(`namespace==%q,topic=="/tasks/exit"`, containerdNamespace))
+
+	if err := listTasks(ctx, client, func(cnt *pb.ContainerDefinition) { fn(cnt, true) }); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case err := <-errs:
+			if ctx.Err() != nil {
+				return nil
+			}
+			clients.invalidate(containerdNamespace, client)
+			return fmt.Errorf("receiving events: %w", err)
+
+		case envelope := <-envelopes:
+			event, err := typeurl.UnmarshalAny(envelope.Event)
+			if err != nil {
+				log.Errorf("decoding containerd event %s: %v", envelope.Topic, err)
+				continue
+			}
+
+			switch e := event.(type) {
+			case *apievents.TaskStart:
+				fn(&pb.ContainerDefinition{Id: e.ContainerID, Pid: e.Pid}, true)
+			case *apievents.TaskExit:
+				// The processes run in the container with exec exit too.
+				if e.ID == e.ContainerID {
+					fn(&pb.ContainerDefinition{Id: e.ContainerID, Pid: e.Pid}, false)
+				}
+			}
+		}
+	}
+}
+
+// WatchImages calls fn with the name of the images created or updated in containerd, like by a pull, until the
+// context is done or the stream fails.
+func WatchImages(ctx context.Context, containerdNamespace string, fn func(name string)) error {
+	client, err := clients.get(ctx, containerdNamespace)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	envelopes, errs := client.Subscribe(ctx,
+		fmt.Sprintf(`namespace==%q,topic=="/images/create"`, containerdNamespace),
+		fmt.Sprintf(`namespace==%q,topic=="/images/update"`, containerdNamespace))
+
+	for {
+		select {
+		case err := <-errs:
+			if ctx.Err() != nil {
+				return nil
+			}
+			clients.invalidate(containerdNamespace, client)
+			return fmt.Errorf("receiving events: %w", err)
+
+		case envelope := <-envelopes:
+			event, err := typeurl.UnmarshalAny(envelope.Event)
+			if err != nil {
+				log.Errorf("decoding containerd event %s: %v", envelope.Topic, err)
+				continue
+			}
+
+			switch e := event.(type) {
+			case *apievents.ImageCreate:
+				fn(e.Name)
+			case *apievents.ImageUpdate:
+				fn(e.Name)
+			}
+		}
+	}
+}
+
+// ListTasks calls fn with the containers whose task is running.
+func ListTasks(ctx context.Context, containerdNamespace string, fn func(cnt *pb.ContainerDefinition)) error {
+	client, err := clients.get(ctx, containerdNamespace)
+	if err != nil {
+		return err
+	}
+
+	return listTasks(ctx, client, fn)
+}
+
+func listTasks(ctx context.Context, client *containerd.Client, fn func(cnt *pb.ContainerDefinition)) error {
+	cnts, err := client.Containers(ctx)
+	if err != nil {
+		return fmt.Errorf("listing containers: %w", err)
+	}
+
+	for _, cnt := range cnts {
+		task, err := cnt.Task(ctx, nil)
+		if err != nil {
+			// It has no task, it is not running.
+			continue
+		}
+
+		status, err := task.Status(ctx)
+		if err != nil || status.Status != containerd.Running {
+			continue
+		}
+
+		fn(&pb.ContainerDefinition{Id: cnt.ID(), Pid: task.Pid()})
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package containerd
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/containerd/containerd/oci"
+	pb "github.com/kinvolk/inspektor-gadget/pkg/gadgettracermanager/api"
+)
+
+// FakeContainer is a container of the Fake runtime.
+type FakeContainer struct {
+	Spec *oci.Spec
+	// Name is named like docker names the containers of the pods, k8s_<container>_<pod>_<namespace>_<pod UID>.
+	Name        string
+	Image       string
+	ImageDigest string
+	PID         uint32
+}
+
+// Fake is a runtime keeping the containers in memory, for the tests of the attach pipeline without containerd.
+type Fake struct {
+	lock       sync.Mutex
+	containers map[string]*FakeContainer
+}
+
+func NewFake() *Fake {
+	return &Fake{containers: make(map[string]*FakeContainer)}
+}
+
+// Add adds or replaces the container.
+func (f *Fake) Add(cntID string, cnt *FakeContainer) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.containers[cntID] = cnt
+}
+
+func (f *Fake) Remove(cntID string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.containers, cntID)
+}
+
+// SetPID changes the PID of the main process of the container, like when it is restarted.
+func (f *Fake) SetPID(cntID string, pid uint32) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	cnt, ok := f.containers[cntID]
+	if !ok {
+		return fmt.Errorf("no container found")
+	}
+
+	cnt.PID = pid
+	return nil
+}
+
+func (f *Fake) get(cntID string) (FakeContainer, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	cnt, ok := f.containers[cntID]
+	if !ok {
+		return FakeContainer{}, fmt.Errorf("getting container from id: no container found")
+	}
+
+	return *cnt, nil
+}
+
+func (f *Fake) OCISpec(cntID string) (*oci.Spec, error) {
+	cnt, err := f.get(cntID)
+	if err != nil {
+		return nil, err
+	}
+
+	if cnt.Spec == nil {
+		return &oci.Spec{}, nil
+	}
+
+	return cnt.Spec, nil
+}
+
+func (f *Fake) ContainerName(cnt *pb.ContainerDefinition) (string, error) {
+	c, err := f.get(cnt.Id)
+	if err != nil {
+		return "", err
+	}
+
+	return c.Name, nil
+}
+
+func (f *Fake) Image(cntID string) (string, string, error) {
+	cnt, err := f.get(cntID)
+	if err != nil {
+		return "", "", err
+	}
+
+	return cnt.Image, cnt.ImageDigest, nil
+}
+
+func (f *Fake) TaskPID(cntID string) (uint32, error) {
+	cnt, err := f.get(cntID)
+	if err != nil {
+		return 0, err
+	}
+
+	return cnt.PID, nil
+}
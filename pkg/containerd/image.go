@@ -0,0 +1,70 @@
+package containerd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/mount"
+	"github.com/opencontainers/image-spec/identity"
+	log "github.com/sirupsen/logrus"
+)
+
+// WithImageRootFS mounts the rootfs of the image read-only and calls fn with its path. The image is taken from the
+// local store and, if it is not there and pull is set, it is pulled. It returns the name and digest of the image.
+func WithImageRootFS(ctx context.Context, ref, containerdNamespace string, pull bool, fn func(root string) error) (string, string, error) {
+	client, err := containerd.New(ContainerdSocket, containerd.WithDefaultNamespace(containerdNamespace))
+	if err != nil {
+		return "", "", fmt.Errorf("creating containerd client: %w", err)
+	}
+	defer client.Close()
+
+	// The lease keeps the content from being garbage collected while it is used.
+	ctx, done, err := client.WithLease(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf("creating lease: %w", err)
+	}
+	defer done(ctx)
+
+	img, err := client.GetImage(ctx, ref)
+	if errdefs.IsNotFound(err) && pull {
+		log.Infof("pulling image %s", ref)
+		img, err = client.Pull(ctx, ref, containerd.WithPullUnpack)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("getting image: %w", err)
+	}
+
+	unpacked, err := img.IsUnpacked(ctx, containerd.DefaultSnapshotter)
+	if err != nil {
+		return "", "", fmt.Errorf("checking image unpacked: %w", err)
+	}
+
+	if !unpacked {
+		if err := img.Unpack(ctx, containerd.DefaultSnapshotter); err != nil {
+			return "", "", fmt.Errorf("unpacking image: %w", err)
+		}
+	}
+
+	diffIDs, err := img.RootFS(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf("getting image layers: %w", err)
+	}
+
+	snapshotter := client.SnapshotService(containerd.DefaultSnapshotter)
+	key := fmt.Sprintf("fanotify-mon-%d-%s", os.Getpid(), img.Target().Digest.Encoded())
+
+	mounts, err := snapshotter.View(ctx, key, identity.ChainID(diffIDs).String())
+	if err != nil {
+		return "", "", fmt.Errorf("creating snapshot view: %w", err)
+	}
+	defer snapshotter.Remove(ctx, key)
+
+	if err := mount.WithTempMount(ctx, mounts, fn); err != nil {
+		return "", "", err
+	}
+
+	return img.Name(), img.Target().Digest.String(), nil
+}
@@ -0,0 +1,46 @@
+package containerd
+
+import (
+	"github.com/containerd/containerd/oci"
+	pb "github.com/kinvolk/inspektor-gadget/pkg/gadgettracermanager/api"
+)
+
+// Runtime looks up the containers in the container runtime. The agent uses the containerd socket, Fake keeps the
+// containers in memory so they can be attached without it.
+type Runtime interface {
+	OCISpec(cntID string) (*oci.Spec, error)
+	// ContainerName returns the name of the container like docker names the containers of the pods.
+	ContainerName(cnt *pb.ContainerDefinition) (string, error)
+	// Image returns the name and digest of the image of the container.
+	Image(cntID string) (string, string, error)
+	// TaskPID returns the PID of the main process of the container.
+	TaskPID(cntID string) (uint32, error)
+}
+
+// Containerd is the runtime of the containerd socket, in the namespace of the runtime of the host.
+type Containerd struct {
+	HostRuntime string
+	Namespace   string
+}
+
+// NewRuntime returns the runtime of the containerd socket for the runtime of the host, set with
+// SetContainerdNamespace.
+func NewRuntime(hostRuntime string) *Containerd {
+	return &Containerd{HostRuntime: hostRuntime, Namespace: ContainerdNamespace}
+}
+
+func (c *Containerd) OCISpec(cntID string) (*oci.Spec, error) {
+	return GetOCISpec(cntID, c.Namespace)
+}
+
+func (c *Containerd) ContainerName(cnt *pb.ContainerDefinition) (string, error) {
+	return GetContainerName(cnt, c.HostRuntime)
+}
+
+func (c *Containerd) Image(cntID string) (string, string, error) {
+	return GetImage(cntID, c.Namespace)
+}
+
+func (c *Containerd) TaskPID(cntID string) (uint32, error) {
+	return GetTaskPID(cntID, c.Namespace)
+}
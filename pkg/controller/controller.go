@@ -0,0 +1,215 @@
+// Package controller has the cluster controller aggregating the NodeStatus objects of the node agents into the status
+// of the ExecPolicy objects, flagging the nodes whose agent stopped reporting, and removing the NodeStatus objects of
+// the nodes which are gone.
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/aggregator"
+	"github.com/kinvolk/fanotify-poc/pkg/alert"
+	"github.com/kinvolk/fanotify-poc/pkg/k8s"
+	"github.com/kinvolk/fanotify-poc/pkg/status"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// violationsPeriod is how far back the violations of the policies are counted.
+const violationsPeriod = 24 * time.Hour
+
+type Controller struct {
+	Client    dynamic.Interface
+	Clientset kubernetes.Interface
+	// Aggregator is where the violations are counted from, they are not counted without it.
+	Aggregator *aggregator.Client
+	// Alerts is where the alerts of the nodes whose agent stopped reporting are sent, if set.
+	Alerts *alert.Client
+
+	// Interval is how often the statuses are aggregated, the nodes which did not report for StaleAfter are counted
+	// with errors.
+	Interval   time.Duration
+	StaleAfter time.Duration
+
+	// stale are the nodes whose agent stopped reporting, with the time of their last report.
+	stale map[string]time.Time
+}
+
+// Run aggregates the statuses every interval until the context is done.
+func (c *Controller) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.sync(ctx); err != nil {
+			log.Errorf("aggregating statuses: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Controller) sync(ctx context.Context) error {
+	nodeStatuses, err := k8s.ListNodeStatuses(ctx, c.Client)
+	if err != nil {
+		return err
+	}
+
+	nodes, err := c.Clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing nodes: %w", err)
+	}
+
+	existing := make(map[string]bool, len(nodes.Items))
+	for _, node := range nodes.Items {
+		existing[node.Name] = true
+	}
+
+	// The NodeStatus objects of the nodes removed from the cluster would be left behind.
+	current := nodeStatuses[:0]
+	for _, s := range nodeStatuses {
+		if existing[s.Name] {
+			current = append(current, s)
+			continue
+		}
+
+		if err := k8s.DeleteNodeStatus(ctx, c.Client, s.Name); err != nil {
+			log.Errorf("%v", err)
+			continue
+		}
+		log.Infof("deleted the status of node %s, it is gone", s.Name)
+	}
+
+	now := time.Now()
+	c.checkReporting(ctx, current, now)
+
+	statuses := status.Policies(current, now, c.StaleAfter)
+
+	var violations map[string]int
+	if c.Aggregator != nil {
+		if violations, err = c.violations(ctx); err != nil {
+			log.Errorf("counting violations: %v", err)
+		}
+	}
+
+	policies, err := k8s.ListPolicies(ctx, c.Client)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range policies {
+		// The policies enforced nowhere are reset.
+		s := statuses[p.Name]
+		if s == nil {
+			s = &status.PolicyStatus{}
+		}
+
+		if violations != nil {
+			count := violations[p.Name]
+			s.ViolationsLast24h = &count
+		}
+
+		updated, err := k8s.UpdatePolicyStatus(ctx, c.Client, p.Name, s)
+		if err != nil {
+			log.Errorf("%v", err)
+		} else if updated {
+			log.Debugf("updated the status of policy %s", p.Name)
+		}
+	}
+
+	return nil
+}
+
+// checkReporting sets the Reporting condition of the nodes whose agent stopped reporting, and fires their alerts until
+// it reports again or the node is gone. The agents set the condition back once they report.
+func (c *Controller) checkReporting(ctx context.Context, nodes []status.NodeStatus, now time.Time) {
+	if c.stale == nil {
+		c.stale = make(map[string]time.Time)
+	}
+
+	stale := make(map[string]time.Time)
+	for _, node := range nodes {
+		last := node.Status.LastReport
+		if last == nil || now.Sub(last.Time) <= c.StaleAfter {
+			continue
+		}
+
+		stale[node.Name] = last.Time
+		if _, ok := c.stale[node.Name]; !ok {
+			log.Warnf("the agent of node %s stopped reporting, its last report was at %s", node.Name, last.Format(time.RFC3339))
+		}
+
+		condition := metav1.Condition{
+			Type:    status.ConditionReporting,
+			Status:  metav1.ConditionFalse,
+			Reason:  "AgentNotReporting",
+			Message: fmt.Sprintf("the agent did not report since %s, the node may not be enforced", last.UTC().Format(time.RFC3339)),
+		}
+		if _, err := k8s.SetNodeStatusCondition(ctx, c.Client, node.Name, condition); err != nil {
+			log.Errorf("flagging node %s: %v", node.Name, err)
+		}
+	}
+
+	alerts := []alert.Alert{}
+	for name, last := range stale {
+		alerts = append(alerts, staleAlert(name, last, time.Time{}))
+	}
+	for name, last := range c.stale {
+		if _, ok := stale[name]; !ok {
+			log.Infof("the agent of node %s reports again, or the node is gone", name)
+			alerts = append(alerts, staleAlert(name, last, now))
+		}
+	}
+	c.stale = stale
+
+	if c.Alerts != nil && len(alerts) > 0 {
+		if err := c.Alerts.Send(alerts); err != nil {
+			log.Errorf("sending %d alerts: %v", len(alerts), err)
+		}
+	}
+}
+
+// staleAlert returns the alert of the node whose agent stopped reporting, resolved at endsAt unless it is zero.
+func staleAlert(node string, last, endsAt time.Time) alert.Alert {
+	a := alert.Alert{
+		Labels: map[string]string{
+			"alertname": "FanotifyMonAgentNotReporting",
+			"severity":  "critical",
+			"node":      node,
+		},
+		Annotations: map[string]string{
+			"summary": fmt.Sprintf("The agent of node %s did not report since %s, the node may not be enforced", node, last.UTC().Format(time.RFC3339)),
+		},
+		StartsAt: last.UTC().Format(time.RFC3339),
+	}
+	if !endsAt.IsZero() {
+		a.EndsAt = endsAt.UTC().Format(time.RFC3339)
+	}
+
+	return a
+}
+
+// violations returns the distinct violations of every policy seen in the violations period.
+func (c *Controller) violations(ctx context.Context) (map[string]int, error) {
+	all, err := c.Aggregator.Violations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	since := time.Now().Add(-violationsPeriod)
+	counts := make(map[string]int)
+	for _, v := range all {
+		if v.LastSeen.After(since) {
+			counts[v.Policy]++
+		}
+	}
+
+	return counts, nil
+}
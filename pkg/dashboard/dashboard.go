@@ -0,0 +1,123 @@
+// Package dashboard serves a read-only web page with the state of the node agent: the enforced containers, the
+// readiness of their baselines and the recent violations and drift, for the clusters without an observability stack.
+package dashboard
+
+import (
+	_ "embed"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/eventstore"
+	"github.com/kinvolk/fanotify-poc/pkg/status"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// RecentPeriod is how far back the violations and the drift are shown.
+	RecentPeriod = 24 * time.Hour
+	// maxRecent is how many violations and drifted executions are shown at most.
+	maxRecent = 50
+	// maxScanned is how many events of the period are read at most.
+	maxScanned = 10000
+)
+
+//go:embed dashboard.html
+var page string
+
+var pageTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"short": func(id string) string {
+		if len(id) > 12 {
+			return id[:12]
+		}
+		return id
+	},
+	"join": func(values []string) string {
+		return strings.Join(values, ", ")
+	},
+	"time": func(t time.Time) string {
+		return t.Local().Format("2006-01-02 15:04:05")
+	},
+}).Parse(page))
+
+type Server struct {
+	Node string
+	// Status returns the state of the enforced containers.
+	Status func() []status.Container
+	// Events queries the event store, it is nil when the events are not stored.
+	Events func(q *eventstore.Query) ([]events.Event, error)
+}
+
+// data is what the page shows.
+type data struct {
+	Node       string
+	Time       time.Time
+	Status     status.NodeStatusStatus
+	Stored     bool
+	Violations []events.Event
+	Drift      []events.Event
+	Error      string
+}
+
+// Run serves the dashboard until it fails.
+func (s *Server) Run(addr string) error {
+	log.Infof("serving the dashboard on %s", addr)
+	return http.ListenAndServe(addr, s)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cnts := s.Status()
+	sort.Slice(cnts, func(i, j int) bool {
+		if cnts[i].Namespace != cnts[j].Namespace {
+			return cnts[i].Namespace < cnts[j].Namespace
+		}
+		if cnts[i].Pod != cnts[j].Pod {
+			return cnts[i].Pod < cnts[j].Pod
+		}
+		return cnts[i].Name < cnts[j].Name
+	})
+
+	d := &data{
+		Node:   s.Node,
+		Time:   time.Now(),
+		Status: status.New(s.Node, cnts, nil).Status,
+		Stored: s.Events != nil,
+	}
+
+	if s.Events != nil {
+		evs, err := s.Events(&eventstore.Query{Since: d.Time.Add(-RecentPeriod), Limit: maxScanned})
+		if err != nil {
+			log.Errorf("dashboard: querying events: %v", err)
+			d.Error = err.Error()
+		}
+
+		// The most recent first.
+		for i := len(evs) - 1; i >= 0; i-- {
+			e := evs[i]
+			if e.IsViolation() && len(d.Violations) < maxRecent {
+				d.Violations = append(d.Violations, e)
+			}
+			if e.Drift && len(d.Drift) < maxRecent {
+				d.Drift = append(d.Drift, e)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := pageTemplate.Execute(w, d); err != nil {
+		log.Errorf("dashboard: writing page: %v", err)
+	}
+}
@@ -1,5 +1,202 @@
+// Package docker talks to dockerd, to enforce the plain docker containers without Kubernetes.
 package docker
 
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
 const (
 	RuntimeDocker = "docker"
+	DockerSocket  = "/run/docker.sock"
 )
+
+// apiVersion is the oldest version of the Docker Engine API with what is used, dockerd 1.13.
+const apiVersion = "v1.25"
+
+// Container is what is known about a running container from dockerd.
+type Container struct {
+	ID     string
+	Name   string
+	Pid    uint32
+	Labels map[string]string
+}
+
+// Event is the start or the end of a container.
+type Event struct {
+	// Started is false once the container is gone.
+	Started   bool
+	Container *Container
+}
+
+// Client talks to the Docker Engine API on the socket of dockerd.
+type Client struct {
+	http *http.Client
+}
+
+func NewClient(socket string) *Client {
+	return &Client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// Watch calls fn with the running containers with all the labels, then with the containers starting and stopping
+// until the context is done or the event stream fails.
+func (c *Client) Watch(ctx context.Context, labels []string, fn func(Event)) error {
+	// The events are streamed from before the containers are listed, so none is missed. A container can be seen
+	// twice.
+	since := time.Now()
+
+	filters := map[string][]string{"status": {"running"}}
+	if len(labels) > 0 {
+		filters["label"] = labels
+	}
+
+	var list []struct {
+		ID string `json:"Id"`
+	}
+	if err := c.get(ctx, "/containers/json", filters, nil, &list); err != nil {
+		return fmt.Errorf("listing containers: %w", err)
+	}
+
+	for _, cnt := range list {
+		inspected, err := c.Inspect(ctx, cnt.ID)
+		if err != nil {
+			// It stopped meanwhile.
+			continue
+		}
+
+		fn(Event{Started: true, Container: inspected})
+	}
+
+	filters = map[string][]string{"type": {"container"}, "event": {"start", "die"}}
+	if len(labels) > 0 {
+		filters["label"] = labels
+	}
+
+	resp, err := c.do(ctx, "/events", filters, url.Values{"since": {strconv.FormatInt(since.Unix(), 10)}})
+	if err != nil {
+		return fmt.Errorf("getting events: %w", err)
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var e struct {
+			Action string `json:"Action"`
+			Actor  struct {
+				ID string `json:"ID"`
+			} `json:"Actor"`
+		}
+		if err := dec.Decode(&e); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("reading events: %w", err)
+		}
+
+		switch e.Action {
+		case "start":
+			inspected, err := c.Inspect(ctx, e.Actor.ID)
+			if err != nil {
+				continue
+			}
+			fn(Event{Started: true, Container: inspected})
+
+		case "die":
+			fn(Event{Container: &Container{ID: e.Actor.ID}})
+		}
+	}
+}
+
+// Inspect returns the container, it is an error when it is not running.
+func (c *Client) Inspect(ctx context.Context, id string) (*Container, error) {
+	var inspected struct {
+		ID    string `json:"Id"`
+		Name  string `json:"Name"`
+		State struct {
+			Running bool   `json:"Running"`
+			Pid     uint32 `json:"Pid"`
+		} `json:"State"`
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"Config"`
+	}
+	if err := c.get(ctx, "/containers/"+url.PathEscape(id)+"/json", nil, nil, &inspected); err != nil {
+		return nil, fmt.Errorf("inspecting container %s: %w", id, err)
+	}
+
+	if !inspected.State.Running {
+		return nil, fmt.Errorf("container %s is not running", id)
+	}
+
+	return &Container{
+		ID:     inspected.ID,
+		Name:   strings.TrimPrefix(inspected.Name, "/"),
+		Pid:    inspected.State.Pid,
+		Labels: inspected.Config.Labels,
+	}, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, filters map[string][]string, q url.Values, v interface{}) error {
+	resp, err := c.do(ctx, path, filters, q)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// do sends the request to the socket and checks the status of the response. The host is ignored.
+func (c *Client) do(ctx context.Context, path string, filters map[string][]string, q url.Values) (*http.Response, error) {
+	if q == nil {
+		q = url.Values{}
+	}
+
+	if filters != nil {
+		data, err := json.Marshal(filters)
+		if err != nil {
+			return nil, err
+		}
+		q.Set("filters", string(data))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://docker/"+apiVersion+path+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+
+		var msg struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&msg)
+
+		return nil, fmt.Errorf("%s: %s", resp.Status, msg.Message)
+	}
+
+	return resp, nil
+}
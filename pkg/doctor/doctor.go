@@ -0,0 +1,299 @@
+// Package doctor checks that the node can run the agent, so the misconfigurations are reported clearly instead of
+// showing up later as cryptic errors.
+package doctor
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type Status string
+
+const (
+	StatusPass Status = "pass"
+	StatusFail Status = "fail"
+	// StatusSkip is for the checks which could not be done, e.g. when the kernel config is not available.
+	StatusSkip Status = "skip"
+)
+
+// ErrSkip is returned by the checks which could not be done.
+var ErrSkip = errors.New("skipped")
+
+type Check struct {
+	Name string
+	// Run returns what was found, or why the check failed.
+	Run func() (string, error)
+}
+
+type Result struct {
+	Name   string
+	Status Status
+	Detail string
+}
+
+// Run runs all the checks.
+func Run(checks []Check) []Result {
+	results := []Result{}
+
+	for _, check := range checks {
+		detail, err := check.Run()
+
+		r := Result{Name: check.Name, Status: StatusPass, Detail: detail}
+		switch {
+		case errors.Is(err, ErrSkip):
+			r.Status = StatusSkip
+			r.Detail = err.Error()
+		case err != nil:
+			r.Status = StatusFail
+			r.Detail = err.Error()
+		}
+
+		results = append(results, r)
+	}
+
+	return results
+}
+
+// Failed tells if any of the checks failed.
+func Failed(results []Result) bool {
+	for _, r := range results {
+		if r.Status == StatusFail {
+			return true
+		}
+	}
+
+	return false
+}
+
+// KernelVersion checks that the kernel is at least major.minor.
+func KernelVersion(major, minor int) Check {
+	return Check{
+		Name: "kernel version",
+		Run: func() (string, error) {
+			release, err := kernelRelease()
+			if err != nil {
+				return "", err
+			}
+
+			// The release looks like this: 5.15.0-91-generic
+			var gotMajor, gotMinor int
+			if _, err := fmt.Sscanf(release, "%d.%d", &gotMajor, &gotMinor); err != nil {
+				return "", fmt.Errorf("parsing release %q: %w", release, err)
+			}
+
+			if gotMajor < major || (gotMajor == major && gotMinor < minor) {
+				return "", fmt.Errorf("%s is older than %d.%d, FAN_OPEN_EXEC_PERM is not supported", release, major, minor)
+			}
+
+			return release, nil
+		},
+	}
+}
+
+// KernelConfig checks that the options are enabled in the config of the running kernel.
+func KernelConfig(options ...string) Check {
+	return Check{
+		Name: "kernel config",
+		Run: func() (string, error) {
+			config, err := readKernelConfig()
+			if err != nil {
+				return "", err
+			}
+
+			missing := []string{}
+			for _, option := range options {
+				if v := config[option]; v != "y" && v != "m" {
+					missing = append(missing, option)
+				}
+			}
+
+			if len(missing) > 0 {
+				return "", fmt.Errorf("not enabled: %s", strings.Join(missing, ", "))
+			}
+
+			return strings.Join(options, ", "), nil
+		},
+	}
+}
+
+// Fanotify checks that a fanotify group getting permission events can be created and that FAN_OPEN_EXEC_PERM can be
+// used. Only a temporary file is marked, so nothing else is blocked.
+func Fanotify() Check {
+	return Check{
+		Name: "fanotify",
+		Run: func() (string, error) {
+			fd, err := unix.FanotifyInit(unix.FAN_CLASS_CONTENT|unix.FAN_CLOEXEC, unix.O_RDONLY)
+			if err != nil {
+				return "", fmt.Errorf("initializing fanotify: %w", err)
+			}
+			defer unix.Close(fd)
+
+			f, err := os.CreateTemp("", "fanotify-mon-doctor")
+			if err != nil {
+				return "", fmt.Errorf("creating file to mark: %w", err)
+			}
+			defer os.Remove(f.Name())
+			f.Close()
+
+			if err := unix.FanotifyMark(fd, unix.FAN_MARK_ADD, unix.FAN_OPEN_EXEC_PERM, unix.AT_FDCWD, f.Name()); err != nil {
+				return "", fmt.Errorf("marking with FAN_OPEN_EXEC_PERM: %w", err)
+			}
+
+			return "FAN_OPEN_EXEC_PERM supported", nil
+		},
+	}
+}
+
+// CapSysAdmin checks that the agent has CAP_SYS_ADMIN, needed by fanotify.
+func CapSysAdmin() Check {
+	return Check{
+		Name: "CAP_SYS_ADMIN",
+		Run: func() (string, error) {
+			f, err := os.Open("/proc/self/status")
+			if err != nil {
+				return "", fmt.Errorf("reading capabilities: %w", err)
+			}
+			defer f.Close()
+
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				value, ok := cutPrefix(scanner.Text(), "CapEff:")
+				if !ok {
+					continue
+				}
+
+				caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+				if err != nil {
+					return "", fmt.Errorf("parsing capabilities: %w", err)
+				}
+
+				if caps&(1<<unix.CAP_SYS_ADMIN) == 0 {
+					return "", fmt.Errorf("not in the effective capabilities, fanotify can't be used")
+				}
+
+				return "effective", nil
+			}
+
+			return "", fmt.Errorf("no effective capabilities found")
+		},
+	}
+}
+
+// HostPID checks that the processes of the containers can be seen in /proc, i.e. the agent runs in the PID namespace
+// of the host and can reach the root of the other processes.
+func HostPID() Check {
+	return Check{
+		Name: "/proc visibility",
+		Run: func() (string, error) {
+			self, err := os.Readlink("/proc/self/ns/pid")
+			if err != nil {
+				return "", fmt.Errorf("reading PID namespace: %w", err)
+			}
+
+			init, err := os.Readlink("/proc/1/ns/pid")
+			if err != nil {
+				return "", fmt.Errorf("reading PID namespace of init: %w", err)
+			}
+
+			if self != init {
+				return "", fmt.Errorf("not in the PID namespace of the host, run with hostPID")
+			}
+
+			if _, err := os.ReadDir("/proc/1/root"); err != nil {
+				return "", fmt.Errorf("reading the root of init, CAP_SYS_PTRACE is needed: %w", err)
+			}
+
+			return "host PID namespace", nil
+		},
+	}
+}
+
+// Socket checks that the unix socket of the runtime accepts connections.
+func Socket(name, path string) Check {
+	return Check{
+		Name: name + " socket",
+		Run: func() (string, error) {
+			conn, err := net.DialTimeout("unix", path, 5*time.Second)
+			if err != nil {
+				return "", err
+			}
+			conn.Close()
+
+			return path, nil
+		},
+	}
+}
+
+func kernelRelease() (string, error) {
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return "", fmt.Errorf("getting kernel release: %w", err)
+	}
+
+	return unix.ByteSliceToString(uname.Release[:]), nil
+}
+
+// readKernelConfig reads the config of the running kernel from /proc/config.gz or from /boot.
+func readKernelConfig() (map[string]string, error) {
+	release, err := kernelRelease()
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader
+	if f, err := os.Open("/proc/config.gz"); err == nil {
+		defer f.Close()
+
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing /proc/config.gz: %w", err)
+		}
+		r = gz
+	} else if f, err := os.Open("/boot/config-" + release); err == nil {
+		defer f.Close()
+		r = f
+	} else {
+		return nil, fmt.Errorf("%w: no /proc/config.gz nor /boot/config-%s", ErrSkip, release)
+	}
+
+	config := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// The lines look like this: CONFIG_FANOTIFY=y
+		if name, value, ok := cut(scanner.Text(), "="); ok && strings.HasPrefix(name, "CONFIG_") {
+			config[name] = value
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading kernel config: %w", err)
+	}
+
+	return config, nil
+}
+
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+
+	return s[len(prefix):], true
+}
+
+func cut(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+
+	return s, "", false
+}
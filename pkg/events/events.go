@@ -0,0 +1,70 @@
+// Package events has the decisions taken on the executions of the enforced containers, as they are reported outside
+// of the node agent.
+package events
+
+import (
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+)
+
+type Verdict string
+
+const (
+	VerdictAllow Verdict = "allow"
+	VerdictDeny  Verdict = "deny"
+	// VerdictAudit is for the executions which should have been denied but were allowed because the policy is only
+	// audited.
+	VerdictAudit Verdict = "audit"
+)
+
+const (
+	// AccessRead is the access of the decisions taken on the reads of the protected files.
+	AccessRead = "read"
+	// AccessWrite is the access of the decisions taken on the files of an immutable rootfs opened for writing.
+	AccessWrite = "write"
+	// AccessAttach is the access of the decisions taken when the container is attached on the executables of its
+	// rootfs which are not the ones of its image.
+	AccessAttach = "attach"
+)
+
+// Event is a decision taken on an execution, or on the access to a protected file.
+type Event struct {
+	Time time.Time `json:"time"`
+	Node string    `json:"node,omitempty"`
+
+	ContainerID string `json:"containerID"`
+	Container   string `json:"container,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+	Pod         string `json:"pod,omitempty"`
+	Policy      string `json:"policy,omitempty"`
+
+	// Path of the executed file inside the container.
+	Path    string  `json:"path"`
+	PID     int     `json:"pid"`
+	Verdict Verdict `json:"verdict"`
+	Reason  string  `json:"reason,omitempty"`
+	// Access is empty for the executions.
+	Access string `json:"access,omitempty"`
+
+	// Drift is set when the file was modified since the baseline was computed or it is not part of it.
+	Drift bool `json:"drift,omitempty"`
+
+	// Late is set when the file was verified after the execution was answered because it missed the response
+	// deadline. The verdict is what the decision would have been.
+	Late bool `json:"late,omitempty"`
+
+	// Request is what the policy was evaluated on, so it can be evaluated again. It is not set when the decision
+	// did not come from the policy, e.g. for the exec probes.
+	Request *policy.Request `json:"request,omitempty"`
+
+	// Count is set on the summaries of identical consecutive decisions, to how many of them it stands for, see
+	// sink.Dedup. The decision is the last of them, Since is the time of the first one.
+	Count int        `json:"count,omitempty"`
+	Since *time.Time `json:"since,omitempty"`
+}
+
+// IsViolation tells if the execution was against the policy, even if it was allowed.
+func (e *Event) IsViolation() bool {
+	return e.Verdict != VerdictAllow
+}
@@ -0,0 +1,169 @@
+package eventstore
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// The events are chained: every line ends with the chain field, the SHA-256 of the chain of the previous event and of
+// the line without it. Modifying, removing or inserting an event breaks the chain of all the events after it, unless
+// all of them are rewritten too, which the heads of the chain anchored outside of the node tell.
+
+// chainSuffix matches the chain field closing a line.
+var chainSuffix = regexp.MustCompile(`,"chain":"([0-9a-f]{64})"}$`)
+
+// chain returns the line of the event encoded without chain, chained to the previous event, and its chain.
+func chain(prev string, event []byte) ([]byte, string) {
+	h := sha256.New()
+	io.WriteString(h, prev+"\n")
+	h.Write(event)
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	line := append(event[:len(event)-1:len(event)-1], `,"chain":"`+sum+`"}`...)
+	return append(line, '\n'), sum
+}
+
+// unchain returns the event of the line without its chain, and the chain. It is false for the lines without chain.
+func unchain(line []byte) ([]byte, string, bool) {
+	m := chainSuffix.FindSubmatchIndex(line)
+	if m == nil {
+		return nil, "", false
+	}
+
+	event := append(line[:m[0]:m[0]], '}')
+	return event, string(line[m[2]:m[3]]), true
+}
+
+// recoverHead returns the chain of the last event of the segment. A partial line left by a crash is removed, it would
+// break the chain.
+func recoverHead(path string) (string, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return "", fmt.Errorf("opening event segment: %w", err)
+	}
+	defer f.Close()
+
+	// previous is the head before the last line, and last its length.
+	head, previous := "", ""
+	last := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		previous, last = head, len(scanner.Bytes())
+		if _, sum, ok := unchain(scanner.Bytes()); ok {
+			head = sum
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("reading event segment: %w", err)
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("reading event segment: %w", err)
+	}
+
+	end := make([]byte, 1)
+	if st.Size() > 0 {
+		if _, err := f.ReadAt(end, st.Size()-1); err != nil {
+			return "", fmt.Errorf("reading event segment: %w", err)
+		}
+
+		if end[0] != '\n' {
+			if err := f.Truncate(st.Size() - int64(last)); err != nil {
+				return "", fmt.Errorf("removing partial event: %w", err)
+			}
+
+			return previous, nil
+		}
+	}
+
+	return head, nil
+}
+
+// Verification is the result of checking the chain of the events.
+type Verification struct {
+	// Events are the events checked, Unchained the lines without chain stored before the events were chained. A line
+	// without chain after the first chained one breaks the chain.
+	Events    int
+	Unchained int
+	// Head is the chain of the last event.
+	Head string
+	// Broken is where the chain is first broken, as SEGMENT:LINE, empty when it is intact.
+	Broken string
+	// Anchors tells for each of the heads checked if it is in the chain.
+	Anchors map[string]bool
+}
+
+// Verify checks the chain of the events stored in dir, and looks for the anchored heads in it. The first event kept is
+// trusted, the ones before it were removed by the retention.
+func Verify(dir string, anchors []string) (*Verification, error) {
+	s := &Store{dir: dir}
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Verification{Anchors: make(map[string]bool)}
+	for _, a := range anchors {
+		v.Anchors[a] = false
+	}
+
+	for _, seg := range segments {
+		if err := v.segment(seg.path); err != nil {
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
+
+func (v *Verification) segment(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening event segment: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		event, sum, ok := unchain(scanner.Bytes())
+		if !ok {
+			// The partial lines left by a crash are removed by the agent, only the events stored before the chain
+			// have none.
+			if v.Events > 0 && v.Broken == "" {
+				v.Broken = fmt.Sprintf("%s:%d", filepath.Base(path), n)
+			}
+			if v.Events == 0 {
+				v.Unchained++
+			}
+			continue
+		}
+
+		// The first event is trusted.
+		if v.Events > 0 {
+			if _, expected := chain(v.Head, event); expected != sum && v.Broken == "" {
+				v.Broken = fmt.Sprintf("%s:%d", filepath.Base(path), n)
+			}
+		}
+
+		v.Events++
+		v.Head = sum
+		if _, ok := v.Anchors[sum]; ok {
+			v.Anchors[sum] = true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading event segment: %w", err)
+	}
+
+	return nil
+}
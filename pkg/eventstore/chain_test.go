@@ -0,0 +1,179 @@
+package eventstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+)
+
+// storeEvents adds n events to a new store and returns the lines of its segment.
+func storeEvents(t *testing.T, n int) (string, []string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	s, err := Open(dir, 24*time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		e := &events.Event{Time: now, ContainerID: "c1", Path: fmt.Sprintf("/bin/exe%d", i), Verdict: events.VerdictDeny}
+		if err := s.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	segment := filepath.Join(dir, now.UTC().Format(segmentLayout)+segmentSuffix)
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return segment, strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name string
+		// tamper changes the lines of the segment, of 5 events.
+		tamper    func(lines []string) []string
+		broken    int
+		unchained int
+	}{
+		{
+			name:   "intact",
+			tamper: func(lines []string) []string { return lines },
+		},
+		{
+			name: "edited",
+			tamper: func(lines []string) []string {
+				lines[2] = strings.Replace(lines[2], "deny", "allow", 1)
+				return lines
+			},
+			broken: 3,
+		},
+		{
+			name: "edited with its chain",
+			tamper: func(lines []string) []string {
+				event, _, _ := unchain([]byte(lines[2]))
+				prev := chainSuffix.FindStringSubmatch(lines[1])[1]
+				line, _ := chain(prev, []byte(strings.Replace(string(event), "deny", "allow", 1)))
+				lines[2] = strings.TrimSuffix(string(line), "\n")
+				return lines
+			},
+			broken: 4,
+		},
+		{
+			name: "deleted",
+			tamper: func(lines []string) []string {
+				return append(lines[:2:2], lines[3:]...)
+			},
+			broken: 3,
+		},
+		{
+			name: "last deleted",
+			tamper: func(lines []string) []string {
+				return lines[:4]
+			},
+		},
+		{
+			name: "inserted without chain",
+			tamper: func(lines []string) []string {
+				return append(lines[:2:2], append([]string{`{"containerID":"c1","path":"/bin/sh","verdict":"allow"}`}, lines[2:]...)...)
+			},
+			broken: 3,
+		},
+		{
+			name: "appended without chain",
+			tamper: func(lines []string) []string {
+				return append(lines, `{"containerID":"c1","path":"/bin/sh","verdict":"allow"}`)
+			},
+			broken: 6,
+		},
+		{
+			name: "inserted with a chain",
+			tamper: func(lines []string) []string {
+				line, _ := chain(chainSuffix.FindStringSubmatch(lines[1])[1], []byte(`{"containerID":"c1","path":"/bin/sh","verdict":"allow"}`))
+				return append(lines[:2:2], append([]string{strings.TrimSuffix(string(line), "\n")}, lines[2:]...)...)
+			},
+			broken: 4,
+		},
+		{
+			name: "stored before the chain",
+			tamper: func(lines []string) []string {
+				return append([]string{`{"containerID":"c1","path":"/bin/sh","verdict":"allow"}`}, lines...)
+			},
+			unchained: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segment, lines := storeEvents(t, 5)
+			lines = tt.tamper(lines)
+			if err := os.WriteFile(segment, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			v, err := Verify(filepath.Dir(segment), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			broken := ""
+			if tt.broken > 0 {
+				broken = fmt.Sprintf("%s:%d", filepath.Base(segment), tt.broken)
+			}
+			if v.Broken != broken {
+				t.Errorf("broken at %q, expected %q", v.Broken, broken)
+			}
+			if v.Unchained != tt.unchained {
+				t.Errorf("%d lines without chain, expected %d", v.Unchained, tt.unchained)
+			}
+		})
+	}
+}
+
+// TestRecoverHead checks that the partial line left by a crash is removed, and the chain goes on from the line before.
+func TestRecoverHead(t *testing.T) {
+	segment, lines := storeEvents(t, 3)
+
+	f, err := os.OpenFile(segment, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"containerID":"c1","pa`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	s, err := Open(filepath.Dir(segment), 24*time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if head := chainSuffix.FindStringSubmatch(lines[2])[1]; s.Head() != head {
+		t.Fatalf("head %q, expected %q", s.Head(), head)
+	}
+
+	if err := s.Add(&events.Event{Time: time.Now(), ContainerID: "c1", Path: "/bin/sh", Verdict: events.VerdictDeny}); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := Verify(filepath.Dir(segment), []string{s.Head()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.Broken != "" || v.Unchained != 0 || v.Events != 4 || !v.Anchors[s.Head()] {
+		t.Errorf("unexpected verification %+v", v)
+	}
+}
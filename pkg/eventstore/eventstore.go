@@ -0,0 +1,376 @@
+// Package eventstore keeps the decisions of the node agent on disk, so they can be queried after the agent restarts.
+//
+// The events are appended as JSON lines to one file per hour, the files older than the retention are removed, and the
+// oldest ones past the quota of the store. Every event is chained to the previous one by a hash, so the tampering with
+// the stored events can be detected, see Verify.
+package eventstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	segmentSuffix = ".jsonl"
+	segmentLayout = "2006010215"
+	segmentPeriod = time.Hour
+)
+
+// Query filters the events, the empty fields match everything.
+type Query struct {
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+	// Path is a glob of the executed file.
+	Path    string         `json:"path,omitempty"`
+	Verdict events.Verdict `json:"verdict,omitempty"`
+	Drift   bool           `json:"drift,omitempty"`
+
+	// Limit is the maximum number of events returned, the most recent ones are kept.
+	Limit int `json:"limit,omitempty"`
+}
+
+// The reasons the segments are evicted from the store.
+const (
+	EvictRetention = "retention"
+	EvictQuota     = "quota"
+)
+
+// Stats are the size of the store and the segments evicted since it was opened, by reason.
+type Stats struct {
+	Bytes     int64
+	Evictions map[string]int
+}
+
+type Store struct {
+	dir       string
+	retention time.Duration
+	quota     int64
+
+	lock    sync.Mutex
+	segment string
+	file    *os.File
+	// latest is the most recent segment, the events are never added to the segments before it.
+	latest string
+	// head is the chain of the last event added.
+	head string
+	// size is the size of the segments, as of the last prune and the events added since, older is how many segments
+	// are before the current one.
+	size      int64
+	older     int
+	evictions map[string]int
+}
+
+// Open opens the store in dir, creating it if needed. The events older than retention are removed, 0 keeps them
+// forever, and the oldest ones when the store is larger than quota bytes, 0 does not limit its size.
+func Open(dir string, retention time.Duration, quota int64) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating event store: %w", err)
+	}
+
+	s := &Store{dir: dir, retention: retention, quota: quota, evictions: map[string]int{}}
+	if err := s.prune(time.Now()); err != nil {
+		return nil, err
+	}
+
+	// The chain goes on from the last event stored before the restart.
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		last := segments[len(segments)-1]
+		if s.head, err = recoverHead(last.path); err != nil {
+			return nil, err
+		}
+		s.latest = last.start.Format(segmentLayout)
+	}
+
+	return s, nil
+}
+
+// Add appends the event to the store.
+func (s *Store) Add(e *events.Event) error {
+	event, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encoding event: %w", err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// The events coming late, like the summaries of the duplicates, go to the latest segment: the chain goes on from its
+	// last event, and the segments before it may have been exported already.
+	segment := e.Time.UTC().Format(segmentLayout)
+	if segment < s.latest {
+		segment = s.latest
+	}
+	if segment != s.segment {
+		if err := s.rotate(segment, e.Time); err != nil {
+			return err
+		}
+	}
+
+	line, head := chain(s.head, event)
+	if _, err := s.file.Write(line); err != nil {
+		return fmt.Errorf("writing event: %w", err)
+	}
+	s.head = head
+
+	s.size += int64(len(line))
+	if s.quota > 0 && s.size > s.quota && s.older > 0 {
+		return s.prune(e.Time)
+	}
+
+	return nil
+}
+
+// Head returns the chain of the last event added, empty before the first one. Recording it outside of the node anchors
+// the events added until then: they can't be rewritten without changing it.
+func (s *Store) Head() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.head
+}
+
+// Record adds the event, logging the errors. It can be used as the callback of the notifiers.
+func (s *Store) Record(e *events.Event) {
+	if err := s.Add(e); err != nil {
+		log.Errorf("storing event: %v", err)
+	}
+}
+
+func (s *Store) rotate(segment string, now time.Time) error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.dir, segment+segmentSuffix), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("opening event segment: %w", err)
+	}
+
+	s.segment = segment
+	s.latest = segment
+	s.file = f
+
+	return s.prune(now)
+}
+
+// prune removes the segments which only have events older than the retention, then the oldest segments until the
+// store fits in the quota. The last segment is kept, even when it is larger than the quota on its own.
+func (s *Store) prune(now time.Time) error {
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+
+	s.size = 0
+	sizes := make([]int64, len(segments))
+	for i, seg := range segments {
+		if info, err := os.Stat(seg.path); err == nil {
+			sizes[i] = info.Size()
+			s.size += sizes[i]
+		}
+	}
+
+	s.older = len(segments) - 1
+	for i, seg := range segments {
+		reason := ""
+		switch {
+		case s.retention > 0 && !seg.start.Add(segmentPeriod).After(now.Add(-s.retention)):
+			reason = EvictRetention
+		case s.quota > 0 && s.size > s.quota && i < len(segments)-1:
+			reason = EvictQuota
+		default:
+			return nil
+		}
+
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing old events: %w", err)
+		}
+
+		s.size -= sizes[i]
+		s.older--
+		s.evictions[reason]++
+	}
+
+	return nil
+}
+
+// Stats returns the size of the store and the segments evicted.
+func (s *Store) Stats() Stats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stats := Stats{Bytes: s.size, Evictions: map[string]int{}}
+	for reason, n := range s.evictions {
+		stats.Evictions[reason] = n
+	}
+
+	return stats
+}
+
+type segment struct {
+	path  string
+	start time.Time
+}
+
+// segments returns the segment files sorted by time.
+func (s *Store) segments() ([]segment, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("listing event store: %w", err)
+	}
+
+	segments := []segment{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+
+		start, err := time.Parse(segmentLayout, strings.TrimSuffix(name, segmentSuffix))
+		if err != nil {
+			continue
+		}
+
+		segments = append(segments, segment{path: filepath.Join(s.dir, name), start: start})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].start.Before(segments[j].start)
+	})
+
+	return segments, nil
+}
+
+// Query returns the events matching the query, the oldest first. The segments are scanned without holding the lock,
+// the most recent first, so the events keep being added meanwhile and the older segments are not read once the limit
+// is reached.
+func (s *Store) Query(q *Query) ([]events.Event, error) {
+	s.lock.Lock()
+	segments, err := s.segments()
+	s.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []events.Event{}
+	for i := len(segments) - 1; i >= 0; i-- {
+		// The segments after the end of the query are scanned too, they can have events which came late.
+		seg := segments[i]
+		if !q.Since.IsZero() && seg.start.Add(segmentPeriod).Before(q.Since) {
+			break
+		}
+
+		found, err := scanSegment(seg.path, q, []events.Event{})
+		if err != nil {
+			return nil, err
+		}
+		result = append(found, result...)
+
+		if q.Limit > 0 && len(result) >= q.Limit {
+			break
+		}
+	}
+
+	// The events which came late are in the order they were added.
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Time.Before(result[j].Time)
+	})
+
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[len(result)-q.Limit:]
+	}
+
+	return result, nil
+}
+
+func scanSegment(name string, q *Query, result []events.Event) ([]events.Event, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		// It was removed by the retention.
+		return result, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("opening event segment: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+
+	for scanner.Scan() {
+		e := events.Event{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A partial line left by a crash, or being written.
+			continue
+		}
+
+		if q.matches(&e) {
+			result = append(result, e)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading event segment: %w", err)
+	}
+
+	return result, nil
+}
+
+func (q *Query) matches(e *events.Event) bool {
+	if (!q.Since.IsZero() && e.Time.Before(q.Since)) || (!q.Until.IsZero() && e.Time.After(q.Until)) {
+		return false
+	}
+
+	if (q.Namespace != "" && e.Namespace != q.Namespace) || (q.Pod != "" && e.Pod != q.Pod) {
+		return false
+	}
+
+	if q.Verdict != "" && e.Verdict != q.Verdict {
+		return false
+	}
+
+	if q.Drift && !e.Drift {
+		return false
+	}
+
+	if q.Path != "" {
+		if ok, _ := path.Match(q.Path, e.Path); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *Store) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+	s.segment = ""
+
+	return err
+}
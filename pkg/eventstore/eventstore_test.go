@@ -0,0 +1,386 @@
+package eventstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+)
+
+// addEvents adds perHour events to the store for every hour from start, the executed files are named after them like
+// /bin/h1-e2.
+func addEvents(t *testing.T, s *Store, start time.Time, hours, perHour int) {
+	t.Helper()
+
+	for h := 0; h < hours; h++ {
+		for i := 0; i < perHour; i++ {
+			namespace, verdict := "prod", events.VerdictAllow
+			if i%2 == 1 {
+				namespace = "dev"
+			}
+			if i == 0 {
+				verdict = events.VerdictDeny
+			}
+
+			e := &events.Event{
+				Time:        start.Add(time.Duration(h)*time.Hour + time.Duration(i)*time.Minute),
+				ContainerID: "c1",
+				Namespace:   namespace,
+				Pod:         fmt.Sprintf("pod%d", h),
+				Path:        fmt.Sprintf("/bin/h%d-e%d", h, i),
+				Verdict:     verdict,
+				Drift:       i == 2,
+			}
+			if err := s.Add(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func paths(evs []events.Event) []string {
+	paths := []string{}
+	for _, e := range evs {
+		paths = append(paths, e.Path)
+	}
+
+	return paths
+}
+
+func segmentNames(t *testing.T, s *Store) []string {
+	t.Helper()
+
+	segments, err := s.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, seg := range segments {
+		names = append(names, filepath.Base(seg.path))
+	}
+
+	return names
+}
+
+func TestQuery(t *testing.T) {
+	start := time.Now().UTC().Truncate(time.Hour).Add(-4 * time.Hour)
+
+	s, err := Open(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	addEvents(t, s, start, 4, 3)
+
+	tests := []struct {
+		name  string
+		query Query
+		paths []string
+	}{
+		{
+			name:  "all",
+			paths: []string{"/bin/h0-e0", "/bin/h0-e1", "/bin/h0-e2", "/bin/h1-e0", "/bin/h1-e1", "/bin/h1-e2", "/bin/h2-e0", "/bin/h2-e1", "/bin/h2-e2", "/bin/h3-e0", "/bin/h3-e1", "/bin/h3-e2"},
+		},
+		{
+			name:  "namespace",
+			query: Query{Namespace: "dev"},
+			paths: []string{"/bin/h0-e1", "/bin/h1-e1", "/bin/h2-e1", "/bin/h3-e1"},
+		},
+		{
+			name:  "pod",
+			query: Query{Pod: "pod1"},
+			paths: []string{"/bin/h1-e0", "/bin/h1-e1", "/bin/h1-e2"},
+		},
+		{
+			name:  "path",
+			query: Query{Path: "/bin/h2-*"},
+			paths: []string{"/bin/h2-e0", "/bin/h2-e1", "/bin/h2-e2"},
+		},
+		{
+			name:  "verdict",
+			query: Query{Verdict: events.VerdictDeny},
+			paths: []string{"/bin/h0-e0", "/bin/h1-e0", "/bin/h2-e0", "/bin/h3-e0"},
+		},
+		{
+			name:  "drift",
+			query: Query{Drift: true},
+			paths: []string{"/bin/h0-e2", "/bin/h1-e2", "/bin/h2-e2", "/bin/h3-e2"},
+		},
+		{
+			name:  "since",
+			query: Query{Since: start.Add(2*time.Hour + time.Minute)},
+			paths: []string{"/bin/h2-e1", "/bin/h2-e2", "/bin/h3-e0", "/bin/h3-e1", "/bin/h3-e2"},
+		},
+		{
+			name:  "until",
+			query: Query{Until: start.Add(time.Hour)},
+			paths: []string{"/bin/h0-e0", "/bin/h0-e1", "/bin/h0-e2", "/bin/h1-e0"},
+		},
+		{
+			name:  "since and until",
+			query: Query{Since: start.Add(time.Hour + time.Minute), Until: start.Add(2 * time.Hour), Namespace: "prod"},
+			paths: []string{"/bin/h1-e2", "/bin/h2-e0"},
+		},
+		{
+			name:  "limit keeping the most recent",
+			query: Query{Limit: 4},
+			paths: []string{"/bin/h2-e2", "/bin/h3-e0", "/bin/h3-e1", "/bin/h3-e2"},
+		},
+		{
+			name:  "limit of the matching events",
+			query: Query{Limit: 2, Verdict: events.VerdictDeny},
+			paths: []string{"/bin/h2-e0", "/bin/h3-e0"},
+		},
+		{
+			name:  "limit over the matching events",
+			query: Query{Limit: 10, Pod: "pod0"},
+			paths: []string{"/bin/h0-e0", "/bin/h0-e1", "/bin/h0-e2"},
+		},
+		{
+			name:  "nothing matching",
+			query: Query{Namespace: "kube-system"},
+			paths: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := s.Query(&tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := paths(result); fmt.Sprint(got) != fmt.Sprint(tt.paths) {
+				t.Errorf("events %v, expected %v", got, tt.paths)
+			}
+		})
+	}
+}
+
+// TestQueryLimit checks that the segments older than the events kept by the limit are not read.
+func TestQueryLimit(t *testing.T) {
+	start := time.Now().UTC().Truncate(time.Hour).Add(-4 * time.Hour)
+
+	s, err := Open(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	addEvents(t, s, start, 4, 3)
+
+	// The first segment can't be read anymore.
+	first := filepath.Join(s.dir, start.Format(segmentLayout)+segmentSuffix)
+	if err := os.Remove(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(first, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Query(&Query{}); err == nil {
+		t.Fatal("first segment read without error")
+	}
+
+	result, err := s.Query(&Query{Limit: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 6 || result[0].Path != "/bin/h2-e0" {
+		t.Errorf("events %v", paths(result))
+	}
+}
+
+// TestQueryConcurrent checks that the events added while querying are either returned or not, whole.
+func TestQueryConcurrent(t *testing.T) {
+	s, err := Open(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		now := time.Now()
+		for i := 0; i < 500; i++ {
+			if err := s.Add(&events.Event{Time: now, ContainerID: "c1", Path: fmt.Sprintf("/bin/e%d", i), Verdict: events.VerdictDeny}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	found := 0
+	for found < 500 && !t.Failed() {
+		result, err := s.Query(&Query{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(result) < found {
+			t.Fatalf("%d events found after %d", len(result), found)
+		}
+		for i, e := range result {
+			if e.Path != fmt.Sprintf("/bin/e%d", i) {
+				t.Fatalf("event %d is %s", i, e.Path)
+			}
+		}
+		found = len(result)
+	}
+
+	wg.Wait()
+}
+
+func TestRetention(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now().UTC().Truncate(time.Hour).Add(-10 * time.Hour)
+
+	s, err := Open(dir, 2*time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addEvents(t, s, start, 5, 2)
+
+	// The segments are pruned as of the last event, at 4h: the segments ending at 2h or before are removed.
+	expected := []string{}
+	for h := 2; h < 5; h++ {
+		expected = append(expected, start.Add(time.Duration(h)*time.Hour).Format(segmentLayout)+segmentSuffix)
+	}
+	if names := segmentNames(t, s); fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Errorf("segments %v, expected %v", names, expected)
+	}
+	if stats := s.Stats(); stats.Evictions[EvictRetention] != 2 || stats.Evictions[EvictQuota] != 0 {
+		t.Errorf("evictions %v", stats.Evictions)
+	}
+	s.Close()
+
+	// The events are older than the retention when the store is opened again.
+	if s, err = Open(dir, 2*time.Hour, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if names := segmentNames(t, s); len(names) != 0 {
+		t.Errorf("segments %v left", names)
+	}
+	if stats := s.Stats(); stats.Evictions[EvictRetention] != 3 || stats.Bytes != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	start := time.Now().UTC().Truncate(time.Hour).Add(-4 * time.Hour)
+
+	// The sizes of the segments of the events, they are the same in every store.
+	s, err := Open(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addEvents(t, s, start, 4, 3)
+	segments, err := s.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := []int64{}
+	for _, seg := range segments {
+		info, err := os.Stat(seg.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, info.Size())
+	}
+	if stats := s.Stats(); stats.Bytes != sizes[0]+sizes[1]+sizes[2]+sizes[3] || len(stats.Evictions) != 0 {
+		t.Errorf("stats %+v of the store without quota", stats)
+	}
+	s.Close()
+
+	tests := []struct {
+		name  string
+		quota int64
+		// kept is how many of the last segments are kept.
+		kept int
+	}{
+		{name: "large enough", quota: sizes[0] + sizes[1] + sizes[2] + sizes[3], kept: 4},
+		{name: "two segments", quota: sizes[2] + sizes[3], kept: 2},
+		{name: "one byte short of two segments", quota: sizes[2] + sizes[3] - 1, kept: 1},
+		// The last segment is kept even when it does not fit.
+		{name: "too small", quota: 1, kept: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Open(t.TempDir(), 0, tt.quota)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			addEvents(t, s, start, 4, 3)
+
+			if names := segmentNames(t, s); len(names) != tt.kept || names[0] != start.Add(time.Duration(4-tt.kept)*time.Hour).Format(segmentLayout)+segmentSuffix {
+				t.Errorf("segments %v, expected the last %d", names, tt.kept)
+			}
+
+			bytes := int64(0)
+			for _, size := range sizes[4-tt.kept:] {
+				bytes += size
+			}
+			if stats := s.Stats(); stats.Bytes != bytes || stats.Evictions[EvictQuota] != 4-tt.kept {
+				t.Errorf("stats %+v, expected %d bytes and %d evictions", stats, bytes, 4-tt.kept)
+			}
+		})
+	}
+}
+
+// TestLateEvents checks that the events older than the latest segment are added to it, even after a restart, so the
+// chain is not broken and they are still found by their time.
+func TestLateEvents(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now().UTC().Truncate(time.Hour).Add(-4 * time.Hour)
+
+	s, err := Open(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addEvents(t, s, start.Add(time.Hour), 1, 2)
+	if err := s.Add(&events.Event{Time: start, ContainerID: "c1", Path: "/bin/late", Verdict: events.VerdictDeny}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	if s, err = Open(dir, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Add(&events.Event{Time: start.Add(time.Minute), ContainerID: "c1", Path: "/bin/restarted", Verdict: events.VerdictDeny}); err != nil {
+		t.Fatal(err)
+	}
+	addEvents(t, s, start.Add(2*time.Hour), 1, 1)
+
+	expected := []string{start.Add(time.Hour).Format(segmentLayout) + segmentSuffix, start.Add(2*time.Hour).Format(segmentLayout) + segmentSuffix}
+	if names := segmentNames(t, s); fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Errorf("segments %v, expected %v", names, expected)
+	}
+
+	result, err := s.Query(&Query{Until: start.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := paths(result); fmt.Sprint(got) != fmt.Sprint([]string{"/bin/late", "/bin/restarted", "/bin/h0-e0"}) {
+		t.Errorf("events %v until the first segment", got)
+	}
+
+	v, err := Verify(dir, []string{s.Head()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Broken != "" || v.Events != 5 || !v.Anchors[s.Head()] {
+		t.Errorf("unexpected verification %+v", v)
+	}
+}
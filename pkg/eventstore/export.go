@@ -0,0 +1,85 @@
+package eventstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// exportedFile keeps the name of the last segment exported, in the directory of the store.
+const exportedFile = ".exported"
+
+// ExportSuffix is the suffix of the exported segments, they are compressed with gzip.
+const ExportSuffix = segmentSuffix + ".gz"
+
+// Export calls upload with the segments no events are added to anymore which were not exported yet, the oldest first,
+// compressed with gzip and named after their hour like 2006010215.jsonl.gz. It stops at the first segment which
+// could not be uploaded, it is exported again the next time.
+func (s *Store) Export(now time.Time, upload func(name string, data []byte) error) (int, error) {
+	segments, err := s.segments()
+	if err != nil {
+		return 0, err
+	}
+
+	last, err := os.ReadFile(filepath.Join(s.dir, exportedFile))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("reading exported segments: %w", err)
+	}
+
+	exported := 0
+	for _, seg := range segments {
+		// Events can still be added to the current segment.
+		if seg.start.Add(segmentPeriod).After(now) {
+			break
+		}
+
+		name := strings.TrimSuffix(filepath.Base(seg.path), segmentSuffix)
+		if name <= strings.TrimSpace(string(last)) {
+			continue
+		}
+
+		data, err := compress(seg.path)
+		if os.IsNotExist(err) {
+			// It was removed by the retention.
+			continue
+		} else if err != nil {
+			return exported, err
+		}
+
+		if err := upload(name+ExportSuffix, data); err != nil {
+			return exported, err
+		}
+
+		if err := os.WriteFile(filepath.Join(s.dir, exportedFile), []byte(name+"\n"), 0600); err != nil {
+			return exported, fmt.Errorf("recording exported segment: %w", err)
+		}
+		exported++
+	}
+
+	return exported, nil
+}
+
+func compress(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.Copy(zw, f); err != nil {
+		return nil, fmt.Errorf("compressing event segment: %w", err)
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("compressing event segment: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
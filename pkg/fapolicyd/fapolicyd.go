@@ -0,0 +1,272 @@
+// Package fapolicyd translates fapolicyd rules into the rules of an ExecPolicy, so the allowlists already maintained
+// for the hosts can be reused for the containers.
+//
+// The rules look like this, see fapolicyd.rules(5):
+//
+//	%languages=application/x-bytecode.ocaml,text/x-python
+//	allow perm=execute uid=0 : dir=/usr/sbin/
+//	deny_audit perm=execute all : all
+//
+// Only the executions are enforced, the rules with perm=open are left out. The rules matching on what can't be known
+// from an execution, like the mime type of the file, are skipped with a warning.
+package fapolicyd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+)
+
+// Result is what was translated.
+type Result struct {
+	Rules []policy.Rule
+	// Warnings are the rules which were skipped or translated with different semantics.
+	Warnings []string
+
+	sets map[string][]string
+}
+
+// Import translates the rules read from r, they are added to the result so several rule files can be imported in
+// order, like the ones of rules.d.
+func Import(r io.Reader, name string, res *Result) error {
+	if res.sets == nil {
+		res.sets = make(map[string][]string)
+	}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		pos := fmt.Sprintf("%s:%d", name, line)
+		if err := res.parseLine(text, pos); err != nil {
+			return fmt.Errorf("%s: %w", pos, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading %s: %w", name, err)
+	}
+
+	return nil
+}
+
+func (res *Result) warnf(pos, format string, args ...interface{}) {
+	res.Warnings = append(res.Warnings, pos+": "+fmt.Sprintf(format, args...))
+}
+
+func (res *Result) parseLine(text, pos string) error {
+	// A set: %name=value1,value2
+	if strings.HasPrefix(text, "%") {
+		i := strings.Index(text, "=")
+		if i < 0 {
+			return fmt.Errorf("invalid set %q", text)
+		}
+
+		res.sets[text[1:i]] = strings.Split(text[i+1:], ",")
+		return nil
+	}
+
+	i := strings.Index(text, " : ")
+	if i < 0 {
+		return fmt.Errorf("no \" : \" between the subject and the object")
+	}
+
+	fields := strings.Fields(text[:i])
+	if len(fields) == 0 {
+		return fmt.Errorf("no decision")
+	}
+
+	// The rules are named after where they come from.
+	rule := policy.Rule{Name: "fapolicyd " + pos}
+
+	// The _audit, _syslog and _log suffixes only tell how the decision is logged, all of them are logged here.
+	switch decision := strings.SplitN(fields[0], "_", 2)[0]; decision {
+	case "allow":
+		rule.Action = policy.ActionAllow
+	case "deny":
+		rule.Action = policy.ActionDeny
+	default:
+		return fmt.Errorf("unknown decision %q", fields[0])
+	}
+
+	perm := "open"
+	subject := []string{}
+	for _, field := range fields[1:] {
+		if strings.HasPrefix(field, "perm=") {
+			perm = strings.TrimPrefix(field, "perm=")
+			continue
+		}
+
+		subject = append(subject, field)
+	}
+
+	switch perm {
+	case "execute", "any":
+	case "open":
+		// The opens are not reported, only the executions.
+		return nil
+	default:
+		return fmt.Errorf("unknown permission %q", perm)
+	}
+
+	for _, attr := range subject {
+		if ok, err := res.subject(&rule, attr, pos); err != nil || !ok {
+			return err
+		}
+	}
+
+	for _, attr := range strings.Fields(text[i+3:]) {
+		if ok, err := res.object(&rule, attr, pos); err != nil || !ok {
+			return err
+		}
+	}
+
+	res.Rules = append(res.Rules, rule)
+	return nil
+}
+
+// subject translates an attribute of the process, it tells if the rule can be translated.
+func (res *Result) subject(rule *policy.Rule, attr, pos string) (bool, error) {
+	if attr == "all" {
+		return true, nil
+	}
+
+	key, values, err := res.attribute(attr)
+	if err != nil {
+		return false, err
+	}
+
+	switch key {
+	case "uid", "gid":
+		ids := []uint32{}
+		for _, v := range values {
+			id, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return false, fmt.Errorf("invalid %s %q", key, v)
+			}
+			ids = append(ids, uint32(id))
+		}
+
+		if key == "uid" {
+			rule.UIDs = append(rule.UIDs, ids...)
+		} else {
+			rule.GIDs = append(rule.GIDs, ids...)
+		}
+
+	case "exe":
+		rule.Processes = append(rule.Processes, values...)
+
+	case "comm":
+		for _, v := range values {
+			rule.Processes = append(rule.Processes, "*/"+v)
+		}
+
+	case "dir":
+		dirs, ok := dirGlobs(values)
+		if !ok {
+			res.skip(rule, pos, "subject dir=%s", strings.Join(values, ","))
+			return false, nil
+		}
+		rule.Processes = append(rule.Processes, dirs...)
+
+	default:
+		res.skip(rule, pos, "subject attribute %s", key)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// object translates an attribute of the executed file, it tells if the rule can be translated.
+func (res *Result) object(rule *policy.Rule, attr, pos string) (bool, error) {
+	if attr == "all" {
+		return true, nil
+	}
+
+	key, values, err := res.attribute(attr)
+	if err != nil {
+		return false, err
+	}
+
+	switch key {
+	case "path":
+		rule.Paths = append(rule.Paths, values...)
+
+	case "dir":
+		dirs, ok := dirGlobs(values)
+		if !ok {
+			res.skip(rule, pos, "object dir=%s", strings.Join(values, ","))
+			return false, nil
+		}
+		rule.Paths = append(rule.Paths, dirs...)
+
+	case "trust":
+		// The baseline is the trust database of the container. Both allowing the trusted files and denying the
+		// untrusted ones verify the files against it, but the other files don't go on to the next rules.
+		if len(values) != 1 || (values[0] == "1") != (rule.Action == policy.ActionAllow) {
+			res.skip(rule, pos, "object trust=%s with this decision", strings.Join(values, ","))
+			return false, nil
+		}
+
+		rule.Action = policy.ActionVerify
+		res.warnf(pos, "trust=%s is verified against the baseline, the executions matching the rest of the rule are decided by it", values[0])
+
+	default:
+		res.skip(rule, pos, "object attribute %s", key)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// skip warns about a rule which can't be translated.
+func (res *Result) skip(rule *policy.Rule, pos, format string, args ...interface{}) {
+	effect := "more executions are denied"
+	if rule.Action == policy.ActionDeny {
+		effect = "more executions are allowed"
+	}
+
+	res.warnf(pos, "%s not supported, rule skipped, %s", fmt.Sprintf(format, args...), effect)
+}
+
+// attribute splits key=value, the value is expanded if it is a set.
+func (res *Result) attribute(attr string) (string, []string, error) {
+	i := strings.Index(attr, "=")
+	if i < 0 {
+		return "", nil, fmt.Errorf("invalid attribute %q", attr)
+	}
+
+	key, value := attr[:i], attr[i+1:]
+	if !strings.HasPrefix(value, "%") {
+		return key, []string{value}, nil
+	}
+
+	values, ok := res.sets[value[1:]]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown set %q", value)
+	}
+
+	return key, values, nil
+}
+
+// dirGlobs returns the globs matching everything below the directories. The keywords like execdirs are not
+// supported.
+func dirGlobs(dirs []string) ([]string, bool) {
+	globs := []string{}
+	for _, dir := range dirs {
+		if !strings.HasPrefix(dir, "/") {
+			return nil, false
+		}
+
+		globs = append(globs, strings.TrimSuffix(dir, "/")+"/**")
+	}
+
+	return globs, true
+}
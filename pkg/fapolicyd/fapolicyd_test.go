@@ -0,0 +1,88 @@
+package fapolicyd
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files of testdata")
+
+// TestImport translates the rule files of testdata and compares the result with the golden files next to them.
+func TestImport(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".rules")
+		t.Run(name, func(t *testing.T) {
+			f, err := os.Open(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			res := &Result{}
+			if err := Import(f, filepath.Base(file), res); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := json.MarshalIndent(struct {
+				Rules    interface{} `json:"rules"`
+				Warnings []string    `json:"warnings"`
+			}{res.Rules, res.Warnings}, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			golden := filepath.Join("testdata", name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, expected) {
+				t.Errorf("%s translated to\n%s\nexpected\n%s", file, got, expected)
+			}
+		})
+	}
+}
+
+func TestImportRejected(t *testing.T) {
+	tests := []struct {
+		rules string
+		err   string
+	}{
+		{rules: "%admins", err: `invalid set "%admins"`},
+		{rules: "allow perm=execute all", err: `no " : " between the subject and the object`},
+		{rules: "permit perm=execute all : all", err: `unknown decision "permit"`},
+		{rules: "allow perm=write all : all", err: `unknown permission "write"`},
+		{rules: "allow perm=execute uid=root : all", err: `invalid uid "root"`},
+		{rules: "allow perm=execute gid=-1 : all", err: `invalid gid "-1"`},
+		{rules: "allow perm=execute uid : all", err: `invalid attribute "uid"`},
+		{rules: "allow perm=execute all : path", err: `invalid attribute "path"`},
+		{rules: "allow perm=execute all : dir=%bins", err: `unknown set "%bins"`},
+		{rules: "# set defined later\nallow perm=execute uid=%admins : all\n%admins=0", err: `unknown set "%admins"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rules, func(t *testing.T) {
+			err := Import(strings.NewReader(tt.rules), "test.rules", &Result{})
+			if err == nil || !strings.HasPrefix(err.Error(), "test.rules:") || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v, expected %q with the line", err, tt.err)
+			}
+		})
+	}
+}
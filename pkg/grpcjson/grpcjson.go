@@ -0,0 +1,58 @@
+// Package grpcjson has the codec of the gRPC services of fanotify-mon. Their messages are the JSON encodings of the Go
+// types, like in the HTTP APIs, the .proto files in api/ describe them for the other clients and servers.
+package grpcjson
+
+import (
+	"context"
+	"encoding/json"
+
+	"google.golang.org/grpc"
+)
+
+// Codec encodes the messages as JSON. It is forced on both sides, its content subtype is json.
+type Codec struct{}
+
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (Codec) Name() string {
+	return "json"
+}
+
+// DialOption makes a client connection use the codec.
+func DialOption() grpc.DialOption {
+	return grpc.WithDefaultCallOptions(grpc.ForceCodec(Codec{}))
+}
+
+// ServerOption makes a server use the codec.
+func ServerOption() grpc.ServerOption {
+	return grpc.ForceServerCodec(Codec{})
+}
+
+// Method returns the unary method of the service, decoding its requests with newRequest and answering them with
+// handle. The interceptor of the server, if any, is called with them.
+func Method(service, name string, newRequest func() interface{}, handle func(ctx context.Context, srv, req interface{}) (interface{}, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := newRequest()
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return handle(ctx, srv, req)
+			}
+			if interceptor == nil {
+				return handler(ctx, req)
+			}
+
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + service + "/" + name}, handler)
+		},
+	}
+}
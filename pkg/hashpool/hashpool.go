@@ -0,0 +1,142 @@
+// Package hashpool bounds how many files are hashed at once on the node, so dozens of containers attached at the same
+// time don't take all the CPUs. The executions waiting for their file to be verified go first.
+package hashpool
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/kinvolk/fanotify-poc/pkg/baseline"
+)
+
+type Priority int
+
+const (
+	// PriorityExec is for the files of the executions waiting for their verdict.
+	PriorityExec Priority = iota
+	// PriorityBackground is for the baselines and everything else nothing waits on.
+	PriorityBackground
+
+	numPriorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityExec:
+		return "exec"
+	case PriorityBackground:
+		return "background"
+	default:
+		return "unknown"
+	}
+}
+
+// Pool runs at most its size of functions at once. A nil pool runs them right away.
+type Pool struct {
+	// MaxFileSize is how many bytes of a file can be hashed, 0 for no limit. The larger files fail with
+	// baseline.ErrTooLarge.
+	MaxFileSize int64
+
+	lock    sync.Mutex
+	free    int
+	waiting [numPriorities][]chan struct{}
+}
+
+func New(size int) *Pool {
+	return &Pool{free: size}
+}
+
+// Do runs fn once the ones with a higher priority or queued before are running.
+func (p *Pool) Do(prio Priority, fn func()) {
+	if p == nil {
+		fn()
+		return
+	}
+
+	p.acquire(prio)
+	defer p.release()
+
+	fn()
+}
+
+func (p *Pool) Hash(prio Priority, r io.Reader) (string, error) {
+	var sum string
+	var err error
+
+	p.Do(prio, func() {
+		sum, err = baseline.HashLimit(r, p.maxFileSize())
+	})
+
+	return sum, err
+}
+
+func (p *Pool) HashFile(prio Priority, path string) (string, error) {
+	var sum string
+	var err error
+
+	p.Do(prio, func() {
+		var f *os.File
+		if f, err = os.Open(path); err != nil {
+			err = fmt.Errorf("opening file: %w", err)
+			return
+		}
+		defer f.Close()
+
+		sum, err = baseline.HashLimit(f, p.maxFileSize())
+	})
+
+	return sum, err
+}
+
+func (p *Pool) maxFileSize() int64 {
+	if p == nil {
+		return 0
+	}
+
+	return p.MaxFileSize
+}
+
+// Waiting returns how many functions of the priority are queued.
+func (p *Pool) Waiting(prio Priority) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.waiting[prio])
+}
+
+func (p *Pool) acquire(prio Priority) {
+	p.lock.Lock()
+
+	if p.free > 0 {
+		p.free--
+		p.lock.Unlock()
+		return
+	}
+
+	ready := make(chan struct{})
+	p.waiting[prio] = append(p.waiting[prio], ready)
+	p.lock.Unlock()
+
+	<-ready
+}
+
+// release hands the slot over to the first function queued with the highest priority.
+func (p *Pool) release() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for prio := range p.waiting {
+		if len(p.waiting[prio]) == 0 {
+			continue
+		}
+
+		ready := p.waiting[prio][0]
+		p.waiting[prio] = p.waiting[prio][1:]
+		close(ready)
+		return
+	}
+
+	p.free++
+}
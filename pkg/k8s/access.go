@@ -0,0 +1,62 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	authv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// AgentPermissions are the permissions the node agent needs, as granted by deploy/agent-rbac.yaml.
+var AgentPermissions = []authv1.ResourceAttributes{
+	{Resource: "pods", Verb: "list"},
+	{Resource: "pods", Verb: "watch"},
+	{Group: "enforce.k8s.io", Resource: "nodestatuses", Verb: "get"},
+	{Group: "enforce.k8s.io", Resource: "nodestatuses", Verb: "create"},
+	{Group: "enforce.k8s.io", Resource: "nodestatuses", Subresource: "status", Verb: "update"},
+}
+
+// MissingPermissions returns the permissions the identity of the kubeconfig doesn't have, as "verb resource".
+func MissingPermissions(ctx context.Context, kubeconfig string, perms []authv1.ResourceAttributes) ([]string, error) {
+	config, err := restConfig(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("building config: %w", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("creating clientset: %w", err)
+	}
+
+	missing := []string{}
+	for i := range perms {
+		review, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authv1.SelfSubjectAccessReview{
+			Spec: authv1.SelfSubjectAccessReviewSpec{ResourceAttributes: &perms[i]},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("reviewing access: %w", err)
+		}
+
+		if !review.Status.Allowed {
+			missing = append(missing, perms[i].Verb+" "+resourceName(&perms[i]))
+		}
+	}
+
+	return missing, nil
+}
+
+func resourceName(attrs *authv1.ResourceAttributes) string {
+	name := attrs.Resource
+	if attrs.Subresource != "" {
+		name += "/" + attrs.Subresource
+	}
+
+	if attrs.Group != "" {
+		name += "." + attrs.Group
+	}
+
+	return strings.TrimSpace(name)
+}
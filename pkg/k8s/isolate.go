@@ -0,0 +1,190 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// IsolatedLabel is set to the UID of the isolated pods, the network policies isolating them select it.
+const IsolatedLabel = "enforce.k8s.io/isolated"
+
+// isolationPrefix prefixes the names of the network policies isolating the pods.
+const isolationPrefix = "fanotify-mon-isolate-"
+
+var (
+	CiliumNetworkPolicyResource = schema.GroupVersionResource{
+		Group:    "cilium.io",
+		Version:  "v2",
+		Resource: "ciliumnetworkpolicies",
+	}
+	CalicoNetworkPolicyResource = schema.GroupVersionResource{
+		Group:    "projectcalico.org",
+		Version:  "v3",
+		Resource: "networkpolicies",
+	}
+)
+
+// Isolator cuts a pod from the network, keeping it running for the forensics. The policies are owned by the pod, they
+// are removed with it.
+type Isolator interface {
+	Isolate(ctx context.Context, namespace, pod string) error
+}
+
+// NewIsolator returns the isolator of the kind: networkpolicy for a Kubernetes NetworkPolicy, cilium for a
+// CiliumNetworkPolicy or calico for a Calico NetworkPolicy.
+func NewIsolator(kind, kubeconfig string) (Isolator, error) {
+	config, err := restConfig(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("building config: %w", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("creating clientset: %w", err)
+	}
+
+	switch kind {
+	case "networkpolicy":
+		return &networkPolicyIsolator{clientset: clientset}, nil
+	case "cilium", "calico":
+		client, err := dynamic.NewForConfig(config)
+		if err != nil {
+			return nil, fmt.Errorf("creating client: %w", err)
+		}
+
+		if kind == "cilium" {
+			return &crdIsolator{clientset: clientset, client: client, resource: CiliumNetworkPolicyResource, spec: ciliumIsolation}, nil
+		}
+		return &crdIsolator{clientset: clientset, client: client, resource: CalicoNetworkPolicyResource, spec: calicoIsolation}, nil
+	default:
+		return nil, fmt.Errorf("unknown isolation %q, it can be networkpolicy, cilium or calico", kind)
+	}
+}
+
+// labelIsolated sets the isolated label on the pod, for the policy to select it alone.
+func labelIsolated(ctx context.Context, clientset kubernetes.Interface, namespace, name string) (*v1.Pod, error) {
+	pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting pod %s/%s: %w", namespace, name, err)
+	}
+
+	patch := fmt.Sprintf(`{"metadata":{"labels":{%q:%q}}}`, IsolatedLabel, pod.UID)
+	pod, err = clientset.CoreV1().Pods(namespace).Patch(ctx, name, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("labeling pod %s/%s: %w", namespace, name, err)
+	}
+
+	return pod, nil
+}
+
+func ownedBy(pod *v1.Pod) []metav1.OwnerReference {
+	return []metav1.OwnerReference{{APIVersion: "v1", Kind: "Pod", Name: pod.Name, UID: pod.UID}}
+}
+
+// networkPolicyIsolator denies all the traffic of the pod with a NetworkPolicy without rules. The NetworkPolicies
+// only add up: the traffic other ones allow is still allowed.
+type networkPolicyIsolator struct {
+	clientset kubernetes.Interface
+}
+
+func (i *networkPolicyIsolator) Isolate(ctx context.Context, namespace, name string) error {
+	pod, err := labelIsolated(ctx, i.clientset, namespace, name)
+	if err != nil {
+		return err
+	}
+
+	np := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            isolationPrefix + pod.Name,
+			Namespace:       namespace,
+			OwnerReferences: ownedBy(pod),
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{IsolatedLabel: string(pod.UID)}},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress},
+		},
+	}
+
+	_, err = i.clientset.NetworkingV1().NetworkPolicies(namespace).Create(ctx, np, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("creating network policy: %w", err)
+	}
+
+	return nil
+}
+
+// crdIsolator denies all the traffic of the pod with the network policy of a CNI, which takes precedence over the
+// policies allowing it.
+type crdIsolator struct {
+	clientset kubernetes.Interface
+	client    dynamic.Interface
+	resource  schema.GroupVersionResource
+	spec      func(uid types.UID) map[string]interface{}
+}
+
+func (i *crdIsolator) Isolate(ctx context.Context, namespace, name string) error {
+	pod, err := labelIsolated(ctx, i.clientset, namespace, name)
+	if err != nil {
+		return err
+	}
+
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": i.resource.GroupVersion().String(),
+		"kind":       kindOf(i.resource),
+		"spec":       i.spec(pod.UID),
+	}}
+	obj.SetName(isolationPrefix + pod.Name)
+	obj.SetNamespace(namespace)
+	obj.SetOwnerReferences(ownedBy(pod))
+
+	_, err = i.client.Resource(i.resource).Namespace(namespace).Create(ctx, obj, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("creating %s: %w", i.resource.Resource, err)
+	}
+
+	return nil
+}
+
+func kindOf(resource schema.GroupVersionResource) string {
+	if resource == CiliumNetworkPolicyResource {
+		return "CiliumNetworkPolicy"
+	}
+
+	return "NetworkPolicy"
+}
+
+// ciliumIsolation denies the traffic from and to all the entities, the deny rules win over the allow ones.
+func ciliumIsolation(uid types.UID) map[string]interface{} {
+	return map[string]interface{}{
+		"endpointSelector": map[string]interface{}{
+			"matchLabels": map[string]interface{}{IsolatedLabel: string(uid)},
+		},
+		"ingressDeny": []interface{}{
+			map[string]interface{}{"fromEntities": []interface{}{"all"}},
+		},
+		"egressDeny": []interface{}{
+			map[string]interface{}{"toEntities": []interface{}{"all"}},
+		},
+	}
+}
+
+// calicoIsolation denies all the traffic with the lowest order, so it is evaluated before the other policies.
+func calicoIsolation(uid types.UID) map[string]interface{} {
+	return map[string]interface{}{
+		"order":    int64(0),
+		"selector": fmt.Sprintf("%s == '%s'", IsolatedLabel, uid),
+		"types":    []interface{}{"Ingress", "Egress"},
+		"ingress":  []interface{}{map[string]interface{}{"action": "Deny"}},
+		"egress":   []interface{}{map[string]interface{}{"action": "Deny"}},
+	}
+}
@@ -2,23 +2,33 @@ package k8s
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/clientcmd"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 )
 
 const (
-	podKey   = "enforce.k8s.io"
-	podValue = "deny-third-party-execution"
+	watchRetryInterval    = time.Second
+	maxWatchRetryInterval = time.Minute
 )
 
-// GetNewPods is used to get information about pods.
-func GetNewPods(pods map[string]*v1.Pod, nodeName, kubeconfig string) {
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+// errWatchClosed is returned when the pod watcher is closed before getting any event.
+var errWatchClosed = errors.New("watch closed without events")
+
+// GetNewPods is used to get information about pods. The pods enforced according to the selector are listed, in the
+// given namespaces all the pods are. The pods are watched again from where the watcher stopped when it is closed, and
+// listed again when that is too old.
+func GetNewPods(pods *Pods, nodeName, kubeconfig string, namespaces []string, selector PodSelector) {
+	config, err := restConfig(kubeconfig)
 	if err != nil {
 		log.Fatalf("building config from flags: %v", err)
 	}
@@ -28,42 +38,207 @@ func GetNewPods(pods map[string]*v1.Pod, nodeName, kubeconfig string) {
 		log.Fatalf("creating clientset: %v", err)
 	}
 
-	ctx := context.Background()
-	watcher, err := clientset.CoreV1().Pods("").Watch(ctx, metav1.ListOptions{
-		LabelSelector: podKey + "=" + podValue,
-		FieldSelector: "spec.nodeName=" + nodeName,
+	selectedNamespaces := make(map[string]bool)
+	for _, namespace := range namespaces {
+		selectedNamespaces[namespace] = true
+	}
+
+	w := &podWatcher{
+		client: clientset.CoreV1().Pods(""),
+		pods:   pods,
+		// The annotations and multiple label selectors can't be selected by the API server, so all the pods of the
+		// node are watched.
+		fieldSelector: "spec.nodeName=" + nodeName,
+		enforced: func(pod *v1.Pod) bool {
+			return selector.IsEnforced(pod) || selectedNamespaces[pod.Namespace]
+		},
+	}
+
+	retry := watchRetryInterval
+	for {
+		err := w.run()
+		if err == nil {
+			retry = watchRetryInterval
+			continue
+		}
+
+		if apierrors.IsResourceExpired(err) || apierrors.IsGone(err) {
+			log.Infof("pod watcher too old, listing the pods again: %v", err)
+			w.resourceVersion = ""
+			continue
+		}
+
+		log.Warnf("watching pods, retrying in %s: %v", retry, err)
+		time.Sleep(retry)
+
+		if retry *= 2; retry > maxWatchRetryInterval {
+			retry = maxWatchRetryInterval
+		}
+	}
+}
+
+type podWatcher struct {
+	client        corev1.PodInterface
+	pods          *Pods
+	fieldSelector string
+	enforced      func(*v1.Pod) bool
+
+	// resourceVersion is where the watcher is at, empty when the pods have to be listed again.
+	resourceVersion string
+}
+
+// run lists the pods if needed, then watches them until the watcher is closed. It returns nil when the watcher got
+// events before being closed.
+func (w *podWatcher) run() error {
+	if w.resourceVersion == "" {
+		list, err := w.client.List(context.Background(), metav1.ListOptions{FieldSelector: w.fieldSelector})
+		if err != nil {
+			return fmt.Errorf("listing pods: %w", err)
+		}
+
+		log.Debugf("listed %d pods", len(list.Items))
+		w.pods.Sync(list.Items, w.enforced)
+		w.resourceVersion = list.ResourceVersion
+	}
+
+	watcher, err := w.client.Watch(context.Background(), metav1.ListOptions{
+		FieldSelector:       w.fieldSelector,
+		ResourceVersion:     w.resourceVersion,
+		AllowWatchBookmarks: true,
 	})
 	if err != nil {
-		log.Fatalf("getting watcher on pods: %v", err)
+		return fmt.Errorf("getting watcher on pods: %w", err)
 	}
+	defer watcher.Stop()
 
-	ch := watcher.ResultChan()
+	got := false
+	for event := range watcher.ResultChan() {
+		got = true
 
-	for {
-		event := <-ch
+		if event.Type == watch.Error {
+			return fmt.Errorf("watching pods: %w", apierrors.FromObject(event.Object))
+		}
 
 		pod, ok := event.Object.(*v1.Pod)
 		if !ok {
 			// When we hit the "too many open files error" at that point this stops working and we start getting nil objects.
-			log.Fatalf("received an object which is not a pod: %#v", event.Object)
+			log.Warnf("received an object which is not a pod: %#v", event.Object)
 			continue
 		}
 
-		for _, cnt := range pod.Spec.Containers {
-			// A typical container name looks like this: k8s_fedora_fedora_kube-system_8143ee7d-d615-4c8e-9b1b-3af20fad49b1_2
-			id := "k8s_" + pod.Name + "_" + cnt.Name + "_" + pod.Namespace + "_" + string(pod.UID)
-
-			switch event.Type {
-			case watch.Added:
-				log.Debugf("got a new container, adding to the list: %s", id)
-				pods[id] = pod
-			case watch.Modified:
-				log.Debugf("got an existing container, updating the list: %s", id)
-				pods[id] = pod
-			case watch.Deleted:
-				log.Debugf("removing the container from the list: %s", id)
-				delete(pods, id)
-			}
+		w.resourceVersion = pod.ResourceVersion
+
+		switch event.Type {
+		case watch.Bookmark:
+			// The bookmarks only move the resource version forward, so the watcher starts again from there.
+		case watch.Deleted:
+			log.Debugf("removing the pod from the list: %s/%s", pod.Namespace, pod.Name)
+			w.pods.Delete(pod)
+		case watch.Added, watch.Modified:
+			selected := w.enforced(pod)
+			log.Debugf("updating the pod in the list: %s/%s, enforced: %t", pod.Namespace, pod.Name, selected)
+			w.pods.Update(pod, selected)
+		}
+	}
+
+	if !got {
+		return errWatchClosed
+	}
+
+	return nil
+}
+
+// IsPodReady tells if the pod has the Ready condition.
+func IsPodReady(pod *v1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == v1.PodReady {
+			return cond.Status == v1.ConditionTrue
+		}
+	}
+
+	return false
+}
+
+// ContainerKey returns the name under which the container runtime knows the given container of the pod.
+func ContainerKey(pod *v1.Pod, cntName string) string {
+	// A typical container name looks like this: k8s_fedora_fedora_kube-system_8143ee7d-d615-4c8e-9b1b-3af20fad49b1_2
+	// Here the restart count at the end is not added.
+	return "k8s_" + pod.Name + "_" + cntName + "_" + pod.Namespace + "_" + string(pod.UID)
+}
+
+// PodKey returns the key under which the pods are listed, besides their containers. The containers of the selected
+// pods missing from their spec, like the sidecars injected by the runtime, are found with it.
+func PodKey(namespace, uid string) string {
+	return "pod_" + namespace + "_" + uid
+}
+
+// ParsePodKey returns the key of the pod and the name of the container from the name under which the container runtime
+// knows the container.
+func ParsePodKey(key string) (string, string, bool) {
+	// The names and the UID can't have underscores.
+	parts := strings.Split(key, "_")
+	if len(parts) != 5 || parts[0] != "k8s" {
+		return "", "", false
+	}
+
+	return PodKey(parts[3], parts[4]), parts[2], true
+}
+
+// GetContainer returns the spec of the pod container which the runtime knows by the given key.
+func GetContainer(pod *v1.Pod, key string) *v1.Container {
+	for _, cnt := range containerSpecs(pod) {
+		if ContainerKey(pod, cnt.Name) == key {
+			return cnt
+		}
+	}
+
+	return nil
+}
+
+// IsEphemeralContainer tells if the runtime container with the given key was added to the pod with kubectl debug.
+func IsEphemeralContainer(pod *v1.Pod, key string) bool {
+	for _, cnt := range pod.Spec.EphemeralContainers {
+		if ContainerKey(pod, cnt.Name) == key {
+			return true
 		}
 	}
+
+	return false
+}
+
+// containerSpecs returns the specs of the init, regular and ephemeral containers of the pod.
+func containerSpecs(pod *v1.Pod) []*v1.Container {
+	cnts := []*v1.Container{}
+
+	for i := range pod.Spec.InitContainers {
+		cnts = append(cnts, &pod.Spec.InitContainers[i])
+	}
+
+	for i := range pod.Spec.Containers {
+		cnts = append(cnts, &pod.Spec.Containers[i])
+	}
+
+	// The ephemeral containers are not part of the containers list, they are added later to the pod using the
+	// ephemeralcontainers subresource which shows up as a modified pod.
+	for i := range pod.Spec.EphemeralContainers {
+		cnt := v1.Container(pod.Spec.EphemeralContainers[i].EphemeralContainerCommon)
+		cnts = append(cnts, &cnt)
+	}
+
+	return cnts
+}
+
+// ExecProbeCommands returns the commands of all the exec probes configured on the container.
+func ExecProbeCommands(cnt *v1.Container) [][]string {
+	cmds := [][]string{}
+
+	for _, probe := range []*v1.Probe{cnt.LivenessProbe, cnt.ReadinessProbe, cnt.StartupProbe} {
+		if probe == nil || probe.Exec == nil || len(probe.Exec.Command) == 0 {
+			continue
+		}
+
+		cmds = append(cmds, probe.Exec.Command)
+	}
+
+	return cmds
 }
@@ -0,0 +1,151 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// ErrNotEnforced is returned for the containers whose pod is not enforced, or which are not part of a pod.
+var ErrNotEnforced = errors.New("not enforced")
+
+// Pods are the pods of the node kept by the pod watcher. The enforced pods are listed by the keys of their containers
+// and by their own key, see PodKey. The containers waiting for their pod are woken up on every update instead of
+// polling for it.
+type Pods struct {
+	lock sync.RWMutex
+	pods map[string]*v1.Pod
+	// ignored are the keys of the pods of the node which are not enforced.
+	ignored map[string]bool
+	// updated is closed on the next update.
+	updated chan struct{}
+}
+
+func NewPods() *Pods {
+	return &Pods{
+		pods:    make(map[string]*v1.Pod),
+		ignored: make(map[string]bool),
+		updated: make(chan struct{}),
+	}
+}
+
+// Get returns the enforced pod listed under the key of one of its containers or its own.
+func (p *Pods) Get(key string) (*v1.Pod, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	pod, ok := p.pods[key]
+	return pod, ok
+}
+
+// Update lists the pod added or modified, under its keys if it is enforced.
+func (p *Pods) Update(pod *v1.Pod, enforced bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.update(pod, enforced)
+	p.notify()
+}
+
+// Sync replaces the pods with the listed ones, the pods deleted while the pod watcher was disconnected are forgotten.
+func (p *Pods) Sync(listed []v1.Pod, enforced func(*v1.Pod) bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.pods = make(map[string]*v1.Pod)
+	p.ignored = make(map[string]bool)
+	for i := range listed {
+		p.update(&listed[i], enforced(&listed[i]))
+	}
+
+	p.notify()
+}
+
+func (p *Pods) update(pod *v1.Pod, enforced bool) {
+	podKey := PodKey(pod.Namespace, string(pod.UID))
+	for _, key := range podKeys(pod) {
+		if enforced {
+			p.pods[key] = pod
+		} else {
+			delete(p.pods, key)
+		}
+	}
+
+	if enforced {
+		delete(p.ignored, podKey)
+	} else {
+		p.ignored[podKey] = true
+	}
+}
+
+// Delete forgets the deleted pod.
+func (p *Pods) Delete(pod *v1.Pod) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, key := range podKeys(pod) {
+		delete(p.pods, key)
+	}
+	delete(p.ignored, PodKey(pod.Namespace, string(pod.UID)))
+
+	p.notify()
+}
+
+func (p *Pods) notify() {
+	close(p.updated)
+	p.updated = make(chan struct{})
+}
+
+// podKeys returns the keys of the containers of the pod and its own.
+func podKeys(pod *v1.Pod) []string {
+	keys := []string{PodKey(pod.Namespace, string(pod.UID))}
+	for _, cnt := range containerSpecs(pod) {
+		keys = append(keys, ContainerKey(pod, cnt.Name))
+	}
+
+	return keys
+}
+
+// Wait returns the pod of the container which the runtime knows by the given key, waiting for the pod watcher to list
+// it. The containers missing from the spec of their enforced pod get the pod too after unlistedDelay, with their name:
+// they are not in the spec, like the sidecars injected by the runtime. It fails with ErrNotEnforced once the pod is
+// known not to be enforced, or with the error of the context.
+func (p *Pods) Wait(ctx context.Context, cntKey string, unlistedDelay time.Duration) (*v1.Pod, string, error) {
+	podKey, name, parsed := ParsePodKey(cntKey)
+	if !parsed {
+		return nil, "", ErrNotEnforced
+	}
+
+	unlisted := time.After(unlistedDelay)
+	waitedUnlisted := false
+
+	for {
+		p.lock.RLock()
+		pod, listed := p.pods[cntKey]
+		podOfUnlisted, podListed := p.pods[podKey]
+		ignored := p.ignored[podKey]
+		updated := p.updated
+		p.lock.RUnlock()
+
+		switch {
+		case listed:
+			return pod, "", nil
+		case ignored:
+			return nil, "", ErrNotEnforced
+		// The ephemeral containers are added to the spec of the pod after it was created.
+		case podListed && waitedUnlisted && GetContainer(podOfUnlisted, cntKey) == nil:
+			return podOfUnlisted, name, nil
+		}
+
+		select {
+		case <-updated:
+		case <-unlisted:
+			waitedUnlisted = true
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodsWait(t *testing.T) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "8143ee7d"},
+		Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "app"}}},
+	}
+	app := ContainerKey(pod, "app")
+	sidecar := ContainerKey(pod, "sidecar")
+
+	tests := []struct {
+		name string
+		key  string
+		// before changes the pods before waiting, during while waiting.
+		before func(p *Pods)
+		during func(p *Pods, cancel context.CancelFunc)
+		// timeout is the timeout of the context.
+		timeout  time.Duration
+		unlisted time.Duration
+		pod      *v1.Pod
+		cntName  string
+		err      error
+	}{
+		{
+			name:   "listed",
+			key:    app,
+			before: func(p *Pods) { p.Update(pod, true) },
+			pod:    pod,
+		},
+		{
+			name:   "listed while waiting",
+			key:    app,
+			during: func(p *Pods, cancel context.CancelFunc) { p.Update(pod, true) },
+			pod:    pod,
+		},
+		{
+			name:   "synced while waiting",
+			key:    app,
+			during: func(p *Pods, cancel context.CancelFunc) { p.Sync([]v1.Pod{*pod}, func(*v1.Pod) bool { return true }) },
+			pod:    pod,
+		},
+		{
+			name:   "not enforced",
+			key:    app,
+			during: func(p *Pods, cancel context.CancelFunc) { p.Update(pod, false) },
+			err:    ErrNotEnforced,
+		},
+		{
+			name: "no longer enforced",
+			key:  app,
+			before: func(p *Pods) {
+				p.Update(pod, true)
+				p.Update(pod, false)
+			},
+			err: ErrNotEnforced,
+		},
+		{
+			name: "not a container of a pod",
+			key:  "nginx",
+			err:  ErrNotEnforced,
+		},
+		{
+			name:     "container missing from the spec",
+			key:      sidecar,
+			before:   func(p *Pods) { p.Update(pod, true) },
+			unlisted: 10 * time.Millisecond,
+			pod:      pod,
+			cntName:  "sidecar",
+		},
+		{
+			name:     "deleted pod",
+			key:      sidecar,
+			before:   func(p *Pods) { p.Update(pod, true) },
+			during:   func(p *Pods, cancel context.CancelFunc) { p.Delete(pod) },
+			timeout:  50 * time.Millisecond,
+			unlisted: 10 * time.Millisecond,
+			err:      context.DeadlineExceeded,
+		},
+		{
+			name:    "timeout",
+			key:     app,
+			timeout: 10 * time.Millisecond,
+			err:     context.DeadlineExceeded,
+		},
+		{
+			name:   "canceled",
+			key:    app,
+			during: func(p *Pods, cancel context.CancelFunc) { cancel() },
+			err:    context.Canceled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPods()
+			if tt.before != nil {
+				tt.before(p)
+			}
+
+			timeout := tt.timeout
+			if timeout == 0 {
+				timeout = 5 * time.Second
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			unlisted := tt.unlisted
+			if unlisted == 0 {
+				unlisted = time.Hour
+			}
+
+			type result struct {
+				pod     *v1.Pod
+				cntName string
+				err     error
+			}
+			results := make(chan result, 1)
+			go func() {
+				pod, cntName, err := p.Wait(ctx, tt.key, unlisted)
+				results <- result{pod, cntName, err}
+			}()
+
+			if tt.during != nil {
+				// The update may come before Wait, it finds the pod then.
+				time.Sleep(time.Millisecond)
+				tt.during(p, cancel)
+			}
+
+			var r result
+			select {
+			case r = <-results:
+			case <-time.After(10 * time.Second):
+				t.Fatal("still waiting")
+			}
+
+			if (r.pod == nil) != (tt.pod == nil) || (r.pod != nil && r.pod.UID != tt.pod.UID) {
+				t.Errorf("pod %v, expected %v", r.pod != nil, tt.pod != nil)
+			}
+			if r.cntName != tt.cntName || !errors.Is(r.err, tt.err) {
+				t.Errorf("container %q and error %v, expected %q and %v", r.cntName, r.err, tt.cntName, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	"github.com/kinvolk/fanotify-poc/pkg/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var (
+	ExecPolicyResource = schema.GroupVersionResource{
+		Group:    "enforce.k8s.io",
+		Version:  "v1alpha1",
+		Resource: "execpolicies",
+	}
+
+	NamespaceDefaultResource = schema.GroupVersionResource{
+		Group:    "enforce.k8s.io",
+		Version:  "v1alpha1",
+		Resource: "namespacedefaults",
+	}
+)
+
+// restConfig builds the client configuration from the kubeconfig or, if it does not exist, from the service account
+// of the pod.
+func restConfig(kubeconfig string) (*rest.Config, error) {
+	kubeconfig = os.ExpandEnv(kubeconfig)
+	if _, err := os.Stat(kubeconfig); err != nil {
+		kubeconfig = ""
+	}
+
+	return clientcmd.BuildConfigFromFlags("", kubeconfig)
+}
+
+// NewDynamicClient returns a client for the policy objects.
+func NewDynamicClient(kubeconfig string) (dynamic.Interface, error) {
+	config, err := restConfig(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("building config: %w", err)
+	}
+
+	return dynamic.NewForConfig(config)
+}
+
+// ListPolicies returns the ExecPolicy objects of the cluster.
+func ListPolicies(ctx context.Context, client dynamic.Interface) ([]*policy.ExecPolicy, error) {
+	list, err := client.Resource(ExecPolicyResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing policies: %w", err)
+	}
+
+	policies := []*policy.ExecPolicy{}
+	for _, item := range list.Items {
+		p := &policy.ExecPolicy{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, p); err != nil {
+			return nil, fmt.Errorf("converting policy %q: %w", item.GetName(), err)
+		}
+
+		policies = append(policies, p)
+	}
+
+	return policies, nil
+}
+
+// UpdatePolicyStatus writes the status of the ExecPolicy object, unless it did not change. It tells if it was written.
+func UpdatePolicyStatus(ctx context.Context, client dynamic.Interface, name string, s *status.PolicyStatus) (bool, error) {
+	resource := client.Resource(ExecPolicyResource)
+
+	obj, err := resource.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("getting policy %q: %w", name, err)
+	}
+
+	updated, err := runtime.DefaultUnstructuredConverter.ToUnstructured(s)
+	if err != nil {
+		return false, fmt.Errorf("converting policy status: %w", err)
+	}
+
+	if current, ok := obj.Object["status"]; ok && reflect.DeepEqual(current, updated) {
+		return false, nil
+	}
+
+	obj.Object["status"] = updated
+	if _, err := resource.UpdateStatus(ctx, obj, metav1.UpdateOptions{}); err != nil {
+		return false, fmt.Errorf("updating status of policy %q: %w", name, err)
+	}
+
+	return true, nil
+}
+
+// ListNamespaceDefaults returns the NamespaceDefault objects of the namespace.
+func ListNamespaceDefaults(ctx context.Context, client dynamic.Interface, namespace string) ([]*policy.NamespaceDefault, error) {
+	list, err := client.Resource(NamespaceDefaultResource).Namespace(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing namespace defaults: %w", err)
+	}
+
+	defaults := []*policy.NamespaceDefault{}
+	for _, item := range list.Items {
+		d := &policy.NamespaceDefault{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, d); err != nil {
+			return nil, fmt.Errorf("converting namespace default %q: %w", item.GetName(), err)
+		}
+
+		defaults = append(defaults, d)
+	}
+
+	return defaults, nil
+}
@@ -0,0 +1,89 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// QuarantineLabel is set to true on the quarantined pods, and on their node when it is quarantined too, for the
+	// NetworkPolicies and the controllers to select them.
+	QuarantineLabel = "enforce.k8s.io/quarantine"
+	// QuarantineReasonAnnotation tells why the pod or the node was quarantined.
+	QuarantineReasonAnnotation = "enforce.k8s.io/quarantine-reason"
+)
+
+// Quarantine sets the quarantine label and reason on the pod, and on the node unless it is empty, and records a
+// warning event on the pod.
+func Quarantine(ctx context.Context, kubeconfig, namespace, pod, node, reason string) error {
+	config, err := restConfig(kubeconfig)
+	if err != nil {
+		return fmt.Errorf("building config: %w", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("creating clientset: %w", err)
+	}
+
+	patch, err := quarantinePatch(reason)
+	if err != nil {
+		return err
+	}
+
+	patched, err := clientset.CoreV1().Pods(namespace).Patch(ctx, pod, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("labeling pod %s/%s: %w", namespace, pod, err)
+	}
+
+	if node != "" {
+		if _, err := clientset.CoreV1().Nodes().Patch(ctx, node, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			return fmt.Errorf("labeling node %s: %w", node, err)
+		}
+	}
+
+	now := metav1.NewTime(time.Now())
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: pod + ".", Namespace: namespace},
+		InvolvedObject: v1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Namespace:  namespace,
+			Name:       pod,
+			UID:        patched.UID,
+		},
+		Type:           v1.EventTypeWarning,
+		Reason:         "Quarantined",
+		Message:        reason,
+		Source:         v1.EventSource{Component: "fanotify-mon", Host: node},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := clientset.CoreV1().Events(namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("recording quarantine event: %w", err)
+	}
+
+	return nil
+}
+
+func quarantinePatch(reason string) ([]byte, error) {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      map[string]string{QuarantineLabel: "true"},
+			"annotations": map[string]string{QuarantineReasonAnnotation: reason},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encoding quarantine patch: %w", err)
+	}
+
+	return patch, nil
+}
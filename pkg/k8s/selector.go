@@ -0,0 +1,43 @@
+package k8s
+
+import (
+	"fmt"
+
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// PodSelector selects the enforced pods. A pod is enforced if it matches any of the label selectors or if it is bound
+// to a policy by annotation.
+type PodSelector []labels.Selector
+
+// NewPodSelector parses the label selectors, like "app in (a, b),!canary".
+func NewPodSelector(exprs []string) (PodSelector, error) {
+	s := PodSelector{}
+	for _, expr := range exprs {
+		selector, err := labels.Parse(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pod selector %q: %w", expr, err)
+		}
+
+		s = append(s, selector)
+	}
+
+	return s, nil
+}
+
+// IsEnforced tells if the pod is selected by one of the label selectors or is bound to a policy by annotation.
+func (s PodSelector) IsEnforced(pod *v1.Pod) bool {
+	if pod.Annotations[policy.PolicyAnnotation] != "" {
+		return true
+	}
+
+	for _, selector := range s {
+		if selector.Matches(labels.Set(pod.Labels)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,148 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kinvolk/fanotify-poc/pkg/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+var NodeStatusResource = schema.GroupVersionResource{
+	Group:    "enforce.k8s.io",
+	Version:  "v1alpha1",
+	Resource: "nodestatuses",
+}
+
+// GetNodeStatus returns the NodeStatus object of the node, or nil if there is none yet.
+func GetNodeStatus(ctx context.Context, client dynamic.Interface, nodeName string) (*status.NodeStatus, error) {
+	obj, err := client.Resource(NodeStatusResource).Get(ctx, nodeName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("getting node status: %w", err)
+	}
+
+	s := &status.NodeStatus{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, s); err != nil {
+		return nil, fmt.Errorf("converting node status: %w", err)
+	}
+
+	return s, nil
+}
+
+// UpdateNodeStatus writes the state of the containers and the anchor of the event store, if any, to the NodeStatus
+// object of the node, creating it if needed.
+func UpdateNodeStatus(ctx context.Context, client dynamic.Interface, nodeName string, containers []status.Container, anchor *status.ChainAnchor) error {
+	resource := client.Resource(NodeStatusResource)
+
+	current, err := GetNodeStatus(ctx, client, nodeName)
+	if err != nil {
+		return err
+	}
+
+	if current == nil {
+		obj, err := toUnstructured(status.New(nodeName, nil, nil))
+		if err != nil {
+			return err
+		}
+
+		// The status is ignored on creation, it is updated below.
+		created, err := resource.Create(ctx, obj, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("creating node status: %w", err)
+		}
+
+		current = &status.NodeStatus{ObjectMeta: metav1.ObjectMeta{ResourceVersion: created.GetResourceVersion()}}
+	}
+
+	s := status.New(nodeName, containers, current.Status.Conditions)
+	s.Status.EventChain = anchor
+	now := metav1.Now()
+	s.Status.LastReport = &now
+
+	obj, err := toUnstructured(s)
+	if err != nil {
+		return err
+	}
+
+	obj.SetResourceVersion(current.ResourceVersion)
+
+	if _, err := resource.UpdateStatus(ctx, obj, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("updating node status: %w", err)
+	}
+
+	return nil
+}
+
+// ListNodeStatuses returns the NodeStatus objects of all the nodes.
+func ListNodeStatuses(ctx context.Context, client dynamic.Interface) ([]status.NodeStatus, error) {
+	list, err := client.Resource(NodeStatusResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing node statuses: %w", err)
+	}
+
+	statuses := make([]status.NodeStatus, 0, len(list.Items))
+	for _, item := range list.Items {
+		s := status.NodeStatus{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &s); err != nil {
+			return nil, fmt.Errorf("converting node status %s: %w", item.GetName(), err)
+		}
+
+		statuses = append(statuses, s)
+	}
+
+	return statuses, nil
+}
+
+// SetNodeStatusCondition sets the condition of the NodeStatus object of the node, unless it is already set. It tells if
+// it was written.
+func SetNodeStatusCondition(ctx context.Context, client dynamic.Interface, nodeName string, condition metav1.Condition) (bool, error) {
+	current, err := GetNodeStatus(ctx, client, nodeName)
+	if err != nil || current == nil {
+		return false, err
+	}
+
+	if existing := meta.FindStatusCondition(current.Status.Conditions, condition.Type); existing != nil &&
+		existing.Status == condition.Status && existing.Reason == condition.Reason && existing.Message == condition.Message {
+		return false, nil
+	}
+
+	meta.SetStatusCondition(&current.Status.Conditions, condition)
+
+	obj, err := toUnstructured(current)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := client.Resource(NodeStatusResource).UpdateStatus(ctx, obj, metav1.UpdateOptions{}); err != nil {
+		return false, fmt.Errorf("updating node status: %w", err)
+	}
+
+	return true, nil
+}
+
+// DeleteNodeStatus deletes the NodeStatus object of the node, it is fine if it is already gone.
+func DeleteNodeStatus(ctx context.Context, client dynamic.Interface, nodeName string) error {
+	err := client.Resource(NodeStatusResource).Delete(ctx, nodeName, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("deleting node status: %w", err)
+	}
+
+	return nil
+}
+
+func toUnstructured(s *status.NodeStatus) (*unstructured.Unstructured, error) {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(s)
+	if err != nil {
+		return nil, fmt.Errorf("converting node status: %w", err)
+	}
+
+	return &unstructured.Unstructured{Object: obj}, nil
+}
@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+)
+
+// hashLength is the length of the hashed label values, in hexadecimal digits.
+const hashLength = 12
+
+// LabelPolicy bounds the cardinality of the labels of the samples: the dropped labels are removed and the samples
+// left with the same labels are summed, the values of the hashed labels are replaced by a short hash, and the values
+// longer than MaxLength are truncated.
+type LabelPolicy struct {
+	Drop      []string
+	Hash      []string
+	MaxLength int
+}
+
+func (p *LabelPolicy) empty() bool {
+	return len(p.Drop) == 0 && len(p.Hash) == 0 && p.MaxLength <= 0
+}
+
+// apply returns the samples with the policy applied, in the order they came in.
+func (p *LabelPolicy) apply(samples []Sample) []Sample {
+	if p.empty() {
+		return samples
+	}
+
+	result := make([]Sample, 0, len(samples))
+	index := make(map[string]int, len(samples))
+	for _, s := range samples {
+		labels := make(map[string]string, len(s.Labels))
+		for name, value := range s.Labels {
+			if contains(p.Drop, name) {
+				continue
+			}
+
+			if contains(p.Hash, name) {
+				sum := sha256.Sum256([]byte(value))
+				value = hex.EncodeToString(sum[:])[:hashLength]
+			} else if p.MaxLength > 0 && len(value) > p.MaxLength {
+				value = value[:p.MaxLength]
+			}
+
+			labels[name] = value
+		}
+
+		key := labelsKey(labels)
+		if i, ok := index[key]; ok {
+			result[i].Value += s.Value
+			continue
+		}
+
+		index[key] = len(result)
+		result = append(result, Sample{Labels: labels, Value: s.Value})
+	}
+
+	return result
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func labelsKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, name+"\x00"+value)
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, "\x00")
+}
@@ -0,0 +1,115 @@
+// Package metrics serves the metrics of the node agent in the Prometheus text format. The values are collected when
+// the metrics are scraped.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const Path = "/metrics"
+
+type Type string
+
+const (
+	TypeGauge   Type = "gauge"
+	TypeCounter Type = "counter"
+)
+
+// Sample is a value of a metric with its labels.
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+type Metric struct {
+	Name string
+	Help string
+	Type Type
+	// Collect returns the current values of the metric.
+	Collect func() []Sample
+}
+
+type Registry struct {
+	// Labels is applied to the samples of all the metrics.
+	Labels LabelPolicy
+
+	lock    sync.Mutex
+	metrics []*Metric
+}
+
+func (r *Registry) Register(m *Metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+// Value returns the samples of a metric without labels.
+func Value(v float64) []Sample {
+	return []Sample{{Value: v}}
+}
+
+// Write writes all the metrics in the Prometheus text format.
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.Lock()
+	metrics := append([]*Metric{}, r.metrics...)
+	r.lock.Unlock()
+
+	bw := bufio.NewWriter(w)
+
+	for _, m := range metrics {
+		fmt.Fprintf(bw, "# HELP %s %s\n", m.Name, strings.ReplaceAll(m.Help, "\n", " "))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", m.Name, m.Type)
+
+		for _, s := range r.Labels.apply(m.Collect()) {
+			fmt.Fprintf(bw, "%s%s %s\n", m.Name, formatLabels(s.Labels), strconv.FormatFloat(s.Value, 'g', -1, 64))
+		}
+	}
+
+	return bw.Flush()
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+"="+strconv.Quote(labels[name]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	if err := r.Write(w); err != nil {
+		log.Errorf("writing metrics: %v", err)
+	}
+}
+
+// Run serves the metrics until it fails.
+func (r *Registry) Run(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle(Path, r)
+
+	log.Infof("serving the metrics on %s%s", addr, Path)
+	return http.ListenAndServe(addr, mux)
+}
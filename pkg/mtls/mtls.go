@@ -0,0 +1,264 @@
+// Package mtls has the mutual TLS configurations of the network APIs. The certificates and the CA are read again when
+// their files change, so they can be rotated without restarting, like the secrets updated by cert-manager.
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Files are the PEM files of a TLS configuration.
+type Files struct {
+	CertFile string
+	KeyFile  string
+	// CAFile has the CAs the peers are verified with. The client uses the system CAs without it, the server doesn't
+	// ask for client certificates.
+	CAFile string
+}
+
+// reloader keeps the certificate and the CAs of the files, which are read again when they are replaced or modified.
+type reloader struct {
+	files Files
+
+	lock  sync.Mutex
+	infos []os.FileInfo
+	cert  *tls.Certificate
+	pool  *x509.CertPool
+}
+
+func newReloader(files Files) (*reloader, error) {
+	if (files.CertFile == "") != (files.KeyFile == "") {
+		return nil, fmt.Errorf("the certificate and the key go together")
+	}
+
+	r := &reloader{files: files}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// get returns the current certificate and CAs. The previous ones are kept when the new files can't be loaded, like
+// when they are only partly written.
+func (r *reloader) get() (*tls.Certificate, *x509.CertPool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.changed() {
+		if err := r.reload(); err != nil {
+			log.Errorf("reloading TLS files, keeping the previous ones: %v", err)
+		}
+	}
+
+	return r.cert, r.pool
+}
+
+func (r *reloader) paths() []string {
+	paths := []string{}
+	for _, p := range []string{r.files.CertFile, r.files.KeyFile, r.files.CAFile} {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+
+	return paths
+}
+
+func (r *reloader) changed() bool {
+	for i, p := range r.paths() {
+		// The mounted secrets are symlinks to the current version, the files they point to are compared.
+		info, err := os.Stat(p)
+		if err != nil {
+			return false
+		}
+
+		if !os.SameFile(info, r.infos[i]) || !info.ModTime().Equal(r.infos[i].ModTime()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *reloader) reload() error {
+	infos := []os.FileInfo{}
+	for _, p := range r.paths() {
+		info, err := os.Stat(p)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", p, err)
+		}
+
+		infos = append(infos, info)
+	}
+
+	var cert *tls.Certificate
+	if r.files.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+		if err != nil {
+			return fmt.Errorf("loading certificate: %w", err)
+		}
+
+		cert = &c
+	}
+
+	var pool *x509.CertPool
+	if r.files.CAFile != "" {
+		data, err := os.ReadFile(r.files.CAFile)
+		if err != nil {
+			return fmt.Errorf("reading CA: %w", err)
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no CA certificate in %s", r.files.CAFile)
+		}
+	}
+
+	// Nothing is replaced when a file changed while it was read, it is read again on the next handshake.
+	r.infos, r.cert, r.pool = infos, cert, pool
+
+	return nil
+}
+
+// ServerConfig returns the configuration of a server. With a CA, the clients need a certificate signed by it and, with
+// allowed identities, one of them. The identities are matched with the patterns of path.Match, like
+// spiffe://cluster.local/ns/kube-system/sa/*.
+func ServerConfig(files Files, allowed []string) (*tls.Config, error) {
+	if files.CertFile == "" {
+		return nil, fmt.Errorf("no server certificate")
+	}
+
+	if files.CAFile == "" && len(allowed) > 0 {
+		return nil, fmt.Errorf("the client identities can't be checked without a CA")
+	}
+
+	for _, pattern := range allowed {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid client identity %q: %w", pattern, err)
+		}
+	}
+
+	r, err := newReloader(files)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := r.get()
+			return cert, nil
+		},
+	}
+
+	if files.CAFile == "" {
+		return config, nil
+	}
+
+	// The chains are verified by the connection, with the CAs at the time of the handshake.
+	config.ClientAuth = tls.RequireAnyClientCert
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		_, pool := r.get()
+		if err := verify(cs.PeerCertificates, pool, "", x509.ExtKeyUsageClientAuth); err != nil {
+			return err
+		}
+
+		if len(allowed) == 0 {
+			return nil
+		}
+
+		identities := Identities(cs.PeerCertificates[0])
+		if !matchIdentity(identities, allowed) {
+			return fmt.Errorf("client %v not allowed", identities)
+		}
+
+		return nil
+	}
+
+	return config, nil
+}
+
+// ClientConfig returns the configuration of a client of the server with the name, the certificate is sent when the
+// server asks for it.
+func ClientConfig(files Files, serverName string) (*tls.Config, error) {
+	r, err := newReloader(files)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.get()
+			if cert == nil {
+				return &tls.Certificate{}, nil
+			}
+			return cert, nil
+		},
+		// The chain is verified by the connection instead, with the CAs at the time of the handshake.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			_, pool := r.get()
+			return verify(cs.PeerCertificates, pool, serverName, x509.ExtKeyUsageServerAuth)
+		},
+	}, nil
+}
+
+func verify(certs []*x509.Certificate, pool *x509.CertPool, name string, usage x509.ExtKeyUsage) error {
+	if len(certs) == 0 {
+		return errors.New("no peer certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       name,
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	if err != nil {
+		return fmt.Errorf("verifying peer certificate: %w", err)
+	}
+
+	return nil
+}
+
+// Identities returns the names of the certificate: its common name, DNS names and URIs, like the SPIFFE IDs.
+func Identities(cert *x509.Certificate) []string {
+	identities := []string{}
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+
+	identities = append(identities, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+
+	return identities
+}
+
+func matchIdentity(identities, allowed []string) bool {
+	for _, identity := range identities {
+		for _, pattern := range allowed {
+			if ok, _ := path.Match(pattern, identity); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
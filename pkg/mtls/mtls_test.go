@@ -0,0 +1,310 @@
+package mtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ca signs the certificates of the tests.
+type ca struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+var serial int64
+
+func template(cn string) *x509.Certificate {
+	serial++
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+}
+
+func newCA(t *testing.T) *ca {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := template("test CA")
+	tmpl.IsCA, tmpl.BasicConstraintsValid, tmpl.KeyUsage = true, true, x509.KeyUsageCertSign
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &ca{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes the certificate and its key for the name, with the SPIFFE ID for the clients, to the files of the
+// directory. The files are replaced like the mounted secrets, not modified.
+func (c *ca) issue(t *testing.T, dir, name, spiffeID string, usage x509.ExtKeyUsage) Files {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := template(name)
+	tmpl.DNSNames, tmpl.ExtKeyUsage = []string{name}, []x509.ExtKeyUsage{usage}
+	if spiffeID != "" {
+		uri, err := url.Parse(spiffeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl.URIs = []*url.URL{uri}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, c.cert, &key.PublicKey, c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := Files{
+		CertFile: filepath.Join(dir, "tls.crt"),
+		KeyFile:  filepath.Join(dir, "tls.key"),
+		CAFile:   filepath.Join(dir, "ca.crt"),
+	}
+	replace(t, files.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	replace(t, files.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+
+	return files
+}
+
+func replace(t *testing.T, name string, data []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(name+".new", data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(name+".new", name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// handshake connects the client to the server, it returns the certificate of the server seen by the client and the
+// errors of both sides.
+func handshake(t *testing.T, server, client *tls.Config) (*x509.Certificate, error, error) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	errs := make(chan error, 1)
+	go func() {
+		sc, err := l.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer sc.Close()
+		sc.SetDeadline(deadline)
+
+		s := tls.Server(sc, server)
+		err = s.Handshake()
+		if err == nil {
+			_, err = s.Write([]byte{1})
+		}
+		errs <- err
+	}()
+
+	cc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	cc.SetDeadline(deadline)
+
+	c := tls.Client(cc, client)
+	clientErr := c.Handshake()
+	if clientErr == nil {
+		// The server verifies the client after the client is done with the handshake in TLS 1.3.
+		_, clientErr = c.Read(make([]byte, 1))
+	}
+	serverErr := <-errs
+
+	var cert *x509.Certificate
+	if certs := c.ConnectionState().PeerCertificates; len(certs) > 0 {
+		cert = certs[0]
+	}
+
+	return cert, serverErr, clientErr
+}
+
+func TestIdentities(t *testing.T) {
+	authority := newCA(t)
+	serverDir := t.TempDir()
+	serverFiles := authority.issue(t, serverDir, "server", "", x509.ExtKeyUsageServerAuth)
+	if err := os.WriteFile(serverFiles.CAFile, authority.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	other := newCA(t)
+
+	tests := []struct {
+		name     string
+		ca       *ca
+		spiffeID string
+		usage    x509.ExtKeyUsage
+		allowed  []string
+		err      string
+	}{
+		{
+			name:     "allowed identity",
+			ca:       authority,
+			spiffeID: "spiffe://cluster.local/ns/kube-system/sa/collector",
+			usage:    x509.ExtKeyUsageClientAuth,
+			allowed:  []string{"spiffe://cluster.local/ns/kube-system/sa/*"},
+		},
+		{
+			name:  "any identity of the CA",
+			ca:    authority,
+			usage: x509.ExtKeyUsageClientAuth,
+		},
+		{
+			name:     "rejected identity",
+			ca:       authority,
+			spiffeID: "spiffe://cluster.local/ns/default/sa/collector",
+			usage:    x509.ExtKeyUsageClientAuth,
+			allowed:  []string{"spiffe://cluster.local/ns/kube-system/sa/*"},
+			err:      "not allowed",
+		},
+		{
+			name:  "another CA",
+			ca:    other,
+			usage: x509.ExtKeyUsageClientAuth,
+			err:   "verifying peer certificate",
+		},
+		{
+			name:  "server certificate",
+			ca:    authority,
+			usage: x509.ExtKeyUsageServerAuth,
+			err:   "verifying peer certificate",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientFiles := tt.ca.issue(t, t.TempDir(), "client", tt.spiffeID, tt.usage)
+			clientFiles.CAFile = serverFiles.CAFile
+
+			server, err := ServerConfig(serverFiles, tt.allowed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := ClientConfig(clientFiles, "server")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, serverErr, clientErr := handshake(t, server, client)
+			if tt.err == "" {
+				if serverErr != nil || clientErr != nil {
+					t.Errorf("connection failed: %v, %v", serverErr, clientErr)
+				}
+				return
+			}
+
+			if serverErr == nil || !strings.Contains(serverErr.Error(), tt.err) || clientErr == nil {
+				t.Errorf("errors %v and %v, expected %q", serverErr, clientErr, tt.err)
+			}
+		})
+	}
+}
+
+// TestRotation checks that the certificates replaced on disk are used from the next handshake.
+func TestRotation(t *testing.T) {
+	authority := newCA(t)
+
+	serverDir := t.TempDir()
+	serverFiles := authority.issue(t, serverDir, "server", "", x509.ExtKeyUsageServerAuth)
+	replace(t, serverFiles.CAFile, authority.pem)
+
+	clientDir := t.TempDir()
+	clientFiles := authority.issue(t, clientDir, "client", "spiffe://cluster.local/ns/kube-system/sa/collector", x509.ExtKeyUsageClientAuth)
+	replace(t, clientFiles.CAFile, authority.pem)
+
+	server, err := ServerConfig(serverFiles, []string{"spiffe://cluster.local/ns/kube-system/sa/*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ClientConfig(clientFiles, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, serverErr, clientErr := handshake(t, server, client)
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("connection failed: %v, %v", serverErr, clientErr)
+	}
+
+	// A new server certificate.
+	authority.issue(t, serverDir, "server", "", x509.ExtKeyUsageServerAuth)
+	second, serverErr, clientErr := handshake(t, server, client)
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("connection failed after the rotation: %v, %v", serverErr, clientErr)
+	}
+	if second.SerialNumber.Cmp(first.SerialNumber) == 0 {
+		t.Errorf("server certificate %s not rotated", second.SerialNumber)
+	}
+
+	// A new client certificate, whose identity is no longer allowed.
+	authority.issue(t, clientDir, "client", "spiffe://cluster.local/ns/default/sa/collector", x509.ExtKeyUsageClientAuth)
+	if _, serverErr, _ := handshake(t, server, client); serverErr == nil || !strings.Contains(serverErr.Error(), "not allowed") {
+		t.Errorf("rotated client identity: %v", serverErr)
+	}
+
+	// A new CA on both sides, the certificates it did not sign are rejected.
+	rotated := newCA(t)
+	replace(t, serverFiles.CAFile, rotated.pem)
+	replace(t, clientFiles.CAFile, rotated.pem)
+	if _, serverErr, clientErr := handshake(t, server, client); serverErr == nil || clientErr == nil {
+		t.Errorf("certificates of the previous CA accepted: %v, %v", serverErr, clientErr)
+	}
+
+	rotated.issue(t, serverDir, "server", "", x509.ExtKeyUsageServerAuth)
+	rotated.issue(t, clientDir, "client", "spiffe://cluster.local/ns/kube-system/sa/collector", x509.ExtKeyUsageClientAuth)
+	if _, serverErr, clientErr := handshake(t, server, client); serverErr != nil || clientErr != nil {
+		t.Errorf("connection failed after rotating the CA: %v, %v", serverErr, clientErr)
+	}
+
+	// Partly written files are not loaded, the previous ones are kept.
+	replace(t, serverFiles.CertFile, []byte("-----BEGIN CERTIFICATE-----\n"))
+	if _, serverErr, clientErr := handshake(t, server, client); serverErr != nil || clientErr != nil {
+		t.Errorf("connection failed with an invalid certificate file: %v, %v", serverErr, clientErr)
+	}
+}
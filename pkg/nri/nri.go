@@ -0,0 +1,82 @@
+// Package nri has the protocol of the plugins of the Node Resource Interface v0.1 of containerd. The plugins are
+// binaries of /opt/nri/bin run with the invoke argument and the request on their standard input, synchronously when
+// the task of a container is created, before its process runs, and when it is deleted. The runtime fails the task
+// when a plugin exits with an error.
+package nri
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Version is the version of the protocol.
+const Version = "0.1"
+
+// State is the lifecycle event of the task the plugin is invoked for.
+type State string
+
+const (
+	Create State = "create"
+	Delete State = "delete"
+	Update State = "update"
+	Pause  State = "pause"
+	Resume State = "resume"
+)
+
+// maxRequestSize bounds the requests, they have the results of the previous plugins.
+const maxRequestSize = 1 << 20
+
+// Request is what the plugins are invoked with.
+type Request struct {
+	Version   string `json:"version"`
+	ID        string `json:"id"`
+	SandboxID string `json:"sandboxID,omitempty"`
+	Pid       int    `json:"pid,omitempty"`
+	State     State  `json:"state"`
+	// Labels are the ones of the container, like the ones of the kubelet with its pod.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Conf is the configuration of the plugin in /etc/nri/conf.json.
+	Conf    json.RawMessage   `json:"conf,omitempty"`
+	Spec    json.RawMessage   `json:"spec,omitempty"`
+	Results []json.RawMessage `json:"results,omitempty"`
+}
+
+// Result is what the plugins answer on their standard output.
+type Result struct {
+	Version  string            `json:"version"`
+	Plugin   string            `json:"plugin"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// ReadRequest decodes the request of the runtime.
+func ReadRequest(r io.Reader) (*Request, error) {
+	req := &Request{}
+	if err := json.NewDecoder(io.LimitReader(r, maxRequestSize)).Decode(req); err != nil {
+		return nil, fmt.Errorf("decoding NRI request: %w", err)
+	}
+
+	if req.ID == "" {
+		return nil, fmt.Errorf("NRI request without container")
+	}
+
+	return req, nil
+}
+
+// DecodeConf decodes the configuration of the plugin into v, which is left as is without one.
+func (r *Request) DecodeConf(v interface{}) error {
+	if len(r.Conf) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(r.Conf, v); err != nil {
+		return fmt.Errorf("decoding NRI plugin configuration: %w", err)
+	}
+
+	return nil
+}
+
+// WriteResult answers the request of the plugin with the metadata.
+func WriteResult(w io.Writer, plugin string, metadata map[string]string) error {
+	return json.NewEncoder(w).Encode(&Result{Version: Version, Plugin: plugin, Metadata: metadata})
+}
@@ -0,0 +1,187 @@
+// Package ocihook lets the agent attach the containers before they start, from an OCI createRuntime hook of the
+// runtime or an NRI plugin. The hook sends the state of the container to the agent on a unix socket and waits for its
+// answer, the runtime only runs the process of the container once the hook returned.
+package ocihook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxMessageSize bounds the messages on the socket.
+const maxMessageSize = 64 * 1024
+
+// State is the container about to start, or deleted.
+type State struct {
+	ID  string `json:"id"`
+	Pid int    `json:"pid"`
+	// RootFS is the path of the rootfs on the host, where the runtime mounted it. The main process of the container
+	// pivots to it after the hook. It is empty when the process was created already, it only waits to run then.
+	RootFS      string            `json:"rootfs,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Deleted is set when the container was deleted rather than created.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// Response tells the hook how attaching the container went.
+type Response struct {
+	// Enforced is set when the container is enforced, the containers of the pods which are not are only let through.
+	Enforced bool   `json:"enforced"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ReadState reads the state of the container the runtime gives the hooks on their standard input, the rootfs comes
+// from the config.json of its bundle.
+func ReadState(r io.Reader) (*State, error) {
+	var state specs.State
+	if err := json.NewDecoder(io.LimitReader(r, maxMessageSize)).Decode(&state); err != nil {
+		return nil, fmt.Errorf("decoding container state: %w", err)
+	}
+
+	if state.Pid == 0 {
+		return nil, fmt.Errorf("container %s has no process", state.ID)
+	}
+
+	data, err := os.ReadFile(filepath.Join(state.Bundle, "config.json"))
+	if err != nil {
+		return nil, fmt.Errorf("reading bundle config: %w", err)
+	}
+
+	var spec specs.Spec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("decoding bundle config: %w", err)
+	}
+
+	if spec.Root == nil || spec.Root.Path == "" {
+		return nil, fmt.Errorf("container %s has no rootfs", state.ID)
+	}
+
+	rootfs := spec.Root.Path
+	if !filepath.IsAbs(rootfs) {
+		rootfs = filepath.Join(state.Bundle, rootfs)
+	}
+
+	return &State{ID: state.ID, Pid: state.Pid, RootFS: rootfs, Annotations: state.Annotations}, nil
+}
+
+// Server attaches the containers the hooks send.
+type Server struct {
+	// Attach enforces the container, it tells if the container is enforced.
+	Attach func(*State) (bool, error)
+	// Remove stops enforcing the deleted container.
+	Remove func(*State)
+	// Timeout is how long the hooks wait for the container to be attached, they let it start without it then.
+	Timeout time.Duration
+}
+
+// Run accepts the connections of the hooks on the unix socket until it fails. A socket left by a previous run is
+// replaced.
+func (s *Server) Run(socket string) error {
+	if err := os.MkdirAll(filepath.Dir(socket), 0o700); err != nil {
+		return fmt.Errorf("creating hook socket directory: %w", err)
+	}
+
+	if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("removing hook socket: %w", err)
+	}
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("listening on hook socket: %w", err)
+	}
+	defer l.Close()
+
+	if err := os.Chmod(socket, 0o600); err != nil {
+		return fmt.Errorf("setting hook socket mode: %w", err)
+	}
+
+	log.Infof("attaching the containers of the OCI hooks on %s", socket)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return fmt.Errorf("accepting hook connection: %w", err)
+		}
+
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var state State
+	if err := json.NewDecoder(io.LimitReader(conn, maxMessageSize)).Decode(&state); err != nil {
+		log.Errorf("decoding hook request: %v", err)
+		return
+	}
+
+	var resp *Response
+	if state.Deleted {
+		s.Remove(&state)
+		resp = &Response{}
+	} else {
+		resp = s.attach(&state)
+	}
+
+	if resp.Error != "" {
+		log.Errorf("attaching container %s from its hook: %s", state.ID, resp.Error)
+	}
+
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		log.Errorf("answering the hook of container %s: %v", state.ID, err)
+	}
+}
+
+// attach answers once the container is attached or after the timeout, the container keeps being attached then.
+func (s *Server) attach(state *State) *Response {
+	done := make(chan *Response, 1)
+	go func() {
+		enforced, err := s.Attach(state)
+		resp := &Response{Enforced: enforced}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		done <- resp
+	}()
+
+	select {
+	case resp := <-done:
+		return resp
+	case <-time.After(s.Timeout):
+		return &Response{Error: fmt.Sprintf("not attached after %s", s.Timeout)}
+	}
+}
+
+// Call sends the state of the container to the agent on the socket and returns its answer, it fails after the
+// timeout.
+func Call(socket string, state *State, timeout time.Duration) (*Response, error) {
+	conn, err := net.DialTimeout("unix", socket, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the agent: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	if err := json.NewEncoder(conn).Encode(state); err != nil {
+		return nil, fmt.Errorf("sending container state: %w", err)
+	}
+
+	resp := &Response{}
+	if err := json.NewDecoder(io.LimitReader(conn, maxMessageSize)).Decode(resp); err != nil {
+		return nil, fmt.Errorf("reading the answer of the agent: %w", err)
+	}
+
+	return resp, nil
+}
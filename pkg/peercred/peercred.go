@@ -0,0 +1,34 @@
+// Package peercred gets the credentials of the process at the other end of a unix socket, to authorize the local
+// clients of the agent.
+package peercred
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// Get returns the credentials of the peer of the connection with SO_PEERCRED, as they were when it connected. It fails
+// for the connections which are not on a unix socket.
+func Get(c net.Conn) (*unix.Ucred, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("not a unix socket")
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+
+	return cred, credErr
+}
@@ -0,0 +1,16 @@
+package policy
+
+import (
+	"hash/fnv"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// CanaryEnforces tells if the pod is among the percentage of the pods a canary policy is enforced on. The pods are
+// spread over 100 buckets by the hash of their UID, the ones of the first buckets are enforced.
+func CanaryEnforces(uid types.UID, percent int) bool {
+	h := fnv.New32a()
+	h.Write([]byte(uid))
+
+	return int(h.Sum32()%100) < percent
+}
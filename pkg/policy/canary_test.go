@@ -0,0 +1,76 @@
+package policy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func uids(n int) []types.UID {
+	uids := []types.UID{}
+	for i := 0; i < n; i++ {
+		uids = append(uids, types.UID(fmt.Sprintf("6f1c54e2-0b7a-4d5e-9c3f-%012d", i)))
+	}
+
+	return uids
+}
+
+func bucket(uid types.UID) int {
+	h := fnv.New32a()
+	h.Write([]byte(uid))
+
+	return int(h.Sum32() % 100)
+}
+
+func TestCanaryEnforces(t *testing.T) {
+	for _, uid := range uids(1000) {
+		b := bucket(uid)
+
+		tests := []struct {
+			percent  int
+			enforced bool
+		}{
+			{percent: 0, enforced: false},
+			{percent: 100, enforced: true},
+			// The pods of the bucket are enforced from the next percentage.
+			{percent: b, enforced: false},
+			{percent: b + 1, enforced: true},
+		}
+
+		for _, tt := range tests {
+			if enforced := CanaryEnforces(uid, tt.percent); enforced != tt.enforced {
+				t.Fatalf("pod %s of bucket %d enforced %v at %d%%", uid, b, enforced, tt.percent)
+			}
+		}
+	}
+}
+
+// TestCanaryStable checks that the pods enforced stay enforced when the percentage grows, and are spread evenly.
+func TestCanaryStable(t *testing.T) {
+	pods := uids(1000)
+
+	enforced := map[types.UID]bool{}
+	for percent := 0; percent <= 100; percent++ {
+		n := 0
+		for _, uid := range pods {
+			e := CanaryEnforces(uid, percent)
+			if e != CanaryEnforces(uid, percent) {
+				t.Fatalf("pod %s enforced differently at %d%%", uid, percent)
+			}
+			if enforced[uid] && !e {
+				t.Fatalf("pod %s no longer enforced at %d%%", uid, percent)
+			}
+
+			enforced[uid] = e
+			if e {
+				n++
+			}
+		}
+
+		if expected := len(pods) * percent / 100; n < expected-60 || n > expected+60 {
+			t.Errorf("%d pods enforced at %d%%, expected about %d", n, percent, expected)
+		}
+	}
+}
@@ -0,0 +1,471 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+type BaselineStatus int
+
+const (
+	// BaselineMatch means the file is part of the baseline and its hash did not change.
+	BaselineMatch BaselineStatus = iota
+	// BaselineModified means the file is part of the baseline but its hash changed.
+	BaselineModified
+	// BaselineUnknown means the file is not part of the baseline.
+	BaselineUnknown
+)
+
+var baselineStatusNames = map[BaselineStatus]string{
+	BaselineMatch:    "match",
+	BaselineModified: "modified",
+	BaselineUnknown:  "unknown",
+}
+
+func (s BaselineStatus) MarshalText() ([]byte, error) {
+	name, ok := baselineStatusNames[s]
+	if !ok {
+		return nil, fmt.Errorf("invalid baseline status %d", s)
+	}
+
+	return []byte(name), nil
+}
+
+func (s *BaselineStatus) UnmarshalText(text []byte) error {
+	for status, name := range baselineStatusNames {
+		if name == string(text) {
+			*s = status
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid baseline status %q", text)
+}
+
+func (s BaselineStatus) String() string {
+	switch s {
+	case BaselineMatch:
+		return "baseline match"
+	case BaselineModified:
+		return "modified file"
+	default:
+		return "unknown file"
+	}
+}
+
+// Request is an execution happening in a container which needs a decision.
+type Request struct {
+	// Path of the executed file inside the container, like /usr/bin/touch.
+	Path     string         `json:"path"`
+	Baseline BaselineStatus `json:"baseline"`
+
+	// ProcessExe is the executable of the process calling exec, i.e. what spawned the new program. ParentExe is the
+	// executable of its parent. Both are paths inside the container.
+	ProcessExe string `json:"processExe,omitempty"`
+	ParentExe  string `json:"parentExe,omitempty"`
+
+	// UID and GID are the effective ids of the process calling exec inside the container's user namespace.
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+
+	ExecSession bool `json:"execSession,omitempty"`
+	Interactive bool `json:"interactive,omitempty"`
+
+	// Arch is the architecture of the executed ELF binary, ForeignArch is set when the node can't run it natively.
+	// Static is set for the statically linked ones. They are not set for the other files, like the scripts.
+	Arch        string `json:"arch,omitempty"`
+	ForeignArch bool   `json:"foreignArch,omitempty"`
+	Static      bool   `json:"static,omitempty"`
+
+	// Writable tells where the executed file is that anything can write to, like tmpfs or the world-writable
+	// directory /tmp. It is empty for the other locations.
+	Writable string `json:"writable,omitempty"`
+
+	// Interpreter is the interpreter of the executed script inside the container, from its shebang. For the scripts run
+	// with env, like #!/usr/bin/env python3, it is the program env runs.
+	Interpreter string `json:"interpreter,omitempty"`
+
+	// Findings are what looks suspicious in the executed binary when it does not match the baseline, for the triage.
+	// The policy does not evaluate them.
+	Findings []string `json:"findings,omitempty"`
+
+	// Ephemeral is set for the containers added with kubectl debug.
+	Ephemeral bool `json:"ephemeral,omitempty"`
+}
+
+type Decision struct {
+	Allow  bool
+	Reason string
+
+	// Audited is set when the execution should have been denied but it was allowed because the policy is only
+	// audited.
+	Audited bool
+}
+
+// Evaluate decides on the execution.
+func (p *ExecPolicy) Evaluate(req *Request) Decision {
+	d := p.evaluate(req)
+	if p.Spec.Mode == ModeAudit {
+		return audit(d)
+	}
+
+	return d
+}
+
+func (p *ExecPolicy) evaluate(req *Request) Decision {
+	if req.Ephemeral {
+		switch p.Spec.EphemeralContainers {
+		case EphemeralDeny:
+			return Decision{Allow: false, Reason: "ephemeral container"}
+		case EphemeralAudit:
+			return audit(p.evaluateRules(req))
+		}
+	}
+
+	return p.evaluateRules(req)
+}
+
+func (p *ExecPolicy) evaluateRules(req *Request) Decision {
+	if req.Writable != "" && !p.Spec.AllowWritableExec {
+		return Decision{Allow: false, Reason: "executed from " + req.Writable}
+	}
+
+	if d, ok := p.evaluateBinary(req); ok {
+		return d
+	}
+
+	for i, rule := range p.Spec.Rules {
+		if !rule.matches(req) {
+			continue
+		}
+
+		name := rule.Name
+		if name == "" {
+			name = "#" + strconv.Itoa(i)
+		}
+
+		return decide(rule.Action, req, "rule "+name)
+	}
+
+	return decide(ActionVerify, req, "no rule")
+}
+
+// evaluateBinary applies the checks on the binary, it is false when none denies it.
+func (p *ExecPolicy) evaluateBinary(req *Request) (Decision, bool) {
+	checks := p.Spec.Binaries
+	if checks == nil {
+		return Decision{}, false
+	}
+
+	if checks.DenyForeignArch && req.ForeignArch {
+		return Decision{Allow: false, Reason: "binary built for " + req.Arch}, true
+	}
+
+	if checks.DenyUnknownStatic && req.Static && req.Baseline != BaselineMatch {
+		return Decision{Allow: false, Reason: "statically linked " + req.Baseline.String()}, true
+	}
+
+	return Decision{}, false
+}
+
+// ProtectsToken tells if the service account token can only be read by some programs.
+func (p *ExecPolicy) ProtectsToken() bool {
+	return p.Spec.ServiceAccountToken != nil
+}
+
+// EvaluateTokenRead decides on the read of the service account token by the process with the executable.
+func (p *ExecPolicy) EvaluateTokenRead(processExe string) Decision {
+	d := Decision{Allow: true, Reason: "service account token reader"}
+	if !matchAny(p.Spec.ServiceAccountToken.Processes, processExe) {
+		d = Decision{Allow: false, Reason: "service account token read by " + processExe}
+	}
+
+	if p.Spec.Mode == ModeAudit {
+		return audit(d)
+	}
+
+	return d
+}
+
+// EvaluateRead decides on the read of the file by the process with the executable. It is false when no read rule
+// protects the file.
+func (p *ExecPolicy) EvaluateRead(path, processExe string) (Decision, bool) {
+	for i, rule := range p.Spec.ProtectReads {
+		if !matchAny(rule.Paths, path) {
+			continue
+		}
+
+		name := rule.Name
+		if name == "" {
+			name = "#" + strconv.Itoa(i)
+		}
+
+		d := Decision{Allow: true, Reason: "read rule " + name}
+		if !matchAny(rule.Processes, processExe) {
+			d = Decision{Allow: false, Reason: "read rule " + name + ", read by " + processExe}
+		}
+
+		if p.Spec.Mode == ModeAudit {
+			return audit(d), true
+		}
+
+		return d, true
+	}
+
+	return Decision{}, false
+}
+
+// ImmutableRootfs tells if the files of the rootfs can't be opened for writing.
+func (p *ExecPolicy) ImmutableRootfs() bool {
+	return p.Spec.ImmutableRootfs
+}
+
+// EvaluateWrite decides on the open for writing of a file of the rootfs, the reason tells why it is considered to be
+// opened for writing.
+func (p *ExecPolicy) EvaluateWrite(reason string) Decision {
+	d := Decision{Allow: !p.Spec.ImmutableRootfs, Reason: "immutable rootfs, " + reason}
+	if p.Spec.Mode == ModeAudit {
+		return audit(d)
+	}
+
+	return d
+}
+
+// ReadPaths returns the globs of the files protected by the read rules.
+func (p *ExecPolicy) ReadPaths() []string {
+	paths := []string{}
+	for _, rule := range p.Spec.ProtectReads {
+		paths = append(paths, rule.Paths...)
+	}
+
+	return paths
+}
+
+// Volume is a volume of the pod mounted in a container.
+type Volume struct {
+	Name string
+	// Type is the type of the volume, see VolumeType.
+	Type      string
+	MountPath string
+}
+
+// VolumeType returns the type of the volume the volume rules match, like hostPath.
+func VolumeType(src *v1.VolumeSource) string {
+	switch {
+	case src.HostPath != nil:
+		return "hostPath"
+	case src.PersistentVolumeClaim != nil:
+		return "persistentVolumeClaim"
+	case src.EmptyDir != nil:
+		return "emptyDir"
+	case src.ConfigMap != nil:
+		return "configMap"
+	case src.Secret != nil:
+		return "secret"
+	case src.Projected != nil:
+		return "projected"
+	case src.DownwardAPI != nil:
+		return "downwardAPI"
+	case src.CSI != nil:
+		return "csi"
+	case src.Ephemeral != nil:
+		return "ephemeral"
+	case src.NFS != nil:
+		return "nfs"
+	}
+
+	return "other"
+}
+
+// VolumeAction returns how the volume is enforced with the reason, it is false when no volume rule matches it.
+func (p *ExecPolicy) VolumeAction(vol *Volume) (VolumeAction, string, bool) {
+	for i, rule := range p.Spec.Volumes {
+		if !rule.matches(vol) {
+			continue
+		}
+
+		name := rule.Name
+		if name == "" {
+			name = "#" + strconv.Itoa(i)
+		}
+
+		return rule.Action, "volume rule " + name + ", volume " + vol.Name, true
+	}
+
+	return "", "", false
+}
+
+// EvaluateVolumeExec decides on the execution of a file of a volume whose executions are all denied.
+func (p *ExecPolicy) EvaluateVolumeExec(reason string) Decision {
+	d := Decision{Allow: false, Reason: reason}
+	if p.Spec.Mode == ModeAudit {
+		return audit(d)
+	}
+
+	return d
+}
+
+// EvaluateNoExec denies the execution of the file inside the container when it is on a noexec mount, it is false
+// when it is not.
+func (p *ExecPolicy) EvaluateNoExec(path string) (Decision, bool) {
+	for _, mnt := range p.Spec.NoExec {
+		if !InDir(path, mnt) {
+			continue
+		}
+
+		mnt = strings.TrimSuffix(mnt, "/")
+
+		d := Decision{Allow: false, Reason: "noexec mount " + mnt}
+		if p.Spec.Mode == ModeAudit {
+			return audit(d), true
+		}
+
+		return d, true
+	}
+
+	return Decision{}, false
+}
+
+// audit turns a deny decision into an allow one which is only logged.
+func audit(d Decision) Decision {
+	if !d.Allow {
+		d.Allow = true
+		d.Audited = true
+	}
+
+	return d
+}
+
+func decide(action Action, req *Request, reason string) Decision {
+	switch action {
+	case ActionAllow:
+		return Decision{Allow: true, Reason: reason}
+	case ActionDeny:
+		return Decision{Allow: false, Reason: reason}
+	}
+
+	return Decision{Allow: req.Baseline == BaselineMatch, Reason: reason + ", " + req.Baseline.String()}
+}
+
+func (r *Rule) matches(req *Request) bool {
+	if len(r.Paths) > 0 && !matchAny(r.Paths, req.Path) {
+		return false
+	}
+
+	if len(r.Processes) > 0 && !matchAny(r.Processes, req.ProcessExe) {
+		return false
+	}
+
+	if len(r.Parents) > 0 && !matchAny(r.Parents, req.ParentExe) {
+		return false
+	}
+
+	if len(r.Interpreters) > 0 && (req.Interpreter == "" || !matchAny(r.Interpreters, req.Interpreter)) {
+		return false
+	}
+
+	if len(r.UIDs) > 0 && !containsID(r.UIDs, req.UID) {
+		return false
+	}
+
+	if len(r.GIDs) > 0 && !containsID(r.GIDs, req.GID) {
+		return false
+	}
+
+	if r.ExecSession != nil && *r.ExecSession != req.ExecSession {
+		return false
+	}
+
+	if r.Interactive != nil && *r.Interactive != req.Interactive {
+		return false
+	}
+
+	return true
+}
+
+func (r *VolumeRule) matches(vol *Volume) bool {
+	if len(r.Volumes) > 0 && !matchAny(r.Volumes, vol.Name) {
+		return false
+	}
+
+	if len(r.Types) > 0 && !contains(r.Types, vol.Type) {
+		return false
+	}
+
+	if len(r.MountPaths) > 0 && !matchAny(r.MountPaths, vol.MountPath) {
+		return false
+	}
+
+	return true
+}
+
+// Excludes tells if the path inside the container is not enforced.
+func (p *ExecPolicy) Excludes(path string) bool {
+	return matchAny(p.Spec.Exclude, path)
+}
+
+// ExcludedFiles returns the excluded paths which are not globs.
+func (p *ExecPolicy) ExcludedFiles() []string {
+	files := []string{}
+	for _, glob := range p.Spec.Exclude {
+		if !strings.ContainsAny(glob, `*?[\`) {
+			files = append(files, glob)
+		}
+	}
+
+	return files
+}
+
+func containsID(ids []uint32, id uint32) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// InDir tells if the absolute path is the directory or a path below it. Both are cleaned first, so /data/ is /data,
+// while /database is not below it.
+func InDir(name, dir string) bool {
+	name, dir = path.Clean(name), path.Clean(dir)
+	if dir == "/" {
+		return strings.HasPrefix(name, "/")
+	}
+
+	return name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+func matchAny(globs []string, name string) bool {
+	for _, glob := range globs {
+		if matchGlob(glob, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchGlob(glob, name string) bool {
+	if dir := strings.TrimSuffix(glob, "/**"); dir != glob {
+		return name == dir || strings.HasPrefix(name, dir+"/")
+	}
+
+	ok, _ := path.Match(glob, name)
+	return ok
+}
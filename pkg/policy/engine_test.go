@@ -0,0 +1,227 @@
+package policy
+
+import "testing"
+
+func TestEvaluate(t *testing.T) {
+	yes, no := true, false
+	allowShell := Rule{Name: "shell", Action: ActionAllow, Paths: []string{"/bin/sh"}}
+
+	tests := []struct {
+		name string
+		spec ExecPolicySpec
+		req  Request
+		d    Decision
+	}{
+		{
+			name: "no rule, baseline match",
+			req:  Request{Path: "/bin/sh", Baseline: BaselineMatch},
+			d:    Decision{Allow: true, Reason: "no rule, baseline match"},
+		},
+		{
+			name: "no rule, modified file",
+			req:  Request{Path: "/bin/sh", Baseline: BaselineModified},
+			d:    Decision{Allow: false, Reason: "no rule, modified file"},
+		},
+		{
+			name: "no rule, unknown file",
+			req:  Request{Path: "/bin/sh", Baseline: BaselineUnknown},
+			d:    Decision{Allow: false, Reason: "no rule, unknown file"},
+		},
+
+		// The writable locations are checked first, then the binaries, then the rules.
+		{
+			name: "writable location before the rules",
+			spec: ExecPolicySpec{Rules: []Rule{allowShell}},
+			req:  Request{Path: "/bin/sh", Baseline: BaselineMatch, Writable: "tmpfs"},
+			d:    Decision{Allow: false, Reason: "executed from tmpfs"},
+		},
+		{
+			name: "writable location before the binaries",
+			spec: ExecPolicySpec{Binaries: &BinaryChecks{DenyForeignArch: true}},
+			req:  Request{Path: "/tmp/sh", Writable: "/tmp", Arch: "arm64", ForeignArch: true},
+			d:    Decision{Allow: false, Reason: "executed from /tmp"},
+		},
+		{
+			name: "writable location decided by the rules",
+			spec: ExecPolicySpec{AllowWritableExec: true, Rules: []Rule{allowShell}},
+			req:  Request{Path: "/bin/sh", Baseline: BaselineUnknown, Writable: "tmpfs"},
+			d:    Decision{Allow: true, Reason: "rule shell"},
+		},
+		{
+			name: "foreign architecture before the rules",
+			spec: ExecPolicySpec{Binaries: &BinaryChecks{DenyForeignArch: true}, Rules: []Rule{allowShell}},
+			req:  Request{Path: "/bin/sh", Baseline: BaselineMatch, Arch: "arm64", ForeignArch: true},
+			d:    Decision{Allow: false, Reason: "binary built for arm64"},
+		},
+		{
+			name: "foreign architecture not checked",
+			spec: ExecPolicySpec{Binaries: &BinaryChecks{DenyUnknownStatic: true}},
+			req:  Request{Path: "/bin/sh", Baseline: BaselineMatch, Arch: "arm64", ForeignArch: true},
+			d:    Decision{Allow: true, Reason: "no rule, baseline match"},
+		},
+		{
+			name: "unknown static binary before the rules",
+			spec: ExecPolicySpec{Binaries: &BinaryChecks{DenyUnknownStatic: true}, Rules: []Rule{allowShell}},
+			req:  Request{Path: "/bin/sh", Baseline: BaselineModified, Static: true},
+			d:    Decision{Allow: false, Reason: "statically linked modified file"},
+		},
+		{
+			name: "static binary of the baseline",
+			spec: ExecPolicySpec{Binaries: &BinaryChecks{DenyUnknownStatic: true}, Rules: []Rule{allowShell}},
+			req:  Request{Path: "/bin/sh", Baseline: BaselineMatch, Static: true},
+			d:    Decision{Allow: true, Reason: "rule shell"},
+		},
+
+		// Each kind of rule.
+		{
+			name: "path",
+			spec: ExecPolicySpec{Rules: []Rule{{Name: "ls", Action: ActionDeny, Paths: []string{"/usr/bin/l?"}}}},
+			req:  Request{Path: "/usr/bin/ls", Baseline: BaselineMatch},
+			d:    Decision{Allow: false, Reason: "rule ls"},
+		},
+		{
+			name: "path not matching",
+			spec: ExecPolicySpec{Rules: []Rule{{Name: "ls", Action: ActionDeny, Paths: []string{"/usr/bin/l?"}}}},
+			req:  Request{Path: "/usr/bin/cat", Baseline: BaselineMatch},
+			d:    Decision{Allow: true, Reason: "no rule, baseline match"},
+		},
+		{
+			name: "directory",
+			spec: ExecPolicySpec{Rules: []Rule{{Name: "app", Action: ActionAllow, Paths: []string{"/app/**"}}}},
+			req:  Request{Path: "/app/bin/server", Baseline: BaselineUnknown},
+			d:    Decision{Allow: true, Reason: "rule app"},
+		},
+		{
+			name: "directory not matching its prefix",
+			spec: ExecPolicySpec{Rules: []Rule{{Name: "app", Action: ActionAllow, Paths: []string{"/app/**"}}}},
+			req:  Request{Path: "/application", Baseline: BaselineUnknown},
+			d:    Decision{Allow: false, Reason: "no rule, unknown file"},
+		},
+		{
+			name: "process",
+			spec: ExecPolicySpec{Rules: []Rule{{Name: "from shell", Action: ActionDeny, Processes: []string{"/bin/*sh"}}}},
+			req:  Request{Path: "/usr/bin/curl", Baseline: BaselineMatch, ProcessExe: "/bin/bash"},
+			d:    Decision{Allow: false, Reason: "rule from shell"},
+		},
+		{
+			name: "parent",
+			spec: ExecPolicySpec{Rules: []Rule{{Name: "from java", Action: ActionDeny, Parents: []string{"/usr/bin/java"}}}},
+			req:  Request{Path: "/bin/sh", Baseline: BaselineMatch, ProcessExe: "/bin/sh", ParentExe: "/usr/bin/java"},
+			d:    Decision{Allow: false, Reason: "rule from java"},
+		},
+		{
+			name: "interpreter",
+			spec: ExecPolicySpec{Rules: []Rule{{Name: "python", Action: ActionAllow, Interpreters: []string{"/usr/bin/python3*"}}}},
+			req:  Request{Path: "/app/run.py", Baseline: BaselineUnknown, Interpreter: "/usr/bin/python3.9"},
+			d:    Decision{Allow: true, Reason: "rule python"},
+		},
+		{
+			name: "interpreter not matching binaries",
+			spec: ExecPolicySpec{Rules: []Rule{{Name: "any", Action: ActionAllow, Interpreters: []string{"*"}}}},
+			req:  Request{Path: "/app/server", Baseline: BaselineUnknown},
+			d:    Decision{Allow: false, Reason: "no rule, unknown file"},
+		},
+		{
+			name: "uid",
+			spec: ExecPolicySpec{Rules: []Rule{{Name: "root", Action: ActionDeny, UIDs: []uint32{0}}}},
+			req:  Request{Path: "/bin/sh", Baseline: BaselineMatch, UID: 0, GID: 1000},
+			d:    Decision{Allow: false, Reason: "rule root"},
+		},
+		{
+			name: "uid not matching",
+			spec: ExecPolicySpec{Rules: []Rule{{Name: "root", Action: ActionDeny, UIDs: []uint32{0}}}},
+			req:  Request{Path: "/bin/sh", Baseline: BaselineMatch, UID: 1000},
+			d:    Decision{Allow: true, Reason: "no rule, baseline match"},
+		},
+		{
+			name: "gid",
+			spec: ExecPolicySpec{Rules: []Rule{{Name: "wheel", Action: ActionDeny, GIDs: []uint32{10, 0}}}},
+			req:  Request{Path: "/bin/sh", Baseline: BaselineMatch, UID: 1000, GID: 10},
+			d:    Decision{Allow: false, Reason: "rule wheel"},
+		},
+		{
+			name: "exec session",
+			spec: ExecPolicySpec{Rules: []Rule{{Name: "exec", Action: ActionDeny, ExecSession: &yes}}},
+			req:  Request{Path: "/bin/sh", Baseline: BaselineMatch, ExecSession: true},
+			d:    Decision{Allow: false, Reason: "rule exec"},
+		},
+		{
+			name: "not an exec session",
+			spec: ExecPolicySpec{Rules: []Rule{{Name: "own", Action: ActionDeny, ExecSession: &no}}},
+			req:  Request{Path: "/bin/sh", Baseline: BaselineMatch, ExecSession: true},
+			d:    Decision{Allow: true, Reason: "no rule, baseline match"},
+		},
+		{
+			name: "interactive",
+			spec: ExecPolicySpec{Rules: []Rule{{Name: "tty", Action: ActionDeny, Interactive: &yes}}},
+			req:  Request{Path: "/bin/sh", Baseline: BaselineMatch, Interactive: true},
+			d:    Decision{Allow: false, Reason: "rule tty"},
+		},
+		{
+			name: "all the fields of the rule",
+			spec: ExecPolicySpec{Rules: []Rule{{Name: "all", Action: ActionDeny, Paths: []string{"/bin/sh"}, Processes: []string{"/app/server"}, UIDs: []uint32{0}}}},
+			req:  Request{Path: "/bin/sh", Baseline: BaselineMatch, ProcessExe: "/app/server", UID: 1000},
+			d:    Decision{Allow: true, Reason: "no rule, baseline match"},
+		},
+		{
+			name: "verified by the baseline",
+			spec: ExecPolicySpec{Rules: []Rule{{Name: "usr", Action: ActionVerify, Paths: []string{"/usr/**"}}, {Name: "all", Action: ActionAllow}}},
+			req:  Request{Path: "/usr/bin/ls", Baseline: BaselineModified},
+			d:    Decision{Allow: false, Reason: "rule usr, modified file"},
+		},
+		{
+			name: "rule without name",
+			spec: ExecPolicySpec{Rules: []Rule{allowShell, {Action: ActionDeny}}},
+			req:  Request{Path: "/bin/ls", Baseline: BaselineMatch},
+			d:    Decision{Allow: false, Reason: "rule #1"},
+		},
+
+		// The first rule matching decides.
+		{
+			name: "conflicting rules, deny first",
+			spec: ExecPolicySpec{Rules: []Rule{{Name: "deny", Action: ActionDeny, Paths: []string{"/bin/*"}}, allowShell}},
+			req:  Request{Path: "/bin/sh", Baseline: BaselineMatch},
+			d:    Decision{Allow: false, Reason: "rule deny"},
+		},
+		{
+			name: "conflicting rules, allow first",
+			spec: ExecPolicySpec{Rules: []Rule{allowShell, {Name: "deny", Action: ActionDeny, Paths: []string{"/bin/*"}}}},
+			req:  Request{Path: "/bin/sh", Baseline: BaselineUnknown},
+			d:    Decision{Allow: true, Reason: "rule shell"},
+		},
+
+		{
+			name: "audited",
+			spec: ExecPolicySpec{Mode: ModeAudit},
+			req:  Request{Path: "/bin/sh", Baseline: BaselineUnknown},
+			d:    Decision{Allow: true, Reason: "no rule, unknown file", Audited: true},
+		},
+		{
+			name: "ephemeral container denied",
+			spec: ExecPolicySpec{EphemeralContainers: EphemeralDeny, Rules: []Rule{allowShell}},
+			req:  Request{Path: "/bin/sh", Baseline: BaselineMatch, Ephemeral: true},
+			d:    Decision{Allow: false, Reason: "ephemeral container"},
+		},
+		{
+			name: "ephemeral container audited",
+			spec: ExecPolicySpec{EphemeralContainers: EphemeralAudit},
+			req:  Request{Path: "/bin/sh", Baseline: BaselineUnknown, Ephemeral: true},
+			d:    Decision{Allow: true, Reason: "no rule, unknown file", Audited: true},
+		},
+		{
+			name: "ephemeral container inheriting the policy",
+			spec: ExecPolicySpec{EphemeralContainers: EphemeralInherit},
+			req:  Request{Path: "/bin/sh", Baseline: BaselineUnknown, Ephemeral: true},
+			d:    Decision{Allow: false, Reason: "no rule, unknown file"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ExecPolicy{Spec: tt.spec}
+			if d := p.Evaluate(&tt.req); d != tt.d {
+				t.Errorf("decision %+v, expected %+v", d, tt.d)
+			}
+		})
+	}
+}
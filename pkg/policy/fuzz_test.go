@@ -0,0 +1,61 @@
+//go:build go1.18
+// +build go1.18
+
+package policy
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// FuzzLoad checks that no policy file makes the parser or the evaluation of the policies it loads panic.
+func FuzzLoad(f *testing.F) {
+	for _, file := range []string{"../../examples/exec-policy.yaml", "../../examples/host.yaml"} {
+		if data, err := os.ReadFile(file); err == nil {
+			f.Add(data, "/usr/bin/sh")
+		}
+	}
+	f.Add([]byte(`{"apiVersion":"enforce.k8s.io/v1alpha1","kind":"ExecPolicy","metadata":{"name":"p"},"spec":{"noExec":["/tmp/"]}}`), "/tmp/x")
+
+	f.Fuzz(func(t *testing.T, data []byte, name string) {
+		set, err := Load(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		for _, p := range set.Policies {
+			req := &Request{Path: name, Baseline: BaselineUnknown, ProcessExe: name, Interpreter: name, Writable: name}
+			p.Evaluate(req)
+			p.Excludes(name)
+			p.EvaluateNoExec(name)
+		}
+	})
+}
+
+// FuzzInDir checks that a path is only below the directories it is under once cleaned, whatever the mount
+// destinations look like.
+func FuzzInDir(f *testing.F) {
+	f.Add("/data/file", "/data")
+	f.Add("/database", "/data")
+	f.Add("/data", "/data/")
+	f.Add("/usr/bin/sh", "/")
+	f.Add("/data/../etc/passwd", "/data")
+
+	f.Fuzz(func(t *testing.T, name, dir string) {
+		if !strings.HasPrefix(name, "/") || !strings.HasPrefix(dir, "/") {
+			return
+		}
+
+		in := InDir(name, dir)
+		name, dir = path.Clean(name), path.Clean(dir)
+
+		rel := strings.TrimPrefix(name, dir)
+		expected := strings.HasPrefix(name, dir) && (dir == "/" || rel == "" || rel[0] == '/')
+		if in != expected {
+			t.Errorf("InDir(%q, %q) = %v", name, dir, in)
+		}
+	})
+}
@@ -0,0 +1,80 @@
+package policy
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const NamespaceDefaultKind = "NamespaceDefault"
+
+// NamespaceDefault enforces all the pods of its namespace, even without the enforcement label. The pods selected by an
+// ExecPolicy use that one instead.
+type NamespaceDefault struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec NamespaceDefaultSpec `json:"spec"`
+}
+
+type NamespaceDefaultSpec struct {
+	// Policy is the name of the ExecPolicy applied to the pods, if it is not set they are only verified against the
+	// baseline.
+	Policy string `json:"policy,omitempty"`
+
+	// Mode overrides the mode of the policy, so a namespace can be audited before it is enforced.
+	Mode Mode `json:"mode,omitempty"`
+}
+
+// Validate checks that the namespace default can be applied.
+func (d *NamespaceDefault) Validate() error {
+	if d.APIVersion != APIVersion || d.Kind != NamespaceDefaultKind {
+		return fmt.Errorf("unsupported object %s, %s", d.APIVersion, d.Kind)
+	}
+
+	if d.Name == "" {
+		return fmt.Errorf("no name")
+	}
+
+	if d.Namespace == "" {
+		return fmt.Errorf("no namespace")
+	}
+
+	switch d.Spec.Mode {
+	case "", ModeEnforce, ModeAudit:
+	default:
+		return fmt.Errorf("unknown mode %q", d.Spec.Mode)
+	}
+
+	return nil
+}
+
+// Namespaces returns the namespaces which have a default, all of their pods are enforced.
+func (s *Set) Namespaces() []string {
+	namespaces := []string{}
+	for _, d := range s.NamespaceDefaults {
+		namespaces = append(namespaces, d.Namespace)
+	}
+
+	return namespaces
+}
+
+func (s *Set) namespaceDefaultPolicy(d *NamespaceDefault) *ExecPolicy {
+	p := Default
+	if d.Spec.Policy != "" {
+		// This was already validated when loading.
+		if p = s.Get(d.Namespace, d.Spec.Policy); p == nil {
+			p = Default
+		}
+	}
+
+	if d.Spec.Mode == "" {
+		return p
+	}
+
+	// Don't change the policy, it can be applied to other pods too.
+	withMode := *p
+	withMode.Spec.Mode = d.Spec.Mode
+
+	return &withMode
+}
@@ -0,0 +1,98 @@
+package policy
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+// CheckOverlaps returns an error if the policy can select the same pods as one of the others. Only the first policy by
+// name is applied to a pod, so overlapping policies are most likely a mistake.
+func CheckOverlaps(p *ExecPolicy, others []*ExecPolicy) error {
+	// The shadow policies don't select pods.
+	if p.Spec.Shadows != "" {
+		return nil
+	}
+
+	for _, other := range others {
+		if other.Name == p.Name && other.Namespace == p.Namespace {
+			// This is the object being updated.
+			continue
+		}
+
+		if other.Spec.Shadows != "" {
+			continue
+		}
+
+		overlap, err := Overlaps(p, other)
+		if err != nil {
+			return err
+		}
+
+		if overlap {
+			return fmt.Errorf("pod selector overlaps with the one of policy %q", other.Name)
+		}
+	}
+
+	return nil
+}
+
+// Overlaps tells if there can be a pod selected by both policies. It is conservative, selectors are only considered
+// disjoint if a requirement of one contradicts a requirement of the other on the same label.
+func Overlaps(a, b *ExecPolicy) (bool, error) {
+	if a.Namespace != "" && b.Namespace != "" && a.Namespace != b.Namespace {
+		return false, nil
+	}
+
+	reqsA, err := requirements(a.Spec.PodSelector)
+	if err != nil {
+		return false, fmt.Errorf("policy %q: %w", a.Name, err)
+	}
+
+	reqsB, err := requirements(b.Spec.PodSelector)
+	if err != nil {
+		return false, fmt.Errorf("policy %q: %w", b.Name, err)
+	}
+
+	for _, reqA := range reqsA {
+		for _, reqB := range reqsB {
+			if reqA.Key() == reqB.Key() && (contradicts(reqA, reqB) || contradicts(reqB, reqA)) {
+				return false, nil
+			}
+		}
+	}
+
+	return true, nil
+}
+
+func requirements(selector *metav1.LabelSelector) (labels.Requirements, error) {
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pod selector: %w", err)
+	}
+
+	reqs, _ := s.Requirements()
+	return reqs, nil
+}
+
+// contradicts tells if no label value can satisfy both requirements, which are on the same key.
+func contradicts(a, b labels.Requirement) bool {
+	switch a.Operator() {
+	case selection.In, selection.Equals, selection.DoubleEquals:
+		switch b.Operator() {
+		case selection.In, selection.Equals, selection.DoubleEquals:
+			return a.Values().Intersection(b.Values()).Len() == 0
+		case selection.NotIn, selection.NotEquals:
+			return b.Values().IsSuperset(a.Values())
+		case selection.DoesNotExist:
+			return true
+		}
+
+	case selection.Exists:
+		return b.Operator() == selection.DoesNotExist
+	}
+
+	return false
+}
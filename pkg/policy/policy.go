@@ -0,0 +1,618 @@
+// Package policy has the execution policies applied to the enforced containers and the logic to evaluate them.
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+const (
+	APIVersion = "enforce.k8s.io/v1alpha1"
+	Kind       = "ExecPolicy"
+
+	// PolicyAnnotation binds a pod to the policy with the given name, whatever the selectors of the policies are. The
+	// pod is enforced even without the enforcement label.
+	PolicyAnnotation = "enforce.k8s.io/policy"
+)
+
+type Mode string
+
+const (
+	// ModeEnforce denies the executions.
+	ModeEnforce Mode = "enforce"
+	// ModeAudit allows everything, the executions which should be denied are only logged.
+	ModeAudit Mode = "audit"
+)
+
+// FailureMode is how the executions of files which can't be verified are answered, e.g. when hashing fails or
+// misses the response deadline.
+type FailureMode string
+
+const (
+	// FailClosed denies the executions.
+	FailClosed FailureMode = "closed"
+	// FailOpen allows the executions, they are audited.
+	FailOpen FailureMode = "open"
+)
+
+// UpdateMode is how the baseline follows the executables written in the container after it was computed.
+type UpdateMode string
+
+const (
+	// UpdateFlag removes the written files from the baseline, their executions are reported as modified even if
+	// their content is restored.
+	UpdateFlag UpdateMode = "flag"
+	// UpdateTrust adds the written files to the baseline, so they can be run like the original ones.
+	UpdateTrust UpdateMode = "trust"
+)
+
+type Action string
+
+const (
+	// ActionVerify allows the execution only if the file is part of the container baseline and is not modified.
+	ActionVerify Action = "verify"
+	// ActionAllow allows the execution without looking at the baseline.
+	ActionAllow Action = "allow"
+	// ActionDeny denies the execution.
+	ActionDeny Action = "deny"
+)
+
+// VolumeAction is how the executions of the files of a volume are enforced.
+type VolumeAction string
+
+const (
+	// VolumeIgnore does not enforce the volume, the executions of its files are allowed without being hashed.
+	VolumeIgnore VolumeAction = "ignore"
+	// VolumeBaseline walks the volume with the rootfs, its executables are part of the baseline of the container.
+	VolumeBaseline VolumeAction = "baseline"
+	// VolumeDeny denies all the executions of the files of the volume.
+	VolumeDeny VolumeAction = "deny"
+)
+
+// volumeTypes are the types of volume the volume rules can match, named after the fields of the volume sources.
+var volumeTypes = []string{
+	"hostPath", "persistentVolumeClaim", "emptyDir", "configMap", "secret", "projected", "downwardAPI", "csi",
+	"ephemeral", "nfs", "other",
+}
+
+// ExecPolicy decides which executions are allowed in the pods it selects.
+type ExecPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ExecPolicySpec `json:"spec"`
+}
+
+// EphemeralMode is how the policy is applied to the ephemeral containers added with kubectl debug.
+type EphemeralMode string
+
+const (
+	// EphemeralInherit applies the policy like for any other container of the pod.
+	EphemeralInherit EphemeralMode = "inherit"
+	// EphemeralAudit evaluates the policy but allows everything, the denials are only logged.
+	EphemeralAudit EphemeralMode = "audit"
+	// EphemeralDeny denies all the executions.
+	EphemeralDeny EphemeralMode = "deny"
+)
+
+type ExecPolicySpec struct {
+	// PodSelector selects the enforced pods this policy applies to. If it is not set all of them are selected. If
+	// the policy has a namespace only the pods in it are selected.
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+
+	// Mode is enforce by default.
+	Mode Mode `json:"mode,omitempty"`
+
+	// Canary only enforces the policy on part of the pods it selects, the others are audited. It only applies in
+	// enforce mode.
+	Canary *Canary `json:"canary,omitempty"`
+
+	// Shadows is the name of the policy this one is a shadow of: it is evaluated on the executions of the pods of that
+	// policy, which still decides, and the decisions it would take differently are reported. A shadow policy does not
+	// select pods itself, its pod selector is ignored.
+	Shadows string `json:"shadows,omitempty"`
+
+	// EphemeralContainers is how the ephemeral containers of the pod are handled, inherit by default.
+	EphemeralContainers EphemeralMode `json:"ephemeralContainers,omitempty"`
+
+	// FailureMode is closed by default.
+	FailureMode FailureMode `json:"failureMode,omitempty"`
+
+	// BaselineUpdates is not set by default: the baseline is not updated and the written files are only found to be
+	// modified when they are run.
+	BaselineUpdates UpdateMode `json:"baselineUpdates,omitempty"`
+
+	// Exclude are globs of paths inside the container which are not enforced, for directories with a lot of
+	// changing executables like JIT caches. The executions of these files are allowed without being hashed, and the
+	// ones of the files given without wildcards are not even reported by the kernel.
+	Exclude []string `json:"exclude,omitempty"`
+
+	// Rules are evaluated in order and the first one matching an execution decides on it. If none matches the
+	// execution is verified against the baseline.
+	Rules []Rule `json:"rules,omitempty"`
+
+	// ServiceAccountToken protects the service account token mounted in the containers from the other programs of
+	// the container, so it can't be exfiltrated with tools like curl or a shell. It is not protected when not set.
+	ServiceAccountToken *TokenProtection `json:"serviceAccountToken,omitempty"`
+
+	// ProtectReads are evaluated in order and the first one matching the file read decides on it. The files matching
+	// none can be read by anything.
+	ProtectReads []ReadRule `json:"protectReads,omitempty"`
+
+	// ImmutableRootfs denies the opens for writing of the files of the rootfs, the ones coming from the image, as if
+	// the container had a read-only root filesystem. The volumes and the tmpfs mounts can still be written.
+	ImmutableRootfs bool `json:"immutableRootfs,omitempty"`
+
+	// RemountReadOnly remounts the rootfs of the containers read-only once their pod is ready, and the given mounts
+	// too. Unlike ImmutableRootfs it is enforced by the mounts, the files can't be deleted or renamed either. It can be
+	// reverted through the admin API.
+	RemountReadOnly *ReadOnlyRemount `json:"remountReadOnly,omitempty"`
+
+	// Volumes are evaluated in order and the first one matching a volume of the container decides how it is enforced.
+	// The volumes matching none are enforced without being part of the baseline, so their executables are unknown.
+	Volumes []VolumeRule `json:"volumes,omitempty"`
+
+	// NoExec are the mounts of the container where nothing can be run, like if they were mounted noexec, for the
+	// volumes which can't be. They are destinations in the container, like /data.
+	NoExec []string `json:"noExec,omitempty"`
+
+	// Binaries are checks on the headers of the executed binaries, evaluated before the rules.
+	Binaries *BinaryChecks `json:"binaries,omitempty"`
+
+	// AllowWritableExec lets the rules decide on the executions of the files in the locations anything can write to,
+	// on a tmpfs or below a world-writable directory like /tmp. They are denied by default whatever their hash.
+	AllowWritableExec bool `json:"allowWritableExec,omitempty"`
+}
+
+// BinaryChecks deny the executed binaries which look like they were dropped into the container.
+type BinaryChecks struct {
+	// DenyForeignArch denies the ELF binaries built for another architecture than the one of the node, even the ones
+	// of the baseline.
+	DenyForeignArch bool `json:"denyForeignArch,omitempty"`
+
+	// DenyUnknownStatic denies the statically linked ELF binaries which don't match the baseline, even when a rule
+	// allows them.
+	DenyUnknownStatic bool `json:"denyUnknownStatic,omitempty"`
+}
+
+// VolumeRule matches a volume mounted in the container if all of its set fields match.
+type VolumeRule struct {
+	Name   string       `json:"name,omitempty"`
+	Action VolumeAction `json:"action"`
+
+	// Volumes are globs matched against the name of the volume in the pod.
+	Volumes []string `json:"volumes,omitempty"`
+
+	// Types are the types of the volume, like hostPath, persistentVolumeClaim or emptyDir.
+	Types []string `json:"types,omitempty"`
+
+	// MountPaths are globs matched against where the volume is mounted in the container.
+	MountPaths []string `json:"mountPaths,omitempty"`
+}
+
+// Canary rolls the policy out to a percentage of the pods it selects.
+type Canary struct {
+	// Percent is the percentage of the selected pods the policy is enforced on. The pods are chosen by a stable hash
+	// of their UID, so the pods enforced stay enforced when it grows.
+	Percent int `json:"percent"`
+}
+
+// ReadOnlyRemount lists the mounts remounted read-only besides the rootfs.
+type ReadOnlyRemount struct {
+	// Mounts are the destinations of the mounts in the container, like /data.
+	Mounts []string `json:"mounts,omitempty"`
+}
+
+// ReadRule only lets the given programs read the files, like the secrets of the application.
+type ReadRule struct {
+	Name string `json:"name,omitempty"`
+
+	// Paths are globs of the protected files inside the container, like /etc/shadow or /app/secrets/*. A glob ending
+	// in "/**" matches everything below the directory.
+	Paths []string `json:"paths"`
+
+	// Processes are globs matched against the executable of the process reading the files, as seen in the container.
+	// The files can't be read at all without them.
+	Processes []string `json:"processes,omitempty"`
+}
+
+// TokenProtection only lets the given programs read the service account token.
+type TokenProtection struct {
+	// Processes are globs matched against the executable of the process opening the token, as seen in the
+	// container, like /app/server.
+	Processes []string `json:"processes"`
+}
+
+// Rule matches an execution if all of its set fields match.
+type Rule struct {
+	Name   string `json:"name,omitempty"`
+	Action Action `json:"action"`
+
+	// Paths are globs matched against the path of the executed file inside the container. A glob ending in "/**"
+	// matches everything below the directory.
+	Paths []string `json:"paths,omitempty"`
+
+	// Processes are globs matched against the executable of the process calling exec, which is still the program
+	// that spawned the new one, e.g. /bin/sh for anything run from a shell.
+	Processes []string `json:"processes,omitempty"`
+
+	// Parents are globs matched against the executable of the parent of the process calling exec.
+	Parents []string `json:"parents,omitempty"`
+
+	// Interpreters are globs matched against the interpreter of the executed script, from its shebang, like
+	// /usr/bin/python3. The rule does not match the executions of binaries then.
+	Interpreters []string `json:"interpreters,omitempty"`
+
+	// UIDs and GIDs match the effective ids of the process calling exec, as seen inside the container.
+	UIDs []uint32 `json:"uids,omitempty"`
+	GIDs []uint32 `json:"gids,omitempty"`
+
+	// ExecSession matches executions coming from a kubectl exec session (or anything else started with runc exec)
+	// when true, and executions from the container's own process tree when false.
+	ExecSession *bool `json:"execSession,omitempty"`
+
+	// Interactive matches executions whose process has a controlling terminal or a terminal as stdin when true, like
+	// the shells of kubectl exec -it.
+	Interactive *bool `json:"interactive,omitempty"`
+}
+
+// Default is used for the pods not selected by any policy, it only verifies executions against the baseline.
+var Default = &ExecPolicy{
+	TypeMeta:   metav1.TypeMeta{APIVersion: APIVersion, Kind: Kind},
+	ObjectMeta: metav1.ObjectMeta{Name: "default"},
+}
+
+// Set holds all the objects read from the policy files.
+type Set struct {
+	Policies          []*ExecPolicy
+	NamespaceDefaults []*NamespaceDefault
+}
+
+// LoadFile reads all the objects from a YAML or JSON file, which can hold multiple documents.
+func LoadFile(path string) (*Set, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening file: %w", err)
+	}
+	defer f.Close()
+
+	return Load(f)
+}
+
+// Load reads all the objects from a YAML or JSON stream.
+func Load(r io.Reader) (*Set, error) {
+	set := &Set{}
+	decoder := yaml.NewYAMLOrJSONDecoder(r, 4096)
+
+	for {
+		var doc json.RawMessage
+		if err := decoder.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return nil, fmt.Errorf("decoding document: %w", err)
+		}
+
+		typeMeta := &metav1.TypeMeta{}
+		if err := json.Unmarshal(doc, typeMeta); err != nil {
+			return nil, fmt.Errorf("decoding document type: %w", err)
+		}
+
+		switch typeMeta.Kind {
+		// Empty documents.
+		case "":
+			continue
+
+		case Kind:
+			p := &ExecPolicy{}
+			if err := json.Unmarshal(doc, p); err != nil {
+				return nil, fmt.Errorf("decoding policy: %w", err)
+			}
+
+			if err := p.Validate(); err != nil {
+				return nil, fmt.Errorf("validating policy %q: %w", p.Name, err)
+			}
+
+			set.Policies = append(set.Policies, p)
+
+		case NamespaceDefaultKind:
+			d := &NamespaceDefault{}
+			if err := json.Unmarshal(doc, d); err != nil {
+				return nil, fmt.Errorf("decoding namespace default: %w", err)
+			}
+
+			if err := d.Validate(); err != nil {
+				return nil, fmt.Errorf("validating namespace default %q: %w", d.Name, err)
+			}
+
+			set.NamespaceDefaults = append(set.NamespaceDefaults, d)
+
+		default:
+			return nil, fmt.Errorf("unsupported object %s, %s", typeMeta.APIVersion, typeMeta.Kind)
+		}
+	}
+
+	sort.Slice(set.Policies, func(i, j int) bool {
+		return set.Policies[i].Name < set.Policies[j].Name
+	})
+
+	for _, d := range set.NamespaceDefaults {
+		if d.Spec.Policy != "" && set.Get(d.Namespace, d.Spec.Policy) == nil {
+			return nil, fmt.Errorf("policy %q of namespace default %s/%s not found", d.Spec.Policy, d.Namespace, d.Name)
+		}
+	}
+
+	return set, nil
+}
+
+// Validate checks that the policy can be evaluated.
+func (p *ExecPolicy) Validate() error {
+	if p.APIVersion != APIVersion || p.Kind != Kind {
+		return fmt.Errorf("unsupported object %s, %s", p.APIVersion, p.Kind)
+	}
+
+	if p.Name == "" {
+		return fmt.Errorf("no name")
+	}
+
+	if _, err := metav1.LabelSelectorAsSelector(p.Spec.PodSelector); err != nil {
+		return fmt.Errorf("invalid pod selector: %w", err)
+	}
+
+	switch p.Spec.Mode {
+	case "", ModeEnforce, ModeAudit:
+	default:
+		return fmt.Errorf("unknown mode %q", p.Spec.Mode)
+	}
+
+	if c := p.Spec.Canary; c != nil && (c.Percent < 0 || c.Percent > 100) {
+		return fmt.Errorf("canary percentage %d not between 0 and 100", c.Percent)
+	}
+
+	if p.Spec.Shadows == p.Name {
+		return fmt.Errorf("policy shadows itself")
+	}
+
+	switch p.Spec.EphemeralContainers {
+	case "", EphemeralInherit, EphemeralAudit, EphemeralDeny:
+	default:
+		return fmt.Errorf("unknown ephemeral containers mode %q", p.Spec.EphemeralContainers)
+	}
+
+	switch p.Spec.FailureMode {
+	case "", FailClosed, FailOpen:
+	default:
+		return fmt.Errorf("unknown failure mode %q", p.Spec.FailureMode)
+	}
+
+	switch p.Spec.BaselineUpdates {
+	case "", UpdateFlag, UpdateTrust:
+	default:
+		return fmt.Errorf("unknown baseline updates mode %q", p.Spec.BaselineUpdates)
+	}
+
+	for _, glob := range p.Spec.Exclude {
+		if _, err := path.Match(glob, ""); err != nil || !path.IsAbs(glob) {
+			return fmt.Errorf("invalid exclude glob %q", glob)
+		}
+	}
+
+	if token := p.Spec.ServiceAccountToken; token != nil {
+		for _, glob := range token.Processes {
+			if _, err := path.Match(glob, ""); err != nil {
+				return fmt.Errorf("service account token: invalid glob %q: %w", glob, err)
+			}
+		}
+	}
+
+	for i, rule := range p.Spec.ProtectReads {
+		if len(rule.Paths) == 0 {
+			return fmt.Errorf("read rule %d: no paths", i)
+		}
+
+		for _, glob := range rule.Paths {
+			if _, err := path.Match(glob, ""); err != nil || !path.IsAbs(glob) {
+				return fmt.Errorf("read rule %d: invalid path glob %q", i, glob)
+			}
+		}
+
+		for _, glob := range rule.Processes {
+			if _, err := path.Match(glob, ""); err != nil {
+				return fmt.Errorf("read rule %d: invalid glob %q: %w", i, glob, err)
+			}
+		}
+	}
+
+	if p.Spec.RemountReadOnly != nil {
+		for _, mnt := range p.Spec.RemountReadOnly.Mounts {
+			if !path.IsAbs(mnt) {
+				return fmt.Errorf("mount %q remounted read-only is not absolute", mnt)
+			}
+		}
+	}
+
+	for _, mnt := range p.Spec.NoExec {
+		if !path.IsAbs(mnt) {
+			return fmt.Errorf("noexec mount %q is not absolute", mnt)
+		}
+	}
+
+	for i, rule := range p.Spec.Volumes {
+		switch rule.Action {
+		case VolumeIgnore, VolumeBaseline, VolumeDeny:
+		default:
+			return fmt.Errorf("volume rule %d: unknown action %q", i, rule.Action)
+		}
+
+		for _, typ := range rule.Types {
+			if !contains(volumeTypes, typ) {
+				return fmt.Errorf("volume rule %d: unknown volume type %q", i, typ)
+			}
+		}
+
+		for _, glob := range rule.Volumes {
+			if _, err := path.Match(glob, ""); err != nil {
+				return fmt.Errorf("volume rule %d: invalid glob %q: %w", i, glob, err)
+			}
+		}
+
+		for _, glob := range rule.MountPaths {
+			if _, err := path.Match(glob, ""); err != nil || !path.IsAbs(glob) {
+				return fmt.Errorf("volume rule %d: invalid mount path glob %q", i, glob)
+			}
+		}
+	}
+
+	for i, rule := range p.Spec.Rules {
+		switch rule.Action {
+		case ActionVerify, ActionAllow, ActionDeny:
+		default:
+			return fmt.Errorf("rule %d: unknown action %q", i, rule.Action)
+		}
+
+		for _, globs := range [][]string{rule.Paths, rule.Processes, rule.Parents, rule.Interpreters} {
+			for _, glob := range globs {
+				if _, err := path.Match(glob, ""); err != nil {
+					return fmt.Errorf("rule %d: invalid glob %q: %w", i, glob, err)
+				}
+			}
+		}
+
+		// The executed files are matched with their absolute path in the container.
+		for _, glob := range rule.Paths {
+			if !path.IsAbs(glob) {
+				return fmt.Errorf("rule %d: path glob %q is not absolute", i, glob)
+			}
+		}
+	}
+
+	return nil
+}
+
+// FailsOpen tells if the executions of the files which can't be verified are allowed.
+func (p *ExecPolicy) FailsOpen() bool {
+	return p.Spec.FailureMode == FailOpen
+}
+
+// Selects tells if the policy applies to the pod.
+func (p *ExecPolicy) Selects(pod *v1.Pod) bool {
+	if p.Namespace != "" && p.Namespace != pod.Namespace {
+		return false
+	}
+
+	if p.Spec.PodSelector == nil {
+		return true
+	}
+
+	// This was already validated.
+	selector, err := metav1.LabelSelectorAsSelector(p.Spec.PodSelector)
+	if err != nil {
+		return false
+	}
+
+	return selector.Matches(labels.Set(pod.Labels))
+}
+
+// Select returns the policy the pod is bound to by annotation or, if there is none, the first policy, sorted by name,
+// which applies to the pod. If there is none the default of the pod namespace is used and if there is no default
+// either Default is returned.
+func (s *Set) Select(pod *v1.Pod) *ExecPolicy {
+	if p := s.Bound(pod); p != nil {
+		return p
+	}
+
+	for _, p := range s.Policies {
+		if p.Spec.Shadows == "" && p.Selects(pod) {
+			return p
+		}
+	}
+
+	for _, d := range s.NamespaceDefaults {
+		if d.Namespace == pod.Namespace {
+			return s.namespaceDefaultPolicy(d)
+		}
+	}
+
+	return Default
+}
+
+// Bound returns the policy named in the PolicyAnnotation of the pod, nil if there is no annotation or no such policy
+// for the namespace of the pod.
+func (s *Set) Bound(pod *v1.Pod) *ExecPolicy {
+	name := pod.Annotations[PolicyAnnotation]
+	if name == "" {
+		return nil
+	}
+
+	p := s.Get(pod.Namespace, name)
+	if p != nil && p.Spec.Shadows != "" {
+		// The shadows don't select any pod, the cluster-wide policy they shadow does.
+		p = s.Get("", name)
+	}
+	if p == nil || p.Spec.Shadows != "" {
+		return nil
+	}
+
+	return p
+}
+
+// Shadow returns the first policy, sorted by name, which is a shadow of the policy of the pod, nil if there is none. A
+// shadow with a namespace only applies to the pods of that namespace.
+func (s *Set) Shadow(p *ExecPolicy, pod *v1.Pod) *ExecPolicy {
+	for _, shadow := range s.Policies {
+		if shadow.Spec.Shadows != p.Name {
+			continue
+		}
+
+		if shadow.Namespace != "" && shadow.Namespace != pod.Namespace {
+			continue
+		}
+
+		return shadow
+	}
+
+	return nil
+}
+
+// Get returns the policy with the given name which applies to the namespace: the one of the namespace, or else the
+// cluster-wide one. The policies of the other namespaces can have the same name.
+func (s *Set) Get(namespace, name string) *ExecPolicy {
+	var clusterWide *ExecPolicy
+	for _, p := range s.Policies {
+		if p.Name != name {
+			continue
+		}
+
+		if p.Namespace == namespace {
+			return p
+		}
+
+		if p.Namespace == "" && clusterWide == nil {
+			clusterWide = p
+		}
+	}
+
+	return clusterWide
+}
+
+// HasName tells if a policy of any namespace has the given name.
+func (s *Set) HasName(name string) bool {
+	for _, p := range s.Policies {
+		if p.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,80 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBound(t *testing.T) {
+	policy := func(namespace, name string, mode Mode) *ExecPolicy {
+		return &ExecPolicy{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}, Spec: ExecPolicySpec{Mode: mode}}
+	}
+
+	clusterWide := policy("", "strict", ModeEnforce)
+	ofA := policy("a", "strict", ModeAudit)
+	ofB := policy("b", "myapp", ModeEnforce)
+	shadow := &ExecPolicy{ObjectMeta: metav1.ObjectMeta{Namespace: "c", Name: "strict"}, Spec: ExecPolicySpec{Shadows: "strict"}}
+	set := &Set{Policies: []*ExecPolicy{ofB, ofA, shadow, clusterWide}}
+
+	tests := []struct {
+		name      string
+		namespace string
+		bound     string
+		policy    *ExecPolicy
+	}{
+		{name: "policy of the namespace", namespace: "a", bound: "strict", policy: ofA},
+		{name: "cluster-wide policy", namespace: "b", bound: "strict", policy: clusterWide},
+		{name: "only policy of the name", namespace: "b", bound: "myapp", policy: ofB},
+		{name: "policy of another namespace", namespace: "a", bound: "myapp"},
+		{name: "shadow in the namespace", namespace: "c", bound: "strict", policy: clusterWide},
+		{name: "unknown policy", namespace: "a", bound: "lax"},
+		{name: "no annotation", namespace: "a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: tt.namespace, Name: "web"}}
+			if tt.bound != "" {
+				pod.Annotations = map[string]string{PolicyAnnotation: tt.bound}
+			}
+
+			if p := set.Bound(pod); p != tt.policy {
+				t.Errorf("policy %v bound, expected %v", p, tt.policy)
+			}
+		})
+	}
+
+	if !set.HasName("myapp") || set.HasName("lax") {
+		t.Error("policies found by name in the wrong namespaces")
+	}
+}
+
+func TestValidateRules(t *testing.T) {
+	tests := []struct {
+		rule Rule
+		err  string
+	}{
+		{rule: Rule{Action: ActionAllow, Paths: []string{"/usr/bin/ls", "/app/**", "/bin/*sh"}}},
+		{rule: Rule{Action: ActionDeny, Processes: []string{"*/curl"}}},
+		{rule: Rule{Action: ActionAllow, Paths: []string{"usr/bin/ls"}}, err: `rule 0: path glob "usr/bin/ls" is not absolute`},
+		{rule: Rule{Action: ActionAllow, Paths: []string{"*"}}, err: `rule 0: path glob "*" is not absolute`},
+		{rule: Rule{Action: ActionAllow, Paths: []string{"/bin/[a"}}, err: `rule 0: invalid glob "/bin/[a"`},
+		{rule: Rule{Action: "trust"}, err: `rule 0: unknown action "trust"`},
+	}
+
+	for _, tt := range tests {
+		p := &ExecPolicy{
+			TypeMeta:   metav1.TypeMeta{APIVersion: APIVersion, Kind: Kind},
+			ObjectMeta: metav1.ObjectMeta{Name: "p"},
+			Spec:       ExecPolicySpec{Rules: []Rule{tt.rule}},
+		}
+
+		err := p.Validate()
+		if (err == nil) != (tt.err == "") || (err != nil && !strings.HasPrefix(err.Error(), tt.err)) {
+			t.Errorf("rule %+v: error %v, expected %q", tt.rule, err, tt.err)
+		}
+	}
+}
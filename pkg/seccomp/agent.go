@@ -0,0 +1,183 @@
+package seccomp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// OrphanTimeout is how long the notification FD of a container waits to be taken before its executions are all
+// allowed, for the containers using the profile without being enforced.
+const OrphanTimeout = time.Minute
+
+// maxStateSize bounds the container process state sent by the runtime.
+const maxStateSize = 64 * 1024
+
+// Agent receives the notification FDs of the containers from the runtime, on the listener path of their seccomp
+// profile.
+type Agent struct {
+	lock  sync.Mutex
+	slots map[string]chan *Listener
+}
+
+func NewAgent() *Agent {
+	return &Agent{
+		slots: map[string]chan *Listener{},
+	}
+}
+
+// Run accepts the connections of the runtime until the listener fails.
+func (a *Agent) Run(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("creating seccomp socket directory: %w", err)
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("removing seccomp socket: %w", err)
+	}
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return fmt.Errorf("listening on seccomp socket: %w", err)
+	}
+	defer l.Close()
+
+	if err := os.Chmod(path, 0o600); err != nil {
+		return fmt.Errorf("setting seccomp socket mode: %w", err)
+	}
+
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return fmt.Errorf("accepting seccomp connection: %w", err)
+		}
+
+		go func() {
+			if err := a.receive(conn); err != nil {
+				log.Errorf("Receiving seccomp notification FD: %v", err)
+			}
+		}()
+	}
+}
+
+func (a *Agent) receive(conn *net.UnixConn) error {
+	defer conn.Close()
+
+	buf := make([]byte, maxStateSize)
+	oob := make([]byte, unix.CmsgSpace(4*4))
+
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return fmt.Errorf("reading message: %w", err)
+	}
+
+	fds := []int{}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return fmt.Errorf("parsing control message: %w", err)
+	}
+
+	for _, msg := range msgs {
+		rights, err := unix.ParseUnixRights(&msg)
+		if err == nil {
+			fds = append(fds, rights...)
+		}
+	}
+
+	var state specs.ContainerProcessState
+	if err := json.Unmarshal(buf[:n], &state); err != nil {
+		closeAll(fds)
+		return fmt.Errorf("decoding container process state: %w", err)
+	}
+
+	fd := -1
+	for i, name := range state.Fds {
+		if name == specs.SeccompFdName && i < len(fds) {
+			fd = fds[i]
+			fds = append(fds[:i:i], fds[i+1:]...)
+			break
+		}
+	}
+	closeAll(fds)
+
+	if fd < 0 {
+		return fmt.Errorf("no %s of container %s", specs.SeccompFdName, state.State.ID)
+	}
+
+	log.Debugf("Received the seccomp notification FD of container %s", state.State.ID)
+	a.add(state.State.ID, newListener(fd))
+
+	return nil
+}
+
+func (a *Agent) slot(id string) chan *Listener {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	ch, ok := a.slots[id]
+	if !ok {
+		ch = make(chan *Listener, 1)
+		a.slots[id] = ch
+	}
+
+	return ch
+}
+
+func (a *Agent) release(id string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	delete(a.slots, id)
+}
+
+func (a *Agent) add(id string, l *Listener) {
+	ch := a.slot(id)
+
+	select {
+	case ch <- l:
+	default:
+		log.Errorf("Container %s already has a seccomp notification FD", id)
+		l.Close()
+		return
+	}
+
+	go func() {
+		time.Sleep(OrphanTimeout)
+
+		select {
+		case orphan := <-ch:
+			a.release(id)
+			log.Warnf("Nothing took the seccomp notification FD of container %s, allowing all its executions", id)
+			orphan.AllowAll()
+		default:
+		}
+	}()
+}
+
+// Take returns the listener of the container, waiting for the runtime to send it.
+func (a *Agent) Take(id string, timeout time.Duration) (*Listener, error) {
+	ch := a.slot(id)
+
+	select {
+	case l := <-ch:
+		a.release(id)
+		return l, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("no seccomp notification FD for container %s after %s", id, timeout)
+	}
+}
+
+func closeAll(fds []int) {
+	for _, fd := range fds {
+		unix.Close(fd)
+	}
+}
@@ -0,0 +1,50 @@
+package seccomp
+
+import (
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Syscalls are the intercepted syscalls.
+var Syscalls = []string{"execve", "execveat"}
+
+// Profile returns the seccomp profile sending the executions to the agent listening on path. The rules of the base
+// profile are kept, but the executions are only notified.
+func Profile(base *specs.LinuxSeccomp, path string) *specs.LinuxSeccomp {
+	p := &specs.LinuxSeccomp{DefaultAction: specs.ActAllow}
+	if base != nil {
+		*p = *base
+		p.Syscalls = nil
+
+		for _, rule := range base.Syscalls {
+			names := []string{}
+			for _, name := range rule.Names {
+				if !intercepted(name) {
+					names = append(names, name)
+				}
+			}
+
+			if len(names) > 0 {
+				rule.Names = names
+				p.Syscalls = append(p.Syscalls, rule)
+			}
+		}
+	}
+
+	p.ListenerPath = path
+	p.Syscalls = append(p.Syscalls, specs.LinuxSyscall{
+		Names:  Syscalls,
+		Action: specs.ActNotify,
+	})
+
+	return p
+}
+
+func intercepted(name string) bool {
+	for _, syscall := range Syscalls {
+		if name == syscall {
+			return true
+		}
+	}
+
+	return false
+}
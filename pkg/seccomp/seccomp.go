@@ -0,0 +1,274 @@
+// Package seccomp intercepts the executions of the containers with seccomp user notifications. The seccomp profile
+// of the containers makes execve and execveat wait for an answer, and the runtime sends the notification FD of every
+// container to the agent.
+//
+// Unlike fanotify, the path is resolved again by the kernel once the execution is allowed, so a process of the
+// container could replace the file in between.
+package seccomp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The ioctls of the notification FD, see include/uapi/linux/seccomp.h.
+const (
+	ioctlNotifRecv    = 0xc0502100
+	ioctlNotifSend    = 0xc0182101
+	ioctlNotifIDValid = 0x40082102
+
+	// userNotifFlagContinue lets the kernel run the syscall, it needs Linux 5.5.
+	userNotifFlagContinue = 0x1
+)
+
+// pollTimeout is how often the listeners check if they were closed while waiting for notifications.
+const pollTimeout = 1000
+
+// ErrClosed is returned once the listener is closed or all the processes of the container exited.
+var ErrClosed = errors.New("listener closed")
+
+type seccompData struct {
+	nr                 int32
+	arch               uint32
+	instructionPointer uint64
+	args               [6]uint64
+}
+
+type notif struct {
+	id    uint64
+	pid   uint32
+	flags uint32
+	data  seccompData
+}
+
+type notifResp struct {
+	id    uint64
+	val   int64
+	error int32
+	flags uint32
+}
+
+// Request is an execution waiting for its answer.
+type Request struct {
+	id uint64
+
+	PID int
+	// Path is the executed file inside the container.
+	Path string
+}
+
+// Listener gets the executions of a container.
+type Listener struct {
+	fd int
+
+	lock   sync.Mutex
+	closed bool
+}
+
+func newListener(fd int) *Listener {
+	return &Listener{fd: fd}
+}
+
+// Receive waits for the next execution.
+func (l *Listener) Receive() (*Request, error) {
+	for {
+		if l.isClosed() {
+			return nil, ErrClosed
+		}
+
+		fds := []unix.PollFd{{Fd: int32(l.fd), Events: unix.POLLIN}}
+		if _, err := unix.Poll(fds, pollTimeout); err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+
+			return nil, fmt.Errorf("polling notifications: %w", err)
+		}
+
+		if fds[0].Revents&unix.POLLHUP != 0 {
+			return nil, ErrClosed
+		}
+
+		if fds[0].Revents&unix.POLLIN == 0 {
+			continue
+		}
+
+		var n notif
+		if err := ioctl(l.fd, ioctlNotifRecv, unsafe.Pointer(&n)); err != nil {
+			// The process was killed meanwhile.
+			if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.EINTR) {
+				continue
+			}
+
+			return nil, fmt.Errorf("receiving notification: %w", err)
+		}
+
+		req, err := l.request(&n)
+		if err != nil {
+			// It can't be verified.
+			l.respond(n.id, false, unix.EPERM)
+			return nil, err
+		}
+
+		if req != nil {
+			return req, nil
+		}
+	}
+}
+
+// request reads the executed path from the memory of the process, it is nil when the process is gone.
+func (l *Listener) request(n *notif) (*Request, error) {
+	pid := int(n.pid)
+
+	var dirFD int64 = unix.AT_FDCWD
+	var pathAddr uintptr
+	var flags uint64
+
+	switch n.data.nr {
+	case unix.SYS_EXECVE:
+		pathAddr = uintptr(n.data.args[0])
+	case unix.SYS_EXECVEAT:
+		dirFD = int64(int32(n.data.args[0]))
+		pathAddr = uintptr(n.data.args[1])
+		flags = n.data.args[4]
+	default:
+		// Like the executions of 32 bits programs, the syscall numbers are different.
+		return nil, fmt.Errorf("unsupported syscall %d of architecture %#x", n.data.nr, n.data.arch)
+	}
+
+	path, err := readString(pid, pathAddr)
+	if err != nil {
+		return nil, fmt.Errorf("reading executed path: %w", err)
+	}
+
+	// The memory could belong to another process if it was killed and the PID reused.
+	if err := ioctl(l.fd, ioctlNotifIDValid, unsafe.Pointer(&n.id)); err != nil {
+		return nil, nil
+	}
+
+	if !filepath.IsAbs(path) {
+		// The path is relative to the working directory, or to the FD of execveat. It is the FD itself with
+		// AT_EMPTY_PATH, for fexecve.
+		link := fmt.Sprintf("/proc/%d/cwd", pid)
+		if dirFD != unix.AT_FDCWD {
+			link = fmt.Sprintf("/proc/%d/fd/%d", pid, dirFD)
+		}
+
+		dir, err := os.Readlink(link)
+		if err != nil {
+			return nil, fmt.Errorf("resolving executed path: %w", err)
+		}
+
+		if path == "" && flags&unix.AT_EMPTY_PATH != 0 {
+			path = dir
+		} else {
+			path = filepath.Join(dir, path)
+		}
+	}
+
+	return &Request{id: n.id, PID: pid, Path: filepath.Clean(path)}, nil
+}
+
+// Respond answers the execution, errno is what the denied execution fails with.
+func (l *Listener) Respond(req *Request, allow bool, errno unix.Errno) error {
+	return l.respond(req.id, allow, errno)
+}
+
+func (l *Listener) respond(id uint64, allow bool, errno unix.Errno) error {
+	resp := notifResp{id: id}
+	if allow {
+		resp.flags = userNotifFlagContinue
+	} else {
+		resp.error = -int32(errno)
+	}
+
+	if err := ioctl(l.fd, ioctlNotifSend, unsafe.Pointer(&resp)); err != nil && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("answering notification: %w", err)
+	}
+
+	return nil
+}
+
+// AllowAll allows all the executions, for the containers which are not enforced, until the container exits.
+func (l *Listener) AllowAll() {
+	defer l.Close()
+
+	for {
+		var n notif
+		fds := []unix.PollFd{{Fd: int32(l.fd), Events: unix.POLLIN}}
+		if _, err := unix.Poll(fds, -1); err != nil && !errors.Is(err, unix.EINTR) {
+			return
+		}
+
+		if fds[0].Revents&unix.POLLHUP != 0 {
+			return
+		}
+
+		if err := ioctl(l.fd, ioctlNotifRecv, unsafe.Pointer(&n)); err == nil {
+			l.respond(n.id, true, 0)
+		}
+	}
+}
+
+func (l *Listener) isClosed() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.closed
+}
+
+// Close closes the notification FD, the waiting executions fail with ENOSYS and the next ones too.
+func (l *Listener) Close() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.closed {
+		l.closed = true
+		unix.Close(l.fd)
+	}
+}
+
+// readString reads the NUL terminated string at the address in the memory of the process.
+func readString(pid int, addr uintptr) (string, error) {
+	mem, err := os.Open(fmt.Sprintf("/proc/%d/mem", pid))
+	if err != nil {
+		return "", err
+	}
+	defer mem.Close()
+
+	buf := []byte{}
+	page := uintptr(os.Getpagesize())
+	for len(buf) < unix.PathMax {
+		// The next page may not be mapped.
+		chunk := make([]byte, page-addr%page)
+		n, err := mem.ReadAt(chunk, int64(addr))
+		if n == 0 && err != nil {
+			return "", err
+		}
+
+		for i := 0; i < n; i++ {
+			if chunk[i] == 0 {
+				return string(append(buf, chunk[:i]...)), nil
+			}
+		}
+
+		buf = append(buf, chunk[:n]...)
+		addr += uintptr(n)
+	}
+
+	return "", unix.ENAMETOOLONG
+}
+
+func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package simulate
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	"sigs.k8s.io/yaml"
+)
+
+// Fixture are synthetic executions with the decisions expected from the policies, to test the policies like code.
+type Fixture struct {
+	// Policy is the name of the policy the cases are evaluated with, unless they name another one.
+	Policy string `json:"policy,omitempty"`
+	// Namespace is where the policies are looked up, only the cluster-wide ones are without it.
+	Namespace string `json:"namespace,omitempty"`
+	Cases     []Case `json:"cases"`
+}
+
+// Case is a synthetic execution with the expected decision.
+type Case struct {
+	Name   string `json:"name,omitempty"`
+	Policy string `json:"policy,omitempty"`
+	// Request is what the policy is evaluated on, the file matches the baseline unless its baseline is set.
+	Request policy.Request `json:"request"`
+
+	// Expect is the expected verdict, Reason a part of the expected reason if it is set.
+	Expect events.Verdict `json:"expect"`
+	Reason string         `json:"reason,omitempty"`
+}
+
+// Failure is a case whose decision is not the expected one.
+type Failure struct {
+	Case    Case
+	Verdict events.Verdict
+	Reason  string
+}
+
+// LoadFixture reads a YAML or JSON fixture file.
+func LoadFixture(path string) (*Fixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading fixture: %w", err)
+	}
+
+	f := &Fixture{}
+	if err := yaml.UnmarshalStrict(data, f); err != nil {
+		return nil, fmt.Errorf("decoding fixture: %w", err)
+	}
+
+	for i, c := range f.Cases {
+		switch c.Expect {
+		case events.VerdictAllow, events.VerdictAudit, events.VerdictDeny:
+		default:
+			return nil, fmt.Errorf("case %s: unknown verdict %q expected", caseName(i, c), c.Expect)
+		}
+	}
+
+	return f, nil
+}
+
+// Test evaluates the cases with the policies and returns the ones which failed. It fails if a policy of the cases is
+// not in the set.
+func (f *Fixture) Test(policies *policy.Set) ([]Failure, error) {
+	failures := []Failure{}
+
+	for i, c := range f.Cases {
+		name := c.Policy
+		if name == "" {
+			name = f.Policy
+		}
+
+		p := policies.Get(f.Namespace, name)
+		if p == nil && (name == "" || name == policy.Default.Name) {
+			p = policy.Default
+		}
+
+		if p == nil {
+			return nil, fmt.Errorf("case %s: policy %q not found", caseName(i, c), name)
+		}
+
+		req := c.Request
+		decision := p.Evaluate(&req)
+		verdict := verdictOf(decision)
+
+		if verdict != c.Expect || !strings.Contains(decision.Reason, c.Reason) {
+			c.Name = caseName(i, c)
+			failures = append(failures, Failure{Case: c, Verdict: verdict, Reason: decision.Reason})
+		}
+	}
+
+	return failures, nil
+}
+
+func caseName(i int, c Case) string {
+	if c.Name != "" {
+		return c.Name
+	}
+
+	return fmt.Sprintf("#%d", i)
+}
@@ -0,0 +1,95 @@
+// Package simulate evaluates recorded executions against candidate policies, to know what a policy change would do
+// before rolling it out.
+package simulate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+)
+
+// Result is the outcome of the simulation.
+type Result struct {
+	Total int
+	// Skipped are the events which could not be evaluated again, because they did not come from a policy or their
+	// policy is not in the candidates.
+	Skipped int
+	// Verdicts counts the simulated verdicts.
+	Verdicts map[events.Verdict]int
+	Changes  []Change
+}
+
+// Change is an event which would have had another verdict with the candidate policies.
+type Change struct {
+	Event   events.Event
+	Verdict events.Verdict
+	Reason  string
+}
+
+// Simulator evaluates every event with the candidate policy of the same name or, if Policy is set, always with that
+// one.
+type Simulator struct {
+	Policies *policy.Set
+	Policy   string
+}
+
+// Run evaluates the events read from r, a stream of JSON objects like the event store files.
+func (s *Simulator) Run(r io.Reader, res *Result) error {
+	if res.Verdicts == nil {
+		res.Verdicts = make(map[events.Verdict]int)
+	}
+
+	dec := json.NewDecoder(r)
+	for {
+		e := events.Event{}
+		if err := dec.Decode(&e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("decoding event %d: %w", res.Total+1, err)
+		}
+
+		res.Total++
+		s.evaluate(&e, res)
+	}
+}
+
+func (s *Simulator) evaluate(e *events.Event, res *Result) {
+	name := s.Policy
+	if name == "" {
+		name = e.Policy
+	}
+
+	p := s.Policies.Get(e.Namespace, name)
+	if name == policy.Default.Name && p == nil {
+		p = policy.Default
+	}
+
+	if p == nil || e.Request == nil {
+		res.Skipped++
+		return
+	}
+
+	decision := p.Evaluate(e.Request)
+	verdict := verdictOf(decision)
+
+	res.Verdicts[verdict]++
+
+	if verdict != e.Verdict {
+		res.Changes = append(res.Changes, Change{Event: *e, Verdict: verdict, Reason: decision.Reason})
+	}
+}
+
+// verdictOf returns the verdict the agent answers the decision with.
+func verdictOf(decision policy.Decision) events.Verdict {
+	switch {
+	case !decision.Allow:
+		return events.VerdictDeny
+	case decision.Audited:
+		return events.VerdictAudit
+	}
+
+	return events.VerdictAllow
+}
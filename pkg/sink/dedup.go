@@ -0,0 +1,157 @@
+package sink
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+)
+
+// Dedup collapses the identical consecutive decisions of every container, on the same path with the same verdict and
+// access, taken within the window: the first one is reported right away, and the next ones are reported as one
+// summary with their count at the end of the window, or when the container takes a different decision.
+type Dedup struct {
+	window time.Duration
+	report func(e *events.Event)
+
+	lock sync.Mutex
+	// last are the last decisions reported of the containers, until their window ends.
+	last       map[string]*dedupState
+	suppressed int64
+
+	wg   sync.WaitGroup
+	done chan struct{}
+	// closed is set with the lock once the summaries were flushed, the decisions are reported as they are after.
+	closed bool
+}
+
+type dedupKey struct {
+	path    string
+	verdict events.Verdict
+	access  string
+}
+
+type dedupState struct {
+	key dedupKey
+	// start is when the window started, the time of the decision reported.
+	start time.Time
+	// since is the time of the first decision collapsed, latest the last one and count how many of them there are.
+	since  time.Time
+	latest *events.Event
+	count  int
+}
+
+// NewDedup starts collapsing the decisions given to report, until it is closed. A window of 0 reports all of them.
+func NewDedup(window time.Duration, report func(e *events.Event)) *Dedup {
+	d := &Dedup{
+		window: window,
+		report: report,
+		last:   make(map[string]*dedupState),
+		done:   make(chan struct{}),
+	}
+
+	if window > 0 {
+		d.wg.Add(1)
+		go d.run()
+	}
+
+	return d
+}
+
+// Report reports the decision, unless it is collapsed. It never blocks if the report callback doesn't.
+func (d *Dedup) Report(e *events.Event) {
+	if d.window <= 0 {
+		d.report(e)
+		return
+	}
+
+	key := dedupKey{path: e.Path, verdict: e.Verdict, access: e.Access}
+
+	// The callback is called with the lock held, so the decisions of a container are reported in order.
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.closed {
+		d.report(e)
+		return
+	}
+
+	st := d.last[e.ContainerID]
+	if st != nil && st.key == key && e.Time.Sub(st.start) < d.window {
+		if st.count == 0 {
+			st.since = e.Time
+		}
+		st.latest = e
+		st.count++
+		atomic.AddInt64(&d.suppressed, 1)
+		return
+	}
+
+	if st != nil {
+		d.flush(st)
+	}
+
+	d.last[e.ContainerID] = &dedupState{key: key, start: e.Time}
+	d.report(e)
+}
+
+// flush reports the summary of the decisions collapsed, if any.
+func (d *Dedup) flush(st *dedupState) {
+	if st.count == 0 {
+		return
+	}
+
+	summary := *st.latest
+	summary.Count = st.count
+	summary.Since = &st.since
+	d.report(&summary)
+}
+
+// run reports the summaries of the windows which ended.
+func (d *Dedup) run() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.window / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.done:
+			return
+		}
+
+		now := time.Now()
+
+		d.lock.Lock()
+		for cid, st := range d.last {
+			if now.Sub(st.start) >= d.window {
+				d.flush(st)
+				delete(d.last, cid)
+			}
+		}
+		d.lock.Unlock()
+	}
+}
+
+// Suppressed returns how many decisions were collapsed into summaries since the agent started.
+func (d *Dedup) Suppressed() int64 {
+	return atomic.LoadInt64(&d.suppressed)
+}
+
+// Close reports the summaries of the windows which did not end yet, the decisions reported after are not collapsed
+// anymore.
+func (d *Dedup) Close() {
+	close(d.done)
+	d.wg.Wait()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.closed = true
+	for cid, st := range d.last {
+		d.flush(st)
+		delete(d.last, cid)
+	}
+}
@@ -0,0 +1,166 @@
+package sink
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+)
+
+// reported collects the decisions reported by a Dedup.
+type reported struct {
+	lock   sync.Mutex
+	events []*events.Event
+}
+
+func (r *reported) report(e *events.Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.events = append(r.events, e)
+}
+
+// summary returns the decisions reported as cid:path:verdict, followed by their count when it is a summary.
+func (r *reported) summary() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	s := []string{}
+	for _, e := range r.events {
+		line := fmt.Sprintf("%s:%s:%s", e.ContainerID, e.Path, e.Verdict)
+		if e.Count > 0 {
+			line += fmt.Sprintf(" x%d", e.Count)
+		}
+		s = append(s, line)
+	}
+
+	return s
+}
+
+func TestDedup(t *testing.T) {
+	start := time.Now()
+	decision := func(cid, path string, verdict events.Verdict, after time.Duration) *events.Event {
+		return &events.Event{Time: start.Add(after), ContainerID: cid, Path: path, Verdict: verdict}
+	}
+
+	tests := []struct {
+		name       string
+		decisions  []*events.Event
+		reported   []string
+		suppressed int64
+	}{
+		{
+			name: "duplicates suppressed until closed",
+			decisions: []*events.Event{
+				decision("c1", "/bin/sh", events.VerdictDeny, 0),
+				decision("c1", "/bin/sh", events.VerdictDeny, time.Second),
+				decision("c1", "/bin/sh", events.VerdictDeny, 2*time.Second),
+			},
+			reported:   []string{"c1:/bin/sh:deny", "c1:/bin/sh:deny x2"},
+			suppressed: 2,
+		},
+		{
+			name: "another path ends the duplicates",
+			decisions: []*events.Event{
+				decision("c1", "/bin/sh", events.VerdictDeny, 0),
+				decision("c1", "/bin/sh", events.VerdictDeny, time.Second),
+				decision("c1", "/bin/ls", events.VerdictDeny, 2*time.Second),
+			},
+			reported:   []string{"c1:/bin/sh:deny", "c1:/bin/sh:deny x1", "c1:/bin/ls:deny"},
+			suppressed: 1,
+		},
+		{
+			name: "another verdict is not a duplicate",
+			decisions: []*events.Event{
+				decision("c1", "/bin/sh", events.VerdictDeny, 0),
+				decision("c1", "/bin/sh", events.VerdictAudit, time.Second),
+			},
+			reported: []string{"c1:/bin/sh:deny", "c1:/bin/sh:audit"},
+		},
+		{
+			name: "other containers are not duplicates",
+			decisions: []*events.Event{
+				decision("c1", "/bin/sh", events.VerdictDeny, 0),
+				decision("c2", "/bin/sh", events.VerdictDeny, time.Second),
+			},
+			reported: []string{"c1:/bin/sh:deny", "c2:/bin/sh:deny"},
+		},
+		{
+			name: "after the window",
+			decisions: []*events.Event{
+				decision("c1", "/bin/sh", events.VerdictDeny, 0),
+				decision("c1", "/bin/sh", events.VerdictDeny, time.Hour),
+				decision("c1", "/bin/sh", events.VerdictDeny, time.Hour+time.Second),
+			},
+			reported:   []string{"c1:/bin/sh:deny", "c1:/bin/sh:deny", "c1:/bin/sh:deny x1"},
+			suppressed: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &reported{}
+			d := NewDedup(time.Minute, r.report)
+
+			for _, e := range tt.decisions {
+				d.Report(e)
+			}
+			d.Close()
+
+			if got := r.summary(); fmt.Sprint(got) != fmt.Sprint(tt.reported) {
+				t.Errorf("reported %q, expected %q", got, tt.reported)
+			}
+			if d.Suppressed() != tt.suppressed {
+				t.Errorf("%d suppressed, expected %d", d.Suppressed(), tt.suppressed)
+			}
+		})
+	}
+}
+
+// TestDedupWindowExpiry checks that the summary is reported once the window ends, with the time of the first decision
+// collapsed.
+func TestDedupWindowExpiry(t *testing.T) {
+	r := &reported{}
+	d := NewDedup(20*time.Millisecond, r.report)
+	defer d.Close()
+
+	first := time.Now()
+	d.Report(&events.Event{Time: first, ContainerID: "c1", Path: "/bin/sh", Verdict: events.VerdictDeny})
+	second := &events.Event{Time: first.Add(time.Millisecond), ContainerID: "c1", Path: "/bin/sh", Verdict: events.VerdictDeny}
+	d.Report(second)
+	d.Report(&events.Event{Time: first.Add(2 * time.Millisecond), ContainerID: "c1", Path: "/bin/sh", Verdict: events.VerdictDeny})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.summary()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no summary reported at the end of the window: %q", r.summary())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	r.lock.Lock()
+	summary := r.events[1]
+	r.lock.Unlock()
+
+	if summary.Count != 2 || summary.Since == nil || !summary.Since.Equal(second.Time) {
+		t.Errorf("summary of %d decisions since %v, expected 2 since %v", summary.Count, summary.Since, second.Time)
+	}
+}
+
+// TestDedupClosed checks that the decisions reported after Close are not collapsed.
+func TestDedupClosed(t *testing.T) {
+	r := &reported{}
+	d := NewDedup(time.Minute, r.report)
+	d.Close()
+
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		d.Report(&events.Event{Time: now, ContainerID: "c1", Path: "/bin/sh", Verdict: events.VerdictDeny})
+	}
+
+	if got := r.summary(); len(got) != 2 {
+		t.Errorf("reported %q after closing", got)
+	}
+}
@@ -0,0 +1,48 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+)
+
+// JSONLines writes every decision as a line of JSON.
+type JSONLines struct {
+	w   io.Writer
+	enc *json.Encoder
+}
+
+// NewLog returns the sink writing the decisions to the standard output of the agent, for the log collectors of the
+// node. The logs of the agent go to the standard error.
+func NewLog() *JSONLines {
+	return &JSONLines{w: os.Stdout, enc: json.NewEncoder(os.Stdout)}
+}
+
+// NewFile returns the sink appending the decisions to the file.
+func NewFile(path string) (*JSONLines, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening decisions file: %w", err)
+	}
+
+	return &JSONLines{w: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (j *JSONLines) Send(e *events.Event) error {
+	if err := j.enc.Encode(e); err != nil {
+		return fmt.Errorf("writing decision: %w", err)
+	}
+
+	return nil
+}
+
+func (j *JSONLines) Close() error {
+	if f, ok := j.w.(*os.File); ok && f != os.Stdout {
+		return f.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package sink
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+)
+
+const (
+	// DefaultForwardTag is the tag of the decisions sent with the forward protocol, unless another one is set.
+	DefaultForwardTag = "fanotify-mon.decision"
+
+	forwardPort    = "24224"
+	forwardTimeout = 10 * time.Second
+)
+
+// Forward sends every decision to Fluentd or Fluent Bit with the forward protocol, in the message mode. The
+// connection is opened again after it failed.
+type Forward struct {
+	Address string
+	Tag     string
+	// Ack waits for the server to acknowledge every decision, so the ones it did not receive are sent again.
+	Ack bool
+
+	conn net.Conn
+}
+
+// NewForward returns the sink of the server at the address, on the default port of the protocol when the address has
+// none.
+func NewForward(address, tag string, ack bool) *Forward {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, forwardPort)
+	}
+
+	if tag == "" {
+		tag = DefaultForwardTag
+	}
+
+	return &Forward{Address: address, Tag: tag, Ack: ack}
+}
+
+func (f *Forward) Send(e *events.Event) error {
+	msg, chunk, err := f.message(e)
+	if err != nil {
+		return err
+	}
+
+	if f.conn == nil {
+		conn, err := net.DialTimeout("tcp", f.Address, forwardTimeout)
+		if err != nil {
+			return fmt.Errorf("connecting to %s: %w", f.Address, err)
+		}
+		f.conn = conn
+	}
+
+	if err := f.send(msg, chunk); err != nil {
+		f.conn.Close()
+		f.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+func (f *Forward) send(msg []byte, chunk string) error {
+	f.conn.SetDeadline(time.Now().Add(forwardTimeout))
+
+	if _, err := f.conn.Write(msg); err != nil {
+		return fmt.Errorf("sending decision: %w", err)
+	}
+
+	if !f.Ack {
+		return nil
+	}
+
+	// The answer is the map {"ack": chunk}, the chunk being unique it is enough to find it there.
+	answer := make([]byte, 128)
+	n, err := f.conn.Read(answer)
+	if err != nil {
+		return fmt.Errorf("reading acknowledgment: %w", err)
+	}
+
+	if !bytes.Contains(answer[:n], []byte(chunk)) {
+		return fmt.Errorf("unexpected acknowledgment %q", answer[:n])
+	}
+
+	return nil
+}
+
+// message returns the decision as the message [tag, time, record, options], with the chunk ID in the options when an
+// acknowledgment is asked for.
+func (f *Forward) message(e *events.Event) ([]byte, string, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, "", fmt.Errorf("encoding decision: %w", err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var record map[string]interface{}
+	if err := dec.Decode(&record); err != nil {
+		return nil, "", fmt.Errorf("encoding decision: %w", err)
+	}
+
+	options := map[string]interface{}{}
+	chunk := ""
+	if f.Ack {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return nil, "", fmt.Errorf("generating chunk ID: %w", err)
+		}
+		chunk = base64.StdEncoding.EncodeToString(id)
+		options["chunk"] = chunk
+	}
+
+	msg := []byte{0x94}
+	msg = appendString(msg, f.Tag)
+	msg = appendEventTime(msg, e.Time)
+	msg = appendMsgpack(msg, record)
+	msg = appendMsgpack(msg, options)
+
+	return msg, chunk, nil
+}
+
+func (f *Forward) Close() error {
+	if f.conn == nil {
+		return nil
+	}
+
+	return f.conn.Close()
+}
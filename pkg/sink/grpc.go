@@ -0,0 +1,75 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/grpcjson"
+	"github.com/kinvolk/fanotify-poc/pkg/mtls"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	// GRPCService receives the decisions encoded as JSON with the json codec, see api/sink.proto. It is served by
+	// the aggregator.
+	GRPCService = "fanotifymon.sink.v1.Decisions"
+	// GRPCMethod answers with an empty JSON object.
+	GRPCMethod = "/" + GRPCService + "/Send"
+
+	grpcTimeout = 10 * time.Second
+)
+
+// GRPC sends every decision to a gRPC server implementing GRPCMethod.
+type GRPC struct {
+	conn *grpc.ClientConn
+}
+
+// NewGRPC connects to the server at the address, over TLS unless insecure is set. The server is verified with the CA
+// of the files or the system CAs, the certificate of the files is sent when the server asks for one: they are read
+// again when they change, see mtls.ClientConfig. The connection is established again by gRPC when it breaks.
+func NewGRPC(address string, insecure bool, files mtls.Files) (*GRPC, error) {
+	creds := grpc.WithInsecure()
+	if insecure {
+		if files != (mtls.Files{}) {
+			return nil, fmt.Errorf("the TLS files can't be used without TLS")
+		}
+	} else {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+
+		config, err := mtls.ClientConfig(files, host)
+		if err != nil {
+			return nil, fmt.Errorf("configuring TLS: %w", err)
+		}
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(config))
+	}
+
+	conn, err := grpc.Dial(address, creds, grpcjson.DialOption())
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", address, err)
+	}
+
+	return &GRPC{conn: conn}, nil
+}
+
+func (g *GRPC) Send(e *events.Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), grpcTimeout)
+	defer cancel()
+
+	var reply struct{}
+	if err := g.conn.Invoke(ctx, GRPCMethod, e, &reply); err != nil {
+		return fmt.Errorf("sending decision: %w", err)
+	}
+
+	return nil
+}
+
+func (g *GRPC) Close() error {
+	return g.conn.Close()
+}
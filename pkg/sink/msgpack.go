@@ -0,0 +1,108 @@
+package sink
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"time"
+)
+
+// The encoding of the MessagePack values used by the forward protocol, the decisions are encoded from their JSON form.
+
+func appendMsgpack(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0)
+	case bool:
+		if v {
+			return append(b, 0xc3)
+		}
+		return append(b, 0xc2)
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return appendInt(b, n)
+		}
+		f, _ := v.Float64()
+		b = append(b, 0xcb)
+		return appendUint64(b, math.Float64bits(f))
+	case string:
+		return appendString(b, v)
+	case []interface{}:
+		b = appendHeader(b, len(v), 0x90, 0xdc, 0xdd)
+		for _, e := range v {
+			b = appendMsgpack(b, e)
+		}
+		return b
+	case map[string]interface{}:
+		// The keys are sorted so the same record is always encoded the same way.
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		b = appendHeader(b, len(v), 0x80, 0xde, 0xdf)
+		for _, k := range keys {
+			b = appendString(b, k)
+			b = appendMsgpack(b, v[k])
+		}
+		return b
+	}
+
+	panic("unsupported msgpack value")
+}
+
+func appendInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 0x7f:
+		return append(b, byte(n))
+	case n < 0 && n >= -32:
+		return append(b, byte(n))
+	}
+
+	b = append(b, 0xd3)
+	return appendUint64(b, uint64(n))
+}
+
+func appendString(b []byte, s string) []byte {
+	if len(s) < 32 {
+		b = append(b, 0xa0|byte(len(s)))
+	} else {
+		b = appendHeader(b, len(s), 0, 0xda, 0xdb)
+	}
+
+	return append(b, s...)
+}
+
+// appendHeader appends the length of an array, a map or a string, with the fixed format when it is short enough.
+func appendHeader(b []byte, n int, fixed, code16, code32 byte) []byte {
+	switch {
+	case fixed != 0 && n < 16:
+		return append(b, fixed|byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, code16)
+		return appendUint16(b, uint16(n))
+	}
+
+	b = append(b, code32)
+	return appendUint32(b, uint32(n))
+}
+
+// appendEventTime appends the EventTime extension of the forward protocol, with the nanoseconds.
+func appendEventTime(b []byte, t time.Time) []byte {
+	b = append(b, 0xd7, 0x00)
+	b = appendUint32(b, uint32(t.Unix()))
+	return appendUint32(b, uint32(t.Nanosecond()))
+}
+
+func appendUint16(b []byte, n uint16) []byte {
+	return append(b, byte(n>>8), byte(n))
+}
+
+func appendUint32(b []byte, n uint32) []byte {
+	return append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendUint64(b []byte, n uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(n>>32)), uint32(n))
+}
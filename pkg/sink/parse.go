@@ -0,0 +1,140 @@
+package sink
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/mtls"
+)
+
+// The types of the sinks.
+const (
+	TypeLog        = "log"
+	TypeFile       = "file"
+	TypeWebhook    = "webhook"
+	TypeGRPC       = "grpc"
+	TypeForward    = "forward"
+	TypePrometheus = "prometheus"
+)
+
+// defaultRetries are the retries of the sinks sending the decisions over the network.
+const defaultRetries = 3
+
+// Parse returns the output of the spec, TYPE[:TARGET] followed by space separated options: verdict and namespace filter
+// the decisions with comma separated values, retries sets how many times a decision is sent again, insecure connects to
+// the gRPC server without TLS, cert, key and ca are the PEM files of its client certificate and of the CA verifying the
+// server, tag is the tag of the forward protocol, ack waits for the acknowledgment of every decision sent with it and
+// path adds the path label to the decisions counted by prometheus. For example:
+//
+//	webhook:https://hooks.example.com/exec verdict=deny,audit namespace=prod retries=5
+func Parse(spec string) (Output, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return Output{}, fmt.Errorf("empty sink")
+	}
+
+	typ, target := fields[0], ""
+	if i := strings.Index(typ, ":"); i >= 0 {
+		typ, target = typ[:i], typ[i+1:]
+	}
+
+	switch typ {
+	case TypeLog, TypeFile, TypeWebhook, TypeGRPC, TypeForward, TypePrometheus:
+	default:
+		return Output{}, fmt.Errorf("unknown sink type %q", typ)
+	}
+
+	out := Output{Name: typ}
+	insecure, ack, path, tag := false, false, false, ""
+	var files mtls.Files
+	if typ == TypeWebhook || typ == TypeGRPC || typ == TypeForward {
+		out.Retries = defaultRetries
+	}
+
+	for _, opt := range fields[1:] {
+		i := strings.Index(opt, "=")
+		if i < 0 {
+			return Output{}, fmt.Errorf("sink %s: option %q is not key=value", typ, opt)
+		}
+
+		key, value := opt[:i], opt[i+1:]
+		switch key {
+		case "verdict":
+			for _, v := range strings.Split(value, ",") {
+				switch verdict := events.Verdict(v); verdict {
+				case events.VerdictAllow, events.VerdictDeny, events.VerdictAudit:
+					out.Filter.Verdicts = append(out.Filter.Verdicts, verdict)
+				default:
+					return Output{}, fmt.Errorf("sink %s: unknown verdict %q", typ, v)
+				}
+			}
+		case "namespace":
+			out.Filter.Namespaces = append(out.Filter.Namespaces, strings.Split(value, ",")...)
+		case "retries":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return Output{}, fmt.Errorf("sink %s: invalid retries %q", typ, value)
+			}
+			out.Retries = n
+		case "insecure":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return Output{}, fmt.Errorf("sink %s: invalid insecure %q", typ, value)
+			}
+			insecure = b
+		case "cert":
+			files.CertFile = value
+		case "key":
+			files.KeyFile = value
+		case "ca":
+			files.CAFile = value
+		case "tag":
+			tag = value
+		case "ack":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return Output{}, fmt.Errorf("sink %s: invalid ack %q", typ, value)
+			}
+			ack = b
+		case "path":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return Output{}, fmt.Errorf("sink %s: invalid path %q", typ, value)
+			}
+			path = b
+		default:
+			return Output{}, fmt.Errorf("sink %s: unknown option %q", typ, key)
+		}
+	}
+
+	needsTarget := typ == TypeFile || typ == TypeWebhook || typ == TypeGRPC || typ == TypeForward
+	if needsTarget && target == "" {
+		return Output{}, fmt.Errorf("sink %s needs a target, like %s:...", typ, typ)
+	}
+	if !needsTarget && target != "" {
+		return Output{}, fmt.Errorf("sink %s has no target", typ)
+	}
+
+	var err error
+	switch typ {
+	case TypeLog:
+		out.Sink = NewLog()
+	case TypeFile:
+		out.Sink, err = NewFile(target)
+	case TypeWebhook:
+		out.Sink = NewWebhook(target)
+	case TypeGRPC:
+		out.Sink, err = NewGRPC(target, insecure, files)
+	case TypeForward:
+		out.Sink = NewForward(target, tag, ack)
+	case TypePrometheus:
+		out.Sink = NewPrometheus(path)
+	}
+	if err != nil {
+		return Output{}, fmt.Errorf("sink %s: %w", typ, err)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,75 @@
+package sink
+
+import (
+	"sync"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	"github.com/kinvolk/fanotify-poc/pkg/metrics"
+)
+
+// Prometheus counts the decisions by container and verdict, and by path with Path, they are served with the metrics
+// of the agent.
+type Prometheus struct {
+	Path bool
+
+	lock   sync.Mutex
+	counts map[decisionKey]int64
+}
+
+type decisionKey struct {
+	namespace, pod, container string
+	verdict                   events.Verdict
+	path                      string
+}
+
+func NewPrometheus(path bool) *Prometheus {
+	return &Prometheus{Path: path, counts: make(map[decisionKey]int64)}
+}
+
+func (p *Prometheus) Send(e *events.Event) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	count := int64(1)
+	if e.Count > 0 {
+		count = int64(e.Count)
+	}
+
+	key := decisionKey{namespace: e.Namespace, pod: e.Pod, container: e.Container, verdict: e.Verdict}
+	if p.Path {
+		key.path = e.Path
+	}
+
+	p.counts[key] += count
+	return nil
+}
+
+// Metric returns the counts of the decisions.
+func (p *Prometheus) Metric() *metrics.Metric {
+	return &metrics.Metric{
+		Name: "fanotify_mon_decisions_total",
+		Help: "Number of decisions taken on the executions of each enforced container by verdict.",
+		Type: metrics.TypeCounter,
+		Collect: func() []metrics.Sample {
+			p.lock.Lock()
+			defer p.lock.Unlock()
+
+			samples := make([]metrics.Sample, 0, len(p.counts))
+			for key, count := range p.counts {
+				labels := map[string]string{
+					"namespace": key.namespace,
+					"pod":       key.pod,
+					"container": key.container,
+					"verdict":   string(key.verdict),
+				}
+				if p.Path {
+					labels["path"] = key.path
+				}
+
+				samples = append(samples, metrics.Sample{Labels: labels, Value: float64(count)})
+			}
+
+			return samples
+		},
+	}
+}
@@ -0,0 +1,223 @@
+// Package sink delivers the decisions of the node agent to their destinations. Every sink gets the decisions matching
+// its filter from its own queue, so a slow or failing destination holds neither the enforcement nor the other sinks
+// back.
+package sink
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// queueSize is how many decisions wait for every sink, the next ones are dropped while it is full.
+	queueSize = 1024
+	// retryInterval is how long to wait before sending a decision again the first time, it doubles every time after.
+	retryInterval = time.Second
+)
+
+// Sink is a destination of the decisions.
+type Sink interface {
+	Send(e *events.Event) error
+}
+
+// Func is a sink which can't fail, like the buffers of the agent.
+type Func func(e *events.Event)
+
+func (f Func) Send(e *events.Event) error {
+	f(e)
+	return nil
+}
+
+// Filter selects the decisions sent to a sink, an empty field selects all of them.
+type Filter struct {
+	Verdicts   []events.Verdict
+	Namespaces []string
+}
+
+func (f *Filter) Match(e *events.Event) bool {
+	if len(f.Verdicts) > 0 {
+		found := false
+		for _, v := range f.Verdicts {
+			found = found || v == e.Verdict
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.Namespaces) > 0 {
+		found := false
+		for _, ns := range f.Namespaces {
+			found = found || ns == e.Namespace
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Output is a sink with the decisions it gets.
+type Output struct {
+	// Name tells the sink apart in the logs and the metrics.
+	Name   string
+	Sink   Sink
+	Filter Filter
+	// Retries is how many times a decision is sent again when the sink fails, before it is dropped.
+	Retries int
+}
+
+// Stats count the decisions of an output since the agent started.
+type Stats struct {
+	Name string
+	Sent int64
+	// Failed were dropped after all the retries failed, Dropped because the queue was full.
+	Failed  int64
+	Dropped int64
+}
+
+type output struct {
+	Output
+	queue chan *events.Event
+
+	sent, failed, dropped int64
+}
+
+// Fanout sends every decision to all the outputs it matches.
+type Fanout struct {
+	outputs []*output
+	wg      sync.WaitGroup
+	done    chan struct{}
+
+	// lock keeps the queues from being closed while decisions are queued, closed is set once they are.
+	lock   sync.RWMutex
+	closed bool
+}
+
+// NewFanout starts sending the decisions to the outputs, until it is closed.
+func NewFanout(outputs ...Output) *Fanout {
+	f := &Fanout{done: make(chan struct{})}
+	for _, o := range outputs {
+		out := &output{Output: o, queue: make(chan *events.Event, queueSize)}
+		f.outputs = append(f.outputs, out)
+
+		f.wg.Add(1)
+		go f.run(out)
+	}
+
+	return f
+}
+
+// Report queues the decision for the outputs it matches, it never blocks. The decision must not be modified after. The
+// decisions reported once the fanout is closed are dropped.
+func (f *Fanout) Report(e *events.Event) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	for _, out := range f.outputs {
+		if !out.Filter.Match(e) {
+			continue
+		}
+
+		if f.closed {
+			atomic.AddInt64(&out.dropped, 1)
+			continue
+		}
+
+		select {
+		case out.queue <- e:
+		default:
+			atomic.AddInt64(&out.dropped, 1)
+		}
+	}
+}
+
+func (f *Fanout) run(out *output) {
+	defer f.wg.Done()
+
+	for e := range out.queue {
+		if err := f.send(out, e); err != nil {
+			log.Errorf("sending decision to sink %s: %v", out.Name, err)
+			atomic.AddInt64(&out.failed, 1)
+			continue
+		}
+
+		atomic.AddInt64(&out.sent, 1)
+	}
+}
+
+// send sends the decision, retrying with backoff. The retries stop once the fanout is closed.
+func (f *Fanout) send(out *output, e *events.Event) error {
+	wait := retryInterval
+	for i := 0; ; i++ {
+		err := out.Sink.Send(e)
+		if err == nil || i >= out.Retries {
+			return err
+		}
+
+		log.Debugf("sending decision to sink %s, retrying in %s: %v", out.Name, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-f.done:
+			return err
+		}
+		wait *= 2
+	}
+}
+
+// Stats returns the counts of every output, in their order.
+func (f *Fanout) Stats() []Stats {
+	stats := make([]Stats, 0, len(f.outputs))
+	for _, out := range f.outputs {
+		stats = append(stats, Stats{
+			Name:    out.Name,
+			Sent:    atomic.LoadInt64(&out.sent),
+			Failed:  atomic.LoadInt64(&out.failed),
+			Dropped: atomic.LoadInt64(&out.dropped),
+		})
+	}
+
+	return stats
+}
+
+// Sinks returns the sinks of the outputs.
+func (f *Fanout) Sinks() []Sink {
+	sinks := make([]Sink, 0, len(f.outputs))
+	for _, out := range f.outputs {
+		sinks = append(sinks, out.Sink)
+	}
+
+	return sinks
+}
+
+// Close sends the queued decisions without retrying them, and closes the sinks which can be. The decisions still
+// taken by the notifiers while the agent exits are dropped.
+func (f *Fanout) Close() {
+	f.lock.Lock()
+	if f.closed {
+		f.lock.Unlock()
+		return
+	}
+
+	f.closed = true
+	close(f.done)
+	for _, out := range f.outputs {
+		close(out.queue)
+	}
+	f.lock.Unlock()
+
+	f.wg.Wait()
+
+	for _, out := range f.outputs {
+		if c, ok := out.Sink.(interface{ Close() error }); ok {
+			c.Close()
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kinvolk/fanotify-poc/pkg/events"
+)
+
+const webhookTimeout = 10 * time.Second
+
+// Webhook posts every decision as JSON to the URL, any 2xx status means it was received.
+type Webhook struct {
+	URL string
+
+	client *http.Client
+}
+
+func NewWebhook(url string) *Webhook {
+	return &Webhook{URL: url, client: &http.Client{Timeout: webhookTimeout}}
+}
+
+func (w *Webhook) Send(e *events.Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encoding decision: %w", err)
+	}
+
+	resp, err := w.client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("posting decision: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("posting decision: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
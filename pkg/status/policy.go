@@ -0,0 +1,64 @@
+package status
+
+import (
+	"sort"
+	"time"
+)
+
+// PolicyStatus is the status of an ExecPolicy over the nodes, aggregated from their NodeStatus objects by the
+// controller.
+type PolicyStatus struct {
+	// Nodes are the nodes enforcing the policy on some containers.
+	Nodes       int `json:"nodes"`
+	PodsCovered int `json:"podsCovered"`
+	Containers  int `json:"containers"`
+	// NodesWithErrors are the nodes with errors on the containers of the policy, or which stopped reporting their
+	// status.
+	NodesWithErrors []string `json:"nodesWithErrors,omitempty"`
+	// ViolationsLast24h are the distinct violations of the policy seen in the last 24 hours, when the violations are
+	// sent to the aggregator.
+	ViolationsLast24h *int `json:"violationsLast24h,omitempty"`
+}
+
+// Policies aggregates the status of the nodes by policy, the policies not enforced anywhere are left out. The nodes
+// which did not report since staleAfter are counted with errors, the agents which don't tell when they reported are
+// not.
+func Policies(nodes []NodeStatus, now time.Time, staleAfter time.Duration) map[string]*PolicyStatus {
+	policies := make(map[string]*PolicyStatus)
+	pods := make(map[string]map[string]bool)
+
+	for _, node := range nodes {
+		stale := node.Status.LastReport != nil && now.Sub(node.Status.LastReport.Time) > staleAfter
+
+		seen := make(map[string]bool)
+		failing := make(map[string]bool)
+		for _, cnt := range node.Status.Containers {
+			p := policies[cnt.Policy]
+			if p == nil {
+				p = &PolicyStatus{}
+				policies[cnt.Policy] = p
+				pods[cnt.Policy] = make(map[string]bool)
+			}
+
+			p.Containers++
+			pods[cnt.Policy][cnt.Namespace+"/"+cnt.Pod+"/"+cnt.PodUID] = true
+
+			if !seen[cnt.Policy] {
+				seen[cnt.Policy] = true
+				p.Nodes++
+			}
+
+			if (stale || cnt.Errors > 0 || cnt.EnforcementFailed) && !failing[cnt.Policy] {
+				failing[cnt.Policy] = true
+				p.NodesWithErrors = append(p.NodesWithErrors, node.Name)
+			}
+		}
+	}
+
+	for name, p := range policies {
+		p.PodsCovered = len(pods[name])
+		sort.Strings(p.NodesWithErrors)
+	}
+
+	return policies
+}
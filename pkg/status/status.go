@@ -0,0 +1,264 @@
+// Package status has the NodeStatus objects where each node agent reports how the enforcement is going on its node.
+package status
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	APIVersion = "enforce.k8s.io/v1alpha1"
+	Kind       = "NodeStatus"
+)
+
+// The condition types of a NodeStatus.
+const (
+	// ConditionEnforcing is true while the agent is running and enforcing the containers of the node.
+	ConditionEnforcing = "Enforcing"
+	// ConditionBaselinesReady is true when the baselines of all the enforced containers were computed.
+	ConditionBaselinesReady = "BaselinesReady"
+	// ConditionHealthy is false when there were errors enforcing the containers.
+	ConditionHealthy = "Healthy"
+	// ConditionReporting is set to false by the controller when the agent stopped reporting, it crashed or was killed,
+	// and the node may not be enforced anymore.
+	ConditionReporting = "Reporting"
+)
+
+// NodeStatus is named after its node.
+type NodeStatus struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Status NodeStatusStatus `json:"status,omitempty"`
+}
+
+type NodeStatusStatus struct {
+	EnforcedContainers int `json:"enforcedContainers"`
+	BaselinesReady     int `json:"baselinesReady"`
+	Errors             int `json:"errors"`
+	// DetectionOnly is how many of the containers are only watched in a detection-only mode.
+	DetectionOnly int `json:"detectionOnly,omitempty"`
+	// EnforcementFailed is how many of the containers could not be enforced, they are not counted as enforced.
+	EnforcementFailed int `json:"enforcementFailed,omitempty"`
+
+	Containers []Container        `json:"containers,omitempty"`
+	Pods       []Pod              `json:"pods,omitempty"`
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// LastReport is when the agent last wrote the status.
+	LastReport *metav1.Time `json:"lastReport,omitempty"`
+
+	// EventChain anchors the events stored on the node, they can be verified against it.
+	EventChain *ChainAnchor `json:"eventChain,omitempty"`
+}
+
+// ChainAnchor is the head of the hash chain of the event store at a time, see eventstore.Verify.
+type ChainAnchor struct {
+	Head string      `json:"head"`
+	Time metav1.Time `json:"time"`
+}
+
+// Container is the enforcement state of one container.
+type Container struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	PodUID    string `json:"podUID,omitempty"`
+	Policy    string `json:"policy"`
+
+	// Unlisted is set when the container is not in the spec of its pod, like the sidecars injected by the runtime, it
+	// is enforced with the policy of the pod.
+	Unlisted bool `json:"unlisted,omitempty"`
+
+	// EnforcementFailed is set when the container could not be enforced, LastError tells why.
+	EnforcementFailed bool `json:"enforcementFailed,omitempty"`
+
+	BaselineReady bool   `json:"baselineReady"`
+	Errors        int    `json:"errors,omitempty"`
+	LastError     string `json:"lastError,omitempty"`
+	OpenFDs       int    `json:"openFDs,omitempty"`
+
+	// BaselineHashed is how many of the BaselineFiles found in the rootfs were hashed so far.
+	BaselineFiles  int `json:"baselineFiles,omitempty"`
+	BaselineHashed int `json:"baselineHashed,omitempty"`
+
+	// Detection is set when the executions are only detected because the permission events are not available:
+	// fanotify with the notifications of the executions, or inotify with the executables written.
+	Detection string `json:"detection,omitempty"`
+
+	// Mode is the mode the policy is applied in, ModeOverride is set when it was changed through the admin API.
+	Mode         string `json:"mode,omitempty"`
+	ModeOverride bool   `json:"modeOverride,omitempty"`
+	// OutOfCanary is set when the container is audited because its pod is not among the ones its canary policy is
+	// enforced on.
+	OutOfCanary bool `json:"outOfCanary,omitempty"`
+
+	// ReadOnly is set when the mounts of the container were remounted read-only after its pod was ready, BreakGlass
+	// when they were made writable again through the admin API.
+	ReadOnly   bool `json:"readOnly,omitempty"`
+	BreakGlass bool `json:"breakGlass,omitempty"`
+
+	// Restarts counts the times the watchdog restarted the notifier of the container after it got stuck.
+	Restarts int `json:"restarts,omitempty"`
+
+	// PendingEvents is how many events of the container are waiting to be answered, the oldest one waits for up to
+	// BacklogSeconds. Backpressure is set while its denials are only audited because they pile up.
+	PendingEvents  int     `json:"pendingEvents,omitempty"`
+	BacklogSeconds float64 `json:"backlogSeconds,omitempty"`
+	Backpressure   bool    `json:"backpressure,omitempty"`
+
+	// ShadowPolicy is evaluated alongside the policy without deciding, ShadowDivergences counts the decisions it took
+	// differently.
+	ShadowPolicy      string `json:"shadowPolicy,omitempty"`
+	ShadowDivergences int    `json:"shadowDivergences,omitempty"`
+
+	// SharesMountsWith is the ID of the container in the same mount namespace whose notifier enforces this one too.
+	SharesMountsWith string `json:"sharesMountsWith,omitempty"`
+}
+
+// Pod is the enforcement state of the containers of a pod.
+type Pod struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	UID       string `json:"uid,omitempty"`
+	// Policies are the policies of the containers, the same one unless the containers were enforced with different
+	// versions of the policies.
+	Policies []string `json:"policies"`
+
+	Containers     []string `json:"containers"`
+	BaselinesReady int      `json:"baselinesReady"`
+	Errors         int      `json:"errors,omitempty"`
+	// Unlisted are the containers which are not in the spec of the pod.
+	Unlisted []string `json:"unlisted,omitempty"`
+}
+
+// Pods aggregates the containers by pod, in the order of the containers.
+func Pods(containers []Container) []Pod {
+	pods := []Pod{}
+	index := make(map[string]int)
+
+	for _, cnt := range containers {
+		key := cnt.Namespace + "/" + cnt.Pod + "/" + cnt.PodUID
+		i, ok := index[key]
+		if !ok {
+			i = len(pods)
+			index[key] = i
+			pods = append(pods, Pod{Namespace: cnt.Namespace, Name: cnt.Pod, UID: cnt.PodUID})
+		}
+
+		pod := &pods[i]
+		pod.Containers = append(pod.Containers, cnt.Name)
+		if !contains(pod.Policies, cnt.Policy) {
+			pod.Policies = append(pod.Policies, cnt.Policy)
+		}
+
+		if cnt.BaselineReady {
+			pod.BaselinesReady++
+		}
+
+		pod.Errors += cnt.Errors
+
+		if cnt.Unlisted {
+			pod.Unlisted = append(pod.Unlisted, cnt.Name)
+		}
+	}
+
+	return pods
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// New returns the status of the node with the given containers. The conditions are set from the previous ones, so
+// their transition times only change when their status does.
+func New(nodeName string, containers []Container, previous []metav1.Condition) *NodeStatus {
+	s := &NodeStatus{
+		TypeMeta:   metav1.TypeMeta{APIVersion: APIVersion, Kind: Kind},
+		ObjectMeta: metav1.ObjectMeta{Name: nodeName},
+		Status: NodeStatusStatus{
+			EnforcedContainers: len(containers),
+			Containers:         containers,
+			Pods:               Pods(containers),
+			Conditions:         previous,
+		},
+	}
+
+	for _, cnt := range containers {
+		if cnt.BaselineReady {
+			s.Status.BaselinesReady++
+		}
+
+		s.Status.Errors += cnt.Errors
+
+		if cnt.Detection != "" {
+			s.Status.DetectionOnly++
+		}
+
+		if cnt.EnforcementFailed {
+			s.Status.EnforcementFailed++
+			s.Status.EnforcedContainers--
+		}
+	}
+
+	enforcing := metav1.Condition{
+		Type:    ConditionEnforcing,
+		Status:  metav1.ConditionTrue,
+		Reason:  "AgentRunning",
+		Message: fmt.Sprintf("%d containers enforced", s.Status.EnforcedContainers),
+	}
+	if s.Status.DetectionOnly > 0 {
+		enforcing.Status = metav1.ConditionFalse
+		enforcing.Reason = "DetectionOnly"
+		enforcing.Message = fmt.Sprintf("%d of %d containers only detected, the permission events are not available", s.Status.DetectionOnly, len(containers))
+	}
+	if s.Status.EnforcementFailed > 0 {
+		enforcing.Status = metav1.ConditionFalse
+		enforcing.Reason = "EnforcementFailed"
+		enforcing.Message = fmt.Sprintf("%d of %d containers could not be enforced", s.Status.EnforcementFailed, len(containers))
+	}
+	meta.SetStatusCondition(&s.Status.Conditions, enforcing)
+
+	baselines := metav1.Condition{
+		Type:    ConditionBaselinesReady,
+		Status:  metav1.ConditionTrue,
+		Reason:  "AllComputed",
+		Message: fmt.Sprintf("%d of %d baselines computed", s.Status.BaselinesReady, s.Status.EnforcedContainers),
+	}
+	if s.Status.BaselinesReady < s.Status.EnforcedContainers {
+		baselines.Status = metav1.ConditionFalse
+		baselines.Reason = "Pending"
+	}
+	meta.SetStatusCondition(&s.Status.Conditions, baselines)
+
+	healthy := metav1.Condition{
+		Type:    ConditionHealthy,
+		Status:  metav1.ConditionTrue,
+		Reason:  "NoErrors",
+		Message: "no errors enforcing the containers",
+	}
+	if s.Status.Errors > 0 {
+		healthy.Status = metav1.ConditionFalse
+		healthy.Reason = "Errors"
+		healthy.Message = fmt.Sprintf("%d errors enforcing the containers", s.Status.Errors)
+	}
+	meta.SetStatusCondition(&s.Status.Conditions, healthy)
+
+	meta.SetStatusCondition(&s.Status.Conditions, metav1.Condition{
+		Type:    ConditionReporting,
+		Status:  metav1.ConditionTrue,
+		Reason:  "AgentReporting",
+		Message: "the agent reports the status of the node",
+	})
+
+	return s
+}
@@ -0,0 +1,143 @@
+package systemd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// invalidFieldChars are replaced in the names of the fields, journald only takes uppercase letters, digits and
+// underscores.
+var invalidFieldChars = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// UnderJournald tells if the standard error of the agent is connected to journald, as set up by systemd for the
+// units logging to the journal.
+func UnderJournald() bool {
+	stream := os.Getenv("JOURNAL_STREAM")
+	if stream == "" {
+		return false
+	}
+
+	var st unix.Stat_t
+	if err := unix.Fstat(int(os.Stderr.Fd()), &st); err != nil {
+		return false
+	}
+
+	return stream == fmt.Sprintf("%d:%d", st.Dev, st.Ino)
+}
+
+// JournalHook sends the log entries to journald with the native protocol, with their fields as journal fields: the
+// fields of the decisions, like the container and the path, can be matched with journalctl.
+type JournalHook struct {
+	// Identifier is the SYSLOG_IDENTIFIER of the entries.
+	Identifier string
+
+	conn *net.UnixConn
+}
+
+func NewJournalHook(identifier string) (*JournalHook, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("connecting to journald: %w", err)
+	}
+
+	return &JournalHook{Identifier: identifier, conn: conn}, nil
+}
+
+func (h *JournalHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *JournalHook) Fire(entry *log.Entry) error {
+	var buf bytes.Buffer
+	writeField(&buf, "MESSAGE", entry.Message)
+	writeField(&buf, "PRIORITY", priority(entry.Level))
+	writeField(&buf, "SYSLOG_IDENTIFIER", h.Identifier)
+
+	keys := make([]string, 0, len(entry.Data))
+	for key := range entry.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name := invalidFieldChars.ReplaceAllString(strings.ToUpper(key), "_")
+		// The fields starting with an underscore are trusted ones set by journald.
+		name = strings.TrimLeft(name, "_")
+		if name == "" {
+			continue
+		}
+
+		writeField(&buf, name, fmt.Sprint(entry.Data[key]))
+	}
+
+	_, err := h.conn.Write(buf.Bytes())
+	if errors.Is(err, unix.EMSGSIZE) || errors.Is(err, unix.ENOBUFS) {
+		return h.sendMemfd(buf.Bytes())
+	}
+
+	return err
+}
+
+// sendMemfd sends the entries too large for a datagram in a sealed memfd.
+func (h *JournalHook) sendMemfd(data []byte) error {
+	fd, err := unix.MemfdCreate("journal", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	if _, err := unix.Write(fd, data); err != nil {
+		return err
+	}
+
+	if _, err := unix.FcntlInt(uintptr(fd), unix.F_ADD_SEALS, unix.F_SEAL_SHRINK|unix.F_SEAL_GROW|unix.F_SEAL_WRITE|unix.F_SEAL_SEAL); err != nil {
+		return err
+	}
+
+	_, _, err = h.conn.WriteMsgUnix(nil, unix.UnixRights(fd), nil)
+	return err
+}
+
+// writeField writes the field in the native protocol, the values with newlines are prefixed with their size.
+func writeField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", name, value)
+		return
+	}
+
+	buf.WriteString(name)
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// priority returns the syslog priority of the level.
+func priority(level log.Level) string {
+	switch level {
+	case log.PanicLevel:
+		return "0"
+	case log.FatalLevel:
+		return "2"
+	case log.ErrorLevel:
+		return "3"
+	case log.WarnLevel:
+		return "4"
+	case log.InfoLevel:
+		return "6"
+	default:
+		return "7"
+	}
+}
@@ -0,0 +1,66 @@
+// Package systemd integrates the agent with systemd when it runs as a unit: the readiness and the watchdog of
+// Type=notify services, and the native protocol of journald for the logs.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notify sends the state to the service manager, like READY=1. It does nothing when the agent is not run by systemd
+// as a Type=notify service.
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// The sockets starting with @ are in the abstract namespace.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("notifying the service manager: %w", err)
+	}
+
+	return nil
+}
+
+// WatchdogInterval returns how often the watchdog has to be pinged with WATCHDOG=1, half of the timeout of the unit.
+// It is false when the watchdog is not enabled for the agent.
+func WatchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2, true
+}
+
+// Watchdog pings the watchdog every interval as long as healthy returns true, systemd restarts the agent once it
+// stops.
+func Watchdog(interval time.Duration, healthy func() bool) {
+	for range time.Tick(interval) {
+		if !healthy() {
+			continue
+		}
+
+		if err := Notify("WATCHDOG=1"); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	log "github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+)
+
+// UnprotectedAnnotation is set on the pods with coverage gaps, its value says what is missing.
+const UnprotectedAnnotation = "enforce.k8s.io/unprotected"
+
+// reviewPod warns about pods created without being enforced or without any policy selecting them. The webhook
+// configuration decides which namespaces are checked.
+func (s *Server) reviewPod(ctx context.Context, req *admissionv1.AdmissionRequest, annotate bool) *admissionv1.AdmissionResponse {
+	resp := &admissionv1.AdmissionResponse{Allowed: true}
+
+	if req.Operation != admissionv1.Create || req.Kind.Kind != "Pod" {
+		return resp
+	}
+
+	pod := &v1.Pod{}
+	if err := json.Unmarshal(req.Object.Raw, pod); err != nil {
+		log.Errorf("decoding pod: %v", err)
+		return resp
+	}
+
+	// The namespace is not set in the object when it comes from the request path.
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
+
+	gap, err := s.coverageGap(ctx, pod)
+	if err != nil {
+		log.Errorf("checking pod %s/%s: %v", pod.Namespace, req.Name, err)
+		return resp
+	}
+
+	if gap == "" {
+		return resp
+	}
+
+	log.Infof("unprotected pod %s/%s: %s", pod.Namespace, req.Name, gap)
+	resp.Warnings = []string{"fanotify-mon: " + gap}
+
+	if annotate {
+		patch, err := annotationPatch(pod, gap)
+		if err != nil {
+			log.Errorf("creating patch: %v", err)
+			return resp
+		}
+
+		patchType := admissionv1.PatchTypeJSONPatch
+		resp.Patch = patch
+		resp.PatchType = &patchType
+	}
+
+	return resp
+}
+
+// coverageGap returns what is missing for the pod to be enforced with a policy, or an empty string if nothing is.
+func (s *Server) coverageGap(ctx context.Context, pod *v1.Pod) (string, error) {
+	defaults, err := s.ListNamespaceDefaults(ctx, pod.Namespace)
+	if err != nil {
+		return "", fmt.Errorf("listing namespace defaults: %w", err)
+	}
+
+	if !s.PodSelector.IsEnforced(pod) && len(defaults) == 0 {
+		return "pod is not enforced, it is not selected by the agents and its namespace has no default", nil
+	}
+
+	policies, err := s.ListPolicies(ctx)
+	if err != nil {
+		return "", fmt.Errorf("listing policies: %w", err)
+	}
+
+	set := &policy.Set{Policies: policies, NamespaceDefaults: defaults}
+
+	if name := pod.Annotations[policy.PolicyAnnotation]; name != "" && set.Bound(pod) == nil {
+		return fmt.Sprintf("policy %q of the %s annotation not found", name, policy.PolicyAnnotation), nil
+	}
+
+	if p := set.Select(pod); p == policy.Default {
+		return "no policy selects the pod, executions are only verified against the baseline", nil
+	}
+
+	return "", nil
+}
+
+type jsonPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+func annotationPatch(pod *v1.Pod, value string) ([]byte, error) {
+	if pod.Annotations == nil {
+		return json.Marshal([]jsonPatchOp{{
+			Op:    "add",
+			Path:  "/metadata/annotations",
+			Value: map[string]string{UnprotectedAnnotation: value},
+		}})
+	}
+
+	return json.Marshal([]jsonPatchOp{{
+		Op: "add",
+		// The slash of the key is escaped as ~1 in JSON pointers.
+		Path:  "/metadata/annotations/enforce.k8s.io~1unprotected",
+		Value: value,
+	}})
+}
@@ -0,0 +1,152 @@
+// Package webhook has the validating admission webhook for the policy objects, so broken policies are rejected when
+// they are created instead of being ignored by the node agents.
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/kinvolk/fanotify-poc/pkg/k8s"
+	"github.com/kinvolk/fanotify-poc/pkg/policy"
+	log "github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	ValidatePath = "/validate"
+
+	// WarnPodsPath and AnnotatePodsPath check the pods for enforcement coverage, the first only returns warnings and
+	// the second also annotates the pod. They never reject a pod.
+	WarnPodsPath     = "/warn-pods"
+	AnnotatePodsPath = "/annotate-pods"
+)
+
+type Server struct {
+	// PodSelector selects the enforced pods, like in the node agents.
+	PodSelector k8s.PodSelector
+
+	// ListPolicies returns the policies already in the cluster, they are needed to check for overlapping selectors
+	// and for the policies referenced by the namespace defaults.
+	ListPolicies func(ctx context.Context) ([]*policy.ExecPolicy, error)
+
+	// ListNamespaceDefaults returns the namespace defaults of the given namespace.
+	ListNamespaceDefaults func(ctx context.Context, namespace string) ([]*policy.NamespaceDefault, error)
+}
+
+type reviewFunc func(ctx context.Context, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse
+
+// Run serves the webhook over TLS until it fails.
+func (s *Server) Run(addr, certFile, keyFile string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ValidatePath, handleReview(s.reviewPolicy))
+	mux.HandleFunc(WarnPodsPath, handleReview(func(ctx context.Context, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+		return s.reviewPod(ctx, req, false)
+	}))
+	mux.HandleFunc(AnnotatePodsPath, handleReview(func(ctx context.Context, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+		return s.reviewPod(ctx, req, true)
+	}))
+
+	log.Infof("serving the admission webhook on %s", addr)
+	return http.ListenAndServeTLS(addr, certFile, keyFile, mux)
+}
+
+// handleReview decodes the admission review and answers with the response of the reviewer.
+func handleReview(reviewer reviewFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("reading body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		review := &admissionv1.AdmissionReview{}
+		if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+			http.Error(w, "invalid admission review", http.StatusBadRequest)
+			return
+		}
+
+		review.Response = reviewer(r.Context(), review.Request)
+		review.Response.UID = review.Request.UID
+		review.Request = nil
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(review); err != nil {
+			log.Errorf("writing admission review: %v", err)
+		}
+	}
+}
+
+func (s *Server) reviewPolicy(ctx context.Context, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if err := s.validatePolicy(ctx, req); err != nil {
+		log.Infof("rejecting %s %q: %v", req.Kind.Kind, req.Name, err)
+
+		return &admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Reason:  metav1.StatusReasonInvalid,
+				Message: err.Error(),
+				Code:    http.StatusUnprocessableEntity,
+			},
+		}
+	}
+
+	return &admissionv1.AdmissionResponse{Allowed: true}
+}
+
+func (s *Server) validatePolicy(ctx context.Context, req *admissionv1.AdmissionRequest) error {
+	if req.Operation == admissionv1.Delete {
+		return nil
+	}
+
+	switch req.Kind.Kind {
+	case policy.Kind:
+		p := &policy.ExecPolicy{}
+		if err := json.Unmarshal(req.Object.Raw, p); err != nil {
+			return fmt.Errorf("decoding policy: %w", err)
+		}
+
+		if err := p.Validate(); err != nil {
+			return err
+		}
+
+		policies, err := s.ListPolicies(ctx)
+		if err != nil {
+			return fmt.Errorf("checking the existing policies: %w", err)
+		}
+
+		return policy.CheckOverlaps(p, policies)
+
+	case policy.NamespaceDefaultKind:
+		d := &policy.NamespaceDefault{}
+		if err := json.Unmarshal(req.Object.Raw, d); err != nil {
+			return fmt.Errorf("decoding namespace default: %w", err)
+		}
+
+		if err := d.Validate(); err != nil {
+			return err
+		}
+
+		if d.Spec.Policy == "" {
+			return nil
+		}
+
+		policies, err := s.ListPolicies(ctx)
+		if err != nil {
+			return fmt.Errorf("checking the existing policies: %w", err)
+		}
+
+		set := &policy.Set{Policies: policies}
+		if set.Get(d.Namespace, d.Spec.Policy) == nil {
+			return fmt.Errorf("policy %q not found", d.Spec.Policy)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("unsupported kind %q", req.Kind.Kind)
+}